@@ -1,11 +1,9 @@
 package repo
 
 import (
-	"crypto/sha1"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"strings"
 )
 
@@ -42,6 +40,14 @@ func isSystemFile(name string) bool {
 }
 
 func AddFile(path string) error {
+	if err := requireWorkTree(); err != nil {
+		return err
+	}
+	// The index holds clean paths, so "./a.txt" stages a.txt.
+	path, err := cleanPathspec(path)
+	if err != nil {
+		return err
+	}
 	if path == "." {
 		entries, err := os.ReadDir(".")
 		if err != nil {
@@ -85,42 +91,63 @@ func addSingleFile(filePath string) error {
 		return fmt.Errorf("skipping system file: %s", filePath)
 	}
 
-	f, err := os.Open(filePath)
+	info, err := os.Lstat(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return fmt.Errorf("failed to stat file: %w", err)
 	}
-	defer f.Close()
-
-	h := sha1.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return fmt.Errorf("failed to hash file: %w", err)
+	objects := localObjects()
+	var hash string
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink: %w", err)
+		}
+		if hash, err = objects.Write(kindBlob, []byte(target)); err != nil {
+			return fmt.Errorf("failed to write blob: %w", err)
+		}
+	} else {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to open file: %w", err)
+		}
+		defer f.Close()
+		if hash, err = objects.writeContent(filePath, f, info.Size()); err != nil {
+			return err
+		}
 	}
 
-	hash := fmt.Sprintf("%x", h.Sum(nil))
-
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to rewind file: %w", err)
-	}
-	content, err := io.ReadAll(f)
-	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
-	}
+	fileMode := fileModeEnabled()
+	return updateIndex(func(entries []indexEntry) []indexEntry {
+		recorded := ""
+		for _, entry := range entries {
+			if entry.Path == filePath {
+				recorded = entry.Mode
+			}
+		}
+		mode := worktreeMode(info, recorded, fileMode)
+		return stageEntry(entries, indexEntry{Hash: hash, Path: filePath, Mode: mode})
+	})
+}
 
-	blobPath := filepath.Join(".kommito", "objects", "blobs", hash)
-	if err := os.WriteFile(blobPath, content, 0644); err != nil {
-		return fmt.Errorf("failed to write blob: %w", err)
+// writeContent stores the content of the file at filePath the way the
+// repository is configured to: as a large-object pointer, as chunks above
+// the chunk threshold, or as a plain blob. It returns the blob hash.
+func (s *ObjectStore) writeContent(filePath string, r io.Reader, size int64) (string, error) {
+	var hash string
+	var err error
+	if isLargeFile(filePath) {
+		var pointer LargePointer
+		if pointer, err = s.writeLarge(r); err != nil {
+			return "", err
+		}
+		hash, err = s.Write(kindBlob, []byte(pointer.String()))
+	} else if threshold := chunkThreshold(); threshold > 0 && size >= threshold {
+		hash, _, err = s.WriteChunked(r)
+	} else {
+		hash, _, err = s.WriteStream(kindBlob, r)
 	}
-
-	indexLine := fmt.Sprintf("%s %s\n", hash, filePath)
-	indexPath := filepath.Join(".kommito", "index")
-	fidx, err := os.OpenFile(indexPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to open index: %w", err)
+		return "", fmt.Errorf("failed to write blob: %w", err)
 	}
-	defer fidx.Close()
-	if _, err := fidx.WriteString(indexLine); err != nil {
-		return fmt.Errorf("failed to update index: %w", err)
-	}
-
-	return nil
+	return hash, nil
 }
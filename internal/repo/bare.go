@@ -0,0 +1,51 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrBareRepository is returned by operations that need a working tree when
+// they run inside a bare repository.
+var ErrBareRepository = errors.New("repository is bare")
+
+// metaDir returns the metadata directory of the repository at path: the
+// path itself for a bare repository, path/.kommito otherwise.
+func metaDir(path string) string {
+	if dir, _, err := findRepoDir(path); err == nil {
+		return dir
+	}
+	return filepath.Join(path, ".kommito")
+}
+
+// repoDir is the metadata directory of the repository in the current
+// directory.
+func repoDir() string {
+	return metaDir(".")
+}
+
+// requireWorkTree refuses to continue when the current directory is a bare
+// repository, so nothing is checked out into or staged from its metadata.
+func requireWorkTree() error {
+	if _, bare, err := findRepoDir("."); err == nil && bare {
+		return fmt.Errorf("this operation needs a working tree: %w", ErrBareRepository)
+	}
+	return nil
+}
+
+// IsBare reports whether the current directory is a bare repository.
+func IsBare() bool {
+	_, bare, err := findRepoDir(".")
+	return err == nil && bare
+}
+
+// InitBareRepo creates a repository without a working tree in dir, suitable
+// as a shared remote that everyone pushes to.
+func InitBareRepo(dir string) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("'%s' already exists and is not empty", dir)
+	}
+	return initMetaDir(dir, true)
+}
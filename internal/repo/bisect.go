@@ -0,0 +1,393 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Bisect state lives in files under .kommito so a bisection carries on
+// across shell sessions:
+//
+//	BISECT_START  the branch (or detached commit) to return to on reset
+//	BISECT_BAD    the bad commit
+//	BISECT_GOOD   the good commits, one per line
+//	BISECT_SKIP   the commits that could not be tested, one per line
+//	BISECT_LOG    the marks so far, as commands with comments
+var bisectFiles = []string{"BISECT_START", "BISECT_BAD", "BISECT_GOOD", "BISECT_SKIP", "BISECT_LOG"}
+
+// BisectStep is where a bisection stands after a mark.
+type BisectStep struct {
+	// Culprit is the first bad commit, once it is known.
+	Culprit string
+	// Candidates is set instead when only skipped commits are left: the
+	// first bad commit is one of them.
+	Candidates []string
+	// Next is the commit checked out to be tested, with the subject of
+	// its message. Remaining commits are left to test after it, in
+	// roughly Steps more steps.
+	Next      string
+	Subject   string
+	Remaining int
+	Steps     int
+}
+
+type bisectState struct {
+	bad        string
+	good, skip []string
+}
+
+// BisectStart begins a bisection. With a bad and at least one good
+// revision the midpoint between them is checked out straight away;
+// otherwise the missing ones are marked with BisectMark, and the returned
+// step is nil until both are known.
+func BisectStart(bad string, good []string) (*BisectStep, error) {
+	if err := requireWorkTree(); err != nil {
+		return nil, err
+	}
+	refs := localRefs()
+	if _, err := os.Stat(refs.path("BISECT_START")); err == nil {
+		return nil, fmt.Errorf("a bisect is already in progress, run 'kommito bisect reset' first")
+	}
+	head, err := resolveHead()
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		return nil, fmt.Errorf("cannot bisect without any commits")
+	}
+	start := head
+	if branch, err := refs.headTarget(); err == nil && strings.HasPrefix(branch, "refs/heads/") {
+		start = strings.TrimPrefix(branch, "refs/heads/")
+	}
+	if err := writeFileAtomic(refs.path("BISECT_START"), []byte(start+"\n"), 0644); err != nil {
+		return nil, fmt.Errorf("failed to record bisect start: %w", err)
+	}
+	if err := appendBisectLog("kommito bisect start\n"); err != nil {
+		return nil, err
+	}
+	var step *BisectStep
+	if bad != "" {
+		_, err = BisectMark("bad", []string{bad})
+	}
+	if err == nil && len(good) > 0 {
+		step, err = BisectMark("good", good)
+	}
+	if err != nil {
+		// Nothing was checked out, so there is nothing to go back to.
+		removeBisectState()
+		return nil, err
+	}
+	return step, nil
+}
+
+// BisectMark marks revisions (HEAD when there are none) as good, bad or
+// skipped, then checks out the next commit to test, or reports the first
+// bad commit once it is found.
+func BisectMark(term string, revs []string) (*BisectStep, error) {
+	state, err := loadBisectState()
+	if err != nil {
+		return nil, err
+	}
+	if len(revs) == 0 {
+		revs = []string{"HEAD"}
+	}
+	if term == "bad" && len(revs) > 1 {
+		return nil, fmt.Errorf("only one commit can be marked bad")
+	}
+	store := localObjects()
+	var log strings.Builder
+	for _, rev := range revs {
+		hash, err := resolveRevision(rev)
+		if err != nil {
+			return nil, err
+		}
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		switch term {
+		case "bad":
+			state.bad = hash
+		case "good":
+			state.good = appendUnique(state.good, hash)
+		case "skip":
+			state.skip = appendUnique(state.skip, hash)
+		default:
+			return nil, fmt.Errorf("unknown bisect term '%s'", term)
+		}
+		fmt.Fprintf(&log, "# %s: [%s] %s\nkommito bisect %s %s\n", term, hash, commitSubject(commit.Message), term, hash)
+	}
+	if err := state.save(); err != nil {
+		return nil, err
+	}
+	if err := appendBisectLog(log.String()); err != nil {
+		return nil, err
+	}
+	if state.bad == "" || len(state.good) == 0 {
+		return nil, nil
+	}
+	return bisectNext(store, state)
+}
+
+// bisectNext picks the commit that splits the remaining candidates most
+// evenly and checks it out. The candidates are the commits reachable from
+// the bad commit but from none of the good ones; the one tested splits
+// them into its own ancestors, left when it is bad, and the rest, left
+// when it is good.
+func bisectNext(store *ObjectStore, state *bisectState) (*BisectStep, error) {
+	good, err := reachableCommits(store, state.good)
+	if err != nil {
+		return nil, err
+	}
+	if good[state.bad] {
+		return nil, fmt.Errorf("bad commit %s is an ancestor of a good commit", state.bad[:7])
+	}
+	var candidates []string
+	err = walkLog(store, []string{state.bad}, good, false, nil, func(hash string, _ *Commit, _ []string, _ bool) (bool, error) {
+		candidates = append(candidates, hash)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 1 {
+		if err := appendBisectLog(bisectLogCulprit(store, state.bad)); err != nil {
+			return nil, err
+		}
+		return &BisectStep{Culprit: state.bad}, nil
+	}
+
+	// Each candidate's ancestors among the candidates, as bit sets built
+	// parents first.
+	sorted, err := topoSortCommits(store, candidates)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int, len(sorted))
+	for i, hash := range sorted {
+		index[hash] = i
+	}
+	words := (len(sorted) + 63) / 64
+	ancestors := make([][]uint64, len(sorted))
+	for i, hash := range sorted {
+		set := make([]uint64, words)
+		set[i/64] |= 1 << (i % 64)
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range commit.Parents {
+			if p, ok := index[parent]; ok {
+				for w := range set {
+					set[w] |= ancestors[p][w]
+				}
+			}
+		}
+		ancestors[i] = set
+	}
+
+	skipped := make(map[string]bool)
+	for _, hash := range state.skip {
+		skipped[hash] = true
+	}
+	total := len(candidates)
+	best, bestScore, bestReach := "", -1, 0
+	for _, hash := range candidates {
+		if hash == state.bad || skipped[hash] {
+			continue
+		}
+		reach := 0
+		for _, word := range ancestors[index[hash]] {
+			reach += bits.OnesCount64(word)
+		}
+		if score := min(reach, total-reach); score > bestScore {
+			best, bestScore, bestReach = hash, score, reach
+		}
+	}
+	if best == "" {
+		step := &BisectStep{}
+		for _, hash := range candidates {
+			if hash == state.bad || skipped[hash] {
+				step.Candidates = append(step.Candidates, hash)
+			}
+		}
+		return step, nil
+	}
+
+	commit, err := store.LoadCommit(best)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckoutTarget(best); err != nil {
+		return nil, err
+	}
+	return &BisectStep{
+		Next:      best,
+		Subject:   commitSubject(commit.Message),
+		Remaining: max(bestReach, total-bestReach) - 1,
+		Steps:     bisectSteps(total),
+	}, nil
+}
+
+// bisectSteps estimates how many more steps it takes to narrow n
+// candidates down to one, as Git does.
+func bisectSteps(n int) int {
+	if n < 3 {
+		return 0
+	}
+	steps := bits.Len(uint(n)) - 1
+	if extra := n - 1<<steps; 1<<steps >= 3*extra {
+		steps--
+	}
+	return steps
+}
+
+func bisectLogCulprit(store *ObjectStore, hash string) string {
+	subject := ""
+	if commit, err := store.LoadCommit(hash); err == nil {
+		subject = commitSubject(commit.Message)
+	}
+	return fmt.Sprintf("# first bad commit: [%s] %s\n", hash, subject)
+}
+
+// BisectRun automates a bisection with a command run at each commit: exit
+// status 0 marks it good, 125 skips it and anything else marks it bad.
+// report is called after each step. A command killed by a signal stops
+// the run.
+func BisectRun(command []string, report func(step *BisectStep)) (*BisectStep, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("no command to run")
+	}
+	state, err := loadBisectState()
+	if err != nil {
+		return nil, err
+	}
+	if state.bad == "" || len(state.good) == 0 {
+		return nil, fmt.Errorf("bisect run needs a good and a bad commit, mark them first")
+	}
+	for {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		term := "good"
+		if err := cmd.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				return nil, fmt.Errorf("failed to run %s: %w", command[0], err)
+			}
+			switch code := exitErr.ExitCode(); code {
+			case -1:
+				return nil, fmt.Errorf("%s was stopped by a signal", command[0])
+			case 125:
+				term = "skip"
+			default:
+				term = "bad"
+			}
+		}
+		step, err := BisectMark(term, nil)
+		if err != nil {
+			return nil, err
+		}
+		if step.Next == "" {
+			return step, nil
+		}
+		report(step)
+	}
+}
+
+// BisectReset ends a bisection and checks out the branch it started on,
+// or target when it is given.
+func BisectReset(target string) error {
+	refs := localRefs()
+	start, err := refs.read("BISECT_START")
+	if os.IsNotExist(err) {
+		return fmt.Errorf("not bisecting")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read bisect state: %w", err)
+	}
+	if target == "" {
+		target = start
+	}
+	if err := CheckoutTarget(target); err != nil {
+		return err
+	}
+	return removeBisectState()
+}
+
+func removeBisectState() error {
+	refs := localRefs()
+	for _, name := range bisectFiles {
+		if err := os.Remove(refs.path(name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// BisectLog returns the marks made so far, as commands with comments.
+func BisectLog() (string, error) {
+	data, err := os.ReadFile(localRefs().path("BISECT_LOG"))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("not bisecting")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read bisect log: %w", err)
+	}
+	return string(data), nil
+}
+
+func loadBisectState() (*bisectState, error) {
+	refs := localRefs()
+	if _, err := os.Stat(refs.path("BISECT_START")); os.IsNotExist(err) {
+		return nil, fmt.Errorf("not bisecting, start with 'kommito bisect start'")
+	}
+	state := &bisectState{}
+	var err error
+	if state.bad, err = refs.read("BISECT_BAD"); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read bisect state: %w", err)
+	}
+	for name, list := range map[string]*[]string{"BISECT_GOOD": &state.good, "BISECT_SKIP": &state.skip} {
+		value, err := refs.read(name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read bisect state: %w", err)
+		}
+		*list = strings.Fields(value)
+	}
+	return state, nil
+}
+
+func (state *bisectState) save() error {
+	refs := localRefs()
+	files := map[string]string{
+		"BISECT_BAD":  state.bad,
+		"BISECT_GOOD": strings.Join(state.good, "\n"),
+		"BISECT_SKIP": strings.Join(state.skip, "\n"),
+	}
+	for name, value := range files {
+		if value == "" {
+			continue
+		}
+		if err := writeFileAtomic(refs.path(name), []byte(value+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to save bisect state: %w", err)
+		}
+	}
+	return nil
+}
+
+func appendBisectLog(entry string) error {
+	f, err := os.OpenFile(localRefs().path("BISECT_LOG"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write bisect log: %w", err)
+	}
+	if _, err := f.WriteString(entry); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write bisect log: %w", err)
+	}
+	return f.Close()
+}
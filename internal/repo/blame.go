@@ -0,0 +1,565 @@
+package repo
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlameOptions controls Blame.
+type BlameOptions struct {
+	// Rev is the revision to blame the file at. Empty means the working
+	// tree, with lines not committed yet blamed on no commit.
+	Rev string
+	// Ranges limit the output to lines "start,end", "start,+count",
+	// "start," or ",end", counted from 1.
+	Ranges []string
+	// IgnoreRevs are commits whose changes are passed through to the
+	// lines they replaced, such as mass reformatting. IgnoreRevsFile
+	// lists more, one per line, with # comments; blame.ignoreRevsFile
+	// names a default.
+	IgnoreRevs     []string
+	IgnoreRevsFile string
+	// Porcelain writes Git's machine-readable blame format.
+	Porcelain bool
+}
+
+// blameLine is one line of the blamed file and the commit that last
+// changed it, at Line of Path in that commit.
+type blameLine struct {
+	Commit string
+	Path   string
+	Line   int
+	Text   string
+}
+
+// blameTarget is a set of lines whose origin is still being looked for in
+// one version of a file. Final indexes the blamed file; Current the file
+// at hash:path.
+type blameTarget struct {
+	hash   string
+	path   string
+	commit *Commit
+	lines  []trackedLine
+	order  int
+}
+
+type trackedLine struct {
+	Final, Current int
+}
+
+// Blame writes each line of a file with the commit, author and date that
+// last changed it.
+func Blame(w io.Writer, path string, opts BlameOptions) error {
+	if err := requireWorkTree(); err != nil {
+		return err
+	}
+	path = filepath.ToSlash(filepath.Clean(path))
+	store := localObjects()
+	b := &blamer{
+		store:   store,
+		ignored: make(map[string]bool),
+		content: make(map[string][]string),
+		entries: make(map[string]map[string]TreeEntry),
+		pending: make(map[string]*blameTarget),
+	}
+	if err := b.loadIgnored(opts); err != nil {
+		return err
+	}
+
+	start, startCommit, err := blameStart(path, opts.Rev)
+	if err != nil {
+		return err
+	}
+	lines, err := b.lines(start, path)
+	if err != nil {
+		return err
+	}
+	selected, err := selectLines(len(lines), opts.Ranges)
+	if err != nil {
+		return err
+	}
+	var tracked []trackedLine
+	for _, i := range selected {
+		tracked = append(tracked, trackedLine{Final: i, Current: i})
+	}
+	result := make([]blameLine, len(lines))
+	b.final, b.result = lines, result
+	b.push(start, path, startCommit, tracked)
+	for b.queue.Len() > 0 {
+		if err := b.blame(heap.Pop(&b.queue).(*blameTarget)); err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	if opts.Porcelain {
+		writeBlamePorcelain(bw, b, selected)
+	} else {
+		writeBlame(bw, b, selected, path)
+	}
+	return bw.Flush()
+}
+
+// blameStart finds the version of the file blame starts from: the file at
+// a revision, or the working tree file as a commit on top of HEAD when it
+// has changes that are not committed.
+func blameStart(path, rev string) (string, *Commit, error) {
+	if rev != "" {
+		hash, err := resolveRevision(rev)
+		if err != nil {
+			return "", nil, err
+		}
+		commit, err := LoadCommit(hash)
+		return hash, commit, err
+	}
+	if _, err := os.Lstat(filepath.FromSlash(path)); err != nil {
+		head, err := resolveRevision("HEAD")
+		if err != nil {
+			return "", nil, err
+		}
+		commit, err := LoadCommit(head)
+		return head, commit, err
+	}
+	commit := &Commit{Author: "Not Committed Yet", Timestamp: time.Now().Format(time.RFC3339)}
+	if head, err := resolveHead(); err == nil && head != "" {
+		commit.Parents = []string{head}
+	}
+	return zeroHash, commit, nil
+}
+
+// selectLines returns the indexes of the lines in ranges, or every line.
+func selectLines(count int, ranges []string) ([]int, error) {
+	if len(ranges) == 0 {
+		all := make([]int, count)
+		for i := range all {
+			all[i] = i
+		}
+		return all, nil
+	}
+	chosen := make([]bool, count)
+	for _, spec := range ranges {
+		from, to, ok := strings.Cut(spec, ",")
+		start, end := 1, count
+		var err error
+		if from != "" {
+			start, err = strconv.Atoi(from)
+		}
+		if err == nil && strings.HasPrefix(to, "+") {
+			var n int
+			n, err = strconv.Atoi(to[1:])
+			end = start + n - 1
+		} else if err == nil && to != "" {
+			end, err = strconv.Atoi(to)
+		}
+		if !ok || err != nil || start < 1 {
+			return nil, fmt.Errorf("invalid line range '%s', use start,end", spec)
+		}
+		if start > count {
+			return nil, fmt.Errorf("file has only %d lines", count)
+		}
+		if end < start {
+			return nil, fmt.Errorf("invalid line range '%s', use start,end", spec)
+		}
+		for i := start - 1; i < end && i < count; i++ {
+			chosen[i] = true
+		}
+	}
+	var selected []int
+	for i, ok := range chosen {
+		if ok {
+			selected = append(selected, i)
+		}
+	}
+	return selected, nil
+}
+
+// blamer follows lines back through history, newest commits first, so
+// lines reaching the same commit along different paths are handled once.
+type blamer struct {
+	store   *ObjectStore
+	ignored map[string]bool
+	// content caches file lines by blob, entries trees by commit.
+	content map[string][]string
+	entries map[string]map[string]TreeEntry
+	pending map[string]*blameTarget
+	queue   blameQueue
+	queued  int
+	// final holds the lines of the version blame starts from, which each
+	// result line shows.
+	final  []string
+	result []blameLine
+	// boundary marks commits blamed only because history ends there.
+	boundary map[string]bool
+	commits  map[string]*Commit
+}
+
+func (b *blamer) loadIgnored(opts BlameOptions) error {
+	revs := append([]string(nil), opts.IgnoreRevs...)
+	file := opts.IgnoreRevsFile
+	if file == "" {
+		if cfg, err := loadConfig(); err == nil {
+			file = cfg.Blame.IgnoreRevsFile
+		}
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read ignore-revs file: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			if line = strings.TrimSpace(line); line != "" {
+				revs = append(revs, line)
+			}
+		}
+	}
+	for _, rev := range revs {
+		hash, err := resolveRevision(rev)
+		if err != nil {
+			return fmt.Errorf("cannot ignore '%s': %w", rev, err)
+		}
+		b.ignored[hash] = true
+	}
+	return nil
+}
+
+// push queues lines to be looked for in hash:path, joining lines already
+// queued there.
+func (b *blamer) push(hash, path string, commit *Commit, lines []trackedLine) {
+	if len(lines) == 0 {
+		return
+	}
+	key := hash + "\x00" + path
+	if target, ok := b.pending[key]; ok {
+		target.lines = append(target.lines, lines...)
+		return
+	}
+	b.queued++
+	target := &blameTarget{hash: hash, path: path, commit: commit, lines: lines, order: b.queued}
+	b.pending[key] = target
+	heap.Push(&b.queue, target)
+}
+
+// blame passes the lines of a target that are unchanged from a parent on
+// to that parent, trying the parents in order, and blames the rest on the
+// target's commit.
+func (b *blamer) blame(target *blameTarget) error {
+	delete(b.pending, target.hash+"\x00"+target.path)
+	lines, err := b.lines(target.hash, target.path)
+	if err != nil {
+		return err
+	}
+	remaining := target.lines
+	boundary := true
+	for i, parentHash := range target.commit.Parents {
+		if len(remaining) == 0 {
+			break
+		}
+		if !b.store.Has(kindCommit, parentHash) {
+			continue
+		}
+		boundary = false
+		parent, err := b.store.LoadCommit(parentHash)
+		if err != nil {
+			return err
+		}
+		parentPath, err := b.findOrigin(target, parentHash)
+		if err != nil {
+			return err
+		}
+		if parentPath == "" {
+			continue
+		}
+		parentLines, err := b.lines(parentHash, parentPath)
+		if err != nil {
+			return err
+		}
+		origin := make([]int, len(lines))
+		for j := range origin {
+			origin[j] = -1
+		}
+		ops := diffLines(parentLines, lines)
+		for _, op := range ops {
+			if op.Kind == ' ' {
+				origin[op.B] = op.A
+			}
+		}
+		if b.ignored[target.hash] && i == 0 {
+			guessOrigins(ops, origin)
+		}
+		var passed, kept []trackedLine
+		for _, line := range remaining {
+			if at := origin[line.Current]; at >= 0 {
+				passed = append(passed, trackedLine{Final: line.Final, Current: at})
+			} else {
+				kept = append(kept, line)
+			}
+		}
+		b.push(parentHash, parentPath, parent, passed)
+		remaining = kept
+	}
+	for _, line := range remaining {
+		b.result[line.Final] = blameLine{Commit: target.hash, Path: target.path, Line: line.Current + 1, Text: b.final[line.Final]}
+	}
+	if len(remaining) > 0 {
+		if b.commits == nil {
+			b.commits = make(map[string]*Commit)
+			b.boundary = make(map[string]bool)
+		}
+		b.commits[target.hash] = target.commit
+		if boundary && target.hash != zeroHash {
+			b.boundary[target.hash] = true
+		}
+	}
+	return nil
+}
+
+// guessOrigins passes the lines an ignored commit changed on to the lines
+// they replaced, line for line within each changed block. Added lines
+// with nothing to replace stay with the ignored commit.
+func guessOrigins(ops []diffOp, origin []int) {
+	var deleted, added []int
+	flush := func() {
+		for k, line := range added {
+			if len(deleted) > 0 {
+				origin[line] = deleted[min(k, len(deleted)-1)]
+			}
+		}
+		deleted, added = nil, nil
+	}
+	for _, op := range ops {
+		switch op.Kind {
+		case '-':
+			deleted = append(deleted, op.A)
+		case '+':
+			added = append(added, op.B)
+		default:
+			flush()
+		}
+	}
+	flush()
+}
+
+// findOrigin returns the path the target's file had in a parent: the same
+// path, or else the file it was renamed from, found by identical content
+// or by sharing at least half its lines with a file the commit removed.
+func (b *blamer) findOrigin(target *blameTarget, parentHash string) (string, error) {
+	parentEntries, err := b.treeEntries(parentHash)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := parentEntries[target.path]; ok || target.hash == zeroHash {
+		if ok {
+			return target.path, nil
+		}
+		return "", nil
+	}
+	entries, err := b.treeEntries(target.hash)
+	if err != nil {
+		return "", err
+	}
+	entry := entries[target.path]
+	var candidates []string
+	for path, parentEntry := range parentEntries {
+		if _, kept := entries[path]; kept {
+			continue
+		}
+		if parentEntry.Hash == entry.Hash {
+			return path, nil
+		}
+		candidates = append(candidates, path)
+	}
+	if len(candidates) > 100 {
+		return "", nil
+	}
+	lines, err := b.lines(target.hash, target.path)
+	if err != nil {
+		return "", err
+	}
+	best, bestScore := "", 0.5
+	sort.Strings(candidates)
+	for _, path := range candidates {
+		candidate, err := b.lines(parentHash, path)
+		if err != nil {
+			return "", err
+		}
+		if len(candidate)+len(lines) == 0 {
+			continue
+		}
+		common := 0
+		for _, op := range diffLines(candidate, lines) {
+			if op.Kind == ' ' {
+				common++
+			}
+		}
+		if score := 2 * float64(common) / float64(len(candidate)+len(lines)); score >= bestScore {
+			best, bestScore = path, score
+		}
+	}
+	return best, nil
+}
+
+func (b *blamer) treeEntries(hash string) (map[string]TreeEntry, error) {
+	if entries, ok := b.entries[hash]; ok {
+		return entries, nil
+	}
+	commit, err := b.store.LoadCommit(hash)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := commitEntries(commit)
+	if err != nil {
+		return nil, err
+	}
+	b.entries[hash] = entries
+	return entries, nil
+}
+
+// lines returns the lines of path at a commit, or in the working tree for
+// zeroHash. Binary files cannot be blamed.
+func (b *blamer) lines(hash, path string) ([]string, error) {
+	file := &diffFile{Path: path, Worktree: true}
+	if hash != zeroHash {
+		entries, err := b.treeEntries(hash)
+		if err != nil {
+			return nil, err
+		}
+		entry, ok := entries[path]
+		if !ok {
+			return nil, fmt.Errorf("no such path '%s' in %s", path, hash[:7])
+		}
+		if lines, ok := b.content[entry.Hash]; ok {
+			return lines, nil
+		}
+		file = &diffFile{Path: path, Hash: entry.Hash, Mode: entry.Mode}
+	}
+	data, binary, err := diffContent(b.store, file)
+	if err != nil {
+		return nil, err
+	}
+	if binary {
+		return nil, fmt.Errorf("cannot blame binary file '%s'", path)
+	}
+	lines := splitLines(data)
+	if hash != zeroHash {
+		b.content[file.Hash] = lines
+	}
+	return lines, nil
+}
+
+// writeBlame writes one line per file line: the commit, with ^ for a
+// commit at the start of the available history, the path when renames
+// were followed, then author, date and line number.
+func writeBlame(w io.Writer, b *blamer, selected []int, path string) {
+	renamed, authorWidth := false, 0
+	for _, i := range selected {
+		line := b.result[i]
+		renamed = renamed || line.Path != path
+		authorWidth = max(authorWidth, len([]rune(authorName(b.commits[line.Commit].Author))))
+	}
+	pathWidth := 0
+	if renamed {
+		for _, i := range selected {
+			pathWidth = max(pathWidth, len(b.result[i].Path))
+		}
+	}
+	numberWidth := len(strconv.Itoa(selected[len(selected)-1] + 1))
+	for _, i := range selected {
+		line := b.result[i]
+		commit := b.commits[line.Commit]
+		hash := line.Commit[:8]
+		if b.boundary[line.Commit] {
+			hash = "^" + line.Commit[:7]
+		}
+		fmt.Fprint(w, hash)
+		if renamed {
+			fmt.Fprintf(w, " %-*s", pathWidth, line.Path)
+		}
+		author := authorName(commit.Author)
+		author += strings.Repeat(" ", authorWidth-len([]rune(author)))
+		fmt.Fprintf(w, " (%s %s %*d) %s\n", author, commitTime(commit).Format("2006-01-02 15:04:05 -0700"),
+			numberWidth, i+1, strings.TrimSuffix(line.Text, "\n"))
+	}
+}
+
+// writeBlamePorcelain writes Git's porcelain format: for each line its
+// commit, original and final line numbers, the commit's details the first
+// time it appears, and the line after a tab.
+func writeBlamePorcelain(w io.Writer, b *blamer, selected []int) {
+	described := make(map[string]bool)
+	for n, i := range selected {
+		line := b.result[i]
+		group := 0
+		if n == 0 || b.result[selected[n-1]].Commit != line.Commit || selected[n-1] != i-1 {
+			for group = 1; n+group < len(selected); group++ {
+				next := b.result[selected[n+group]]
+				if next.Commit != line.Commit || selected[n+group] != i+group {
+					break
+				}
+			}
+		}
+		if group > 0 {
+			fmt.Fprintf(w, "%s %d %d %d\n", line.Commit, line.Line, i+1, group)
+		} else {
+			fmt.Fprintf(w, "%s %d %d\n", line.Commit, line.Line, i+1)
+		}
+		if !described[line.Commit] {
+			described[line.Commit] = true
+			commit := b.commits[line.Commit]
+			when := commitTime(commit)
+			name, mail := authorName(commit.Author), authorMail(commit.Author)
+			for _, role := range []string{"author", "committer"} {
+				fmt.Fprintf(w, "%s %s\n%s-mail <%s>\n%s-time %d\n%s-tz %s\n", role, name, role, mail, role, when.Unix(), role, when.Format("-0700"))
+			}
+			fmt.Fprintf(w, "summary %s\n", commitSubject(commit.Message))
+			if b.boundary[line.Commit] {
+				fmt.Fprintln(w, "boundary")
+			}
+			fmt.Fprintf(w, "filename %s\n", line.Path)
+		}
+		fmt.Fprintf(w, "\t%s\n", strings.TrimSuffix(line.Text, "\n"))
+	}
+}
+
+// authorName and authorMail split an author recorded as "Name <mail>".
+func authorName(author string) string {
+	if i := strings.LastIndex(author, " <"); i >= 0 && strings.HasSuffix(author, ">") {
+		return author[:i]
+	}
+	return author
+}
+
+func authorMail(author string) string {
+	if i := strings.LastIndex(author, " <"); i >= 0 && strings.HasSuffix(author, ">") {
+		return author[i+2 : len(author)-1]
+	}
+	return ""
+}
+
+// blameQueue hands out the newest commit first.
+type blameQueue []*blameTarget
+
+func (q blameQueue) Len() int { return len(q) }
+func (q blameQueue) Less(i, j int) bool {
+	ti, tj := commitTime(q[i].commit), commitTime(q[j].commit)
+	if !ti.Equal(tj) {
+		return ti.After(tj)
+	}
+	return q[i].order < q[j].order
+}
+func (q blameQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *blameQueue) Push(x any)   { *q = append(*q, x.(*blameTarget)) }
+func (q *blameQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type Branch struct {
@@ -21,11 +22,18 @@ func NewBranchManager(repoPath string) *BranchManager {
 	}
 }
 
+func (bm *BranchManager) refs() *refStore {
+	return newRefStore(metaDir(bm.repoPath))
+}
+
 func (bm *BranchManager) CreateBranch(name string) error {
 
 	if name == "" {
 		return fmt.Errorf("branch name cannot be empty")
 	}
+	if err := checkRefName(name); err != nil {
+		return err
+	}
 
 	branches, err := bm.ListBranches()
 	if err != nil {
@@ -37,19 +45,17 @@ func (bm *BranchManager) CreateBranch(name string) error {
 		}
 	}
 
-	headPath := filepath.Join(bm.repoPath, ".kommito", "HEAD")
-	headContent, err := os.ReadFile(headPath)
+	refs := bm.refs()
+	headCommit, err := refs.resolve("HEAD")
 	if err != nil {
-		return fmt.Errorf("failed to read HEAD: %v", err)
+		return err
 	}
-
-	branchPath := filepath.Join(bm.repoPath, ".kommito", "refs", "heads", name)
-	if err := os.MkdirAll(filepath.Dir(branchPath), 0755); err != nil {
-		return fmt.Errorf("failed to create branch directory: %v", err)
+	if headCommit == "" {
+		return fmt.Errorf("cannot create branch '%s': no commits yet", name)
 	}
 
-	if err := os.WriteFile(branchPath, headContent, 0644); err != nil {
-		return fmt.Errorf("failed to create branch: %v", err)
+	if err := refs.update("refs/heads/"+name, headCommit, "", "branch: Created from HEAD"); err != nil {
+		return fmt.Errorf("failed to create branch: %w", err)
 	}
 
 	return nil
@@ -57,26 +63,21 @@ func (bm *BranchManager) CreateBranch(name string) error {
 
 func (bm *BranchManager) SwitchBranch(name string) error {
 
-	branchPath := filepath.Join(bm.repoPath, ".kommito", "refs", "heads", name)
+	branchPath := filepath.Join(metaDir(bm.repoPath), "refs", "heads", name)
 	if _, err := os.Stat(branchPath); os.IsNotExist(err) {
 		return fmt.Errorf("branch '%s' does not exist", name)
 	}
 
-	branchContent, err := os.ReadFile(branchPath)
-	if err != nil {
-		return fmt.Errorf("failed to read branch: %v", err)
-	}
-
-	headPath := filepath.Join(bm.repoPath, ".kommito", "HEAD")
-	if err := os.WriteFile(headPath, branchContent, 0644); err != nil {
-		return fmt.Errorf("failed to switch branch: %v", err)
+	from, _ := bm.GetCurrentBranch()
+	if err := bm.refs().setHead("ref: refs/heads/"+name, fmt.Sprintf("checkout: moving from %s to %s", from, name)); err != nil {
+		return fmt.Errorf("failed to switch branch: %w", err)
 	}
 
 	return nil
 }
 
 func (bm *BranchManager) ListBranches() ([]Branch, error) {
-	headsPath := filepath.Join(bm.repoPath, ".kommito", "refs", "heads")
+	headsPath := filepath.Join(metaDir(bm.repoPath), "refs", "heads")
 	entries, err := os.ReadDir(headsPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -87,7 +88,7 @@ func (bm *BranchManager) ListBranches() ([]Branch, error) {
 
 	var branches []Branch
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if entry.IsDir() || !isRefFile(entry.Name()) {
 			continue
 		}
 
@@ -99,7 +100,7 @@ func (bm *BranchManager) ListBranches() ([]Branch, error) {
 
 		branches = append(branches, Branch{
 			Name:   entry.Name(),
-			Commit: string(commit),
+			Commit: strings.TrimSpace(string(commit)),
 		})
 	}
 
@@ -108,47 +109,47 @@ func (bm *BranchManager) ListBranches() ([]Branch, error) {
 
 func (bm *BranchManager) DeleteBranch(name string) error {
 
-	branchPath := filepath.Join(bm.repoPath, ".kommito", "refs", "heads", name)
+	branchPath := filepath.Join(metaDir(bm.repoPath), "refs", "heads", name)
 	if _, err := os.Stat(branchPath); os.IsNotExist(err) {
 		return fmt.Errorf("branch '%s' does not exist", name)
 	}
 
-	headPath := filepath.Join(bm.repoPath, ".kommito", "HEAD")
-	headContent, err := os.ReadFile(headPath)
-	if err != nil {
-		return fmt.Errorf("failed to read HEAD: %v", err)
+	currentBranch, _ := bm.GetCurrentBranch()
+	if currentBranch == name {
+		return fmt.Errorf("cannot delete current branch")
 	}
 
-	branchContent, err := os.ReadFile(branchPath)
+	branchCommit, err := bm.GetBranchCommit(name)
 	if err != nil {
 		return fmt.Errorf("failed to read branch: %v", err)
 	}
 
-	if string(headContent) == string(branchContent) {
-		return fmt.Errorf("cannot delete current branch")
-	}
-
-	if err := os.Remove(branchPath); err != nil {
-		return fmt.Errorf("failed to delete branch: %v", err)
+	if err := bm.refs().delete("refs/heads/"+name, branchCommit); err != nil {
+		return fmt.Errorf("failed to delete branch: %w", err)
 	}
 
 	return nil
 }
 
 func (bm *BranchManager) GetCurrentBranch() (string, error) {
-	headPath := filepath.Join(bm.repoPath, ".kommito", "HEAD")
+	headPath := filepath.Join(metaDir(bm.repoPath), "HEAD")
 	headContent, err := os.ReadFile(headPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to read HEAD: %v", err)
 	}
 
+	head := strings.TrimSpace(string(headContent))
+	if strings.HasPrefix(head, "ref: refs/heads/") {
+		return strings.TrimPrefix(head, "ref: refs/heads/"), nil
+	}
+
 	branches, err := bm.ListBranches()
 	if err != nil {
 		return "", err
 	}
 
 	for _, branch := range branches {
-		if branch.Commit == string(headContent) {
+		if branch.Commit == head {
 			return branch.Name, nil
 		}
 	}
@@ -157,10 +158,10 @@ func (bm *BranchManager) GetCurrentBranch() (string, error) {
 }
 
 func (bm *BranchManager) GetBranchCommit(name string) (string, error) {
-	branchPath := filepath.Join(bm.repoPath, ".kommito", "refs", "heads", name)
+	branchPath := filepath.Join(metaDir(bm.repoPath), "refs", "heads", name)
 	commit, err := os.ReadFile(branchPath)
 	if err != nil {
 		return "", err
 	}
-	return string(commit), nil
+	return strings.TrimSpace(string(commit)), nil
 }
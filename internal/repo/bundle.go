@@ -0,0 +1,391 @@
+package repo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A bundle carries history between repositories that cannot reach each
+// other, as a single file: a header naming the refs it records and the
+// commits it builds on, followed by a pack of the objects in between.
+//
+//	# kommito bundle v1
+//	-<hash> <subject>       a prerequisite the receiver must already have
+//	<hash> <ref>            a branch or tag recorded in the bundle
+//	@head <ref>             the branch HEAD pointed at, if recorded
+//	<empty line>
+//	KPACK 1 ...
+//
+// A bundle file works as a remote URL, so it can be cloned and fetched
+// from. Large files travel as their pointers; their content has to be
+// moved with `kommito large push` and `fetch` as usual.
+const bundleHeader = "# kommito bundle v1"
+
+type Bundle struct {
+	Refs map[string]string
+	// Head is the branch HEAD pointed at when the bundle was created.
+	Head string
+	// Prerequisites maps each commit the bundle builds on to its subject.
+	Prerequisites map[string]string
+}
+
+// BundleResult describes a bundle that was created or verified.
+type BundleResult struct {
+	Bundle
+	Objects int
+	// Missing lists the prerequisites the current repository lacks.
+	Missing []string
+}
+
+// CreateBundle writes the history selected by revs to path. A rev is a
+// branch, tag or HEAD to record, "^<rev>" or "<rev>..<rev>" to leave out
+// history the receiver already has, or "--all" for every branch and tag.
+func CreateBundle(path string, revs []string) (*BundleResult, error) {
+	refs, err := localRefs().list()
+	if err != nil {
+		return nil, err
+	}
+	bundle := Bundle{Refs: make(map[string]string), Prerequisites: make(map[string]string)}
+	var excluded []string
+	include := func(rev string) error {
+		hash, ref, err := resolveRevisionRef(rev)
+		if err != nil {
+			return err
+		}
+		if ref == "" && rev != "HEAD" && rev != "@" {
+			return fmt.Errorf("'%s' is not a branch or tag; a bundle can only record refs", rev)
+		}
+		if ref == "" {
+			head, err := localRefs().headTarget()
+			if err != nil {
+				return err
+			}
+			if head == "" {
+				return fmt.Errorf("HEAD is detached; name a branch to bundle instead")
+			}
+			ref = head
+		}
+		bundle.Refs[ref] = hash
+		if rev == "HEAD" || rev == "@" {
+			bundle.Head = ref
+		}
+		return nil
+	}
+	exclude := func(rev string) error {
+		hash, err := resolveRevision(rev)
+		excluded = append(excluded, hash)
+		return err
+	}
+	for _, rev := range revs {
+		switch {
+		case rev == "--all":
+			for name, hash := range refs {
+				if strings.HasPrefix(name, "refs/heads/") || strings.HasPrefix(name, "refs/tags/") {
+					bundle.Refs[name] = hash
+				}
+			}
+			if head, err := localRefs().headTarget(); err == nil && refs[head] != "" {
+				bundle.Head = head
+			}
+		case strings.HasPrefix(rev, "^"):
+			err = exclude(rev[1:])
+		case strings.Contains(rev, ".."):
+			from, to, _ := strings.Cut(rev, "..")
+			if from == "" {
+				from = "HEAD"
+			}
+			if to == "" {
+				to = "HEAD"
+			}
+			if err = exclude(from); err == nil {
+				err = include(to)
+			}
+		default:
+			err = include(rev)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(bundle.Refs) == 0 {
+		return nil, fmt.Errorf("refusing to create an empty bundle; name the branches or tags to include")
+	}
+
+	store := localObjects()
+	have, err := commonObjects(store, excluded, nil)
+	if err != nil {
+		return nil, err
+	}
+	var tips []string
+	for _, hash := range bundle.Refs {
+		tips = append(tips, hash)
+	}
+	objects, err := missingObjects(store, tips, have)
+	if err != nil {
+		return nil, err
+	}
+	// The prerequisites are the excluded commits the bundled history
+	// builds on directly.
+	bundled := make(map[string]bool)
+	for _, ref := range objects {
+		if ref.Kind == kindCommit {
+			bundled[ref.Hash] = true
+		}
+	}
+	if len(bundled) == 0 {
+		return nil, fmt.Errorf("refusing to create an empty bundle; every commit is excluded")
+	}
+	for hash := range bundled {
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range commit.Parents {
+			if bundled[parent] {
+				continue
+			}
+			prerequisite, err := store.LoadCommit(parent)
+			if err != nil {
+				return nil, err
+			}
+			bundle.Prerequisites[parent] = commitSubject(prerequisite.Message)
+		}
+	}
+
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+name+".tmp_")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bundle: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	err = writeBundle(tmp, store, bundle, objects)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return &BundleResult{Bundle: bundle, Objects: len(objects)}, nil
+}
+
+func writeBundle(w io.Writer, store *ObjectStore, bundle Bundle, objects []objectRef) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, bundleHeader)
+	for _, hash := range sortedKeys(bundle.Prerequisites) {
+		fmt.Fprintf(bw, "-%s %s\n", hash, bundle.Prerequisites[hash])
+	}
+	for _, name := range sortedKeys(bundle.Refs) {
+		fmt.Fprintf(bw, "%s %s\n", bundle.Refs[name], name)
+	}
+	if bundle.Head != "" {
+		fmt.Fprintf(bw, "@head %s\n", bundle.Head)
+	}
+	fmt.Fprintln(bw)
+	if err := writePack(bw, store, objects); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// commitSubject returns the first line of a commit message.
+func commitSubject(message string) string {
+	subject, _, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	return subject
+}
+
+// readBundleHeader parses the header of a bundle and leaves r at the start
+// of its pack.
+func readBundleHeader(r *bufio.Reader) (Bundle, error) {
+	bundle := Bundle{Refs: make(map[string]string), Prerequisites: make(map[string]string)}
+	line, err := r.ReadString('\n')
+	if err != nil || strings.TrimSuffix(line, "\n") != bundleHeader {
+		return bundle, fmt.Errorf("not a Kommito bundle")
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return bundle, fmt.Errorf("bundle header ended unexpectedly")
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return bundle, nil
+		}
+		first, rest, _ := strings.Cut(line, " ")
+		switch {
+		case strings.HasPrefix(first, "-") && isObjectHash(first[1:]):
+			bundle.Prerequisites[first[1:]] = rest
+		case first == "@head" && strings.HasPrefix(rest, "refs/heads/"):
+			bundle.Head = rest
+		case isObjectHash(first) && strings.HasPrefix(rest, "refs/") && checkRefName(rest) == nil:
+			bundle.Refs[rest] = first
+		default:
+			return bundle, fmt.Errorf("malformed bundle header line %q", line)
+		}
+	}
+}
+
+// isBundle reports whether path is a bundle file rather than a repository.
+func isBundle(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, len(bundleHeader)+1)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return string(header) == bundleHeader+"\n"
+}
+
+// missingPrerequisites lists the prerequisites of a bundle that store lacks.
+func (b Bundle) missingPrerequisites(store *ObjectStore) []string {
+	var missing []string
+	for _, hash := range sortedKeys(b.Prerequisites) {
+		if !store.Has(kindCommit, hash) {
+			missing = append(missing, hash)
+		}
+	}
+	return missing
+}
+
+// VerifyBundle checks that a bundle is complete and intact, by unpacking it
+// into a scratch directory, and reports which of its prerequisites the
+// current repository is missing.
+func VerifyBundle(path string) (*BundleResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer f.Close()
+	br := bufio.NewReaderSize(f, 1<<16)
+	bundle, err := readBundleHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	scratch, err := os.MkdirTemp("", "kommito-bundle-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+	unpacked := NewObjectStore(scratch)
+	count, err := readPack(br, unpacked)
+	if err != nil {
+		return nil, fmt.Errorf("bundle is damaged: %w", err)
+	}
+	result := &BundleResult{Bundle: bundle, Objects: count}
+	if _, _, err := findRepoDir("."); err == nil {
+		result.Missing = bundle.missingPrerequisites(localObjects())
+	} else {
+		result.Missing = sortedKeys(bundle.Prerequisites)
+	}
+	for name, hash := range bundle.Refs {
+		if !unpacked.Has(kindCommit, hash) {
+			return nil, fmt.Errorf("bundle records %s at %s but does not contain that commit", name, hash)
+		}
+	}
+	return result, nil
+}
+
+// bundleTransport reads a bundle file as if it were a remote that only
+// supports fetching.
+type bundleTransport struct {
+	path   string
+	bundle Bundle
+}
+
+func openBundle(path string) (*bundleTransport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer f.Close()
+	bundle, err := readBundleHeader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return &bundleTransport{path: path, bundle: bundle}, nil
+}
+
+// ListRefs returns the recorded refs. Without a recorded HEAD, a clone
+// checks out the only branch, or else main or master.
+func (t *bundleTransport) ListRefs() (map[string]string, string, error) {
+	refs := make(map[string]string)
+	var branches []string
+	for name, hash := range t.bundle.Refs {
+		refs[name] = hash
+		if strings.HasPrefix(name, "refs/heads/") {
+			branches = append(branches, name)
+		}
+	}
+	head := t.bundle.Head
+	if head == "" && len(branches) == 1 {
+		head = branches[0]
+	}
+	for _, name := range []string{"refs/heads/main", "refs/heads/master"} {
+		if _, ok := refs[name]; ok && head == "" {
+			head = name
+		}
+	}
+	return refs, head, nil
+}
+
+// Fetch unpacks the whole bundle; there is no one on the other side to
+// pick out only the objects wanted.
+func (t *bundleTransport) Fetch(wants []string, dst *ObjectStore, opts FetchOptions) (int, error) {
+	if opts.Depth > 0 || opts.deepens() || opts.Filter != "" {
+		return 0, fmt.Errorf("shallow and partial fetches from a bundle are not supported")
+	}
+	complete := true
+	for _, hash := range wants {
+		complete = complete && dst.hasRaw(kindCommit, hash)
+	}
+	if complete {
+		return 0, nil
+	}
+	if missing := t.bundle.missingPrerequisites(dst); len(missing) > 0 {
+		return 0, fmt.Errorf("bundle builds on %d commits this repository does not have, starting with %s", len(missing), missing[0])
+	}
+	f, err := os.Open(t.path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer f.Close()
+	br := bufio.NewReaderSize(f, 1<<16)
+	if _, err := readBundleHeader(br); err != nil {
+		return 0, err
+	}
+	return readPack(br, dst)
+}
+
+func (t *bundleTransport) FetchBlobs(hashes []string, dst *ObjectStore) (int, error) {
+	return 0, fmt.Errorf("a bundle cannot serve blobs on demand")
+}
+
+func (t *bundleTransport) Push(src *ObjectStore, updates []RefUpdate) (int, error) {
+	return 0, fmt.Errorf("cannot push to a bundle; create a new one with `kommito bundle create`")
+}
+
+func (t *bundleTransport) Close() error {
+	return nil
+}
@@ -1,82 +1,306 @@
 package repo
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 )
 
-
+// CheckoutTarget switches the working tree, index and HEAD to a branch, or
+// to any other revision on a detached HEAD.
 func CheckoutTarget(target string) error {
-	bm := NewBranchManager(".")
-	commitHash := target
-
-	
-	branches, err := bm.ListBranches()
-	if err == nil {
-		for _, branch := range branches {
-			if branch.Name == target {
-				commitHash = branch.Commit
-				break
-			}
-		}
+	if err := requireWorkTree(); err != nil {
+		return err
+	}
+	refs := localRefs()
+	commitHash, ref, err := resolveRevisionRef(target)
+	if err != nil {
+		return fmt.Errorf("could not find commit or branch '%s': %w", target, err)
 	}
-
 	commit, err := LoadCommit(commitHash)
 	if err != nil {
 		return fmt.Errorf("could not find commit or branch '%s': %w", target, err)
 	}
-
-	
-	blobToPath, err := getBlobToPathMap(commit)
+	head, err := resolveHead()
 	if err != nil {
 		return err
 	}
-	filesInCommit := make(map[string]string) 
-	for hash, path := range blobToPath {
-		filesInCommit[path] = hash
+	if err := updateWorkingTree(head, commit); err != nil {
+		return err
 	}
 
-	
-	entries, err := ioutil.ReadDir(".")
+	from := "detached HEAD"
+	if current, err := refs.headTarget(); err == nil && current != "" {
+		from = strings.TrimPrefix(current, "refs/heads/")
+	}
+	message := fmt.Sprintf("checkout: moving from %s to %s", from, target)
+	if strings.HasPrefix(ref, "refs/heads/") {
+		err = refs.setHead("ref: "+ref, message)
+	} else {
+		err = refs.setHead(commitHash, message)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update HEAD: %w", err)
+	}
+	fmt.Printf("Checked out %s\n", target)
+	return nil
+}
+
+// updateWorkingTree moves the working tree and the index from the commit
+// HEAD is at (from, or "" when there is none) to commit.
+func updateWorkingTree(from string, commit *Commit) error {
+	current := make(map[string]TreeEntry)
+	if from != "" {
+		fromCommit, err := LoadCommit(from)
+		if err != nil {
+			return err
+		}
+		if current, err = commitEntries(fromCommit); err != nil {
+			return err
+		}
+	}
+	target, err := commitEntries(commit)
 	if err != nil {
 		return err
 	}
+	return moveWorkingTree(current, target)
+}
+
+// moveWorkingTree moves the working tree and the index from the files in
+// current to those in target. Only the files that differ between the two
+// are written or deleted, at any depth, and directories left empty are
+// removed. Nothing is touched when that would lose an untracked file or a
+// local change; the other local changes are carried over.
+func moveWorkingTree(current, target map[string]TreeEntry) error {
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	staged := make(map[string]indexEntry)
 	for _, entry := range entries {
-		name := entry.Name()
-		if entry.IsDir() || isSystemFile(name) {
-			continue
+		staged[entry.Path] = entry
+	}
+
+	var writes, removes []string
+	for path, entry := range target {
+		if current[path] != entry {
+			writes = append(writes, path)
 		}
-		if _, ok := filesInCommit[name]; !ok {
-			_ = os.Remove(name)
+	}
+	for path := range current {
+		if _, ok := target[path]; !ok {
+			removes = append(removes, path)
+		}
+	}
+	sort.Strings(writes)
+	sort.Strings(removes)
+	for _, path := range append(writes, removes...) {
+		if err := checkWorktreePath(path); err != nil {
+			return err
 		}
 	}
 
-	
-	for path, hash := range filesInCommit {
-		blobPath := filepath.Join(".kommito", "objects", "blobs", hash)
-		content, err := os.ReadFile(blobPath)
-		if err != nil {
-			return fmt.Errorf("failed to read blob for %s: %w", path, err)
+	// Fetch what a partial clone left out before touching any file, so
+	// an offline checkout fails without changing the working tree.
+	objects := localObjects()
+	var needed []string
+	for _, path := range writes {
+		needed = append(needed, target[path].Hash, current[path].Hash)
+	}
+	for _, path := range removes {
+		needed = append(needed, current[path].Hash)
+	}
+	if err := objects.prefetchBlobs(needed); err != nil {
+		return err
+	}
+
+	removed := make(map[string]bool)
+	for _, path := range removes {
+		removed[path] = true
+	}
+	fileMode := fileModeEnabled()
+	var problems []string
+	for _, path := range append(writes, removes...) {
+		if problem := checkoutConflict(objects, path, current, target, staged, removed, fileMode); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("checkout would lose local work, commit or remove it first:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	for _, path := range removes {
+		if err := os.Remove(filepath.FromSlash(path)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		pruneEmptyDirs(filepath.Dir(filepath.FromSlash(path)))
+	}
+	for _, path := range writes {
+		diskPath := filepath.FromSlash(path)
+		if info, err := os.Lstat(diskPath); err == nil && info.IsDir() {
+			// Only removed files were in it; what is left is empty.
+			if err := os.RemoveAll(diskPath); err != nil {
+				return fmt.Errorf("failed to replace directory %s: %w", path, err)
+			}
 		}
-		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		if err := objects.checkoutEntry(target[path], diskPath, fileMode); err != nil {
 			return fmt.Errorf("failed to restore file %s: %w", path, err)
 		}
 	}
 
-	
-	for _, branch := range branches {
-		if branch.Name == target {
-			headPath := filepath.Join(".kommito", "HEAD")
-			if err := os.WriteFile(headPath, []byte(branch.Commit), 0644); err != nil {
-				return fmt.Errorf("failed to update HEAD: %w", err)
+	// The index takes the new tree, keeping what was staged for paths
+	// the checkout left alone.
+	return updateIndex(func(entries []indexEntry) []indexEntry {
+		files := make(map[string]indexEntry)
+		for path, entry := range target {
+			files[path] = indexEntry{Hash: entry.Hash, Path: path, Mode: entry.Mode}
+		}
+		for _, entry := range entries {
+			if current[entry.Path] == target[entry.Path] && !removed[entry.Path] {
+				files[entry.Path] = entry
 			}
-			break
 		}
+		updated := make([]indexEntry, 0, len(files))
+		for _, entry := range files {
+			updated = append(updated, entry)
+		}
+		sort.Slice(updated, func(i, j int) bool { return updated[i].Path < updated[j].Path })
+		return updated
+	})
+}
+
+// resetWorkingTree forces the working tree and the index to target,
+// discarding local changes to the files in the index, in target or in
+// paths. Other untracked files are left alone.
+func resetWorkingTree(target map[string]TreeEntry, paths []string) error {
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+	for path := range target {
+		paths = append(paths, path)
 	}
+	sort.Strings(paths)
+	paths = slices.Compact(paths)
 
-	fmt.Printf("Checked out %s\n", target)
+	objects := localObjects()
+	var needed []string
+	for _, entry := range target {
+		needed = append(needed, entry.Hash)
+	}
+	if err := objects.prefetchBlobs(needed); err != nil {
+		return err
+	}
+	fileMode := fileModeEnabled()
+	for _, path := range paths {
+		if err := checkWorktreePath(path); err != nil {
+			return err
+		}
+		diskPath := filepath.FromSlash(path)
+		entry, ok := target[path]
+		if !ok {
+			if err := os.Remove(diskPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove %s: %w", path, err)
+			}
+			pruneEmptyDirs(filepath.Dir(diskPath))
+			continue
+		}
+		if hash, mode, err := hashWorktreeFile(diskPath, entry.Mode, fileMode); err == nil && hash == objects.worktreeHash(entry.Hash) && mode == entry.Mode {
+			continue
+		}
+		if info, err := os.Lstat(diskPath); err == nil && info.IsDir() {
+			if err := os.RemoveAll(diskPath); err != nil {
+				return fmt.Errorf("failed to replace directory %s: %w", path, err)
+			}
+		}
+		if err := objects.checkoutEntry(entry, diskPath, fileMode); err != nil {
+			return fmt.Errorf("failed to restore file %s: %w", path, err)
+		}
+	}
+	return resetIndex(target)
+}
+
+// checkoutConflict explains why path cannot be changed by a checkout, or
+// returns "" when it can: an untracked file or directory is in the way, or
+// the file has changes that are not committed.
+func checkoutConflict(objects *ObjectStore, path string, current, target map[string]TreeEntry, staged map[string]indexEntry, removed map[string]bool, fileMode bool) string {
+	// Parent directories must be free of untracked files.
+	for dir := filepath.Dir(path); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		info, err := os.Lstat(filepath.FromSlash(dir))
+		if err == nil && !info.IsDir() && !removed[filepath.ToSlash(dir)] {
+			return fmt.Sprintf("%s: untracked file would be replaced by a directory", dir)
+		}
+	}
+	diskPath := filepath.FromSlash(path)
+	info, err := os.Lstat(diskPath)
+	if err != nil {
+		return ""
+	}
+	if info.IsDir() {
+		if _, ok := target[path]; !ok {
+			return ""
+		}
+		blocked := ""
+		filepath.WalkDir(diskPath, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && !removed[filepath.ToSlash(p)] {
+				blocked = filepath.ToSlash(p)
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if blocked != "" {
+			return fmt.Sprintf("%s: untracked file is in the way of %s", blocked, path)
+		}
+		return ""
+	}
+
+	committed, tracked := current[path]
+	hash, _, err := hashWorktreeFile(diskPath, committed.Mode, fileMode)
+	if err != nil {
+		return fmt.Sprintf("%s: %v", path, err)
+	}
+	if want, ok := target[path]; ok && hash == objects.worktreeHash(want.Hash) {
+		return ""
+	}
+	if !tracked {
+		if _, ok := staged[path]; ok {
+			return fmt.Sprintf("%s: staged file would be overwritten", path)
+		}
+		return fmt.Sprintf("%s: untracked file would be overwritten", path)
+	}
+	if index, ok := staged[path]; ok && index.Hash != committed.Hash {
+		return fmt.Sprintf("%s: staged changes would be lost", path)
+	}
+	if hash != objects.worktreeHash(committed.Hash) {
+		return fmt.Sprintf("%s: local changes would be lost", path)
+	}
+	return ""
+}
+
+// checkWorktreePath refuses tree paths that would write outside the working
+// tree or into the repository metadata.
+func checkWorktreePath(path string) error {
+	clean := filepath.ToSlash(filepath.Clean(filepath.FromSlash(path)))
+	first := strings.Split(clean, "/")[0]
+	if clean != path || filepath.IsAbs(path) || first == ".." || strings.EqualFold(first, ".kommito") || strings.EqualFold(first, ".git") {
+		return fmt.Errorf("refusing to check out unsafe path '%s'", path)
+	}
 	return nil
-} 
\ No newline at end of file
+}
+
+// pruneEmptyDirs removes dir and its parents for as long as they are empty.
+func pruneEmptyDirs(dir string) {
+	for dir != "." && dir != string(filepath.Separator) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
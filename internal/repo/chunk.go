@@ -0,0 +1,175 @@
+package repo
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	kindChunk    = "chunks"
+	kindManifest = "manifests"
+)
+
+// Chunk boundaries are chosen by a gear rolling hash so that an edit only
+// changes the chunks around it; the rest of the file dedupes against the
+// chunks already stored.
+const (
+	minChunkSize = 512 << 10
+	maxChunkSize = 8 << 20
+	chunkMask    = (1 << 21) - 1 // ~2 MiB average chunk
+)
+
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x6b6f6d6d69746f) // "kommito"
+	for i := range table {
+		// splitmix64 gives a fixed, well-mixed table without shipping
+		// 256 literal constants.
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+type ChunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Manifest lists, in order, the chunks that make up a chunked blob. It is
+// stored under objects/manifests using the hash of the whole content, so
+// trees and the index refer to chunked and plain blobs the same way.
+type Manifest struct {
+	Size   int64      `json:"size"`
+	Chunks []ChunkRef `json:"chunks"`
+}
+
+// nextChunk reads one content-defined chunk from r into buf.
+func nextChunk(r *bufio.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	var h uint64
+	for len(buf) < maxChunkSize {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(buf) > 0 {
+				return buf, nil
+			}
+			return buf, err
+		}
+		buf = append(buf, b)
+		h = (h << 1) + gearTable[b]
+		if len(buf) >= minChunkSize && h&chunkMask == 0 {
+			break
+		}
+	}
+	return buf, nil
+}
+
+// WriteChunked stores r as content-defined chunks plus a manifest, hashing
+// the full content in the same pass. The returned hash is the blob hash the
+// content would have had as a plain blob.
+func (s *ObjectStore) WriteChunked(r io.Reader) (string, int64, error) {
+	whole := sha1.New()
+	reader := bufio.NewReaderSize(io.TeeReader(r, whole), 1<<20)
+	buf := make([]byte, 0, maxChunkSize)
+
+	var manifest Manifest
+	for {
+		chunk, err := nextChunk(reader, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to read content: %w", err)
+		}
+		hash, err := s.Write(kindChunk, chunk)
+		if err != nil {
+			return "", 0, err
+		}
+		manifest.Chunks = append(manifest.Chunks, ChunkRef{Hash: hash, Size: int64(len(chunk))})
+		manifest.Size += int64(len(chunk))
+		buf = chunk
+	}
+
+	hash := fmt.Sprintf("%x", whole.Sum(nil))
+	if freshen(s.path(kindBlob, hash)) || freshen(s.path(kindManifest, hash)) {
+		return hash, manifest.Size, nil
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path(kindManifest, hash)), 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+	if err := writeFileAtomic(s.path(kindManifest, hash), data, 0644); err != nil {
+		return "", 0, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return hash, manifest.Size, nil
+}
+
+func (s *ObjectStore) ReadManifest(hash string) (*Manifest, error) {
+	data, err := os.ReadFile(s.path(kindManifest, hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", hash, err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest %s: %w", hash, err)
+	}
+	return &manifest, nil
+}
+
+func (s *ObjectStore) isChunked(hash string) bool {
+	_, err := os.Stat(s.path(kindManifest, hash))
+	return err == nil
+}
+
+// chunkReader concatenates the chunks of a manifest, opening one chunk file
+// at a time.
+type chunkReader struct {
+	store   *ObjectStore
+	chunks  []ChunkRef
+	current io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(c.store.path(kindChunk, c.chunks[0].Hash))
+			if err != nil {
+				return 0, fmt.Errorf("failed to open chunk %s: %w", c.chunks[0].Hash, err)
+			}
+			c.current = f
+			c.chunks = c.chunks[1:]
+		}
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.current != nil {
+		return c.current.Close()
+	}
+	return nil
+}
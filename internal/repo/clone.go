@@ -2,79 +2,228 @@ package repo
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 )
 
-func CloneRepo(source, destination string) error {
-	if strings.HasPrefix(source, "http") || strings.HasPrefix(source, "git@") {
-		return cloneGitRepo(source, destination)
+type CloneOptions struct {
+	// Bare clones only the repository metadata, without a working tree.
+	Bare bool
+	// Mirror implies Bare and keeps the source's branches and tags under
+	// their own names, so later fetches overwrite them to match.
+	Mirror bool
+	// Depth limits the history cloned behind each branch to that many
+	// commits, leaving a shallow clone that fetch can deepen later.
+	Depth int
+	// SingleBranch clones only the branch that is checked out, and makes
+	// later fetches update only that branch.
+	SingleBranch bool
+	// Branch is checked out instead of the source's HEAD branch. A tag
+	// checks out its commit on a detached HEAD.
+	Branch string
+	// Filter makes a partial clone that leaves out blobs ("blob:none" or
+	// "blob:limit=<size>") and fetches them from the source when needed.
+	Filter string
+}
+
+func CloneRepo(source, destination string, opts CloneOptions) error {
+	bare := opts.Bare || opts.Mirror
+	entries, err := os.ReadDir(destination)
+	if err == nil && len(entries) > 0 {
+		return fmt.Errorf("destination '%s' already exists and is not empty", destination)
+	}
+	if opts.Filter != "" {
+		if _, err := parseBlobFilter(opts.Filter); err != nil {
+			return err
+		}
+	}
+	_, _, notKommito := findRepoDir(source)
+	fromGit := isGitURL(source) || (!isNetworkURL(source) && notKommito != nil && isGitRepo(source))
+	// Copying the metadata directory takes everything, so a clone of part
+	// of a local repository goes through the transport like a network one.
+	partial := opts.Depth > 0 || opts.SingleBranch || opts.Branch != "" || opts.Filter != ""
+	if fromGit || isNetworkURL(source) || partial || isBundle(source) {
+		existed := err == nil
+		clone := cloneRemote
+		if fromGit {
+			clone = cloneGitRepo
+		} else {
+			source = absoluteRemotePath(source)
+		}
+		if err := clone(source, destination, opts); err != nil {
+			// Do not leave a half-initialized repository behind; an
+			// existing destination was empty, so empty it again.
+			if !existed {
+				os.RemoveAll(destination)
+			} else if entries, readErr := os.ReadDir(destination); readErr == nil {
+				for _, entry := range entries {
+					os.RemoveAll(filepath.Join(destination, entry.Name()))
+				}
+			}
+			return err
+		}
+		return nil
 	}
 
-	sourceKommito := filepath.Join(source, ".kommito")
-	if _, err := os.Stat(sourceKommito); os.IsNotExist(err) {
+	source = absoluteRemotePath(source)
+	sourceDir, _, err := findRepoDir(source)
+	if err != nil {
 		return fmt.Errorf("source is not a valid Kommito repository: %w", err)
 	}
-
 	if err := os.MkdirAll(destination, 0755); err != nil {
 		return fmt.Errorf("failed to create destination directory: %w", err)
 	}
 
-	if err := copyDir(sourceKommito, filepath.Join(destination, ".kommito")); err != nil {
-		return fmt.Errorf("failed to copy .kommito directory: %w", err)
+	dstDir := filepath.Join(destination, ".kommito")
+	if bare {
+		dstDir = destination
+	}
+	if err := copyDir(sourceDir, dstDir); err != nil {
+		return fmt.Errorf("failed to copy repository metadata: %w", err)
+	}
+	// Operations in progress stay with the repository they were started in.
+	stale := append([]string{"MERGE_HEAD", "CHERRY_PICK_HEAD", "REVERT_HEAD", "sequencer", "rebase", "rebase-todo", "ORIG_HEAD", "index"}, bisectFiles...)
+	if !opts.Mirror {
+		stale = append(stale, filepath.Join("refs", "remotes"))
+	}
+	for _, name := range stale {
+		if err := os.RemoveAll(filepath.Join(dstDir, name)); err != nil {
+			return fmt.Errorf("failed to reset %s: %w", name, err)
+		}
 	}
 
-	indexPath := filepath.Join(sourceKommito, "index")
-	indexData, err := os.ReadFile(indexPath)
+	sourceRefs, _, err := (&localTransport{dir: sourceDir}).ListRefs()
 	if err != nil {
-		return fmt.Errorf("failed to read index: %w", err)
+		return fmt.Errorf("failed to list source refs: %w", err)
 	}
+	if bare {
+		// Branches of a bare clone are the source's branches, so there is
+		// nothing to track separately.
+		sourceRefs = nil
+	}
+	// A copy of a partial clone promises the same blobs, now through it.
+	origin := RemoteConfig{Mirror: opts.Mirror}
+	if _, promisor, ok := NewObjectStore(sourceDir).promisor(); ok {
+		origin.Filter = promisor.Filter
+	}
+	if err := setOrigin(dstDir, source, sourceRefs, origin); err != nil {
+		return fmt.Errorf("failed to record origin: %w", err)
+	}
+	if bare {
+		return nil
+	}
+	return checkoutClone(destination)
+}
 
-	lines := strings.Split(strings.TrimSpace(string(indexData)), "\n")
-	for _, line := range lines {
-		if line == "" {
-			continue
+// cloneRemote clones through a Transport into a freshly initialized
+// repository, for sources that cannot simply be copied.
+func cloneRemote(url, destination string, opts CloneOptions) error {
+	bare := opts.Bare || opts.Mirror
+	dstDir := filepath.Join(destination, ".kommito")
+	if bare {
+		dstDir = destination
+	}
+	if err := initMetaDir(dstDir, bare); err != nil {
+		return err
+	}
+
+	transport, err := openTransport(url)
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+	sourceRefs, head, err := transport.ListRefs()
+	if err != nil {
+		return fmt.Errorf("failed to list remote refs: %w", err)
+	}
+	checkout, detached, err := cloneBranch(sourceRefs, head, opts.Branch)
+	if err != nil {
+		return err
+	}
+	remote := RemoteConfig{Mirror: opts.Mirror, Filter: opts.Filter}
+	if opts.SingleBranch && checkout != "" {
+		remote.Branches = []string{strings.TrimPrefix(checkout, "refs/heads/")}
+	}
+	var wants []string
+	for name, hash := range sourceRefs {
+		if remote.fetches(name) {
+			wants = append(wants, hash)
 		}
-		parts := strings.SplitN(line, " ", 2)
-		if len(parts) != 2 {
+	}
+	if opts.SingleBranch && detached != "" {
+		wants = []string{detached}
+	}
+	store := NewObjectStore(dstDir)
+	received, err := fetchInto(transport, wants, store, FetchOptions{Depth: opts.Depth, Filter: opts.Filter})
+	if err != nil {
+		return fmt.Errorf("failed to fetch objects: %w", err)
+	}
+	fmt.Printf("📥 Received %d objects\n", received)
+
+	// Branches outside a single-branch clone are left out, and so are tags
+	// whose commits were not fetched.
+	fetched := make(map[string]string)
+	for name, hash := range sourceRefs {
+		if strings.HasPrefix(name, "refs/heads/") && !remote.fetches(name) {
 			continue
 		}
-		filePath := parts[1]
-
-		sourceFile := filepath.Join(source, filePath)
-		destFile := filepath.Join(destination, filePath)
-
-		if err := os.MkdirAll(filepath.Dir(destFile), 0755); err != nil {
-			return fmt.Errorf("failed to create parent directories for %s: %w", filePath, err)
+		if store.Has(kindCommit, hash) {
+			fetched[name] = hash
 		}
-
-		if err := copyFile(sourceFile, destFile); err != nil {
-			return fmt.Errorf("failed to copy file %s: %w", filePath, err)
+	}
+	var updates []RefUpdate
+	for name, hash := range fetched {
+		if bare || strings.HasPrefix(name, "refs/tags/") || name == checkout {
+			updates = append(updates, RefUpdate{Name: name, New: hash})
 		}
 	}
-
-	return nil
+	refs := newRefStore(dstDir)
+	if err := refs.updateAll(updates, "clone: from "+url); err != nil {
+		return err
+	}
+	if detached != "" {
+		if err := refs.setHead(detached, "clone: from "+url); err != nil {
+			return err
+		}
+	} else if checkout != "" {
+		if err := refs.setHead("ref: "+checkout, "clone: from "+url); err != nil {
+			return err
+		}
+	}
+	tracked := fetched
+	if bare {
+		tracked = nil
+	}
+	if err := setOrigin(dstDir, url, tracked, remote); err != nil {
+		return fmt.Errorf("failed to record origin: %w", err)
+	}
+	if bare {
+		return nil
+	}
+	return checkoutClone(destination)
 }
 
-func cloneGitRepo(gitURL, destination string) error {
-
-	tempDir, err := os.MkdirTemp("", "kommito-git-*")
-	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %w", err)
+// cloneBranch picks what a clone checks out: the named branch, the commit
+// of the named tag (returned as detached), or else the source's HEAD branch.
+func cloneBranch(refs map[string]string, head, name string) (string, string, error) {
+	if name == "" {
+		return head, "", nil
 	}
-	defer os.RemoveAll(tempDir)
-
-	cmd := exec.Command("git", "clone", gitURL, tempDir)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to clone Git repository: %w", err)
+	if _, ok := refs["refs/heads/"+name]; ok {
+		return "refs/heads/" + name, "", nil
 	}
-
-	if err := os.MkdirAll(destination, 0755); err != nil {
-		return fmt.Errorf("failed to create destination directory: %w", err)
+	if hash, ok := refs["refs/tags/"+name]; ok {
+		return "", hash, nil
 	}
+	return "", "", fmt.Errorf("remote branch '%s' not found", name)
+}
 
+// checkoutClone fills the working tree and index of a fresh clone from its
+// HEAD commit.
+func checkoutClone(destination string) error {
 	originalDir, err := os.Getwd()
 	if err != nil {
 		return fmt.Errorf("failed to get current directory: %w", err)
@@ -83,57 +232,108 @@ func cloneGitRepo(gitURL, destination string) error {
 		return fmt.Errorf("failed to change to destination directory: %w", err)
 	}
 	defer os.Chdir(originalDir)
+	return checkoutHead()
+}
 
-	if err := InitRepo(); err != nil {
-		return fmt.Errorf("failed to initialize Kommito repository: %w", err)
+func checkoutHead() error {
+	head, err := resolveHead()
+	if err != nil || head == "" {
+		if err == nil {
+			err = writeIndex(nil)
+		}
+		return err
 	}
-
-	entries, err := os.ReadDir(tempDir)
+	commit, err := LoadCommit(head)
 	if err != nil {
-		return fmt.Errorf("failed to read Git repository: %w", err)
+		return err
 	}
+	return updateWorkingTree("", commit)
+}
 
-	var addedFiles []string
-	for _, entry := range entries {
-		name := entry.Name()
-		if name == ".git" || isSystemFile(name) {
-			continue
-		}
-
-		srcPath := filepath.Join(tempDir, name)
-		dstPath := name
-
-		if entry.IsDir() {
-
-			if err := os.MkdirAll(dstPath, 0755); err != nil {
-				fmt.Printf("(╥﹏╥) Could not create directory %s: %v\n", name, err)
-				continue
-			}
-
-			if err := copyDir(srcPath, dstPath); err != nil {
-				fmt.Printf("(╥﹏╥) Could not copy directory %s: %v\n", name, err)
-				continue
-			}
-		} else {
+// isGitURL recognizes network Git remotes, which are fetched with git
+// itself before being imported natively.
+func isGitURL(source string) bool {
+	if strings.HasPrefix(source, "git@") || strings.HasPrefix(source, "ssh://") || strings.HasPrefix(source, "git://") {
+		return true
+	}
+	return (strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")) && strings.HasSuffix(source, ".git")
+}
 
-			if err := copyFile(srcPath, dstPath); err != nil {
-				fmt.Printf("(╥﹏╥) Could not copy file %s: %v\n", name, err)
-				continue
-			}
+// cloneGitRepo imports a Git repository with its full history. A local
+// repository is read directly; a network URL is first mirrored into a
+// temporary directory with git, since Kommito does not speak Git's
+// network protocol.
+func cloneGitRepo(source, destination string, opts CloneOptions) error {
+	if opts.Depth > 0 || opts.SingleBranch || opts.Filter != "" {
+		return fmt.Errorf("shallow, single-branch and partial clones of Git repositories are not supported")
+	}
+	gitPath := source
+	if isGitURL(source) {
+		tempDir, err := os.MkdirTemp("", "kommito-git-*")
+		if err != nil {
+			return fmt.Errorf("failed to create temp directory: %w", err)
 		}
-		addedFiles = append(addedFiles, name)
+		defer os.RemoveAll(tempDir)
+		cmd := exec.Command("git", "clone", "--mirror", "--quiet", source, tempDir)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to fetch Git repository (network Git URLs need git installed; a local Git repository can be cloned without it): %w", err)
+		}
+		gitPath = tempDir
+	}
+	gitPath, err := filepath.Abs(gitPath)
+	if err != nil {
+		return err
 	}
 
-	if err := AddFile("."); err != nil {
-		return fmt.Errorf("failed to add files to Kommito: %w", err)
+	bare := opts.Bare || opts.Mirror
+	dstDir := filepath.Join(destination, ".kommito")
+	if bare {
+		dstDir = destination
+	}
+	if err := initMetaDir(dstDir, bare); err != nil {
+		return err
 	}
 
-	if err := CommitStaged("Initial commit from Git repository"); err != nil {
-		return fmt.Errorf("failed to create initial commit: %w", err)
+	originalDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	if err := os.Chdir(destination); err != nil {
+		return fmt.Errorf("failed to change to destination directory: %w", err)
 	}
+	defer os.Chdir(originalDir)
 
-	fmt.Printf("(＾▽＾) Successfully added %d files!\n", len(addedFiles))
-	return nil
+	result, err := importGit(gitPath)
+	if err != nil {
+		return fmt.Errorf("failed to import Git repository: %w", err)
+	}
+	fmt.Printf("(＾▽＾) Imported %d commits, %d branches and %d tags from Git!\n", result.Commits, len(result.Branches), len(result.Tags))
+	for _, name := range result.Annotated {
+		fmt.Printf("⚠️  %s is an annotated tag; its tagger and message were dropped\n", name)
+	}
+	if opts.Branch != "" {
+		refs := localRefs()
+		all, err := refs.list()
+		if err != nil {
+			return err
+		}
+		checkout, detached, err := cloneBranch(all, "", opts.Branch)
+		if err != nil {
+			return err
+		}
+		head := "ref: " + checkout
+		if detached != "" {
+			head = detached
+		}
+		if err := refs.setHead(head, "clone: from "+source); err != nil {
+			return err
+		}
+	}
+	if bare {
+		return nil
+	}
+	return checkoutHead()
 }
 
 func copyDir(src, dst string) error {
@@ -170,10 +370,23 @@ func copyDir(src, dst string) error {
 }
 
 func copyFile(src, dst string) error {
-	data, err := os.ReadFile(src)
+	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
+	defer in.Close()
 
-	return os.WriteFile(dst, data, 0644)
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
 }
@@ -1,11 +1,10 @@
 package repo
 
 import (
-	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"os"
-	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -15,36 +14,272 @@ type Commit struct {
 	Timestamp string   `json:"timestamp"`
 	Message   string   `json:"message"`
 	Blobs     []string `json:"blobs"`
+	Parents   []string `json:"parents,omitempty"`
+	Tree      string   `json:"tree,omitempty"`
 }
 
-func CommitStaged(message string) error {
+// CommitOptions controls what CommitStaged records.
+type CommitOptions struct {
+	// Message is the commit message. When it is empty the message is
+	// written in the editor, below a summary of what is being committed.
+	Message string
+	// All stages every tracked file's working tree changes first,
+	// including deletions.
+	All bool
+	// Amend replaces HEAD instead of adding a commit on top of it, keeping
+	// its author. Without a new message its message is edited.
+	Amend bool
+	// Fixup and Squash name a commit for rebase --autosquash to fold this
+	// one into; the message starts with "fixup! " or "squash! " and that
+	// commit's subject.
+	Fixup, Squash string
+	// AllowEmpty records a commit even when it changes nothing.
+	AllowEmpty bool
+}
 
-	indexPath := filepath.Join(".kommito", "index")
-	indexData, err := os.ReadFile(indexPath)
+// CommitStaged commits what is staged and returns the new commit.
+func CommitStaged(opts CommitOptions) (string, error) {
+	if err := requireWorkTree(); err != nil {
+		return "", err
+	}
+	if opts.Fixup != "" && opts.Squash != "" {
+		return "", fmt.Errorf("--fixup and --squash cannot be used together")
+	}
+	if opts.Amend && (opts.Fixup != "" || opts.Squash != "") {
+		return "", fmt.Errorf("--amend cannot be used with --fixup or --squash")
+	}
+	if opts.All {
+		if err := stageTracked(); err != nil {
+			return "", err
+		}
+	}
+	head, err := resolveHead()
 	if err != nil {
-		return fmt.Errorf("failed to read index: %w", err)
+		return "", err
 	}
-	lines := strings.Split(strings.TrimSpace(string(indexData)), "\n")
-	var blobs []string
-	for _, line := range lines {
-		if line == "" {
+	mergeHead, err := localRefs().resolve("MERGE_HEAD")
+	if err != nil {
+		return "", err
+	}
+	store := localObjects()
+	message, author := opts.Message, commitAuthor()
+	edit := message == "" && opts.Fixup == ""
+
+	// base is the commit the new one will sit on, to tell whether it
+	// changes anything.
+	base := head
+	if opts.Amend {
+		if head == "" {
+			return "", fmt.Errorf("there is no commit to amend yet")
+		}
+		if mergeHead != "" {
+			return "", fmt.Errorf("a merge is in progress, it cannot be amended")
+		}
+		commit, err := store.LoadCommit(head)
+		if err != nil {
+			return "", err
+		}
+		author, base = commit.Author, ""
+		if len(commit.Parents) > 0 {
+			base = commit.Parents[0]
+		}
+		if message == "" {
+			message = commit.Message
+		}
+	}
+	if !opts.Amend && mergeHead == "" && !opts.AllowEmpty {
+		changed, err := stagedChanges(base)
+		if err != nil {
+			return "", err
+		}
+		if len(changed) == 0 {
+			return "", fmt.Errorf("nothing to commit, stage some changes or use --allow-empty")
+		}
+	}
+
+	marker, target := "fixup! ", opts.Fixup
+	if opts.Squash != "" {
+		marker, target = "squash! ", opts.Squash
+	}
+	if target != "" {
+		hash, err := resolveRevision(target)
+		if err != nil {
+			return "", err
+		}
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return "", err
+		}
+		prefix := marker + commitSubject(commit.Message)
+		switch {
+		case message != "":
+			message = prefix + "\n\n" + message
+		case opts.Fixup != "":
+			message = prefix
+		default:
+			message = prefix + "\n\n"
+		}
+	}
+	if edit {
+		template, err := commitTemplate(base)
+		if err != nil {
+			return "", err
+		}
+		if message, err = editMessage(message, template); err != nil {
+			return "", err
+		}
+	}
+	return commitIndex(message, author, opts.Amend)
+}
+
+// stagedChanges describes how the index differs from the commit base, as
+// "new file", "modified" or "deleted" lines sorted by path.
+func stagedChanges(base string) ([]string, error) {
+	files := map[string]TreeEntry{}
+	if base != "" {
+		var err error
+		if files, err = revisionEntries(base); err != nil {
+			return nil, err
+		}
+	}
+	staged, err := indexTree()
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for path, entry := range staged {
+		if old, ok := files[path]; !ok {
+			changed = append(changed, "new file:   "+path)
+		} else if old != entry {
+			changed = append(changed, "modified:   "+path)
+		}
+	}
+	for path := range files {
+		if _, ok := staged[path]; !ok {
+			changed = append(changed, "deleted:    "+path)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i][12:] < changed[j][12:] })
+	return changed, nil
+}
+
+// commitTemplate summarises, for the commit message editor, what is
+// staged against base and what is left out of the commit.
+func commitTemplate(base string) (string, error) {
+	staged, err := stagedChanges(base)
+	if err != nil {
+		return "", err
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return "", err
+	}
+	objects := localObjects()
+	fileMode := fileModeEnabled()
+	tracked := make(map[string]bool)
+	var unstaged []string
+	for _, entry := range entries {
+		tracked[entry.Path] = true
+		hash, mode, err := hashWorktreeFile(entry.Path, entry.Mode, fileMode)
+		switch {
+		case os.IsNotExist(err):
+			unstaged = append(unstaged, "deleted:    "+entry.Path)
+		case err != nil:
+			return "", err
+		case hash != objects.worktreeHash(entry.Hash) || mode != entry.Mode:
+			unstaged = append(unstaged, "modified:   "+entry.Path)
+		}
+	}
+	var untracked []string
+	dirEntries, _ := os.ReadDir(".")
+	for _, entry := range dirEntries {
+		if name := entry.Name(); !entry.IsDir() && !isSystemFile(name) && !tracked[name] {
+			untracked = append(untracked, name)
+		}
+	}
+
+	var b strings.Builder
+	for _, section := range []struct {
+		title string
+		lines []string
+	}{
+		{"Changes to be committed:", staged},
+		{"Changes not staged for commit:", unstaged},
+		{"Untracked files:", untracked},
+	} {
+		if len(section.lines) == 0 {
 			continue
 		}
-		parts := strings.SplitN(line, " ", 2)
-		if len(parts) > 0 {
-			blobs = append(blobs, parts[0])
+		b.WriteString(section.title + "\n")
+		for _, line := range section.lines {
+			b.WriteString("\t" + line + "\n")
 		}
 	}
+	return b.String(), nil
+}
 
-	author := "Kommito User"
-	configPath := filepath.Join(".kommito", "config.json")
-	if configData, err := os.ReadFile(configPath); err == nil {
-		var cfg struct {
-			Name string `json:"name"`
+// stageTracked stages the working tree version of every file in the
+// index, dropping the files that were deleted.
+func stageTracked() error {
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	objects := localObjects()
+	fileMode := fileModeEnabled()
+	deleted := make(map[string]bool)
+	for _, entry := range entries {
+		hash, mode, err := hashWorktreeFile(entry.Path, entry.Mode, fileMode)
+		switch {
+		case os.IsNotExist(err):
+			deleted[entry.Path] = true
+		case err != nil:
+			return fmt.Errorf("failed to read %s: %w", entry.Path, err)
+		case hash != objects.worktreeHash(entry.Hash) || mode != entry.Mode:
+			if err := addSingleFile(entry.Path); err != nil {
+				return err
+			}
 		}
-		if err := json.Unmarshal(configData, &cfg); err == nil && cfg.Name != "" {
-			author = cfg.Name
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+	return updateIndex(func(entries []indexEntry) []indexEntry {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if !deleted[entry.Path] {
+				kept = append(kept, entry)
+			}
 		}
+		return kept
+	})
+}
+
+// commitIndex commits what is staged on top of HEAD and returns the new
+// commit. A pending merge adds its second parent; a pending cherry-pick or
+// revert is concluded. With amend the commit replaces HEAD instead, taking
+// its parents.
+func commitIndex(message, author string, amend bool) (string, error) {
+	entries, err := readIndex()
+	if err != nil {
+		return "", err
+	}
+	var blobs []string
+	var files []TreeEntry
+	for _, entry := range entries {
+		blobs = append(blobs, entry.Hash)
+		files = append(files, TreeEntry{Path: entry.Path, Hash: entry.Hash, Mode: entry.Mode})
+	}
+
+	objects := localObjects()
+	tree, err := objects.WriteTree(files)
+	if err != nil {
+		return "", err
+	}
+
+	parent, err := resolveHead()
+	if err != nil {
+		return "", err
 	}
 
 	commit := Commit{
@@ -52,26 +287,58 @@ func CommitStaged(message string) error {
 		Timestamp: time.Now().Format(time.RFC3339),
 		Message:   message,
 		Blobs:     blobs,
+		Tree:      tree,
+	}
+	refs := localRefs()
+	action := "commit"
+	switch {
+	case amend:
+		if parent == "" {
+			return "", fmt.Errorf("there is no commit to amend yet")
+		}
+		head, err := objects.LoadCommit(parent)
+		if err != nil {
+			return "", err
+		}
+		commit.Parents = head.Parents
+		action = "commit (amend)"
+	case parent != "":
+		commit.Parents = []string{parent}
+	}
+	mergeHead, err := refs.resolve("MERGE_HEAD")
+	if err != nil {
+		return "", err
+	}
+	if mergeHead != "" && mergeHead != parent && !amend {
+		commit.Parents = append(commit.Parents, mergeHead)
 	}
 
 	commitBytes, err := json.MarshalIndent(commit, "", "  ")
 	if err != nil {
-		return fmt.Errorf("failed to marshal commit: %w", err)
+		return "", fmt.Errorf("failed to marshal commit: %w", err)
 	}
 
-	h := sha1.New()
-	h.Write(commitBytes)
-	commitHash := fmt.Sprintf("%x", h.Sum(nil))
-
-	commitPath := filepath.Join(".kommito", "objects", "commits", commitHash)
-	if err := os.WriteFile(commitPath, commitBytes, 0644); err != nil {
-		return fmt.Errorf("failed to write commit object: %w", err)
+	commitHash, err := objects.Write(kindCommit, commitBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to write commit object: %w", err)
 	}
 
-	headPath := filepath.Join(".kommito", "HEAD")
-	if err := os.WriteFile(headPath, []byte(commitHash), 0644); err != nil {
-		return fmt.Errorf("failed to update HEAD: %w", err)
+	subject := strings.SplitN(message, "\n", 2)[0]
+	if err := refs.updateHead(commitHash, parent, action+": "+subject); err != nil {
+		return "", fmt.Errorf("failed to update HEAD: %w", err)
 	}
+	for _, name := range []string{"MERGE_HEAD", "CHERRY_PICK_HEAD", "REVERT_HEAD"} {
+		if err := os.Remove(refs.path(name)); err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to clear %s: %w", name, err)
+		}
+	}
+	return commitHash, nil
+}
 
-	return nil
+func commitAuthor() string {
+	author := "Kommito User"
+	if cfg, err := loadConfig(); err == nil && cfg.Name != "" {
+		author = cfg.Name
+	}
+	return author
 }
@@ -0,0 +1,260 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Config struct {
+	Name    string                  `json:"name"`
+	Version string                  `json:"version"`
+	Core    CoreConfig              `json:"core"`
+	Large   LargeConfig             `json:"large"`
+	Blame   BlameConfig             `json:"blame"`
+	Remotes map[string]RemoteConfig `json:"remotes,omitempty"`
+}
+
+type RemoteConfig struct {
+	URL    string `json:"url"`
+	Mirror bool   `json:"mirror,omitempty"`
+	// Branches limits fetches to these branches, as set up by a
+	// single-branch clone. Empty means every branch and tag.
+	Branches []string `json:"branches,omitempty"`
+	// Filter is the blob filter of a partial clone. It is applied to every
+	// fetch from this remote, which also supplies the left-out blobs.
+	Filter string `json:"filter,omitempty"`
+}
+
+// fetches reports whether a remote ref is fetched from this remote.
+func (r RemoteConfig) fetches(name string) bool {
+	if len(r.Branches) == 0 {
+		return true
+	}
+	for _, branch := range r.Branches {
+		if name == "refs/heads/"+branch {
+			return true
+		}
+	}
+	return false
+}
+
+type CoreConfig struct {
+	// ChunkThreshold is the file size from which blobs are stored as
+	// content-defined chunks. Zero disables chunking.
+	ChunkThreshold int64 `json:"chunkThreshold,omitempty"`
+	// FileMode records and restores executable bits and symlinks. Unset
+	// means on; turn it off on filesystems that do not support them.
+	FileMode *bool `json:"fileMode,omitempty"`
+	// Pager is the command long output is shown through on a terminal.
+	// Empty falls back to $PAGER and then less; "cat" turns paging off.
+	Pager string `json:"pager,omitempty"`
+	// Editor is the command messages and rebase todo lists are edited
+	// with. Empty falls back to $VISUAL, $EDITOR and then vi.
+	Editor string `json:"editor,omitempty"`
+}
+
+type LargeConfig struct {
+	// Patterns select the files stored as large-object pointers, matched
+	// against both the full path and the base name ("*.psd", "media/*").
+	Patterns []string `json:"patterns,omitempty"`
+	// Remote is the directory large objects are uploaded to and fetched from.
+	Remote string `json:"remote,omitempty"`
+}
+
+type BlameConfig struct {
+	// IgnoreRevsFile lists commits blame looks through, such as mass
+	// reformatting, one per line.
+	IgnoreRevsFile string `json:"ignoreRevsFile,omitempty"`
+}
+
+// configKey maps a dotted "section.name" key onto a Config field.
+type configKey struct {
+	get func(cfg *Config) string
+	set func(cfg *Config, value string) error
+}
+
+var configKeys = map[string]configKey{
+	"name": {
+		get: func(cfg *Config) string { return cfg.Name },
+		set: func(cfg *Config, value string) error { cfg.Name = value; return nil },
+	},
+	"blame.ignoreRevsFile": {
+		get: func(cfg *Config) string { return cfg.Blame.IgnoreRevsFile },
+		set: func(cfg *Config, value string) error { cfg.Blame.IgnoreRevsFile = value; return nil },
+	},
+	"core.chunkThreshold": {
+		get: func(cfg *Config) string { return strconv.FormatInt(cfg.Core.ChunkThreshold, 10) },
+		set: func(cfg *Config, value string) error {
+			size, err := parseSize(value)
+			if err != nil {
+				return err
+			}
+			cfg.Core.ChunkThreshold = size
+			return nil
+		},
+	},
+	"core.editor": {
+		get: func(cfg *Config) string { return cfg.Core.Editor },
+		set: func(cfg *Config, value string) error { cfg.Core.Editor = value; return nil },
+	},
+	"core.fileMode": {
+		get: func(cfg *Config) string { return strconv.FormatBool(cfg.Core.FileMode == nil || *cfg.Core.FileMode) },
+		set: func(cfg *Config, value string) error {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("expected true or false")
+			}
+			cfg.Core.FileMode = &enabled
+			return nil
+		},
+	},
+	"core.pager": {
+		get: func(cfg *Config) string { return cfg.Core.Pager },
+		set: func(cfg *Config, value string) error { cfg.Core.Pager = value; return nil },
+	},
+	"large.patterns": {
+		get: func(cfg *Config) string { return strings.Join(cfg.Large.Patterns, ",") },
+		set: func(cfg *Config, value string) error {
+			cfg.Large.Patterns = nil
+			for _, pattern := range strings.Split(value, ",") {
+				if pattern = strings.TrimSpace(pattern); pattern != "" {
+					cfg.Large.Patterns = append(cfg.Large.Patterns, pattern)
+				}
+			}
+			return nil
+		},
+	},
+	"large.remote": {
+		get: func(cfg *Config) string { return cfg.Large.Remote },
+		set: func(cfg *Config, value string) error { cfg.Large.Remote = value; return nil },
+	},
+}
+
+func configPath() string {
+	return filepath.Join(repoDir(), "config.json")
+}
+
+func loadConfig() (*Config, error) {
+	return loadConfigFrom(repoDir())
+}
+
+// loadConfigFrom reads the config of the repository whose metadata lives in
+// dir, such as a freshly cloned repository.
+func loadConfigFrom(dir string) (*Config, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	return &cfg, nil
+}
+
+func saveConfig(cfg *Config) error {
+	return saveConfigTo(repoDir(), cfg)
+}
+
+func saveConfigTo(dir string, cfg *Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "config.json"), data, 0644); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return nil
+}
+
+// GetConfig returns the value of a dotted config key.
+func GetConfig(key string) (string, error) {
+	k, ok := configKeys[key]
+	if !ok {
+		return "", fmt.Errorf("unknown config key '%s'", key)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+	return k.get(cfg), nil
+}
+
+// SetConfig updates a dotted config key while holding config.json.lock.
+func SetConfig(key, value string) error {
+	k, ok := configKeys[key]
+	if !ok {
+		return fmt.Errorf("unknown config key '%s'", key)
+	}
+	return updateConfig(func(cfg *Config) error {
+		if err := k.set(cfg, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+// updateConfig runs a read-modify-write cycle on config.json under its lock.
+func updateConfig(update func(cfg *Config) error) error {
+	lock, err := acquireLock(configPath())
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if err := update(cfg); err != nil {
+		return err
+	}
+	return saveConfig(cfg)
+}
+
+func ConfigKeys() []string {
+	keys := make([]string, 0, len(configKeys))
+	for key := range configKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func chunkThreshold() int64 {
+	cfg, err := loadConfig()
+	if err != nil {
+		return 0
+	}
+	return cfg.Core.ChunkThreshold
+}
+
+// parseSize accepts plain byte counts or k/m/g suffixed sizes ("64m").
+func parseSize(value string) (int64, error) {
+	value = strings.TrimSpace(strings.ToLower(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "b"), "i")
+	multiplier := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return n * multiplier, nil
+}
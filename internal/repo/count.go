@@ -0,0 +1,76 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type ObjectCount struct {
+	Kind  string
+	Count int
+	Size  int64
+}
+
+type ObjectCounts struct {
+	Kinds []ObjectCount
+	// ChunkedBlobs is the number of blobs stored as chunk manifests and
+	// ChunkedSize their combined content size before deduplication.
+	ChunkedBlobs int
+	ChunkedSize  int64
+	// ChunkStorage is the disk space actually used by the unique chunks.
+	ChunkStorage int64
+}
+
+func (c *ObjectCounts) Total() (int, int64) {
+	var count int
+	var size int64
+	for _, kind := range c.Kinds {
+		count += kind.Count
+		size += kind.Size
+	}
+	return count, size
+}
+
+// DedupSavings is how much less space chunked blobs take than they would
+// as plain blobs.
+func (c *ObjectCounts) DedupSavings() int64 {
+	return c.ChunkedSize - c.ChunkStorage
+}
+
+func CountObjects() (*ObjectCounts, error) {
+	objects := localObjects()
+	counts := &ObjectCounts{}
+	for _, kind := range []string{kindCommit, kindTree, kindBlob, kindManifest, kindChunk} {
+		entries, err := os.ReadDir(filepath.Join(objects.dir, "objects", kind))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to list %s: %w", kind, err)
+		}
+		count := ObjectCount{Kind: kind}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			count.Count++
+			count.Size += info.Size()
+			if kind == kindManifest {
+				manifest, err := objects.ReadManifest(entry.Name())
+				if err != nil {
+					return nil, err
+				}
+				counts.ChunkedBlobs++
+				counts.ChunkedSize += manifest.Size
+			}
+		}
+		if kind == kindChunk {
+			counts.ChunkStorage = count.Size
+		}
+		counts.Kinds = append(counts.Kinds, count)
+	}
+	return counts, nil
+}
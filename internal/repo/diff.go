@@ -0,0 +1,561 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// diffMaxEdits bounds the work spent finding a minimal diff. Files that
+// differ in more lines than this are shown as replaced wholesale.
+const diffMaxEdits = 4000
+
+// DiffOptions selects what Diff compares.
+type DiffOptions struct {
+	// Staged compares the index with HEAD instead of the working tree
+	// with the index.
+	Staged bool
+	// Paths limits the diff to these files and directories.
+	Paths []string
+}
+
+// diffFile is one side of a file comparison. A nil *diffFile is a file
+// that does not exist on that side.
+type diffFile struct {
+	Path string
+	Hash string
+	Mode string
+	// Worktree reads the content from the working tree instead of the
+	// object store.
+	Worktree bool
+}
+
+// Diff writes the changes that are not staged yet, or with opts.Staged the
+// changes that are staged but not committed, as a unified diff in Git's
+// format. Mode-only changes are shown with their old and new mode.
+func Diff(w io.Writer, opts DiffOptions) error {
+	if err := requireWorkTree(); err != nil {
+		return err
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	objects := localObjects()
+	var pairs [][2]*diffFile
+
+	if opts.Staged {
+		head := make(map[string]TreeEntry)
+		hash, err := resolveHead()
+		if err != nil {
+			return err
+		}
+		if hash != "" {
+			commit, err := LoadCommit(hash)
+			if err != nil {
+				return err
+			}
+			if head, err = commitEntries(commit); err != nil {
+				return err
+			}
+		}
+		staged := make(map[string]TreeEntry)
+		for _, entry := range entries {
+			staged[entry.Path] = TreeEntry{Path: entry.Path, Hash: entry.Hash, Mode: entry.Mode}
+		}
+		pairs = treeDiffPairs(head, staged)
+	} else {
+		fileMode := fileModeEnabled()
+		for _, entry := range entries {
+			old := &diffFile{Path: entry.Path, Hash: entry.Hash, Mode: entry.Mode}
+			hash, mode, err := hashWorktreeFile(entry.Path, entry.Mode, fileMode)
+			if os.IsNotExist(err) {
+				pairs = append(pairs, [2]*diffFile{old, nil})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if hash != objects.worktreeHash(entry.Hash) || mode != entry.Mode {
+				pairs = append(pairs, [2]*diffFile{old, {Path: entry.Path, Hash: hash, Mode: mode, Worktree: true}})
+			}
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i][0].Path < pairs[j][0].Path })
+	}
+
+	var selected [][2]*diffFile
+	var needed []string
+	for _, pair := range pairs {
+		if !matchesPaths(diffPath(pair), opts.Paths) {
+			continue
+		}
+		selected = append(selected, pair)
+		for _, f := range pair {
+			if f != nil && !f.Worktree {
+				needed = append(needed, f.Hash)
+			}
+		}
+	}
+	if err := objects.prefetchBlobs(needed); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for _, pair := range selected {
+		if err := writeFileDiff(bw, objects, pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// treeDiffPairs pairs up the entries of two trees that differ, by path.
+func treeDiffPairs(old, new map[string]TreeEntry) [][2]*diffFile {
+	paths := make(map[string]bool)
+	for path := range old {
+		paths[path] = true
+	}
+	for path := range new {
+		paths[path] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	var pairs [][2]*diffFile
+	for _, path := range sorted {
+		a, inOld := old[path]
+		b, inNew := new[path]
+		if inOld && inNew && a.Hash == b.Hash && a.Mode == b.Mode {
+			continue
+		}
+		var pair [2]*diffFile
+		if inOld {
+			pair[0] = &diffFile{Path: path, Hash: a.Hash, Mode: a.Mode}
+		}
+		if inNew {
+			pair[1] = &diffFile{Path: path, Hash: b.Hash, Mode: b.Mode}
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+// contentHash identifies the content of a file the way the working tree
+// sees it, so a large-file pointer matches the file it stands for.
+func (f *diffFile) contentHash(store *ObjectStore) string {
+	if f.Worktree {
+		return f.Hash
+	}
+	return store.worktreeHash(f.Hash)
+}
+
+func diffPath(pair [2]*diffFile) string {
+	if pair[0] != nil {
+		return pair[0].Path
+	}
+	return pair[1].Path
+}
+
+// matchesPaths reports whether path is one of paths or lies below one of
+// them. No paths match everything.
+func matchesPaths(path string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		p = strings.TrimSuffix(p, "/")
+		if p == "." || path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileDiff writes the header and hunks for one file.
+func writeFileDiff(w io.Writer, store *ObjectStore, old, new *diffFile) error {
+	path := diffPath([2]*diffFile{old, new})
+	fmt.Fprintf(w, "diff --git a/%s b/%s\n", path, path)
+	switch {
+	case old == nil:
+		fmt.Fprintf(w, "new file mode %s\n", displayMode(new.Mode))
+	case new == nil:
+		fmt.Fprintf(w, "deleted file mode %s\n", displayMode(old.Mode))
+	case old.Mode != new.Mode:
+		fmt.Fprintf(w, "old mode %s\nnew mode %s\n", displayMode(old.Mode), displayMode(new.Mode))
+	}
+	oldHash, newHash := zeroHash, zeroHash
+	if old != nil {
+		oldHash = old.Hash
+	}
+	if new != nil {
+		newHash = new.Hash
+	}
+	if old != nil && new != nil && old.contentHash(store) == new.contentHash(store) {
+		return nil
+	}
+	if old != nil && new != nil && old.Mode == new.Mode {
+		fmt.Fprintf(w, "index %s..%s %s\n", oldHash[:7], newHash[:7], displayMode(old.Mode))
+	} else {
+		fmt.Fprintf(w, "index %s..%s\n", oldHash[:7], newHash[:7])
+	}
+
+	a, aBinary, err := diffContent(store, old)
+	if err != nil {
+		return err
+	}
+	b, bBinary, err := diffContent(store, new)
+	if err != nil {
+		return err
+	}
+	oldName, newName := "a/"+path, "b/"+path
+	if old == nil {
+		oldName = "/dev/null"
+	}
+	if new == nil {
+		newName = "/dev/null"
+	}
+	if aBinary || bBinary {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+		return nil
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newName)
+	writeHunks(w, splitLines(a), splitLines(b))
+	return nil
+}
+
+// fileStat counts the lines one file comparison adds and deletes.
+type fileStat struct {
+	Path           string
+	Added, Deleted int
+	Binary         bool
+}
+
+func diffFileStat(store *ObjectStore, old, new *diffFile) (fileStat, error) {
+	stat := fileStat{Path: diffPath([2]*diffFile{old, new})}
+	if old != nil && new != nil && old.contentHash(store) == new.contentHash(store) {
+		return stat, nil
+	}
+	a, aBinary, err := diffContent(store, old)
+	if err != nil {
+		return stat, err
+	}
+	b, bBinary, err := diffContent(store, new)
+	if err != nil {
+		return stat, err
+	}
+	if aBinary || bBinary {
+		stat.Binary = true
+		return stat, nil
+	}
+	for _, op := range diffLines(splitLines(a), splitLines(b)) {
+		switch op.Kind {
+		case '+':
+			stat.Added++
+		case '-':
+			stat.Deleted++
+		}
+	}
+	return stat, nil
+}
+
+// writeDiffStat writes a "--stat" summary of the file comparisons: one
+// line per file with a bar of its insertions and deletions, scaled down
+// to fit 80 columns, and a total.
+func writeDiffStat(w io.Writer, store *ObjectStore, pairs [][2]*diffFile) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	stats := make([]fileStat, 0, len(pairs))
+	nameWidth, maxChanges, added, deleted := 0, 0, 0, 0
+	for _, pair := range pairs {
+		stat, err := diffFileStat(store, pair[0], pair[1])
+		if err != nil {
+			return err
+		}
+		stats = append(stats, stat)
+		nameWidth = max(nameWidth, len(stat.Path))
+		maxChanges = max(maxChanges, stat.Added+stat.Deleted)
+		added += stat.Added
+		deleted += stat.Deleted
+	}
+	countWidth := max(len(strconv.Itoa(maxChanges)), 3)
+	barWidth := max(80-nameWidth-countWidth-6, 10)
+	for _, stat := range stats {
+		if stat.Binary {
+			fmt.Fprintf(w, " %-*s | %*s\n", nameWidth, stat.Path, countWidth, "Bin")
+			continue
+		}
+		plus, minus := stat.Added, stat.Deleted
+		if maxChanges > barWidth {
+			plus = scaleStat(plus, maxChanges, barWidth)
+			minus = scaleStat(minus, maxChanges, barWidth)
+		}
+		fmt.Fprintf(w, " %-*s | %*d %s%s\n", nameWidth, stat.Path, countWidth, stat.Added+stat.Deleted,
+			strings.Repeat("+", plus), strings.Repeat("-", minus))
+	}
+	summary := fmt.Sprintf(" %d %s changed", len(stats), plural(len(stats), "file", "files"))
+	if added > 0 || deleted == 0 {
+		summary += fmt.Sprintf(", %d %s(+)", added, plural(added, "insertion", "insertions"))
+	}
+	if deleted > 0 || added == 0 {
+		summary += fmt.Sprintf(", %d %s(-)", deleted, plural(deleted, "deletion", "deletions"))
+	}
+	fmt.Fprintln(w, summary)
+	return nil
+}
+
+func scaleStat(n, total, width int) int {
+	if n == 0 {
+		return 0
+	}
+	return max(n*width/total, 1)
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// diffContent loads one side of a file comparison, reporting binary and
+// oversized content instead of returning it.
+func diffContent(store *ObjectStore, f *diffFile) ([]byte, bool, error) {
+	if f == nil {
+		return nil, false, nil
+	}
+	var r io.ReadCloser
+	var err error
+	switch {
+	case f.Worktree:
+		if info, statErr := os.Lstat(f.Path); statErr == nil && info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(f.Path)
+			return []byte(target), false, err
+		}
+		r, err = os.Open(f.Path)
+	case f.Mode == modeSymlink:
+		r, err = store.Open(kindBlob, f.Hash)
+	default:
+		r, err = store.openWorktreeContent(f.Hash)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, mergeTextLimit+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read %s: %w", f.Path, err)
+	}
+	head := data
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if len(data) > mergeTextLimit || bytes.IndexByte(head, 0) >= 0 {
+		return nil, true, nil
+	}
+	return data, false, nil
+}
+
+// splitLines splits content into lines that keep their newline, so a
+// missing newline at the end counts as a difference.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		lines = append(lines, string(data[:end]))
+		data = data[end:]
+	}
+	return lines
+}
+
+// diffOp is one step of an edit script: a line kept (' '), deleted from a
+// ('-') or inserted from b ('+'). A and B are the line indexes the step
+// starts at in a and b.
+type diffOp struct {
+	Kind byte
+	A, B int
+}
+
+// diffLines returns a minimal edit script turning a into b, found with
+// Myers' algorithm after trimming the common prefix and suffix.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var ops []diffOp
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{' ', i, i})
+	}
+	ops = append(ops, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], prefix, prefix)...)
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, diffOp{' ', len(a) - suffix + i, len(b) - suffix + i})
+	}
+	return ops
+}
+
+// myersDiff diffs the middle of two files; offA and offB are where it
+// starts in them.
+func myersDiff(a, b []string, offA, offB int) []diffOp {
+	n, m := len(a), len(b)
+	replace := func() []diffOp {
+		var ops []diffOp
+		for i := range a {
+			ops = append(ops, diffOp{'-', offA + i, offB})
+		}
+		for j := range b {
+			ops = append(ops, diffOp{'+', offA + n, offB + j})
+		}
+		return ops
+	}
+	if n == 0 || m == 0 {
+		return replace()
+	}
+
+	max := n + m
+	v := make([]int, 2*max+4)
+	// trace[d] holds v[-d-1..d+1] as it was before round d.
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && d <= diffMaxEdits && !found; d++ {
+		trace = append(trace, append([]int(nil), v[max-d-1+1:max+d+1+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k] < v[max+k+2]) {
+				x = v[max+k+2]
+			} else {
+				x = v[max+k] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[max+k+1] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return replace()
+	}
+
+	var reversed []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		snapshot := trace[d]
+		at := func(k int) int { return snapshot[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, diffOp{' ', offA + x, offB + y})
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, diffOp{'+', offA + x, offB + prevY})
+			} else {
+				reversed = append(reversed, diffOp{'-', offA + prevX, offB + y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	ops := make([]diffOp, len(reversed))
+	for i, op := range reversed {
+		ops[len(reversed)-1-i] = op
+	}
+	return ops
+}
+
+// writeHunks writes the changes between a and b as unified diff hunks.
+func writeHunks(w io.Writer, a, b []string) {
+	ops := diffLines(a, b)
+	var changes []int
+	for i, op := range ops {
+		if op.Kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	for len(changes) > 0 {
+		// A hunk runs from its first change to the last change that is
+		// within two contexts of the one before it.
+		last := 0
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*diffContext {
+			last++
+		}
+		start := changes[0] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := changes[last] + diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		changes = changes[last+1:]
+
+		hunk := ops[start:end]
+		var aLen, bLen int
+		for _, op := range hunk {
+			if op.Kind != '+' {
+				aLen++
+			}
+			if op.Kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(hunk[0].A, aLen), hunkRange(hunk[0].B, bLen))
+		for _, op := range hunk {
+			line := ""
+			switch op.Kind {
+			case '-':
+				line = a[op.A]
+			default:
+				line = b[op.B]
+			}
+			fmt.Fprintf(w, "%c%s", op.Kind, line)
+			if !strings.HasSuffix(line, "\n") {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+	}
+}
+
+// hunkRange formats the start and length of one side of a hunk the way
+// Git does: lengths of one are left out, and an empty range starts at the
+// line before it.
+func hunkRange(start, length int) string {
+	switch length {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
@@ -0,0 +1,72 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// editFile opens path in the editor named by $KOMMITO_EDITOR, core.editor,
+// $VISUAL or $EDITOR, falling back to vi, and waits for it to exit.
+func editFile(path string) error {
+	command := os.Getenv("KOMMITO_EDITOR")
+	if command == "" {
+		if cfg, err := loadConfig(); err == nil {
+			command = cfg.Core.Editor
+		}
+	}
+	for _, name := range []string{"VISUAL", "EDITOR"} {
+		if command == "" {
+			command = os.Getenv(name)
+		}
+	}
+	if command == "" {
+		command = "vi"
+	}
+	args := strings.Fields(command)
+	cmd := exec.Command(args[0], append(args[1:], path)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor %s failed: %w", args[0], err)
+	}
+	return nil
+}
+
+// editMessage lets the user edit a commit message in .kommito/COMMIT_EDITMSG
+// and returns it without the comment lines, which explain what is being
+// committed. An empty message is an error.
+func editMessage(message, comment string) (string, error) {
+	path := localRefs().path("COMMIT_EDITMSG")
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(message, "\n"))
+	b.WriteString("\n\n# Please enter the commit message. Lines starting with '#' are ignored,\n# and an empty message aborts the commit.\n")
+	for _, line := range strings.Split(strings.TrimRight(comment, "\n"), "\n") {
+		if line != "" {
+			b.WriteString("# " + line + "\n")
+		}
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return "", fmt.Errorf("failed to write commit message: %w", err)
+	}
+	if err := editFile(path); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read commit message: %w", err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, strings.TrimRight(line, " \t\r"))
+		}
+	}
+	edited := strings.TrimSpace(strings.Join(lines, "\n"))
+	if edited == "" {
+		return "", fmt.Errorf("empty commit message")
+	}
+	return edited, nil
+}
@@ -0,0 +1,255 @@
+package repo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FastExport writes every branch and tag, with their full history, to w as a
+// stream that git fast-import (and FastImport) can read. Large files are
+// exported with their real content, files keep their modes, and files that
+// moved unchanged between a commit and its first parent are exported as
+// renames.
+func FastExport(w io.Writer) error {
+	refs, err := localRefs().list()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range refs {
+		if strings.HasPrefix(name, "refs/heads/") || strings.HasPrefix(name, "refs/tags/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	e := &fastExporter{
+		w:           bufio.NewWriterSize(w, 1<<16),
+		store:       localObjects(),
+		blobMarks:   make(map[string]int),
+		commitMarks: make(map[string]int),
+	}
+	fmt.Fprintln(e.w, "feature done")
+	for _, name := range names {
+		if err := e.exportRef(name, refs[name]); err != nil {
+			return fmt.Errorf("failed to export %s: %w", name, err)
+		}
+	}
+	fmt.Fprintln(e.w, "done")
+	return e.w.Flush()
+}
+
+type fastExporter struct {
+	w           *bufio.Writer
+	store       *ObjectStore
+	blobMarks   map[string]int
+	commitMarks map[string]int
+	lastMark    int
+}
+
+// exportRef writes the commits reachable from tip that no earlier ref has
+// exported, parents first, and makes sure the ref ends up at tip.
+func (e *fastExporter) exportRef(name, tip string) error {
+	var pending []string
+	seen := make(map[string]bool)
+	stack := []string{tip}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[hash] || e.commitMarks[hash] != 0 {
+			continue
+		}
+		seen[hash] = true
+		commit, err := e.store.LoadCommit(hash)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, hash)
+		stack = append(stack, commit.Parents...)
+	}
+	order, err := topoSortCommits(e.store, pending)
+	if err != nil {
+		return err
+	}
+	for _, hash := range order {
+		if err := e.exportCommit(name, hash); err != nil {
+			return err
+		}
+	}
+	if len(order) == 0 || order[len(order)-1] != tip {
+		fmt.Fprintf(e.w, "reset %s\nfrom :%d\n\n", name, e.commitMarks[tip])
+	}
+	return nil
+}
+
+func (e *fastExporter) exportCommit(ref, hash string) error {
+	commit, err := e.store.LoadCommit(hash)
+	if err != nil {
+		return err
+	}
+	files, err := commitEntries(commit)
+	if err != nil {
+		return err
+	}
+	parentFiles := make(map[string]TreeEntry)
+	if len(commit.Parents) > 0 {
+		parent, err := e.store.LoadCommit(commit.Parents[0])
+		if err != nil {
+			return err
+		}
+		if parentFiles, err = commitEntries(parent); err != nil {
+			return err
+		}
+	}
+
+	// A path that disappeared and a new path with the same blob and mode
+	// make a rename; every other difference is a modify or a delete.
+	removedByBlob := make(map[string][]string)
+	var removed, modified []string
+	for path, entry := range parentFiles {
+		if _, ok := files[path]; !ok {
+			removedByBlob[entry.Hash+entry.Mode] = append(removedByBlob[entry.Hash+entry.Mode], path)
+		}
+	}
+	for _, paths := range removedByBlob {
+		sort.Strings(paths)
+	}
+	var added []string
+	for path, entry := range files {
+		if old, ok := parentFiles[path]; !ok {
+			added = append(added, path)
+		} else if old != entry {
+			modified = append(modified, path)
+		}
+	}
+	sort.Strings(added)
+	var renames [][2]string
+	for _, path := range added {
+		key := files[path].Hash + files[path].Mode
+		if sources := removedByBlob[key]; len(sources) > 0 {
+			renames = append(renames, [2]string{sources[0], path})
+			removedByBlob[key] = sources[1:]
+		} else {
+			modified = append(modified, path)
+		}
+	}
+	for _, paths := range removedByBlob {
+		removed = append(removed, paths...)
+	}
+	sort.Strings(removed)
+	sort.Strings(modified)
+
+	blobMarks := make(map[string]int)
+	for _, path := range modified {
+		mark, err := e.exportBlob(files[path].Hash)
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", path, err)
+		}
+		blobMarks[path] = mark
+	}
+
+	if len(commit.Parents) == 0 {
+		// Without a from line fast-import would build on the ref's
+		// current commit.
+		fmt.Fprintf(e.w, "reset %s\n", ref)
+	}
+	mark := e.nextMark()
+	ident := fastExportIdent(commit.Author, commit.Timestamp)
+	fmt.Fprintf(e.w, "commit %s\nmark :%d\nauthor %s\ncommitter %s\n", ref, mark, ident, ident)
+	fmt.Fprintf(e.w, "data %d\n%s\n", len(commit.Message), commit.Message)
+	for i, parent := range commit.Parents {
+		command := "merge"
+		if i == 0 {
+			command = "from"
+		}
+		fmt.Fprintf(e.w, "%s :%d\n", command, e.commitMarks[parent])
+	}
+	for _, rename := range renames {
+		fmt.Fprintf(e.w, "R %s %s\n", fastExportPath(rename[0], true), fastExportPath(rename[1], false))
+	}
+	for _, path := range removed {
+		fmt.Fprintf(e.w, "D %s\n", fastExportPath(path, false))
+	}
+	for _, path := range modified {
+		fmt.Fprintf(e.w, "M %s :%d %s\n", displayMode(files[path].Mode), blobMarks[path], fastExportPath(path, false))
+	}
+	fmt.Fprintln(e.w)
+	e.commitMarks[hash] = mark
+	return nil
+}
+
+// exportBlob writes a blob once and returns its mark.
+func (e *fastExporter) exportBlob(hash string) (int, error) {
+	if mark, ok := e.blobMarks[hash]; ok {
+		return mark, nil
+	}
+	size, err := e.store.Size(kindBlob, hash)
+	if err != nil {
+		return 0, err
+	}
+	if pointer, ok := e.store.readLargePointer(hash); ok {
+		size = pointer.Size
+	}
+	content, err := e.store.openWorktreeContent(hash)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+
+	mark := e.nextMark()
+	fmt.Fprintf(e.w, "blob\nmark :%d\ndata %d\n", mark, size)
+	written, err := io.Copy(e.w, content)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read blob %s: %w", hash, err)
+	}
+	if written != size {
+		return 0, fmt.Errorf("blob %s has %d bytes, expected %d", hash, written, size)
+	}
+	fmt.Fprintln(e.w)
+	e.blobMarks[hash] = mark
+	return mark, nil
+}
+
+func (e *fastExporter) nextMark() int {
+	e.lastMark++
+	return e.lastMark
+}
+
+// fastExportIdent turns a Kommito author and RFC 3339 timestamp into the
+// "Name <email> seconds zone" form of the stream. Authors without an email
+// get an empty one, which FastImport drops again.
+func fastExportIdent(author, timestamp string) string {
+	name, email := author, ""
+	if start := strings.LastIndex(author, "<"); start >= 0 && strings.HasSuffix(author, ">") {
+		name, email = strings.TrimSpace(author[:start]), author[start+1:len(author)-1]
+	}
+	clean := strings.NewReplacer("<", "", ">", "", "\n", " ")
+	name, email = clean.Replace(name), clean.Replace(email)
+
+	when, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		when = time.Unix(0, 0).UTC()
+	}
+	_, offset := when.Zone()
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	ident := strings.TrimSpace(name + " <" + email + ">")
+	return fmt.Sprintf("%s %d %c%02d%02d", ident, when.Unix(), sign, offset/3600, offset/60%60)
+}
+
+// fastExportPath quotes a path when the stream syntax requires it: always
+// for a leading quote or a newline, and for spaces when more follows on the
+// line.
+func fastExportPath(path string, spaceEnds bool) string {
+	if !strings.HasPrefix(path, `"`) && !strings.Contains(path, "\n") && !(spaceEnds && strings.Contains(path, " ")) {
+		return path
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + escape.Replace(path) + `"`
+}
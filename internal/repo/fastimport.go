@@ -0,0 +1,672 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type FastImportResult struct {
+	Commits int
+	ImportedRefs
+}
+
+// FastImport reads a git fast-import stream, such as the output of
+// git fast-export or FastExport, into the current repository. Branches only
+// move forward and existing tags are kept unless force is set. Annotated
+// tags become plain tags and are listed in Annotated; submodules are left
+// out and symlinks are stored as files holding their target, as with
+// ImportGit.
+func FastImport(r io.Reader, force bool) (*FastImportResult, error) {
+	im := &fastImporter{
+		in:        bufio.NewReaderSize(r, 1<<16),
+		store:     localObjects(),
+		marks:     make(map[string]string),
+		refs:      make(map[string]string),
+		annotated: make(map[string]bool),
+		large:     make(map[string]string),
+	}
+	result := &FastImportResult{}
+	err := im.run()
+	result.Commits = im.commits
+	if err != nil {
+		return result, err
+	}
+
+	var names []string
+	for name, hash := range im.refs {
+		if hash != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if err := result.update(im.store, names, im.refs, "fast-import", force); err != nil {
+		return result, err
+	}
+	result.noteAnnotated(im.annotated)
+	return result, nil
+}
+
+type fastImporter struct {
+	in      *bufio.Reader
+	pending *string
+	store   *ObjectStore
+	// marks maps ":<n>" to the blob or commit it names.
+	marks map[string]string
+	// refs holds the refs written by the stream so far; a reset ref with no
+	// commit yet holds "".
+	refs map[string]string
+	// annotated holds the tags last written by a tag command, whose
+	// tagger and message are dropped.
+	annotated map[string]bool
+	// large maps plain blobs to the pointer blobs stored for paths that
+	// match large.patterns.
+	large   map[string]string
+	commits int
+}
+
+// readLine returns the next line without its newline, or io.EOF.
+func (im *fastImporter) readLine() (string, error) {
+	if im.pending != nil {
+		line := *im.pending
+		im.pending = nil
+		return line, nil
+	}
+	line, err := im.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimSuffix(line, "\n"), err
+}
+
+func (im *fastImporter) unreadLine(line string) {
+	im.pending = &line
+}
+
+func (im *fastImporter) run() error {
+	for {
+		line, err := im.readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read stream: %w", err)
+		}
+		command, arg, _ := strings.Cut(line, " ")
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case line == "done":
+			return nil
+		case command == "blob":
+			err = im.importBlob()
+		case command == "commit":
+			err = im.importCommit(arg)
+		case command == "tag":
+			err = im.importTag(arg)
+		case command == "reset":
+			err = im.importReset(arg)
+		case command == "alias":
+			err = im.importAlias()
+		case command == "feature":
+			switch arg {
+			case "done", "date-format=raw", "force", "relative-marks", "no-relative-marks":
+			default:
+				err = fmt.Errorf("unsupported feature '%s'", arg)
+			}
+		case command == "option", command == "progress", command == "checkpoint":
+		default:
+			err = fmt.Errorf("unsupported command '%s'", line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// optional consumes the next line if it starts with prefix and returns the
+// rest of it.
+func (im *fastImporter) optional(prefix string) (string, bool, error) {
+	line, err := im.readLine()
+	if err == io.EOF {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if strings.HasPrefix(line, prefix) {
+		return strings.TrimPrefix(line, prefix), true, nil
+	}
+	im.unreadLine(line)
+	return "", false, nil
+}
+
+// openData starts reading the content of a data command. done must be
+// called once the content is consumed.
+func (im *fastImporter) openData(line string) (io.Reader, int64, func() error, error) {
+	if !strings.HasPrefix(line, "data ") {
+		return nil, 0, nil, fmt.Errorf("expected data, got '%s'", line)
+	}
+	arg := strings.TrimPrefix(line, "data ")
+	if strings.HasPrefix(arg, "<<") {
+		delimiter := strings.TrimPrefix(arg, "<<")
+		var buf bytes.Buffer
+		for {
+			l, err := im.readLine()
+			if err != nil {
+				return nil, 0, nil, fmt.Errorf("data ended before '%s': %w", delimiter, err)
+			}
+			if l == delimiter {
+				break
+			}
+			buf.WriteString(l + "\n")
+		}
+		return &buf, int64(buf.Len()), func() error { return nil }, nil
+	}
+	size, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || size < 0 {
+		return nil, 0, nil, fmt.Errorf("malformed data length '%s'", arg)
+	}
+	content := &io.LimitedReader{R: im.in, N: size}
+	done := func() error {
+		if content.N != 0 {
+			return fmt.Errorf("stream ended inside %d bytes of data", size)
+		}
+		if next, err := im.in.Peek(1); err == nil && next[0] == '\n' {
+			im.in.ReadByte()
+		}
+		return nil
+	}
+	return content, size, done, nil
+}
+
+func (im *fastImporter) readData(line string) ([]byte, error) {
+	content, _, done, err := im.openData(line)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	return data, done()
+}
+
+// writeData stores the content of a data command as a blob.
+func (im *fastImporter) writeData(line string) (string, error) {
+	content, size, done, err := im.openData(line)
+	if err != nil {
+		return "", err
+	}
+	hash, err := im.store.writeContent("", content, size)
+	if err != nil {
+		return "", err
+	}
+	return hash, done()
+}
+
+func (im *fastImporter) importBlob() error {
+	mark, _, err := im.optional("mark ")
+	if err != nil {
+		return err
+	}
+	if _, _, err := im.optional("original-oid "); err != nil {
+		return err
+	}
+	line, err := im.readLine()
+	if err != nil {
+		return fmt.Errorf("blob without data: %w", err)
+	}
+	hash, err := im.writeData(line)
+	if err != nil {
+		return err
+	}
+	if mark != "" {
+		im.marks[mark] = hash
+	}
+	return nil
+}
+
+func (im *fastImporter) importCommit(ref string) error {
+	if err := checkImportedRef(ref); err != nil {
+		return err
+	}
+	mark, _, err := im.optional("mark ")
+	if err != nil {
+		return err
+	}
+	if _, _, err := im.optional("original-oid "); err != nil {
+		return err
+	}
+	author, _, err := im.optional("author ")
+	if err != nil {
+		return err
+	}
+	committer, ok, err := im.optional("committer ")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("commit to %s has no committer", ref)
+	}
+	if author == "" {
+		author = committer
+	}
+	if _, _, err := im.optional("encoding "); err != nil {
+		return err
+	}
+	line, err := im.readLine()
+	if err != nil {
+		return fmt.Errorf("commit to %s has no message: %w", ref, err)
+	}
+	message, err := im.readData(line)
+	if err != nil {
+		return err
+	}
+
+	commit := Commit{Message: string(message)}
+	commit.Author, commit.Timestamp = parseGitSignature(author)
+	commit.Author = strings.TrimSuffix(commit.Author, " <>")
+	if from, ok, err := im.optional("from "); err != nil {
+		return err
+	} else if ok {
+		parent, err := im.resolveCommit(from)
+		if err != nil {
+			return err
+		}
+		commit.Parents = append(commit.Parents, parent)
+	} else if tip := im.refs[ref]; tip != "" {
+		commit.Parents = append(commit.Parents, tip)
+	}
+	for {
+		merge, ok, err := im.optional("merge ")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		parent, err := im.resolveCommit(merge)
+		if err != nil {
+			return err
+		}
+		commit.Parents = append(commit.Parents, parent)
+	}
+
+	files := make(map[string]TreeEntry)
+	if len(commit.Parents) > 0 {
+		parent, err := im.store.LoadCommit(commit.Parents[0])
+		if err != nil {
+			return err
+		}
+		if files, err = commitEntries(parent); err != nil {
+			return err
+		}
+	}
+	if err := im.applyFileChanges(files); err != nil {
+		return fmt.Errorf("commit to %s: %w", ref, err)
+	}
+
+	var entries []TreeEntry
+	for _, entry := range files {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	if commit.Tree, err = im.store.WriteTree(entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		commit.Blobs = append(commit.Blobs, entry.Hash)
+	}
+	data, err := json.MarshalIndent(commit, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal commit: %w", err)
+	}
+	hash, err := im.store.Write(kindCommit, data)
+	if err != nil {
+		return err
+	}
+	if mark != "" {
+		im.marks[mark] = hash
+	}
+	im.refs[ref] = hash
+	delete(im.annotated, ref)
+	im.commits++
+	return nil
+}
+
+// applyFileChanges applies the file commands of a commit to its files.
+// Directory paths in D, R and C apply to everything below them.
+func (im *fastImporter) applyFileChanges(files map[string]TreeEntry) error {
+	for {
+		line, err := im.readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		command, arg, _ := strings.Cut(line, " ")
+		switch command {
+		case "M":
+			fields := strings.SplitN(arg, " ", 3)
+			if len(fields) != 3 {
+				return fmt.Errorf("malformed filemodify '%s'", line)
+			}
+			path, _, err := parseFastImportPath(fields[2], false)
+			if err != nil {
+				return err
+			}
+			if err := im.modifyFile(files, fields[0], fields[1], path); err != nil {
+				return err
+			}
+		case "D":
+			path, _, err := parseFastImportPath(arg, false)
+			if err != nil {
+				return err
+			}
+			removeFastImportPath(files, path)
+		case "R", "C":
+			source, rest, err := parseFastImportPath(arg, true)
+			if err != nil {
+				return err
+			}
+			dest, _, err := parseFastImportPath(rest, false)
+			if err != nil {
+				return err
+			}
+			moved := make(map[string]TreeEntry)
+			for path, entry := range files {
+				if path == source {
+					moved[dest] = entry
+				} else if strings.HasPrefix(path, source+"/") {
+					moved[dest+strings.TrimPrefix(path, source)] = entry
+				}
+			}
+			if len(moved) == 0 {
+				return fmt.Errorf("path '%s' not in branch", source)
+			}
+			if command == "R" {
+				removeFastImportPath(files, source)
+			}
+			removeFastImportPath(files, dest)
+			for path, entry := range moved {
+				entry.Path = path
+				files[path] = entry
+			}
+		case "deleteall":
+			for path := range files {
+				delete(files, path)
+			}
+		case "N":
+			// Notes are not kept, but inline note data must be skipped.
+			if strings.HasPrefix(arg, "inline ") {
+				data, err := im.readLine()
+				if err != nil {
+					return err
+				}
+				if _, err := im.readData(data); err != nil {
+					return err
+				}
+			}
+		case "":
+			return nil
+		default:
+			im.unreadLine(line)
+			return nil
+		}
+	}
+}
+
+func (im *fastImporter) modifyFile(files map[string]TreeEntry, mode, dataref, path string) error {
+	switch mode {
+	case "160000":
+		return nil
+	case "040000", "40000":
+		return fmt.Errorf("cannot import directory '%s' by tree reference", path)
+	case "644", "755":
+		mode = "100" + mode
+	}
+	if !isFileMode(mode) || mode == "" {
+		return fmt.Errorf("unsupported mode %s for '%s'", mode, path)
+	}
+	var hash string
+	switch {
+	case dataref == "inline":
+		line, err := im.readLine()
+		if err != nil {
+			return err
+		}
+		if hash, err = im.writeData(line); err != nil {
+			return err
+		}
+	case strings.HasPrefix(dataref, ":"):
+		hash = im.marks[dataref]
+		if hash == "" {
+			return fmt.Errorf("unknown mark %s for '%s'", dataref, path)
+		}
+	default:
+		if !im.store.Has(kindBlob, dataref) {
+			return fmt.Errorf("unknown blob %s for '%s'", dataref, path)
+		}
+		hash = dataref
+	}
+	if mode != modeSymlink {
+		var err error
+		if hash, err = im.largeBlob(path, hash); err != nil {
+			return err
+		}
+	}
+
+	removeFastImportPath(files, path)
+	for dir := path; strings.Contains(dir, "/"); {
+		dir = dir[:strings.LastIndex(dir, "/")]
+		delete(files, dir)
+	}
+	files[path] = TreeEntry{Path: path, Hash: hash, Mode: storedMode(mode)}
+	return nil
+}
+
+// largeBlob stores a blob as a large-object pointer when its path matches
+// large.patterns, the way adding the file would.
+func (im *fastImporter) largeBlob(path, hash string) (string, error) {
+	if !isLargeFile(path) {
+		return hash, nil
+	}
+	if pointer, ok := im.large[hash]; ok {
+		return pointer, nil
+	}
+	if _, ok := im.store.readLargePointer(hash); ok {
+		return hash, nil
+	}
+	size, err := im.store.Size(kindBlob, hash)
+	if err != nil {
+		return "", err
+	}
+	content, err := im.store.Open(kindBlob, hash)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+	pointer, err := im.store.writeContent(path, content, size)
+	if err != nil {
+		return "", err
+	}
+	im.large[hash] = pointer
+	return pointer, nil
+}
+
+func (im *fastImporter) importTag(name string) error {
+	if err := checkImportedRef("refs/tags/" + name); err != nil {
+		return err
+	}
+	mark, _, err := im.optional("mark ")
+	if err != nil {
+		return err
+	}
+	from, ok, err := im.optional("from ")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("tag %s has no from", name)
+	}
+	hash, err := im.resolveCommit(from)
+	if err != nil {
+		return err
+	}
+	if _, _, err := im.optional("original-oid "); err != nil {
+		return err
+	}
+	if _, _, err := im.optional("tagger "); err != nil {
+		return err
+	}
+	line, err := im.readLine()
+	if err != nil {
+		return fmt.Errorf("tag %s has no message: %w", name, err)
+	}
+	if _, err := im.readData(line); err != nil {
+		return err
+	}
+	if mark != "" {
+		im.marks[mark] = hash
+	}
+	im.refs["refs/tags/"+name] = hash
+	im.annotated["refs/tags/"+name] = true
+	return nil
+}
+
+func (im *fastImporter) importReset(ref string) error {
+	if err := checkImportedRef(ref); err != nil {
+		return err
+	}
+	im.refs[ref] = ""
+	delete(im.annotated, ref)
+	from, ok, err := im.optional("from ")
+	if err != nil || !ok {
+		return err
+	}
+	hash, err := im.resolveCommit(from)
+	if err != nil {
+		return err
+	}
+	im.refs[ref] = hash
+	delete(im.annotated, ref)
+	return nil
+}
+
+func (im *fastImporter) importAlias() error {
+	mark, ok, err := im.optional("mark ")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("alias has no mark")
+	}
+	to, ok, err := im.optional("to ")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("alias %s has no target", mark)
+	}
+	hash, err := im.resolveCommit(to)
+	if err != nil {
+		return err
+	}
+	im.marks[mark] = hash
+	return nil
+}
+
+// resolveCommit accepts a mark, a commit hash, a ref written by the stream
+// or a ref of the repository.
+func (im *fastImporter) resolveCommit(name string) (string, error) {
+	name = strings.TrimSuffix(strings.TrimSpace(name), "^0")
+	if strings.HasPrefix(name, ":") {
+		if hash, ok := im.marks[name]; ok {
+			return hash, nil
+		}
+		return "", fmt.Errorf("unknown mark %s", name)
+	}
+	if isObjectHash(name) && im.store.Has(kindCommit, name) {
+		return name, nil
+	}
+	if hash := im.refs[name]; hash != "" {
+		return hash, nil
+	}
+	if hash, err := localRefs().resolve(name); err == nil && hash != "" && strings.HasPrefix(name, "refs/") {
+		return hash, nil
+	}
+	return "", fmt.Errorf("unknown commit '%s'", name)
+}
+
+// parseFastImportPath reads a possibly quoted path from the start of s. An
+// unquoted path runs to the end of the line, or to the first space when
+// spaceEnds is set. It returns the path and what follows it.
+func parseFastImportPath(s string, spaceEnds bool) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		if spaceEnds {
+			path, rest, ok := strings.Cut(s, " ")
+			if !ok {
+				return "", "", fmt.Errorf("missing path after '%s'", s)
+			}
+			return path, rest, nil
+		}
+		return s, "", nil
+	}
+	var path []byte
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return string(path), strings.TrimPrefix(s[i+1:], " "), nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'a':
+				path = append(path, '\a')
+			case 'b':
+				path = append(path, '\b')
+			case 'f':
+				path = append(path, '\f')
+			case 'n':
+				path = append(path, '\n')
+			case 'r':
+				path = append(path, '\r')
+			case 't':
+				path = append(path, '\t')
+			case 'v':
+				path = append(path, '\v')
+			case '0', '1', '2', '3':
+				if i+2 >= len(s) {
+					return "", "", fmt.Errorf("malformed quoted path %s", s)
+				}
+				value, err := strconv.ParseUint(s[i:i+3], 8, 8)
+				if err != nil {
+					return "", "", fmt.Errorf("malformed quoted path %s", s)
+				}
+				path = append(path, byte(value))
+				i += 2
+			default:
+				path = append(path, s[i])
+			}
+		default:
+			path = append(path, c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated quoted path %s", s)
+}
+
+// removeFastImportPath deletes a file, or every file below a directory.
+func removeFastImportPath(files map[string]TreeEntry, path string) {
+	delete(files, path)
+	for file := range files {
+		if strings.HasPrefix(file, path+"/") {
+			delete(files, file)
+		}
+	}
+}
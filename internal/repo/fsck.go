@@ -0,0 +1,189 @@
+package repo
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type FsckProblem struct {
+	Kind    string
+	Hash    string
+	Problem string
+}
+
+func (p FsckProblem) String() string {
+	return fmt.Sprintf("%s %s: %s", strings.TrimSuffix(p.Kind, "s"), p.Hash, p.Problem)
+}
+
+type FsckResult struct {
+	Checked  int
+	Problems []FsckProblem
+}
+
+// Fsck verifies that every stored object matches its hash, that chunk
+// manifests reassemble to the blob they describe, and that commits, trees
+// and refs only point at objects that exist. The missing parents of a
+// shallow clone's boundary commits are expected, and so are the blobs a
+// partial clone left out.
+func Fsck() (*FsckResult, error) {
+	objects := localObjects()
+	result := &FsckResult{}
+	report := func(kind, hash, format string, args ...interface{}) {
+		result.Problems = append(result.Problems, FsckProblem{Kind: kind, Hash: hash, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	for _, kind := range []string{kindBlob, kindChunk, kindTree, kindCommit, kindManifest} {
+		hashes, err := listObjects(objects, kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range hashes {
+			result.Checked++
+			if kind == kindManifest {
+				checkManifest(objects, hash, report)
+				continue
+			}
+			actual, err := hashFile(objects.path(kind, hash))
+			if err != nil {
+				report(kind, hash, "unreadable: %v", err)
+				continue
+			}
+			if actual != hash {
+				report(kind, hash, "hash mismatch, content hashes to %s", actual)
+				continue
+			}
+			switch kind {
+			case kindTree:
+				checkTree(objects, hash, report)
+			case kindCommit:
+				checkCommit(objects, hash, report)
+			}
+		}
+	}
+
+	refs, err := localRefs().list()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if hash := refs[name]; hash != "" && !objects.Has(kindCommit, hash) {
+			report("ref", name, "points to missing commit %s", hash)
+		}
+	}
+	for _, hash := range objects.shallowList() {
+		if !objects.Has(kindCommit, hash) {
+			report(shallowFile, hash, "lists a missing commit")
+		}
+	}
+	return result, nil
+}
+
+func listObjects(objects *ObjectStore, kind string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(objects.dir, "objects", kind))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list %s: %w", kind, err)
+	}
+	var hashes []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		hashes = append(hashes, entry.Name())
+	}
+	return hashes, nil
+}
+
+type fsckReporter func(kind, hash, format string, args ...interface{})
+
+func checkManifest(objects *ObjectStore, hash string, report fsckReporter) {
+	manifest, err := objects.ReadManifest(hash)
+	if err != nil {
+		report(kindManifest, hash, "%v", err)
+		return
+	}
+	var total int64
+	for _, chunk := range manifest.Chunks {
+		size, err := objects.Size(kindChunk, chunk.Hash)
+		if err != nil {
+			report(kindManifest, hash, "missing chunk %s", chunk.Hash)
+			return
+		}
+		if size != chunk.Size {
+			report(kindManifest, hash, "chunk %s is %d bytes, manifest says %d", chunk.Hash, size, chunk.Size)
+			return
+		}
+		total += size
+	}
+	if total != manifest.Size {
+		report(kindManifest, hash, "chunks add up to %d bytes, manifest says %d", total, manifest.Size)
+		return
+	}
+	r := &chunkReader{store: objects, chunks: manifest.Chunks}
+	defer r.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		report(kindManifest, hash, "failed to reassemble: %v", err)
+		return
+	}
+	if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != hash {
+		report(kindManifest, hash, "reassembled content hashes to %s", actual)
+	}
+}
+
+func checkTree(objects *ObjectStore, hash string, report fsckReporter) {
+	tree, err := objects.ReadTree(hash)
+	if err != nil {
+		report(kindTree, hash, "%v", err)
+		return
+	}
+	_, _, partial := objects.promisor()
+	for _, entry := range tree.Entries {
+		if !objects.Has(kindBlob, entry.Hash) && !partial {
+			report(kindTree, hash, "missing blob %s for %s", entry.Hash, entry.Path)
+		}
+		if !isFileMode(entry.Mode) {
+			report(kindTree, hash, "invalid mode %s for %s", entry.Mode, entry.Path)
+		}
+	}
+}
+
+func checkCommit(objects *ObjectStore, hash string, report fsckReporter) {
+	data, err := objects.Read(kindCommit, hash)
+	if err != nil {
+		report(kindCommit, hash, "%v", err)
+		return
+	}
+	var commit Commit
+	if err := json.Unmarshal(data, &commit); err != nil {
+		report(kindCommit, hash, "invalid commit: %v", err)
+		return
+	}
+	if commit.Tree != "" && !objects.Has(kindTree, commit.Tree) {
+		report(kindCommit, hash, "missing tree %s", commit.Tree)
+	}
+	for _, parent := range commit.Parents {
+		if !objects.Has(kindCommit, parent) && !objects.isShallow(hash) {
+			report(kindCommit, hash, "missing parent %s", parent)
+		}
+	}
+	_, _, partial := objects.promisor()
+	for _, blob := range commit.Blobs {
+		if !objects.Has(kindBlob, blob) && !partial {
+			report(kindCommit, hash, "missing blob %s", blob)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPruneExpire protects objects written in the last two weeks, so a
+// prune running next to an in-flight add never removes its fresh blobs.
+const DefaultPruneExpire = "2.weeks.ago"
+
+type PruneResult struct {
+	Reachable int
+	Removed   int
+	Reclaimed int64
+	Recent    int
+	// DryRun is set when nothing was actually removed.
+	DryRun bool
+}
+
+// reachableSet records marked objects keyed by their directory under
+// .kommito/objects ("commits", "blobs", ...).
+type reachableSet map[string]map[string]bool
+
+func (r reachableSet) mark(kind, hash string) bool {
+	if r[kind] == nil {
+		r[kind] = make(map[string]bool)
+	}
+	if r[kind][hash] {
+		return false
+	}
+	r[kind][hash] = true
+	return true
+}
+
+func (r reachableSet) count() int {
+	n := 0
+	for _, hashes := range r {
+		n += len(hashes)
+	}
+	return n
+}
+
+// ParseExpiry turns an age such as "2.weeks.ago", "3 days ago", "36h",
+// "now", "never" or an absolute date into a cutoff time. Objects modified
+// before the cutoff are eligible for pruning; "never" returns the zero time.
+func ParseExpiry(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(strings.ToLower(value))
+	switch value {
+	case "", "now", "all":
+		return now, nil
+	case "never", "false":
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == '.' || r == ' ' || r == '_'
+	})
+	if len(fields) > 0 && fields[len(fields)-1] == "ago" {
+		fields = fields[:len(fields)-1]
+	}
+	var amount, unit string
+	switch len(fields) {
+	case 1:
+		i := strings.IndexFunc(fields[0], func(r rune) bool { return r < '0' || r > '9' })
+		if i <= 0 {
+			return time.Time{}, fmt.Errorf("invalid expiry '%s'", value)
+		}
+		amount, unit = fields[0][:i], fields[0][i:]
+	case 2:
+		amount, unit = fields[0], fields[1]
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiry '%s'", value)
+	}
+	n, err := strconv.Atoi(amount)
+	if err != nil || n < 0 {
+		return time.Time{}, fmt.Errorf("invalid expiry '%s'", value)
+	}
+
+	switch strings.TrimSuffix(unit, "s") {
+	case "second", "sec", "s":
+		return now.Add(-time.Duration(n) * time.Second), nil
+	case "minute", "min", "m":
+		return now.Add(-time.Duration(n) * time.Minute), nil
+	case "hour", "h":
+		return now.Add(-time.Duration(n) * time.Hour), nil
+	case "day", "d":
+		return now.AddDate(0, 0, -n), nil
+	case "week", "w":
+		return now.AddDate(0, 0, -7*n), nil
+	case "month":
+		return now.AddDate(0, -n, 0), nil
+	case "year", "y":
+		return now.AddDate(-n, 0, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry unit '%s'", unit)
+}
+
+// reachableObjects marks everything reachable from refs, pseudo-refs,
+// reflogs and the index.
+func reachableObjects() (reachableSet, error) {
+	reachable := make(reachableSet)
+	refStore := localRefs()
+	var roots []string
+
+	for _, name := range specialRefs {
+		hash, err := refStore.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, hash)
+	}
+
+	refs, err := refStore.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range refs {
+		roots = append(roots, hash)
+	}
+
+	logged, err := reflogHashes()
+	if err != nil {
+		return nil, err
+	}
+	roots = append(roots, logged...)
+
+	objects := localObjects()
+	entries, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if err := walkBlob(objects, entry.Hash, reachable.mark); err != nil {
+			return nil, fmt.Errorf("refusing to prune, %w", err)
+		}
+	}
+
+	if err := walkObjects(objects, roots, reachable.mark); err != nil {
+		return nil, fmt.Errorf("refusing to prune, %w", err)
+	}
+	return reachable, nil
+}
+
+// reflogHashes collects the old and new values recorded in every reflog
+// under logs/ so that recently abandoned commits survive a prune.
+func reflogHashes() ([]string, error) {
+	var hashes []string
+	root := filepath.Join(repoDir(), "logs")
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			for i := 0; i < len(fields) && i < 2; i++ {
+				if isObjectHash(fields[i]) && strings.Trim(fields[i], "0") != "" {
+					hashes = append(hashes, fields[i])
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reflogs: %w", err)
+	}
+	return hashes, nil
+}
+
+func isObjectHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// PruneObjects removes every unreachable object last modified before the
+// cutoff. With dryRun set it only reports what would be removed.
+func PruneObjects(cutoff time.Time, dryRun bool) (*PruneResult, error) {
+	reachable, err := reachableObjects()
+	if err != nil {
+		return nil, err
+	}
+	result := &PruneResult{Reachable: reachable.count(), DryRun: dryRun}
+
+	objectsPath := filepath.Join(repoDir(), "objects")
+	kinds, err := os.ReadDir(objectsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read objects: %w", err)
+	}
+	for _, kind := range kinds {
+		if !kind.IsDir() {
+			continue
+		}
+		kindPath := filepath.Join(objectsPath, kind.Name())
+		objects, err := os.ReadDir(kindPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", kindPath, err)
+		}
+		for _, object := range objects {
+			if object.IsDir() || reachable[kind.Name()][object.Name()] {
+				continue
+			}
+			info, err := object.Info()
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			if !info.ModTime().Before(cutoff) {
+				result.Recent++
+				continue
+			}
+			if !dryRun {
+				if err := os.Remove(filepath.Join(kindPath, object.Name())); err != nil && !os.IsNotExist(err) {
+					return nil, fmt.Errorf("failed to remove %s/%s: %w", kind.Name(), object.Name(), err)
+				}
+			}
+			result.Removed++
+			result.Reclaimed += info.Size()
+		}
+	}
+	return result, nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (r *PruneResult) String() string {
+	if r.DryRun {
+		return fmt.Sprintf("%d unreachable objects would be removed, %s would be reclaimed (%d reachable, %d too recent to prune)",
+			r.Removed, formatBytes(r.Reclaimed), r.Reachable, r.Recent)
+	}
+	return fmt.Sprintf("%d unreachable objects removed, %s reclaimed (%d reachable, %d too recent to prune)",
+		r.Removed, formatBytes(r.Reclaimed), r.Reachable, r.Recent)
+}
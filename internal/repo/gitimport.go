@@ -0,0 +1,389 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gitMapFile records "<git commit> <kommito commit>" for every imported
+// commit, so importing the same Git repository again only converts what is
+// new.
+const gitMapFile = "git-map"
+
+type GitImportResult struct {
+	Commits int
+	ImportedRefs
+}
+
+// ImportedRefs reports how an import moved the local branches and tags.
+type ImportedRefs struct {
+	Branches []RefChange
+	Tags     []RefChange
+	// Skipped lists refs left alone because the local ref has moved on
+	// since the last import.
+	Skipped []string
+	// CheckedOut is the branch left alone because it is checked out, and
+	// moving it would leave the working tree and index behind.
+	CheckedOut string
+	// Annotated lists the imported tags whose tagger and message were
+	// dropped, since tags here are plain refs.
+	Annotated []string
+}
+
+// update points each named ref at tips[name]. Branches only move forward and
+// existing tags are kept, unless force is set. Every name is checked before
+// any ref is written.
+func (r *ImportedRefs) update(store *ObjectStore, names []string, tips map[string]string, message string, force bool) error {
+	for _, name := range names {
+		if err := checkImportedRef(name); err != nil {
+			return err
+		}
+	}
+	refs := localRefs()
+	local, err := refs.list()
+	if err != nil {
+		return err
+	}
+	current := ""
+	if !IsBare() {
+		if current, err = refs.headTarget(); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		hash := tips[name]
+		old := local[name]
+		if old == hash {
+			continue
+		}
+		if name == current && old != "" {
+			r.CheckedOut = name
+			continue
+		}
+		change := RefChange{Remote: name, Local: name, Old: old, New: hash}
+		if strings.HasPrefix(name, "refs/tags/") {
+			if old != "" && !force {
+				r.Skipped = append(r.Skipped, name)
+				continue
+			}
+			r.Tags = append(r.Tags, change)
+		} else {
+			if ok, err := isAncestor(store, old, hash); !force && (err != nil || !ok) {
+				r.Skipped = append(r.Skipped, name)
+				continue
+			}
+			r.Branches = append(r.Branches, change)
+		}
+		if err := refs.update(name, hash, old, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noteAnnotated records the tags just written that were annotated.
+func (r *ImportedRefs) noteAnnotated(annotated map[string]bool) {
+	for _, change := range r.Tags {
+		if annotated[change.Local] {
+			r.Annotated = append(r.Annotated, change.Local)
+		}
+	}
+}
+
+// checkImportedRef accepts the valid branch and tag names an import may
+// write.
+func checkImportedRef(name string) error {
+	if !strings.HasPrefix(name, "refs/heads/") && !strings.HasPrefix(name, "refs/tags/") {
+		return fmt.Errorf("refusing to import '%s': only refs/heads/ and refs/tags/ can be written", name)
+	}
+	return checkRefName(name)
+}
+
+func gitTime(seconds int64, offset int) string {
+	return time.Unix(seconds, 0).In(time.FixedZone("", offset)).Format(time.RFC3339)
+}
+
+// ImportGit converts the branches and tags of the Git repository at path,
+// with their full history and authors, into the current repository. A
+// repository with no commits yet checks out the Git repository's current
+// branch. Annotated tags become plain tags, and are listed in Annotated.
+func ImportGit(path string) (*GitImportResult, error) {
+	head, err := resolveHead()
+	if err != nil {
+		return nil, err
+	}
+	result, err := importGit(path)
+	if err != nil || head != "" || IsBare() {
+		return result, err
+	}
+	return result, checkoutHead()
+}
+
+// importGit is ImportGit without the checkout, for clone to do its own.
+func importGit(path string) (*GitImportResult, error) {
+	git, err := openGitRepo(path)
+	if err != nil {
+		return nil, err
+	}
+	defer git.Close()
+
+	gitRefs, gitHead, err := git.refs()
+	if err != nil {
+		return nil, err
+	}
+	imported, err := loadGitMap()
+	if err != nil {
+		return nil, err
+	}
+
+	// Tags may point at anything; only those naming a commit are imported,
+	// and annotated ones lose their annotation.
+	tips := make(map[string]string)
+	annotated := make(map[string]bool)
+	var names []string
+	for name, hash := range gitRefs {
+		if !strings.HasPrefix(name, "refs/heads/") && !strings.HasPrefix(name, "refs/tags/") {
+			continue
+		}
+		kind, target, err := git.peel(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if kind != "commit" {
+			continue
+		}
+		tips[name] = target
+		annotated[name] = target != hash
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	importer := &gitImporter{git: git, store: localObjects(), imported: imported, trees: make(map[string][]TreeEntry), blobs: make(map[string]string)}
+	result := &GitImportResult{}
+	for _, name := range names {
+		n, err := importer.importHistory(tips[name])
+		result.Commits += n
+		if err != nil {
+			return result, err
+		}
+	}
+
+	converted := make(map[string]string)
+	for _, name := range names {
+		converted[name] = imported[tips[name]]
+	}
+	if err := result.update(importer.store, names, converted, "import-git: from "+path, false); err != nil {
+		return result, err
+	}
+	result.noteAnnotated(annotated)
+
+	// A fresh repository takes over the Git repository's current branch.
+	if head, err := resolveHead(); err == nil && head == "" && tips[gitHead] != "" {
+		if err := localRefs().setHead("ref: "+gitHead, "import-git: from "+path); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+type gitImporter struct {
+	git      *gitRepo
+	store    *ObjectStore
+	imported map[string]string
+	// trees caches the flattened entries of Git trees, relative to the
+	// tree, so unchanged directories are converted once.
+	trees map[string][]TreeEntry
+	// blobs maps Git blob names to Kommito blob hashes.
+	blobs map[string]string
+}
+
+// importHistory converts every commit reachable from tip that has not been
+// imported yet, parents first, and returns how many were converted.
+func (im *gitImporter) importHistory(tip string) (int, error) {
+	var order []string
+	visited := make(map[string]bool)
+	type frame struct {
+		hash     string
+		expanded bool
+	}
+	stack := []frame{{hash: tip}}
+	commits := make(map[string]*gitCommit)
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if top.expanded {
+			order = append(order, top.hash)
+			continue
+		}
+		if visited[top.hash] || im.imported[top.hash] != "" {
+			continue
+		}
+		visited[top.hash] = true
+		kind, data, err := im.git.readObject(top.hash)
+		if err != nil {
+			return 0, err
+		}
+		if kind != "commit" {
+			return 0, fmt.Errorf("git object %s is a %s, not a commit", top.hash, kind)
+		}
+		commit, err := parseGitCommit(data)
+		if err != nil {
+			return 0, fmt.Errorf("git commit %s: %w", top.hash, err)
+		}
+		commits[top.hash] = commit
+		stack = append(stack, frame{hash: top.hash, expanded: true})
+		for i := len(commit.Parents) - 1; i >= 0; i-- {
+			stack = append(stack, frame{hash: commit.Parents[i]})
+		}
+	}
+
+	mapping, err := os.OpenFile(filepath.Join(repoDir(), gitMapFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", gitMapFile, err)
+	}
+	defer mapping.Close()
+
+	for i, gitHash := range order {
+		hash, err := im.convertCommit(commits[gitHash])
+		if err != nil {
+			return i, fmt.Errorf("failed to import git commit %s: %w", gitHash, err)
+		}
+		// The mapping is appended as each commit lands, so an interrupted
+		// import resumes where it stopped.
+		if _, err := fmt.Fprintf(mapping, "%s %s\n", gitHash, hash); err != nil {
+			return i, fmt.Errorf("failed to update %s: %w", gitMapFile, err)
+		}
+		im.imported[gitHash] = hash
+		delete(commits, gitHash)
+	}
+	return len(order), nil
+}
+
+func (im *gitImporter) convertCommit(gc *gitCommit) (string, error) {
+	entries, err := im.convertTree(gc.Tree)
+	if err != nil {
+		return "", err
+	}
+	tree, err := im.store.WriteTree(entries)
+	if err != nil {
+		return "", err
+	}
+	commit := Commit{
+		Author:    gc.Author,
+		Timestamp: gc.Timestamp,
+		Message:   gc.Message,
+		Tree:      tree,
+	}
+	for _, entry := range entries {
+		commit.Blobs = append(commit.Blobs, entry.Hash)
+	}
+	for _, parent := range gc.Parents {
+		commit.Parents = append(commit.Parents, im.imported[parent])
+	}
+	data, err := json.MarshalIndent(commit, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal commit: %w", err)
+	}
+	return im.store.Write(kindCommit, data)
+}
+
+// convertTree flattens a Git tree into Kommito's full-path entries, storing
+// each blob with the repository's usual large-file and chunking rules.
+// Executable files and symlinks keep their modes; submodules have no
+// content here and are left out.
+func (im *gitImporter) convertTree(hash string) ([]TreeEntry, error) {
+	if entries, ok := im.trees[hash]; ok {
+		return entries, nil
+	}
+	kind, data, err := im.git.readObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	if kind != "tree" {
+		return nil, fmt.Errorf("git object %s is a %s, not a tree", hash, kind)
+	}
+	gitEntries, err := parseGitTree(data)
+	if err != nil {
+		return nil, fmt.Errorf("git tree %s: %w", hash, err)
+	}
+
+	var entries []TreeEntry
+	for _, entry := range gitEntries {
+		switch entry.Mode {
+		case "40000", "040000":
+			children, err := im.convertTree(entry.Hash)
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				child.Path = entry.Name + "/" + child.Path
+				entries = append(entries, child)
+			}
+		case "160000":
+			continue
+		case modeSymlink:
+			_, target, err := im.git.readObject(entry.Hash)
+			if err != nil {
+				return nil, err
+			}
+			blob, err := im.store.Write(kindBlob, target)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, TreeEntry{Path: entry.Name, Hash: blob, Mode: modeSymlink})
+		default:
+			blob, err := im.convertBlob(entry.Name, entry.Hash)
+			if err != nil {
+				return nil, err
+			}
+			mode := ""
+			if entry.Mode == modeExecutable {
+				mode = modeExecutable
+			}
+			entries = append(entries, TreeEntry{Path: entry.Name, Hash: blob, Mode: mode})
+		}
+	}
+	im.trees[hash] = entries
+	return entries, nil
+}
+
+func (im *gitImporter) convertBlob(name, hash string) (string, error) {
+	if blob, ok := im.blobs[hash]; ok {
+		return blob, nil
+	}
+	_, data, err := im.git.readObject(hash)
+	if err != nil {
+		return "", err
+	}
+	blob, err := im.store.writeContent(name, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	im.blobs[hash] = blob
+	return blob, nil
+}
+
+func loadGitMap() (map[string]string, error) {
+	mapping := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(repoDir(), gitMapFile))
+	if os.IsNotExist(err) {
+		return mapping, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", gitMapFile, err)
+	}
+	store := localObjects()
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && store.Has(kindCommit, fields[1]) {
+			mapping[fields[0]] = fields[1]
+		}
+	}
+	return mapping, nil
+}
@@ -0,0 +1,528 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// gitRepo reads a Git object database directly: loose objects, packfiles
+// with their .idx files, and loose or packed refs. It never runs git.
+type gitRepo struct {
+	dir   string
+	packs []*gitPack
+}
+
+// openGitRepo accepts a working tree containing .git, a .git directory
+// itself, or a bare Git repository.
+func openGitRepo(path string) (*gitRepo, error) {
+	dir := filepath.Join(path, ".git")
+	if data, err := os.ReadFile(dir); err == nil {
+		// A .git file points at the real directory, as in worktrees and
+		// submodules.
+		target := strings.TrimSpace(strings.TrimPrefix(string(data), "gitdir:"))
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(path, target)
+		}
+		dir = target
+	} else if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		dir = path
+	}
+	if _, err := os.Stat(filepath.Join(dir, "objects")); err != nil {
+		return nil, fmt.Errorf("'%s' is not a Git repository", path)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil {
+		return nil, fmt.Errorf("'%s' is not a Git repository", path)
+	}
+
+	repo := &gitRepo{dir: dir}
+	indexes, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	for _, idx := range indexes {
+		pack, err := openGitPack(strings.TrimSuffix(idx, ".idx"))
+		if err != nil {
+			repo.Close()
+			return nil, err
+		}
+		repo.packs = append(repo.packs, pack)
+	}
+	return repo, nil
+}
+
+func isGitRepo(path string) bool {
+	g, err := openGitRepo(path)
+	if err != nil {
+		return false
+	}
+	g.Close()
+	return true
+}
+
+func (g *gitRepo) Close() error {
+	for _, pack := range g.packs {
+		pack.file.Close()
+	}
+	return nil
+}
+
+// refs returns every ref under refs/ with its value and the branch HEAD
+// points at. Loose refs take precedence over packed-refs.
+func (g *gitRepo) refs() (map[string]string, string, error) {
+	refs := make(map[string]string)
+	if data, err := os.ReadFile(filepath.Join(g.dir, "packed-refs")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == "" || line[0] == '#' || line[0] == '^' {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 2 {
+				refs[fields[1]] = fields[0]
+			}
+		}
+	}
+	root := filepath.Join(g.dir, "refs")
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		value := strings.TrimSpace(string(data))
+		if isObjectHash(value) {
+			rel, _ := filepath.Rel(g.dir, path)
+			refs[filepath.ToSlash(rel)] = value
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, "", fmt.Errorf("failed to read Git refs: %w", err)
+	}
+
+	head := ""
+	if data, err := os.ReadFile(filepath.Join(g.dir, "HEAD")); err == nil {
+		value := strings.TrimSpace(string(data))
+		if strings.HasPrefix(value, "ref: ") {
+			head = strings.TrimPrefix(value, "ref: ")
+		}
+	}
+	return refs, head, nil
+}
+
+// readObject returns the type ("commit", "tree", "blob" or "tag") and
+// content of an object.
+func (g *gitRepo) readObject(hash string) (string, []byte, error) {
+	if !isObjectHash(hash) {
+		return "", nil, fmt.Errorf("'%s' is not a git object name", hash)
+	}
+	loose := filepath.Join(g.dir, "objects", hash[:2], hash[2:])
+	if f, err := os.Open(loose); err == nil {
+		defer f.Close()
+		return readLooseObject(f, hash)
+	}
+	for _, pack := range g.packs {
+		if offset, ok := pack.find(hash); ok {
+			return pack.readAt(g, offset)
+		}
+	}
+	return "", nil, fmt.Errorf("git object %s not found", hash)
+}
+
+func readLooseObject(r io.Reader, hash string) (string, []byte, error) {
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("git object %s is corrupt: %w", hash, err)
+	}
+	defer z.Close()
+	data, err := io.ReadAll(z)
+	if err != nil {
+		return "", nil, fmt.Errorf("git object %s is corrupt: %w", hash, err)
+	}
+	nul := bytes.IndexByte(data, 0)
+	if nul < 0 {
+		return "", nil, fmt.Errorf("git object %s has no header", hash)
+	}
+	header := strings.Fields(string(data[:nul]))
+	if len(header) != 2 {
+		return "", nil, fmt.Errorf("git object %s has a malformed header", hash)
+	}
+	return header[0], data[nul+1:], nil
+}
+
+// gitPack is one packfile and its index.
+type gitPack struct {
+	file    *os.File
+	hashes  []byte // sorted 20-byte object names
+	offsets []int64
+	// cache keeps recently inflated objects, since delta chains share
+	// their bases.
+	cache     map[int64]gitCached
+	cacheSize int
+}
+
+type gitCached struct {
+	kind string
+	data []byte
+}
+
+const gitPackCacheLimit = 64 << 20
+
+func openGitPack(base string) (*gitPack, error) {
+	idx, err := os.ReadFile(base + ".idx")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack index: %w", err)
+	}
+	pack := &gitPack{cache: make(map[int64]gitCached)}
+	if err := pack.parseIndex(idx); err != nil {
+		return nil, fmt.Errorf("%s.idx: %w", filepath.Base(base), err)
+	}
+	if pack.file, err = os.Open(base + ".pack"); err != nil {
+		return nil, fmt.Errorf("failed to open pack: %w", err)
+	}
+	return pack, nil
+}
+
+// parseIndex reads version 1 and version 2 pack indexes.
+func (p *gitPack) parseIndex(idx []byte) error {
+	short := fmt.Errorf("index is truncated")
+	if len(idx) >= 8 && bytes.Equal(idx[:4], []byte{0xff, 't', 'O', 'c'}) {
+		if v := binary.BigEndian.Uint32(idx[4:8]); v != 2 {
+			return fmt.Errorf("unsupported index version %d", v)
+		}
+		if len(idx) < 8+256*4 {
+			return short
+		}
+		n := int(binary.BigEndian.Uint32(idx[8+255*4:]))
+		names := 8 + 256*4
+		offsets := names + n*20 + n*4
+		large := offsets + n*4
+		if len(idx) < large {
+			return short
+		}
+		p.hashes = idx[names : names+n*20]
+		p.offsets = make([]int64, n)
+		for i := 0; i < n; i++ {
+			off := binary.BigEndian.Uint32(idx[offsets+i*4:])
+			if off&0x80000000 == 0 {
+				p.offsets[i] = int64(off)
+				continue
+			}
+			at := large + int(off&0x7fffffff)*8
+			if len(idx) < at+8 {
+				return short
+			}
+			p.offsets[i] = int64(binary.BigEndian.Uint64(idx[at:]))
+		}
+		return nil
+	}
+
+	if len(idx) < 256*4 {
+		return short
+	}
+	n := int(binary.BigEndian.Uint32(idx[255*4:]))
+	if len(idx) < 256*4+n*24 {
+		return short
+	}
+	p.hashes = make([]byte, 0, n*20)
+	p.offsets = make([]int64, n)
+	for i := 0; i < n; i++ {
+		entry := idx[256*4+i*24:]
+		p.offsets[i] = int64(binary.BigEndian.Uint32(entry))
+		p.hashes = append(p.hashes, entry[4:24]...)
+	}
+	return nil
+}
+
+func (p *gitPack) find(hash string) (int64, bool) {
+	raw, err := hex.DecodeString(hash)
+	if err != nil || len(raw) != 20 {
+		return 0, false
+	}
+	n := len(p.offsets)
+	i := sort.Search(n, func(i int) bool { return bytes.Compare(p.hashes[i*20:i*20+20], raw) >= 0 })
+	if i < n && bytes.Equal(p.hashes[i*20:i*20+20], raw) {
+		return p.offsets[i], true
+	}
+	return 0, false
+}
+
+var gitPackTypes = map[byte]string{1: "commit", 2: "tree", 3: "blob", 4: "tag"}
+
+const (
+	gitOfsDelta = 6
+	gitRefDelta = 7
+)
+
+// readAt inflates the object at offset, resolving deltas against their
+// bases in this pack or, for ref deltas, anywhere in the repository.
+func (p *gitPack) readAt(g *gitRepo, offset int64) (string, []byte, error) {
+	if cached, ok := p.cache[offset]; ok {
+		return cached.kind, cached.data, nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(p.file, offset, 1<<62))
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read pack entry at %d: %w", offset, err)
+	}
+	typ := (b >> 4) & 7
+	size := int64(b & 0x0f)
+	for shift := uint(4); b&0x80 != 0; shift += 7 {
+		if b, err = r.ReadByte(); err != nil {
+			return "", nil, err
+		}
+		size |= int64(b&0x7f) << shift
+	}
+
+	var kind string
+	var base []byte
+	switch typ {
+	case gitOfsDelta:
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", nil, err
+		}
+		distance := int64(b & 0x7f)
+		for b&0x80 != 0 {
+			if b, err = r.ReadByte(); err != nil {
+				return "", nil, err
+			}
+			distance = ((distance + 1) << 7) | int64(b&0x7f)
+		}
+		if kind, base, err = p.readAt(g, offset-distance); err != nil {
+			return "", nil, err
+		}
+	case gitRefDelta:
+		var name [20]byte
+		if _, err := io.ReadFull(r, name[:]); err != nil {
+			return "", nil, err
+		}
+		if kind, base, err = g.readObject(hex.EncodeToString(name[:])); err != nil {
+			return "", nil, err
+		}
+	default:
+		var ok bool
+		if kind, ok = gitPackTypes[typ]; !ok {
+			return "", nil, fmt.Errorf("unknown pack entry type %d at %d", typ, offset)
+		}
+	}
+
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("corrupt pack entry at %d: %w", offset, err)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(z, data)
+	z.Close()
+	if err != nil {
+		return "", nil, fmt.Errorf("corrupt pack entry at %d: %w", offset, err)
+	}
+	if base != nil {
+		if data, err = applyGitDelta(base, data); err != nil {
+			return "", nil, fmt.Errorf("pack entry at %d: %w", offset, err)
+		}
+	}
+
+	if p.cacheSize+len(data) > gitPackCacheLimit {
+		p.cache = make(map[int64]gitCached)
+		p.cacheSize = 0
+	}
+	p.cache[offset] = gitCached{kind: kind, data: data}
+	p.cacheSize += len(data)
+	return kind, data, nil
+}
+
+// applyGitDelta rebuilds an object from its base and a delta made of copy
+// and insert instructions.
+func applyGitDelta(base, delta []byte) ([]byte, error) {
+	bad := fmt.Errorf("malformed delta")
+	varint := func() (int, bool) {
+		n, shift := 0, uint(0)
+		for len(delta) > 0 {
+			b := delta[0]
+			delta = delta[1:]
+			n |= int(b&0x7f) << shift
+			shift += 7
+			if b&0x80 == 0 {
+				return n, true
+			}
+		}
+		return 0, false
+	}
+	sourceSize, ok := varint()
+	if !ok || sourceSize != len(base) {
+		return nil, bad
+	}
+	targetSize, ok := varint()
+	if !ok {
+		return nil, bad
+	}
+
+	out := make([]byte, 0, targetSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0:
+			var offset, size int
+			for i := uint(0); i < 4; i++ {
+				if op&(1<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, bad
+					}
+					offset |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			for i := uint(0); i < 3; i++ {
+				if op&(0x10<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, bad
+					}
+					size |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > len(base) {
+				return nil, bad
+			}
+			out = append(out, base[offset:offset+size]...)
+		case op != 0:
+			if int(op) > len(delta) {
+				return nil, bad
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, bad
+		}
+	}
+	if len(out) != targetSize {
+		return nil, bad
+	}
+	return out, nil
+}
+
+// gitCommit holds the parts of a Git commit that Kommito keeps.
+type gitCommit struct {
+	Tree      string
+	Parents   []string
+	Author    string
+	Timestamp string
+	Message   string
+}
+
+func parseGitCommit(data []byte) (*gitCommit, error) {
+	commit := &gitCommit{}
+	headers, message, _ := strings.Cut(string(data), "\n\n")
+	for _, line := range strings.Split(headers, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			commit.Tree = value
+		case "parent":
+			commit.Parents = append(commit.Parents, value)
+		case "author":
+			commit.Author, commit.Timestamp = parseGitSignature(value)
+		}
+	}
+	if commit.Tree == "" {
+		return nil, fmt.Errorf("commit has no tree")
+	}
+	commit.Message = strings.TrimRight(message, "\n")
+	return commit, nil
+}
+
+// parseGitSignature splits "Name <email> 1700000000 +0100" into the author
+// and an RFC 3339 timestamp in the author's own time zone.
+func parseGitSignature(value string) (string, string) {
+	end := strings.LastIndex(value, ">")
+	if end < 0 {
+		return value, ""
+	}
+	author := value[:end+1]
+	fields := strings.Fields(value[end+1:])
+	if len(fields) != 2 {
+		return author, ""
+	}
+	seconds, err := strconv.ParseInt(fields[0], 10, 64)
+	zone := fields[1]
+	if err != nil || len(zone) != 5 {
+		return author, ""
+	}
+	hours, _ := strconv.Atoi(zone[1:3])
+	minutes, _ := strconv.Atoi(zone[3:5])
+	offset := hours*3600 + minutes*60
+	if zone[0] == '-' {
+		offset = -offset
+	}
+	return author, gitTime(seconds, offset)
+}
+
+// gitTreeEntry is one entry of a Git tree object.
+type gitTreeEntry struct {
+	Mode string
+	Name string
+	Hash string
+}
+
+func parseGitTree(data []byte) ([]gitTreeEntry, error) {
+	var entries []gitTreeEntry
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		if space < 0 {
+			return nil, fmt.Errorf("malformed tree entry")
+		}
+		nul := bytes.IndexByte(data[space:], 0)
+		if nul < 0 || space+nul+21 > len(data) {
+			return nil, fmt.Errorf("malformed tree entry")
+		}
+		nul += space
+		entries = append(entries, gitTreeEntry{
+			Mode: string(data[:space]),
+			Name: string(data[space+1 : nul]),
+			Hash: hex.EncodeToString(data[nul+1 : nul+21]),
+		})
+		data = data[nul+21:]
+	}
+	return entries, nil
+}
+
+// peel follows annotated tags to the object they finally name.
+func (g *gitRepo) peel(hash string) (string, string, error) {
+	for depth := 0; depth < 10; depth++ {
+		kind, data, err := g.readObject(hash)
+		if err != nil {
+			return "", "", err
+		}
+		if kind != "tag" {
+			return kind, hash, nil
+		}
+		object := ""
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "object ") {
+				object = strings.TrimPrefix(line, "object ")
+				break
+			}
+		}
+		if object == "" {
+			return "", "", fmt.Errorf("tag %s names no object", hash)
+		}
+		hash = object
+	}
+	return "", "", fmt.Errorf("tag chain at %s is too deep", hash)
+}
@@ -0,0 +1,375 @@
+package repo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// deltaCopy and deltaInsert encode the two delta instructions.
+func deltaCopy(offset, size int) []byte {
+	op := []byte{0x80}
+	for i := uint(0); i < 4; i++ {
+		if b := byte(offset >> (8 * i)); b != 0 {
+			op[0] |= 1 << i
+			op = append(op, b)
+		}
+	}
+	if size == 0x10000 {
+		size = 0
+	}
+	for i := uint(0); i < 3; i++ {
+		if b := byte(size >> (8 * i)); b != 0 {
+			op[0] |= 0x10 << i
+			op = append(op, b)
+		}
+	}
+	return op
+}
+
+func deltaInsert(data string) []byte {
+	return append([]byte{byte(len(data))}, data...)
+}
+
+func deltaVarint(n int) []byte {
+	var b []byte
+	for n >= 0x80 {
+		b = append(b, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(b, byte(n))
+}
+
+func makeDelta(sourceSize, targetSize int, ops ...[]byte) []byte {
+	delta := append(deltaVarint(sourceSize), deltaVarint(targetSize)...)
+	for _, op := range ops {
+		delta = append(delta, op...)
+	}
+	return delta
+}
+
+func TestApplyGitDelta(t *testing.T) {
+	base := []byte("The quick brown fox jumps over the lazy dog\n")
+	large := bytes.Repeat([]byte("0123456789abcdef"), 0x2000)
+	tests := []struct {
+		name  string
+		base  []byte
+		delta []byte
+		want  string
+		bad   bool
+	}{
+		{
+			name:  "copy and insert",
+			base:  base,
+			delta: makeDelta(len(base), 24, deltaCopy(0, 10), deltaInsert("red"), deltaCopy(15, 5), deltaInsert("jumps\n")),
+			want:  "The quick red fox jumps\n",
+		},
+		{
+			name:  "copy from a high offset",
+			base:  large,
+			delta: makeDelta(len(large), 4, deltaCopy(0x1ff00, 4)),
+			want:  "0123",
+		},
+		{
+			name:  "size zero copies 64 KiB",
+			base:  large,
+			delta: makeDelta(len(large), 0x10000, deltaCopy(0x10000, 0x10000)),
+			want:  string(large[0x10000:0x20000]),
+		},
+		{
+			name:  "empty target",
+			base:  base,
+			delta: makeDelta(len(base), 0),
+			want:  "",
+		},
+		{
+			name:  "wrong base size",
+			base:  base,
+			delta: makeDelta(len(base)+1, 3, deltaCopy(0, 3)),
+			bad:   true,
+		},
+		{
+			name:  "copy past the base",
+			base:  base,
+			delta: makeDelta(len(base), 10, deltaCopy(len(base)-5, 10)),
+			bad:   true,
+		},
+		{
+			name:  "truncated insert",
+			base:  base,
+			delta: makeDelta(len(base), 5, []byte{5, 'a', 'b'}),
+			bad:   true,
+		},
+		{
+			name:  "reserved instruction",
+			base:  base,
+			delta: makeDelta(len(base), 1, []byte{0}),
+			bad:   true,
+		},
+		{
+			name:  "wrong target size",
+			base:  base,
+			delta: makeDelta(len(base), 4, deltaCopy(0, 3)),
+			bad:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyGitDelta(tt.base, tt.delta)
+			if tt.bad {
+				if err == nil {
+					t.Fatalf("applied a malformed delta: %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// packEntry is one object of a test pack: a whole object, or a delta
+// against an earlier entry (ofs) or any object by name (ref).
+type packEntry struct {
+	kind    string
+	data    string
+	ofsBase int
+	refBase string
+	delta   []byte
+}
+
+func gitObjectName(kind string, data []byte) string {
+	sum := sha1.Sum(append([]byte(kind+" "+strconv.Itoa(len(data))+"\x00"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeGitPack writes a pack of entries and an index in the given version
+// into dir, returning each entry's object name.
+func writeGitPack(t *testing.T, dir string, version int, entries []packEntry, resolve func(string) []byte) []string {
+	t.Helper()
+	types := map[string]byte{"commit": 1, "tree": 2, "blob": 3, "tag": 4}
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(len(entries)))
+
+	names := make([]string, len(entries))
+	offsets := make([]int, len(entries))
+	contents := make([][]byte, len(entries))
+	for i, e := range entries {
+		offsets[i] = pack.Len()
+		typ, body := types[e.kind], []byte(e.data)
+		var extra []byte
+		switch {
+		case e.delta != nil && e.refBase != "":
+			typ, body = gitRefDelta, e.delta
+			raw, _ := hex.DecodeString(e.refBase)
+			extra = raw
+			contents[i], _ = applyGitDelta(resolve(e.refBase), e.delta)
+		case e.delta != nil:
+			typ, body = gitOfsDelta, e.delta
+			n := offsets[i] - offsets[e.ofsBase]
+			extra = []byte{byte(n & 0x7f)}
+			for n >>= 7; n > 0; n >>= 7 {
+				n--
+				extra = append([]byte{0x80 | byte(n&0x7f)}, extra...)
+			}
+			contents[i], _ = applyGitDelta(contents[e.ofsBase], e.delta)
+		default:
+			contents[i] = body
+		}
+		if contents[i] == nil {
+			t.Fatalf("entry %d does not apply to its base", i)
+		}
+		names[i] = gitObjectName(e.kind, contents[i])
+
+		size := len(body)
+		header := []byte{typ<<4 | byte(size&0x0f)}
+		for size >>= 4; size > 0; size >>= 7 {
+			header[len(header)-1] |= 0x80
+			header = append(header, byte(size&0x7f))
+		}
+		pack.Write(header)
+		pack.Write(extra)
+		z := zlib.NewWriter(&pack)
+		z.Write(body)
+		z.Close()
+	}
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return names[order[a]] < names[order[b]] })
+	var fanout [256]uint32
+	for _, name := range names {
+		first, _ := hex.DecodeString(name[:2])
+		for b := int(first[0]); b < 256; b++ {
+			fanout[b]++
+		}
+	}
+	var idx bytes.Buffer
+	if version == 2 {
+		idx.Write([]byte{0xff, 't', 'O', 'c'})
+		binary.Write(&idx, binary.BigEndian, uint32(2))
+		binary.Write(&idx, binary.BigEndian, fanout)
+		for _, i := range order {
+			raw, _ := hex.DecodeString(names[i])
+			idx.Write(raw)
+		}
+		idx.Write(make([]byte, 4*len(entries)))
+		for _, i := range order {
+			binary.Write(&idx, binary.BigEndian, uint32(offsets[i]))
+		}
+	} else {
+		binary.Write(&idx, binary.BigEndian, fanout)
+		for _, i := range order {
+			binary.Write(&idx, binary.BigEndian, uint32(offsets[i]))
+			raw, _ := hex.DecodeString(names[i])
+			idx.Write(raw)
+		}
+	}
+	idx.Write(sum[:])
+	idx.Write(make([]byte, 20))
+
+	base := filepath.Join(dir, "objects", "pack", "pack-test")
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".pack", pack.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".idx", idx.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// writeLooseGitObject stores a loose object in dir and returns its name.
+func writeLooseGitObject(t *testing.T, dir, kind, data string) string {
+	t.Helper()
+	name := gitObjectName(kind, []byte(data))
+	var b bytes.Buffer
+	z := zlib.NewWriter(&b)
+	z.Write([]byte(kind + " " + strconv.Itoa(len(data)) + "\x00" + data))
+	z.Close()
+	path := filepath.Join(dir, "objects", name[:2], name[2:])
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestGitPackDeltas(t *testing.T) {
+	v1 := strings.Repeat("line of the first version\n", 40)
+	v2 := v1 + "a second version adds a line\n"
+	loose := "a loose object that a ref delta in the pack is based on\n"
+
+	for _, version := range []int{1, 2} {
+		t.Run("index v"+strconv.Itoa(version), func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "HEAD"), []byte("ref: refs/heads/main\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			looseName := writeLooseGitObject(t, dir, "blob", loose)
+			v2Name := gitObjectName("blob", []byte(v2))
+			contents := map[string][]byte{looseName: []byte(loose), v2Name: []byte(v2)}
+			entries := []packEntry{
+				{kind: "blob", data: v1},
+				// ofs delta against the whole object above
+				{kind: "blob", ofsBase: 0, delta: makeDelta(len(v1), len(v2), deltaCopy(0, len(v1)), deltaInsert("a second version adds a line\n"))},
+				// ofs delta against a delta, two links from the base
+				{kind: "blob", ofsBase: 1, delta: makeDelta(len(v2), 11, deltaCopy(len(v1)+2, 6), deltaInsert("hand\n"))},
+				// ref delta against an object in the same pack
+				{kind: "blob", refBase: v2Name, delta: makeDelta(len(v2), 5, deltaCopy(0, 4), deltaInsert("\n"))},
+				// ref delta against a loose object
+				{kind: "blob", refBase: looseName, delta: makeDelta(len(loose), 8, deltaCopy(2, 5), deltaInsert("!\n\n"))},
+			}
+			want := []string{v1, v2, "secondhand\n", "line\n", "loose!\n\n"}
+			names := writeGitPack(t, dir, version, entries, func(name string) []byte { return contents[name] })
+
+			git, err := openGitRepo(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer git.Close()
+			for i, name := range names {
+				kind, data, err := git.readObject(name)
+				if err != nil {
+					t.Fatalf("entry %d: %v", i, err)
+				}
+				if kind != "blob" || string(data) != want[i] {
+					t.Errorf("entry %d is %s %q, want blob %q", i, kind, data, want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestGitPackFromGit reads every object of a repository that git itself
+// packed with deltas, and compares it with what git reports.
+func TestGitPackFromGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "commit.gpgsign=false"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+		}
+		return string(out)
+	}
+	git("init", "-q")
+	text := strings.Repeat("a line that stays the same in every version\n", 200)
+	for i := 0; i < 8; i++ {
+		text += "version " + strconv.Itoa(i) + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "file.txt")
+		git("commit", "-q", "-m", "version "+strconv.Itoa(i))
+	}
+	git("gc", "-q", "--aggressive")
+
+	repo, err := openGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if len(repo.packs) == 0 {
+		t.Fatal("git gc left no pack")
+	}
+	for _, line := range strings.Split(strings.TrimSpace(git("cat-file", "--batch-all-objects", "--batch-check")), "\n") {
+		fields := strings.Fields(line)
+		name, kind := fields[0], fields[1]
+		gotKind, data, err := repo.readObject(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want := git("cat-file", kind, name); gotKind != kind || string(data) != want {
+			t.Errorf("%s read as %s of %d bytes, want %s of %d bytes", name, gotKind, len(data), kind, len(want))
+		}
+	}
+}
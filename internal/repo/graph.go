@@ -0,0 +1,190 @@
+package repo
+
+import "strings"
+
+// GraphStyle is the set of glyphs a Graph draws with.
+type GraphStyle struct {
+	Commit   string
+	Vertical string
+	// Left and Right are the diagonals of a lane moving one column left
+	// or right between two rows.
+	Left, Right string
+}
+
+var (
+	ASCIIGraph   = GraphStyle{Commit: "*", Vertical: "|", Left: "/", Right: "\\"}
+	UnicodeGraph = GraphStyle{Commit: "●", Vertical: "│", Left: "╱", Right: "╲"}
+)
+
+// graphColors are the ANSI colours lanes cycle through.
+var graphColors = []string{"31", "32", "33", "34", "35", "36"}
+
+// Graph draws history as lanes, one commit at a time, the way "git log
+// --graph" does. Each lane waits for a commit; a commit is drawn in its
+// lane, which then continues to its first parent, with new lanes opened
+// to the right for the other parents. Lanes waiting for the same commit
+// are joined as soon as they meet.
+//
+// Commits must be given children before parents. Graph knows nothing
+// about repositories, so it can draw any DAG.
+type Graph struct {
+	style     GraphStyle
+	color     bool
+	lanes     []graphLane
+	nextColor int
+	width     int
+}
+
+type graphLane struct {
+	hash  string
+	color int
+}
+
+// graphCell is one glyph of a row and the lane colour it is drawn in.
+type graphCell struct {
+	glyph string
+	color int
+}
+
+// NewGraph returns an empty graph. With color, each lane is drawn in its
+// own ANSI colour.
+func NewGraph(style GraphStyle, color bool) *Graph {
+	return &Graph{style: style, color: color}
+}
+
+// Commit adds the next commit and returns the rows to draw for it: the
+// commit's own row, then any rows that move lanes into place for the
+// commits below. Every row is padded to the same width, so text written
+// after each lines up.
+func (g *Graph) Commit(hash string, parents []string) []string {
+	current := -1
+	for i, lane := range g.lanes {
+		if lane.hash == hash {
+			current = i
+			break
+		}
+	}
+	if current < 0 {
+		g.lanes = append(g.lanes, graphLane{hash: hash, color: g.newColor()})
+		current = len(g.lanes) - 1
+	}
+
+	// The lanes below: this commit's lane becomes its parents' lanes, and
+	// lanes waiting for the same commit are joined into the leftmost.
+	var next []graphLane
+	for i, lane := range g.lanes {
+		if i != current {
+			next = append(next, lane)
+			continue
+		}
+		for k, parent := range parents {
+			color := lane.color
+			if k > 0 {
+				color = g.newColor()
+			}
+			next = append(next, graphLane{hash: parent, color: color})
+		}
+	}
+	var joined []graphLane
+	at := make(map[string]int)
+	type edge struct{ from, to, color int }
+	var edges []edge
+	n := 0
+	for i := range g.lanes {
+		count := 1
+		if i == current {
+			count = len(parents)
+		}
+		for ; count > 0; count-- {
+			target, ok := at[next[n].hash]
+			if !ok {
+				target = len(joined)
+				at[next[n].hash] = target
+				joined = append(joined, next[n])
+			}
+			edges = append(edges, edge{from: i, to: target, color: next[n].color})
+			n++
+		}
+	}
+
+	g.width = 2 * max(len(g.lanes), len(joined))
+	row := make([]graphCell, g.width)
+	for i, lane := range g.lanes {
+		if i == current {
+			row[2*i] = graphCell{glyph: g.style.Commit, color: -1}
+		} else {
+			row[2*i] = graphCell{glyph: g.style.Vertical, color: lane.color}
+		}
+	}
+	rows := []string{g.render(row)}
+
+	// Move every edge one column per row until each is in its lane. Edges
+	// that cross would meet in the same cell, so the one that comes later
+	// waits a row and crosses in the next.
+	x := make([]int, len(edges))
+	for i, e := range edges {
+		x[i] = 2 * e.from
+	}
+	for {
+		settled := true
+		for i, e := range edges {
+			if x[i] != 2*e.to {
+				settled = false
+			}
+		}
+		if settled {
+			break
+		}
+		row := make([]graphCell, g.width)
+		for i, e := range edges {
+			cell, glyph, step := x[i], g.style.Vertical, 0
+			switch target := 2 * e.to; {
+			case x[i] > target:
+				cell, glyph, step = x[i]-1, g.style.Left, -2
+			case x[i] < target:
+				cell, glyph, step = x[i]+1, g.style.Right, 2
+			}
+			if taken := row[cell].glyph; taken != "" && taken != glyph {
+				cell, glyph, step = x[i], g.style.Vertical, 0
+			}
+			if row[cell].glyph == "" {
+				row[cell] = graphCell{glyph: glyph, color: e.color}
+			}
+			x[i] += step
+		}
+		rows = append(rows, g.render(row))
+	}
+	g.lanes = joined
+	return rows
+}
+
+// Padding returns the row to draw beside text that continues after the
+// rows of the last commit: the lanes passing by, padded like those rows.
+func (g *Graph) Padding() string {
+	row := make([]graphCell, max(g.width, 2*len(g.lanes)))
+	for i, lane := range g.lanes {
+		row[2*i] = graphCell{glyph: g.style.Vertical, color: lane.color}
+	}
+	return g.render(row)
+}
+
+func (g *Graph) newColor() int {
+	color := g.nextColor
+	g.nextColor = (g.nextColor + 1) % len(graphColors)
+	return color
+}
+
+func (g *Graph) render(row []graphCell) string {
+	var b strings.Builder
+	for _, cell := range row {
+		switch {
+		case cell.glyph == "":
+			b.WriteByte(' ')
+		case g.color && cell.color >= 0:
+			b.WriteString("\x1b[" + graphColors[cell.color] + "m" + cell.glyph + "\x1b[m")
+		default:
+			b.WriteString(cell.glyph)
+		}
+	}
+	return b.String()
+}
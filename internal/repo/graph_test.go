@@ -0,0 +1,133 @@
+package repo
+
+import (
+	"strings"
+	"testing"
+)
+
+// graphCommit is a commit of a test DAG, given children before parents.
+type graphCommit struct {
+	hash    string
+	parents []string
+}
+
+func drawGraph(commits []graphCommit) string {
+	graph := NewGraph(ASCIIGraph, false)
+	var b strings.Builder
+	for _, c := range commits {
+		for i, row := range graph.Commit(c.hash, c.parents) {
+			if i == 0 {
+				row += c.hash
+			}
+			b.WriteString(strings.TrimRight(row, " ") + "\n")
+		}
+	}
+	return b.String()
+}
+
+func TestGraph(t *testing.T) {
+	tests := []struct {
+		name    string
+		commits []graphCommit
+		want    string
+	}{
+		{
+			name: "linear",
+			commits: []graphCommit{
+				{"C", []string{"B"}},
+				{"B", []string{"A"}},
+				{"A", nil},
+			},
+			want: `* C
+* B
+* A
+`,
+		},
+		{
+			name: "branch and merge",
+			commits: []graphCommit{
+				{"M", []string{"B", "C"}},
+				{"C", []string{"A"}},
+				{"B", []string{"A"}},
+				{"A", nil},
+			},
+			want: `*   M
+|\
+| * C
+* | B
+|/
+* A
+`,
+		},
+		{
+			name: "two tips",
+			commits: []graphCommit{
+				{"D", []string{"B"}},
+				{"C", []string{"A"}},
+				{"B", []string{"A"}},
+				{"A", nil},
+			},
+			want: `* D
+| * C
+* | B
+|/
+* A
+`,
+		},
+		{
+			name: "octopus",
+			commits: []graphCommit{
+				{"M", []string{"B", "C", "D"}},
+				{"D", []string{"A"}},
+				{"C", []string{"A"}},
+				{"B", []string{"A"}},
+				{"A", nil},
+			},
+			want: `*     M
+|\
+| |\
+| | * D
+| * | C
+| |/
+* | B
+|/
+* A
+`,
+		},
+		{
+			// The merge's edge to B moves right past X's lane while B's
+			// own lane moves left across it; the edges must not share a
+			// cell, or the merge looks like it has one parent.
+			name: "crossing edges",
+			commits: []graphCommit{
+				{"N", []string{"M"}},
+				{"T", []string{"X"}},
+				{"U", []string{"B"}},
+				{"M", []string{"A", "B"}},
+				{"X", []string{"A"}},
+				{"B", []string{"A"}},
+				{"A", nil},
+			},
+			want: `* N
+| * T
+| | * U
+* | | M
+|\ \|
+| |/|
+| | * X
+| |/
+|/|
+| * B
+|/
+* A
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := drawGraph(tt.commits); got != tt.want {
+				t.Errorf("graph:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package repo
+
+// isAncestor reports whether ancestor is reachable from descendant by
+// following parents. A commit is its own ancestor.
+func isAncestor(store *ObjectStore, ancestor, descendant string) (bool, error) {
+	if ancestor == "" {
+		return true, nil
+	}
+	found := false
+	seen := make(map[string]bool)
+	pending := []string{descendant}
+	for len(pending) > 0 && !found {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if hash == "" || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		if hash == ancestor {
+			found = true
+			break
+		}
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return false, err
+		}
+		pending = append(pending, commit.Parents...)
+	}
+	return found, nil
+}
+
+// reachableCommits returns every commit reachable from tips, tips
+// included. Commits missing from a shallow clone are left out.
+func reachableCommits(store *ObjectStore, tips []string) (map[string]bool, error) {
+	reachable := make(map[string]bool)
+	pending := append([]string(nil), tips...)
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if reachable[hash] || !store.Has(kindCommit, hash) {
+			continue
+		}
+		reachable[hash] = true
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, commit.Parents...)
+	}
+	return reachable, nil
+}
+
+// mergeBase returns a best common ancestor of a and b, one that no other
+// common ancestor descends from, or "" when they share no history.
+func mergeBase(store *ObjectStore, a, b string) (string, error) {
+	fromA, err := reachableCommits(store, []string{a})
+	if err != nil {
+		return "", err
+	}
+	// The common ancestors reached from b without going past another one.
+	var common []string
+	seen := make(map[string]bool)
+	pending := []string{b}
+	for len(pending) > 0 {
+		hash := pending[0]
+		pending = pending[1:]
+		if seen[hash] || !store.Has(kindCommit, hash) {
+			continue
+		}
+		seen[hash] = true
+		if fromA[hash] {
+			common = append(common, hash)
+			continue
+		}
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return "", err
+		}
+		pending = append(pending, commit.Parents...)
+	}
+	for _, candidate := range common {
+		best := true
+		for _, other := range common {
+			if other == candidate {
+				continue
+			}
+			below, err := isAncestor(store, candidate, other)
+			if err != nil {
+				return "", err
+			}
+			if below {
+				best = false
+				break
+			}
+		}
+		if best {
+			return candidate, nil
+		}
+	}
+	return "", nil
+}
+
+// topoSortCommits orders a set of commits so that every parent in the set
+// comes before its children.
+func topoSortCommits(store *ObjectStore, commits []string) ([]string, error) {
+	inSet := make(map[string]bool)
+	for _, hash := range commits {
+		inSet[hash] = true
+	}
+	done := make(map[string]bool)
+	var sorted []string
+	var visit func(hash string) error
+	visit = func(hash string) error {
+		if done[hash] {
+			return nil
+		}
+		done[hash] = true
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return err
+		}
+		for _, parent := range commit.Parents {
+			if inSet[parent] {
+				if err := visit(parent); err != nil {
+					return err
+				}
+			}
+		}
+		sorted = append(sorted, hash)
+		return nil
+	}
+	for _, hash := range commits {
+		if err := visit(hash); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
@@ -0,0 +1,346 @@
+package repo
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The HTTP protocol serves each repository under its path relative to the
+// served directory, e.g. http://host:8080/team/project.kommito:
+//
+//	GET  <repo>/refs   advertises branches, tags and HEAD as JSON
+//	POST <repo>/fetch  takes {"wants", "haves", "shallow", "depth",
+//	                   "deepen", "unshallow", "filter"}, or {"blobs"} for
+//	                   a partial clone, and answers with a pack
+//	POST <repo>/push   takes one JSON line {"updates"} followed by a pack
+//
+// Errors are reported as a JSON body {"error": "..."} with a non-2xx status.
+const packContentType = "application/x-kommito-pack"
+
+type refAdvertisement struct {
+	Refs  map[string]string `json:"refs"`
+	Head  string            `json:"head,omitempty"`
+	Error string            `json:"error,omitempty"`
+}
+
+type fetchRequest struct {
+	Wants []string `json:"wants"`
+	Haves []string `json:"haves"`
+	// Shallow lists the client's shallow commits, whose history it lacks
+	// even though it has them.
+	Shallow []string `json:"shallow,omitempty"`
+	// Blobs asks for these blobs by hash instead, to fill in a partial
+	// clone; wants and haves are then ignored.
+	Blobs []string `json:"blobs,omitempty"`
+	FetchOptions
+}
+
+type pushRequest struct {
+	Updates []RefUpdate `json:"updates"`
+}
+
+type pushResponse struct {
+	Objects int    `json:"objects"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Serve hosts every Kommito repository below root, bare or not, at addr.
+func Serve(addr, root string) error {
+	server := &http.Server{Addr: addr, Handler: NewHTTPHandler(root)}
+	return server.ListenAndServe()
+}
+
+// NewHTTPHandler returns the handler behind Serve, for embedding in another
+// server.
+func NewHTTPHandler(root string) http.Handler {
+	return &httpHandler{root: root}
+}
+
+type httpHandler struct {
+	root string
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, action := path.Split(path.Clean("/" + r.URL.Path))
+	dir, bare, err := findRepoDir(filepath.Join(h.root, filepath.FromSlash(name)))
+	if err != nil {
+		httpError(w, http.StatusNotFound, fmt.Errorf("no repository at %s", name))
+		return
+	}
+	transport := &localTransport{dir: dir, bare: bare}
+
+	switch {
+	case action == "refs" && r.Method == http.MethodGet:
+		h.serveRefs(w, transport)
+	case action == "fetch" && r.Method == http.MethodPost:
+		h.serveFetch(w, r, transport)
+	case action == "push" && r.Method == http.MethodPost:
+		h.servePush(w, r, transport)
+	default:
+		httpError(w, http.StatusNotFound, fmt.Errorf("unknown request %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (h *httpHandler) serveRefs(w http.ResponseWriter, t *localTransport) {
+	refs, head, err := t.ListRefs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refAdvertisement{Refs: refs, Head: head})
+}
+
+func (h *httpHandler) serveFetch(w http.ResponseWriter, r *http.Request, t *localTransport) {
+	var req fetchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("malformed fetch request: %w", err))
+		return
+	}
+	missing, err := t.negotiate(req)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", packContentType)
+	if err := writePack(w, NewObjectStore(t.dir), missing); err != nil {
+		// The status line is already sent; the client sees a truncated pack.
+		log.Printf("fetch from %s failed: %v", t.dir, err)
+	}
+}
+
+func (h *httpHandler) servePush(w http.ResponseWriter, r *http.Request, t *localTransport) {
+	body := bufio.NewReader(r.Body)
+	line, err := body.ReadBytes('\n')
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("malformed push request: %w", err))
+		return
+	}
+	var req pushRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("malformed push request: %w", err))
+		return
+	}
+
+	received, err := t.receive(body, req.Updates)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrRefChanged) {
+			status = http.StatusConflict
+		}
+		httpError(w, status, err)
+		return
+	}
+	log.Printf("push to %s: %d objects, %d refs", t.dir, received, len(req.Updates))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pushResponse{Objects: received})
+}
+
+// negotiate works out which objects a fetching client lacks. Only the tips
+// of advertised branches and tags may be requested.
+func (t *localTransport) negotiate(req fetchRequest) ([]objectRef, error) {
+	if len(req.Blobs) > 0 {
+		return promisedObjects(NewObjectStore(t.dir), req.Blobs)
+	}
+	refs, _, err := t.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+	advertised := make(map[string]bool)
+	for _, hash := range refs {
+		advertised[hash] = true
+	}
+	for _, want := range req.Wants {
+		if !advertised[want] {
+			return nil, fmt.Errorf("%s is not the tip of any branch or tag", want)
+		}
+	}
+	store := NewObjectStore(t.dir)
+	have, err := commonObjects(store, req.Haves, req.Shallow)
+	if err != nil {
+		return nil, err
+	}
+	return fetchMissing(store, req.Wants, req.Shallow, req.FetchOptions, have)
+}
+
+// receive stores a pushed pack and applies the ref updates once every new
+// ref value is fully connected.
+func (t *localTransport) receive(pack io.Reader, updates []RefUpdate) (int, error) {
+	if err := t.checkPushable(updates); err != nil {
+		return 0, err
+	}
+	store := NewObjectStore(t.dir)
+	received, err := readPack(pack, store)
+	if err != nil {
+		return received, fmt.Errorf("failed to receive objects: %w", err)
+	}
+
+	refs, _, err := t.ListRefs()
+	if err != nil {
+		return received, err
+	}
+	var known, tips []string
+	for _, hash := range refs {
+		known = append(known, hash)
+	}
+	for _, update := range updates {
+		if update.New != "" {
+			tips = append(tips, update.New)
+		}
+	}
+	if err := checkConnected(store, tips, known); err != nil {
+		return received, fmt.Errorf("push is incomplete: %w", err)
+	}
+	return received, newRefStore(t.dir).updateAll(updates, "push")
+}
+
+func httpError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(pushResponse{Error: err.Error()})
+}
+
+// httpTransport is the client side of the HTTP protocol.
+type httpTransport struct {
+	url    string
+	client *http.Client
+	refs   map[string]string
+}
+
+func newHTTPTransport(url string) *httpTransport {
+	return &httpTransport{url: strings.TrimSuffix(url, "/"), client: &http.Client{}}
+}
+
+func (t *httpTransport) ListRefs() (map[string]string, string, error) {
+	resp, err := t.client.Get(t.url + "/refs")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := httpResponseError(resp); err != nil {
+		return nil, "", err
+	}
+	var adv refAdvertisement
+	if err := json.NewDecoder(resp.Body).Decode(&adv); err != nil {
+		return nil, "", fmt.Errorf("%s did not answer like a Kommito server: %w", t.url, err)
+	}
+	if adv.Refs == nil {
+		adv.Refs = make(map[string]string)
+	}
+	t.refs = adv.Refs
+	return adv.Refs, adv.Head, nil
+}
+
+func (t *httpTransport) Fetch(wants []string, dst *ObjectStore, opts FetchOptions) (int, error) {
+	if len(wants) == 0 && !opts.deepens() {
+		return 0, nil
+	}
+	local, err := newRefStore(dst.dir).list()
+	if err != nil {
+		return 0, err
+	}
+	req := fetchRequest{Wants: wants, Shallow: dst.shallowList(), FetchOptions: opts}
+	for _, hash := range local {
+		req.Haves = append(req.Haves, hash)
+	}
+	return t.fetchPack(req, dst)
+}
+
+func (t *httpTransport) FetchBlobs(hashes []string, dst *ObjectStore) (int, error) {
+	return t.fetchPack(fetchRequest{Blobs: hashes}, dst)
+}
+
+func (t *httpTransport) fetchPack(req fetchRequest, dst *ObjectStore) (int, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := t.client.Post(t.url+"/fetch", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := httpResponseError(resp); err != nil {
+		return 0, err
+	}
+	return readPack(resp.Body, dst)
+}
+
+func (t *httpTransport) Push(src *ObjectStore, updates []RefUpdate) (int, error) {
+	if t.refs == nil {
+		if _, _, err := t.ListRefs(); err != nil {
+			return 0, err
+		}
+	}
+	var known, wants []string
+	for _, hash := range t.refs {
+		known = append(known, hash)
+	}
+	for _, update := range updates {
+		if update.New != "" {
+			wants = append(wants, update.New)
+		}
+	}
+	have, err := commonObjects(src, known, nil)
+	if err != nil {
+		return 0, err
+	}
+	missing, err := missingObjects(src, wants, have)
+	if err != nil {
+		return 0, err
+	}
+
+	header, err := json.Marshal(pushRequest{Updates: updates})
+	if err != nil {
+		return 0, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		if _, err := pw.Write(append(header, '\n')); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(writePack(pw, src, missing))
+	}()
+	resp, err := t.client.Post(t.url+"/push", packContentType, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := httpResponseError(resp); err != nil {
+		return 0, err
+	}
+	var result pushResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("malformed push response: %w", err)
+	}
+	return result.Objects, nil
+}
+
+func (t *httpTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+func httpResponseError(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	var body pushResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err == nil && body.Error != "" {
+		if resp.StatusCode == http.StatusConflict {
+			return fmt.Errorf("remote rejected the update: %s: %w", body.Error, ErrRefChanged)
+		}
+		return fmt.Errorf("remote rejected the request: %s", body.Error)
+	}
+	return fmt.Errorf("remote answered %s", resp.Status)
+}
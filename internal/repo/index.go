@@ -0,0 +1,161 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type indexEntry struct {
+	Hash string
+	Path string
+	// Mode is modeExecutable or modeSymlink, or empty for a regular file.
+	Mode string
+}
+
+// readIndex returns the effective staging area. addSingleFile appends a new
+// line every time a file is re-added, so later lines win over earlier ones.
+// Each line is "<hash> <path>", with ":<mode>" after the hash for files
+// that are not regular.
+func readIndex() ([]indexEntry, error) {
+	indexPath := filepath.Join(".kommito", "index")
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	positions := make(map[string]int)
+	var entries []indexEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		hash, mode, _ := strings.Cut(parts[0], ":")
+		entry := indexEntry{Hash: hash, Path: parts[1], Mode: mode}
+		if i, ok := positions[entry.Path]; ok {
+			entries[i] = entry
+			continue
+		}
+		positions[entry.Path] = len(entries)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func writeIndex(entries []indexEntry) error {
+	var b strings.Builder
+	for _, entry := range entries {
+		if entry.Mode != "" {
+			fmt.Fprintf(&b, "%s:%s %s\n", entry.Hash, entry.Mode, entry.Path)
+			continue
+		}
+		fmt.Fprintf(&b, "%s %s\n", entry.Hash, entry.Path)
+	}
+	indexPath := filepath.Join(".kommito", "index")
+	if err := writeFileAtomic(indexPath, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
+
+// updateIndex runs a read-modify-write cycle on the index while holding
+// index.lock, so concurrent adds cannot lose each other's entries.
+func updateIndex(update func([]indexEntry) []indexEntry) error {
+	lock, err := acquireLock(filepath.Join(".kommito", "index"))
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	return writeIndex(update(entries))
+}
+
+// resetIndex replaces the index with the files of a commit.
+func resetIndex(files map[string]TreeEntry) error {
+	return updateIndex(func([]indexEntry) []indexEntry {
+		entries := make([]indexEntry, 0, len(files))
+		for path, file := range files {
+			entries = append(entries, indexEntry{Hash: file.Hash, Path: path, Mode: file.Mode})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+		return entries
+	})
+}
+
+func stageEntry(entries []indexEntry, entry indexEntry) []indexEntry {
+	for i := range entries {
+		if entries[i].Path == entry.Path {
+			entries[i] = entry
+			return entries
+		}
+	}
+	return append(entries, entry)
+}
+
+// indexTree returns the index as the tree a commit of it would record.
+func indexTree() (map[string]TreeEntry, error) {
+	entries, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]TreeEntry, len(entries))
+	for _, entry := range entries {
+		files[entry.Path] = TreeEntry{Path: entry.Path, Hash: entry.Hash, Mode: entry.Mode}
+	}
+	return files, nil
+}
+
+// pathspecFiles returns the files among candidates that the pathspecs
+// name, either directly or as a directory holding them, sorted. "." names
+// every file. A pathspec that names none of them is an error.
+func pathspecFiles(candidates map[string]TreeEntry, specs []string) ([]string, error) {
+	matched := make(map[string]bool)
+	for _, spec := range specs {
+		clean, err := cleanPathspec(spec)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for path := range candidates {
+			if clean == "." || path == clean || strings.HasPrefix(path, clean+"/") {
+				matched[path] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("pathspec '%s' did not match any files", spec)
+		}
+	}
+	files := make([]string, 0, len(matched))
+	for path := range matched {
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// cleanPathspec turns a path given on the command line into the form the
+// index uses, refusing paths outside the working tree.
+func cleanPathspec(spec string) (string, error) {
+	clean := filepath.ToSlash(filepath.Clean(spec))
+	if filepath.IsAbs(spec) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("'%s' is outside the repository", spec)
+	}
+	if first := strings.Split(clean, "/")[0]; strings.EqualFold(first, ".kommito") || strings.EqualFold(first, ".git") {
+		return "", fmt.Errorf("'%s' is inside the repository's metadata", spec)
+	}
+	return clean, nil
+}
@@ -4,32 +4,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
-type Config struct {
-	Name    string `json:"name"`
-	Version string `json:"version"`
+func InitRepo() error {
+	return initMetaDir(".kommito", false)
 }
 
-func InitRepo() error {
-	if err := os.MkdirAll(".kommito", 0755); err != nil {
-		return fmt.Errorf("failed to create .kommito directory: %w", err)
+// initMetaDir lays out an empty repository in dir. Bare repositories have no
+// index because nothing is ever staged in them.
+func initMetaDir(dir string, bare bool) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s directory: %w", dir, err)
 	}
 	dirs := []string{
-		".kommito/objects/commits",
-		".kommito/objects/blobs",
-		".kommito/refs/heads",
+		filepath.Join(dir, "objects", "commits"),
+		filepath.Join(dir, "objects", "blobs"),
+		filepath.Join(dir, "refs", "heads"),
 	}
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
 	}
-	if err := os.WriteFile(".kommito/HEAD", []byte("ref: refs/heads/main"), 0644); err != nil {
+	if err := os.WriteFile(filepath.Join(dir, "HEAD"), []byte("ref: refs/heads/main"), 0644); err != nil {
 		return fmt.Errorf("failed to create HEAD file: %w", err)
 	}
-	if err := os.WriteFile(".kommito/index", []byte{}, 0644); err != nil {
-		return fmt.Errorf("failed to create index file: %w", err)
+	if !bare {
+		if err := os.WriteFile(filepath.Join(dir, "index"), []byte{}, 0644); err != nil {
+			return fmt.Errorf("failed to create index file: %w", err)
+		}
 	}
 	config := Config{
 		Name:    "kommito",
@@ -39,7 +43,7 @@ func InitRepo() error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
-	if err := os.WriteFile(".kommito/config.json", configData, 0644); err != nil {
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), configData, 0644); err != nil {
 		return fmt.Errorf("failed to create config.json: %w", err)
 	}
 	return nil
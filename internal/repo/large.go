@@ -0,0 +1,495 @@
+package repo
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Files matching large.patterns are committed as a small pointer blob while
+// their content goes to .kommito/large/objects, a store outside the main
+// object database that can be fetched and pruned independently.
+const largePointerVersion = "version kommito-large/1"
+
+// LargePointer is the content of the blob committed in place of a large file.
+type LargePointer struct {
+	Oid  string
+	Size int64
+}
+
+func (p LargePointer) String() string {
+	return fmt.Sprintf("%s\noid sha1:%s\nsize %d\n", largePointerVersion, p.Oid, p.Size)
+}
+
+// parseLargePointer recognises pointer blobs. Anything else, including
+// ordinary files that merely look similar, returns ok == false.
+func parseLargePointer(data []byte) (LargePointer, bool) {
+	var pointer LargePointer
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || lines[0] != largePointerVersion {
+		return pointer, false
+	}
+	if !strings.HasPrefix(lines[1], "oid sha1:") || !strings.HasPrefix(lines[2], "size ") {
+		return pointer, false
+	}
+	pointer.Oid = strings.TrimPrefix(lines[1], "oid sha1:")
+	size, err := strconv.ParseInt(strings.TrimPrefix(lines[2], "size "), 10, 64)
+	if err != nil || !isObjectHash(pointer.Oid) {
+		return pointer, false
+	}
+	pointer.Size = size
+	return pointer, true
+}
+
+// maxPointerSize bounds how much of a blob is read to check for a pointer.
+const maxPointerSize = 200
+
+// readLargePointer returns the pointer stored in a blob, if it is one.
+func (s *ObjectStore) readLargePointer(hash string) (LargePointer, bool) {
+	size, err := s.Size(kindBlob, hash)
+	if err != nil || size > maxPointerSize {
+		return LargePointer{}, false
+	}
+	data, err := s.Read(kindBlob, hash)
+	if err != nil {
+		return LargePointer{}, false
+	}
+	return parseLargePointer(data)
+}
+
+// LargeTransfer moves large objects between the local cache and wherever
+// the team keeps them. New transports only need to implement this.
+type LargeTransfer interface {
+	Has(oid string) (bool, error)
+	Upload(oid string, r io.Reader) error
+	Download(oid string, w io.Writer) error
+}
+
+// dirLargeTransfer keeps large objects as plain files in a directory, such
+// as a network share.
+type dirLargeTransfer struct {
+	dir string
+}
+
+func (t *dirLargeTransfer) path(oid string) string {
+	return filepath.Join(t.dir, oid[:2], oid)
+}
+
+func (t *dirLargeTransfer) Has(oid string) (bool, error) {
+	_, err := os.Stat(t.path(oid))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (t *dirLargeTransfer) Upload(oid string, r io.Reader) error {
+	dst := t.path(oid)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp_"+oid+"_")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (t *dirLargeTransfer) Download(oid string, w io.Writer) error {
+	f, err := os.Open(t.path(oid))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// largeTransfer returns the transport configured in large.remote.
+func largeTransfer() (LargeTransfer, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	remote := cfg.Large.Remote
+	if remote == "" {
+		return nil, fmt.Errorf("no large.remote configured")
+	}
+	if strings.Contains(remote, "://") && !strings.HasPrefix(remote, "file://") {
+		return nil, fmt.Errorf("unsupported large.remote '%s'", remote)
+	}
+	return &dirLargeTransfer{dir: strings.TrimPrefix(remote, "file://")}, nil
+}
+
+func isLargeFile(filePath string) bool {
+	cfg, err := loadConfig()
+	if err != nil {
+		return false
+	}
+	slashed := filepath.ToSlash(filePath)
+	for _, pattern := range cfg.Large.Patterns {
+		if ok, _ := path.Match(pattern, slashed); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(slashed)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ObjectStore) largePath(oid string) string {
+	return filepath.Join(s.dir, "large", "objects", oid)
+}
+
+func (s *ObjectStore) hasLarge(oid string) bool {
+	_, err := os.Stat(s.largePath(oid))
+	return err == nil
+}
+
+// writeLarge streams r into the large-object cache and returns the pointer
+// describing it.
+func (s *ObjectStore) writeLarge(r io.Reader) (LargePointer, error) {
+	dir := filepath.Join(s.dir, "large", "objects")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return LargePointer{}, fmt.Errorf("failed to create large object directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp_large_")
+	if err != nil {
+		return LargePointer{}, fmt.Errorf("failed to create large object: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha1.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		tmp.Close()
+		return LargePointer{}, fmt.Errorf("failed to write large object: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return LargePointer{}, fmt.Errorf("failed to write large object: %w", err)
+	}
+	pointer := LargePointer{Oid: fmt.Sprintf("%x", h.Sum(nil)), Size: size}
+	if !s.hasLarge(pointer.Oid) {
+		if err := os.Rename(tmp.Name(), s.largePath(pointer.Oid)); err != nil {
+			return LargePointer{}, fmt.Errorf("failed to store large object: %w", err)
+		}
+	}
+	return pointer, nil
+}
+
+// fetchLarge downloads a large object into the cache through the
+// configured transfer.
+func (s *ObjectStore) fetchLarge(transfer LargeTransfer, oid string) error {
+	dir := filepath.Join(s.dir, "large", "objects")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp_large_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha1.New()
+	if err := transfer.Download(oid, io.MultiWriter(tmp, h)); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to download large object %s: %w", oid, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != oid {
+		return fmt.Errorf("large object %s is corrupt on the remote (hashes to %s)", oid, actual)
+	}
+	return os.Rename(tmp.Name(), s.largePath(oid))
+}
+
+// openWorktreeContent returns the content a blob should have in the working
+// tree: the blob itself, or the large object its pointer refers to, fetched
+// on demand when it is not cached yet.
+func (s *ObjectStore) openWorktreeContent(hash string) (io.ReadCloser, error) {
+	pointer, ok := s.readLargePointer(hash)
+	if !ok {
+		return s.Open(kindBlob, hash)
+	}
+	if !s.hasLarge(pointer.Oid) {
+		transfer, err := largeTransfer()
+		if err != nil {
+			return nil, fmt.Errorf("large object %s is not cached: %w", pointer.Oid, err)
+		}
+		if err := s.fetchLarge(transfer, pointer.Oid); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(s.largePath(pointer.Oid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open large object %s: %w", pointer.Oid, err)
+	}
+	return f, nil
+}
+
+// worktreeHash is the hash to compare a working file against: the blob
+// hash, or the large object id for pointer blobs.
+func (s *ObjectStore) worktreeHash(hash string) string {
+	if pointer, ok := s.readLargePointer(hash); ok {
+		return pointer.Oid
+	}
+	return hash
+}
+
+type LargeObject struct {
+	Path   string
+	Oid    string
+	Size   int64
+	Cached bool
+}
+
+// largeObjectsAt lists the pointers in a commit's tree, or in the index when
+// commitHash is empty.
+func largeObjectsAt(commitHash string) ([]LargeObject, error) {
+	objects := localObjects()
+	files := make(map[string]string)
+	if commitHash == "" {
+		entries, err := readIndex()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			files[entry.Path] = entry.Hash
+		}
+	} else {
+		commit, err := LoadCommit(commitHash)
+		if err != nil {
+			return nil, err
+		}
+		if files, err = commitFiles(commit); err != nil {
+			return nil, err
+		}
+	}
+
+	var large []LargeObject
+	for filePath, hash := range files {
+		pointer, ok := objects.readLargePointer(hash)
+		if !ok {
+			continue
+		}
+		large = append(large, LargeObject{
+			Path:   filePath,
+			Oid:    pointer.Oid,
+			Size:   pointer.Size,
+			Cached: objects.hasLarge(pointer.Oid),
+		})
+	}
+	sort.Slice(large, func(i, j int) bool { return large[i].Path < large[j].Path })
+	return large, nil
+}
+
+// ListLargeObjects lists the large files tracked at HEAD and in the index.
+func ListLargeObjects() ([]LargeObject, error) {
+	all, err := largeObjectsAt("")
+	if err != nil {
+		return nil, err
+	}
+	head, err := resolveHead()
+	if err != nil {
+		return nil, err
+	}
+	if head != "" {
+		atHead, err := largeObjectsAt(head)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[LargeObject]bool)
+		for _, object := range all {
+			seen[object] = true
+		}
+		for _, object := range atHead {
+			if !seen[object] {
+				all = append(all, object)
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Path < all[j].Path })
+	return all, nil
+}
+
+// FetchLargeObjects downloads every large object needed by HEAD and the
+// index that is not cached yet. It returns how many were downloaded.
+func FetchLargeObjects() (int, error) {
+	large, err := ListLargeObjects()
+	if err != nil {
+		return 0, err
+	}
+	objects := localObjects()
+	var transfer LargeTransfer
+	fetched := 0
+	for _, object := range large {
+		if object.Cached || objects.hasLarge(object.Oid) {
+			continue
+		}
+		if transfer == nil {
+			if transfer, err = largeTransfer(); err != nil {
+				return fetched, err
+			}
+		}
+		if err := objects.fetchLarge(transfer, object.Oid); err != nil {
+			return fetched, err
+		}
+		fetched++
+	}
+	return fetched, nil
+}
+
+// PushLargeObjects uploads every cached large object the remote lacks.
+func PushLargeObjects() (int, error) {
+	transfer, err := largeTransfer()
+	if err != nil {
+		return 0, err
+	}
+	oids, err := cachedLargeObjects()
+	if err != nil {
+		return 0, err
+	}
+	objects := localObjects()
+	pushed := 0
+	for _, oid := range oids {
+		has, err := transfer.Has(oid)
+		if err != nil {
+			return pushed, err
+		}
+		if has {
+			continue
+		}
+		f, err := os.Open(objects.largePath(oid))
+		if err != nil {
+			return pushed, err
+		}
+		err = transfer.Upload(oid, f)
+		f.Close()
+		if err != nil {
+			return pushed, fmt.Errorf("failed to upload large object %s: %w", oid, err)
+		}
+		pushed++
+	}
+	return pushed, nil
+}
+
+func cachedLargeObjects() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(repoDir(), "large", "objects"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list large objects: %w", err)
+	}
+	var oids []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isObjectHash(entry.Name()) {
+			oids = append(oids, entry.Name())
+		}
+	}
+	return oids, nil
+}
+
+// PruneLargeObjects removes cached large objects that neither HEAD nor the
+// index refers to. Objects the remote does not have yet are kept, so prune
+// never destroys the only copy.
+func PruneLargeObjects(dryRun bool) (int, int64, error) {
+	oids, err := cachedLargeObjects()
+	if err != nil {
+		return 0, 0, err
+	}
+	large, err := ListLargeObjects()
+	if err != nil {
+		return 0, 0, err
+	}
+	needed := make(map[string]bool)
+	for _, object := range large {
+		needed[object.Oid] = true
+	}
+
+	objects := localObjects()
+	var transfer LargeTransfer
+	removed := 0
+	var reclaimed int64
+	for _, oid := range oids {
+		if needed[oid] {
+			continue
+		}
+		if transfer == nil {
+			if transfer, err = largeTransfer(); err != nil {
+				return removed, reclaimed, fmt.Errorf("cannot confirm large objects are stored remotely: %w", err)
+			}
+		}
+		if has, err := transfer.Has(oid); err != nil || !has {
+			continue
+		}
+		info, err := os.Stat(objects.largePath(oid))
+		if err != nil {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(objects.largePath(oid)); err != nil {
+				return removed, reclaimed, fmt.Errorf("failed to remove large object %s: %w", oid, err)
+			}
+		}
+		removed++
+		reclaimed += info.Size()
+	}
+	return removed, reclaimed, nil
+}
+
+// VerifyLargeObjects checks every cached large object against its id and
+// reports pointers at HEAD or in the index whose content is missing.
+func VerifyLargeObjects() ([]string, error) {
+	var problems []string
+	objects := localObjects()
+	oids, err := cachedLargeObjects()
+	if err != nil {
+		return nil, err
+	}
+	for _, oid := range oids {
+		actual, err := hashFile(objects.largePath(oid))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: unreadable: %v", oid, err))
+		} else if actual != oid {
+			problems = append(problems, fmt.Sprintf("%s: content hashes to %s", oid, actual))
+		}
+	}
+
+	large, err := ListLargeObjects()
+	if err != nil {
+		return nil, err
+	}
+	transfer, _ := largeTransfer()
+	for _, object := range large {
+		if object.Cached {
+			if info, err := os.Stat(objects.largePath(object.Oid)); err == nil && info.Size() != object.Size {
+				problems = append(problems, fmt.Sprintf("%s: %s is %d bytes, pointer says %d", object.Path, object.Oid, info.Size(), object.Size))
+			}
+			continue
+		}
+		if transfer != nil {
+			if has, err := transfer.Has(object.Oid); err == nil && has {
+				continue
+			}
+		}
+		problems = append(problems, fmt.Sprintf("%s: large object %s is neither cached nor on the remote", object.Path, object.Oid))
+	}
+	return problems, nil
+}
@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// lockWait is how long we keep retrying a held lock before giving up,
+	// which lets parallel CI jobs queue up instead of failing immediately.
+	lockWait = 5 * time.Second
+	// staleLockAge is the age after which a lock is reported as abandoned.
+	staleLockAge = 10 * time.Minute
+)
+
+// LockError reports a .lock file that could not be acquired.
+type LockError struct {
+	Path  string
+	Owner string
+	Since time.Time
+	Stale bool
+}
+
+func (e *LockError) Error() string {
+	lockPath := e.Path + ".lock"
+	age := time.Since(e.Since).Round(time.Second)
+	if e.Stale {
+		return fmt.Sprintf("unable to lock %s: stale lock left by %s %s ago; if no kommito process is running, remove %s and retry",
+			e.Path, e.Owner, age, lockPath)
+	}
+	return fmt.Sprintf("unable to lock %s: held by %s for %s; another kommito command is still running, retry when it finishes",
+		e.Path, e.Owner, age)
+}
+
+// ErrRefChanged is returned when a compare-and-swap ref update finds a
+// different value than the caller expected.
+var ErrRefChanged = errors.New("ref changed concurrently")
+
+type lockFile struct {
+	path     string
+	lockPath string
+}
+
+// acquireLock creates path+".lock" with create-exclusive semantics. The
+// lock records its owner so a blocked process can say who holds it.
+func acquireLock(path string) (*lockFile, error) {
+	lockPath := path + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	deadline := time.Now().Add(lockWait)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			host, _ := os.Hostname()
+			fmt.Fprintf(f, "%d %s %d\n", os.Getpid(), host, time.Now().Unix())
+			if err := f.Close(); err != nil {
+				os.Remove(lockPath)
+				return nil, fmt.Errorf("failed to write lock %s: %w", lockPath, err)
+			}
+			return &lockFile{path: path, lockPath: lockPath}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock %s: %w", lockPath, err)
+		}
+
+		lockErr := describeLock(path)
+		if lockErr.Stale || time.Now().After(deadline) {
+			return nil, lockErr
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func describeLock(path string) *LockError {
+	lockErr := &LockError{Path: path, Owner: "an unknown process", Since: time.Now()}
+	lockPath := path + ".lock"
+	if info, err := os.Stat(lockPath); err == nil {
+		lockErr.Since = info.ModTime()
+	}
+	if data, err := os.ReadFile(lockPath); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) >= 2 {
+			lockErr.Owner = fmt.Sprintf("pid %s on %s", fields[0], fields[1])
+		}
+		if len(fields) >= 3 {
+			if secs, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+				lockErr.Since = time.Unix(secs, 0)
+			}
+		}
+	}
+	lockErr.Stale = time.Since(lockErr.Since) > staleLockAge
+	return lockErr
+}
+
+func (l *lockFile) release() error {
+	if err := os.Remove(l.lockPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to release lock %s: %w", l.lockPath, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the destination
+// directory and renames it into place, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, ".tmp_"+filepath.Base(path)+"_")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
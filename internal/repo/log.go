@@ -1,28 +1,755 @@
 package repo
 
 import (
-	"encoding/json"
+	"bufio"
+	"bytes"
+	"container/heap"
 	"fmt"
-	"io/ioutil"
-	"path/filepath"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 )
 
-func LogCommits() error {
-	headPath := filepath.Join(".kommito", "HEAD")
-	headData, err := ioutil.ReadFile(headPath)
+// LogOptions selects the commits Log shows and how it shows them.
+type LogOptions struct {
+	// Revisions are where the walk starts: names, "^name" to leave out a
+	// commit and its history, or "a..b". Empty means HEAD.
+	Revisions []string
+	// All starts from every branch, tag and remote-tracking branch too.
+	All bool
+	// MaxCount stops after this many commits; zero means no limit.
+	MaxCount int
+	// Since and Until keep commits made in that window; zero means open.
+	Since, Until time.Time
+	// Author and Grep are regular expressions the author and the message
+	// must match.
+	Author, Grep string
+	// Paths keeps only commits that change these files or directories.
+	Paths []string
+	// Format is "oneline", "medium" (the default) or a template of
+	// placeholders such as "%h %an %s", optionally prefixed with
+	// "format:" or "tformat:".
+	Format      string
+	Reverse     bool
+	FirstParent bool
+	// Patch and Stat add each commit's changes against its first parent.
+	Patch, Stat bool
+	// Graph draws the history beside the commits, in "ascii" or "unicode"
+	// lines; empty means no graph.
+	Graph string
+	// Color marks up hashes, ref names and graph lanes with ANSI colours.
+	Color bool
+}
+
+// Log writes the history reachable from opts.Revisions, newest first.
+func Log(w io.Writer, opts LogOptions) error {
+	if opts.Graph != "" && opts.Reverse {
+		return fmt.Errorf("--graph and --reverse cannot be used together")
+	}
+	store := localObjects()
+	tips, hidden, err := logRange(store, opts)
+	if err != nil {
+		return err
+	}
+	if len(tips) == 0 {
+		return fmt.Errorf("no commits yet")
+	}
+	var author, grep *regexp.Regexp
+	if opts.Author != "" {
+		if author, err = regexp.Compile(opts.Author); err != nil {
+			return fmt.Errorf("invalid --author pattern: %w", err)
+		}
+	}
+	if opts.Grep != "" {
+		if grep, err = regexp.Compile(opts.Grep); err != nil {
+			return fmt.Errorf("invalid --grep pattern: %w", err)
+		}
+	}
+	decorations, err := refDecorations(store)
 	if err != nil {
-		return fmt.Errorf("failed to read HEAD: %w", err)
+		return err
+	}
+	f := logFormatter{store: store, opts: opts, decorations: decorations, shallow: store.shallowCommits(), now: time.Now()}
+	switch f.format = strings.TrimPrefix(strings.TrimPrefix(opts.Format, "tformat:"), "format:"); f.format {
+	case "", "medium":
+		f.format = ""
+	case "oneline":
+		f.format = "%C(yellow)%h%C(reset)%d %s"
+	}
+
+	// Reversed and graph output need the whole selection first; the graph
+	// also needs the parents each commit was reached through.
+	collect := opts.Reverse || opts.Graph != ""
+	var selected []string
+	var parentsOf map[string][]string
+	if opts.Graph != "" {
+		parentsOf = make(map[string][]string)
+	}
+	bw := bufio.NewWriter(w)
+	shown := 0
+	err = walkLog(store, tips, hidden, opts.FirstParent, opts.Paths, func(hash string, commit *Commit, parents []string, changed bool) (bool, error) {
+		if parentsOf != nil {
+			parentsOf[hash] = parents
+		}
+		if !changed {
+			return true, nil
+		}
+		when := commitTime(commit)
+		if !opts.Since.IsZero() && when.Before(opts.Since) || !opts.Until.IsZero() && when.After(opts.Until) {
+			return true, nil
+		}
+		if author != nil && !author.MatchString(commit.Author) || grep != nil && !grep.MatchString(commit.Message) {
+			return true, nil
+		}
+		if collect {
+			selected = append(selected, hash)
+		} else if err := f.write(bw, hash, commit, shown == 0); err != nil {
+			return false, err
+		}
+		shown++
+		return opts.MaxCount <= 0 || shown < opts.MaxCount, nil
+	})
+	if err != nil {
+		return err
+	}
+	if opts.Graph != "" {
+		if err := f.writeGraph(bw, selected, parentsOf); err != nil {
+			return err
+		}
+	}
+	for i := len(selected) - 1; i >= 0 && opts.Reverse; i-- {
+		commit, err := store.LoadCommit(selected[i])
+		if err != nil {
+			return err
+		}
+		if err := f.write(bw, selected[i], commit, i == len(selected)-1); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeGraph draws the selected commits beside a graph of their history.
+// A commit's parents in the graph are its nearest selected ancestors, so
+// the lines stay connected across commits the filters left out, and the
+// commits are ordered so that each branch is drawn in one run.
+func (f *logFormatter) writeGraph(w io.Writer, selected []string, parentsOf map[string][]string) error {
+	shown := make(map[string]bool)
+	for _, hash := range selected {
+		shown[hash] = true
+	}
+	nearest := make(map[string][]string)
+	var ancestors func(hash string) []string
+	ancestors = func(hash string) []string {
+		if shown[hash] {
+			return []string{hash}
+		}
+		if found, ok := nearest[hash]; ok {
+			return found
+		}
+		nearest[hash] = nil
+		var found []string
+		for _, parent := range parentsOf[hash] {
+			found = appendUnique(found, ancestors(parent)...)
+		}
+		nearest[hash] = found
+		return found
+	}
+	parents := make(map[string][]string)
+	children := make(map[string]int)
+	for _, hash := range selected {
+		for _, parent := range parentsOf[hash] {
+			parents[hash] = appendUnique(parents[hash], ancestors(parent)...)
+		}
+		for _, parent := range parents[hash] {
+			children[parent]++
+		}
+	}
+
+	// A commit is drawn once all its children are. The last commit made
+	// ready is drawn next, which keeps to one branch until it meets
+	// another.
+	var ready []string
+	for i := len(selected) - 1; i >= 0; i-- {
+		if children[selected[i]] == 0 {
+			ready = append(ready, selected[i])
+		}
+	}
+	style := ASCIIGraph
+	if f.opts.Graph == "unicode" {
+		style = UnicodeGraph
+	}
+	graph := NewGraph(style, f.opts.Color)
+	first := true
+	for len(ready) > 0 {
+		hash := ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+		for _, parent := range parents[hash] {
+			if children[parent]--; children[parent] == 0 {
+				ready = append(ready, parent)
+			}
+		}
+		commit, err := f.store.LoadCommit(hash)
+		if err != nil {
+			return err
+		}
+		if !first && f.format == "" {
+			fmt.Fprintln(w, strings.TrimRight(graph.Padding(), " "))
+		}
+		var text bytes.Buffer
+		if err := f.write(&text, hash, commit, true); err != nil {
+			return err
+		}
+		first = false
+		rows := graph.Commit(hash, parents[hash])
+		lines := strings.Split(strings.TrimSuffix(text.String(), "\n"), "\n")
+		padding := graph.Padding()
+		for i := 0; i < max(len(lines), len(rows)); i++ {
+			prefix := padding
+			if i < len(rows) {
+				prefix = rows[i]
+			}
+			line := ""
+			if i < len(lines) {
+				line = lines[i]
+			}
+			fmt.Fprintln(w, strings.TrimRight(prefix+line, " "))
+		}
+	}
+	return nil
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		if !slices.Contains(list, item) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// logRange resolves where a log walk starts and the commits it must not
+// reach.
+func logRange(store *ObjectStore, opts LogOptions) ([]string, map[string]bool, error) {
+	var tips, excluded []string
+	include := func(rev string) error {
+		hash, err := resolveRevision(rev)
+		tips = append(tips, hash)
+		return err
+	}
+	exclude := func(rev string) error {
+		hash, err := resolveRevision(rev)
+		excluded = append(excluded, hash)
+		return err
+	}
+	for _, rev := range opts.Revisions {
+		var err error
+		switch {
+		case strings.HasPrefix(rev, "^"):
+			err = exclude(rev[1:])
+		case strings.Contains(rev, ".."):
+			from, to, _ := strings.Cut(rev, "..")
+			if from == "" {
+				from = "HEAD"
+			}
+			if to == "" {
+				to = "HEAD"
+			}
+			if err = exclude(from); err == nil {
+				err = include(to)
+			}
+		default:
+			err = include(rev)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.All {
+		refs, err := localRefs().list()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range sortedKeys(refs) {
+			if store.Has(kindCommit, refs[name]) {
+				tips = append(tips, refs[name])
+			}
+		}
 	}
-	commitHash := string(headData)
-	commitPath := filepath.Join(".kommito", "objects", "commits", commitHash)
-	commitData, err := ioutil.ReadFile(commitPath)
+	if len(tips) == 0 && (len(opts.Revisions) == 0 || opts.All) {
+		head, err := resolveHead()
+		if err != nil {
+			return nil, nil, err
+		}
+		if head != "" {
+			tips = append(tips, head)
+		}
+	}
+
+	hidden, err := reachableCommits(store, excluded)
 	if err != nil {
-		return fmt.Errorf("failed to read commit: %w", err)
+		return nil, nil, err
 	}
-	var commit Commit
-	if err := json.Unmarshal(commitData, &commit); err != nil {
-		return fmt.Errorf("failed to parse commit: %w", err)
+	return tips, hidden, nil
+}
+
+// walkLog visits the commits reachable from tips, newest first by commit
+// time, skipping hidden ones, with the parents the walk follows from each;
+// visit returns false to stop. Commits missing from a shallow clone end
+// the walk along their branch.
+//
+// With paths, changed reports whether a commit changes them. A commit whose
+// paths match one of its parents is unchanged, and only that parent is
+// followed, so a merge that took a file from one side hides the other
+// side's history of it, as in Git.
+func walkLog(store *ObjectStore, tips []string, hidden map[string]bool, firstParent bool, paths []string, visit func(hash string, commit *Commit, parents []string, changed bool) (bool, error)) error {
+	queue := &commitQueue{}
+	seen := make(map[string]bool)
+	push := func(hash string) error {
+		if seen[hash] || hidden[hash] || !store.Has(kindCommit, hash) {
+			return nil
+		}
+		seen[hash] = true
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return err
+		}
+		heap.Push(queue, queuedCommit{hash: hash, commit: commit, time: commitTime(commit), order: len(seen)})
+		return nil
+	}
+	for _, tip := range tips {
+		if err := push(tip); err != nil {
+			return err
+		}
+	}
+
+	selected := make(map[string]map[string]TreeEntry)
+	pathEntries := func(hash string, commit *Commit) (map[string]TreeEntry, error) {
+		if entries, ok := selected[hash]; ok {
+			return entries, nil
+		}
+		if commit == nil {
+			var err error
+			if commit, err = store.LoadCommit(hash); err != nil {
+				return nil, err
+			}
+		}
+		all, err := commitEntries(commit)
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[string]TreeEntry)
+		for path, entry := range all {
+			if matchesPaths(path, paths) {
+				entries[path] = entry
+			}
+		}
+		selected[hash] = entries
+		return entries, nil
+	}
+
+	for queue.Len() > 0 {
+		next := heap.Pop(queue).(queuedCommit)
+		parents := next.commit.Parents
+		if firstParent && len(parents) > 1 {
+			parents = parents[:1]
+		}
+		show := true
+		if len(paths) > 0 {
+			entries, err := pathEntries(next.hash, next.commit)
+			if err != nil {
+				return err
+			}
+			// A root commit, or the edge of a shallow clone, changes the
+			// paths if it has them at all.
+			show = len(entries) > 0
+			for _, parent := range parents {
+				if !store.Has(kindCommit, parent) {
+					continue
+				}
+				show = true
+				parentEntries, err := pathEntries(parent, nil)
+				if err != nil {
+					return err
+				}
+				if sameEntries(entries, parentEntries) {
+					show = false
+					parents = []string{parent}
+					break
+				}
+			}
+		}
+		for _, parent := range parents {
+			if err := push(parent); err != nil {
+				return err
+			}
+		}
+		more, err := visit(next.hash, next.commit, parents, show)
+		if err != nil || !more {
+			return err
+		}
 	}
-	fmt.Printf("🕐 Commit: %s\n📜 Message: %s\n👤 Author: %s\n🕰️ Date: %s\n", commitHash, commit.Message, commit.Author, commit.Timestamp)
 	return nil
 }
+
+func sameEntries(a, b map[string]TreeEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, entry := range a {
+		if b[path] != entry {
+			return false
+		}
+	}
+	return true
+}
+
+func commitTime(commit *Commit) time.Time {
+	t, _ := time.Parse(time.RFC3339, commit.Timestamp)
+	return t
+}
+
+type queuedCommit struct {
+	hash   string
+	commit *Commit
+	time   time.Time
+	order  int
+}
+
+// commitQueue hands out the newest commit first, and commits made at the
+// same time in the order they were found.
+type commitQueue []queuedCommit
+
+func (q commitQueue) Len() int { return len(q) }
+func (q commitQueue) Less(i, j int) bool {
+	if !q[i].time.Equal(q[j].time) {
+		return q[i].time.After(q[j].time)
+	}
+	return q[i].order < q[j].order
+}
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x any)   { *q = append(*q, x.(queuedCommit)) }
+func (q *commitQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// decoration is one ref name shown next to a commit, with the ANSI colour
+// it is shown in.
+type decoration struct {
+	Label string
+	Color string
+}
+
+// refDecorations lists the refs pointing at each commit the way Git
+// decorates log output: "HEAD -> main", other branches, remote-tracking
+// branches, then "tag: v1". Commits whose parents a shallow clone left
+// out are marked "grafted".
+func refDecorations(store *ObjectStore) (map[string][]decoration, error) {
+	refs := localRefs()
+	all, err := refs.list()
+	if err != nil {
+		return nil, err
+	}
+	head, err := resolveHead()
+	if err != nil {
+		return nil, err
+	}
+	headRef, _ := refs.headTarget()
+
+	decorations := make(map[string][]decoration)
+	if head != "" && headRef == "" {
+		decorations[head] = append(decorations[head], decoration{"HEAD", "1;36"})
+	}
+	names := sortedKeys(all)
+	for _, kind := range []struct{ prefix, label, color string }{
+		{"refs/heads/", "", "1;32"},
+		{"refs/remotes/", "", "1;31"},
+		{"refs/tags/", "tag: ", "1;33"},
+	} {
+		for _, name := range names {
+			if !strings.HasPrefix(name, kind.prefix) {
+				continue
+			}
+			hash := all[name]
+			label := kind.label + strings.TrimPrefix(name, kind.prefix)
+			if name == headRef {
+				decorations[hash] = append([]decoration{{"HEAD -> " + label, "1;36"}}, decorations[hash]...)
+				continue
+			}
+			decorations[hash] = append(decorations[hash], decoration{label, kind.color})
+		}
+	}
+	for _, hash := range store.shallowList() {
+		decorations[hash] = append(decorations[hash], decoration{"grafted", "1;34"})
+	}
+	return decorations, nil
+}
+
+// logFormatter writes commits in one log format.
+type logFormatter struct {
+	store       *ObjectStore
+	opts        LogOptions
+	decorations map[string][]decoration
+	shallow     map[string]bool
+	now         time.Time
+	// format is a placeholder template, or "" for the default format.
+	format string
+}
+
+func (f *logFormatter) write(w io.Writer, hash string, commit *Commit, first bool) error {
+	if f.format != "" {
+		fmt.Fprintln(w, f.expand(f.format, hash, commit))
+		if (f.opts.Stat || f.opts.Patch) && !f.oneline() {
+			fmt.Fprintln(w)
+		}
+	} else {
+		if !first {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "🕐 Commit: %s%s\n", f.paint(hash, "33"), f.decorate(hash, true))
+		if len(commit.Parents) > 1 {
+			var short []string
+			for _, parent := range commit.Parents {
+				short = append(short, parent[:7])
+			}
+			fmt.Fprintf(w, "🔀 Merge: %s\n", strings.Join(short, " "))
+		}
+		lines := strings.Split(strings.TrimRight(commit.Message, "\n"), "\n")
+		fmt.Fprintf(w, "📜 Message: %s\n", lines[0])
+		for _, line := range lines[1:] {
+			fmt.Fprintf(w, "   %s\n", line)
+		}
+		fmt.Fprintf(w, "👤 Author: %s\n🕰️ Date: %s\n", commit.Author, commit.Timestamp)
+		if f.shallow[hash] {
+			fmt.Fprintln(w, "🌱 Earlier history was not fetched (shallow clone)")
+		}
+		if f.opts.Stat || f.opts.Patch {
+			fmt.Fprintln(w)
+		}
+	}
+	if !f.opts.Stat && !f.opts.Patch || len(commit.Parents) > 1 {
+		return nil
+	}
+
+	pairs, err := commitDiffPairs(f.store, commit, f.opts.Paths)
+	if err != nil {
+		return err
+	}
+	if f.opts.Stat {
+		if err := writeDiffStat(w, f.store, pairs); err != nil {
+			return err
+		}
+		if f.opts.Patch && len(pairs) > 0 {
+			fmt.Fprintln(w)
+		}
+	}
+	if f.opts.Patch {
+		for _, pair := range pairs {
+			if err := writeFileDiff(w, f.store, pair[0], pair[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *logFormatter) oneline() bool {
+	return !strings.Contains(f.format, "%n") && !strings.Contains(f.format, "%b") && !strings.Contains(f.format, "%B")
+}
+
+// expand fills in a format template. Placeholders follow Git: %H and %h
+// for the commit hash, %T and %t for its tree, %P and %p for its parents,
+// %an, %ad, %ar, %ai, %as and %at for the author and date (%c… is the
+// same, as commits record one time), %s, %b and %B for the message, %d
+// and %D for decorations, %C(red) or %Cred for colours, %n for a newline
+// and %% for a percent sign. Anything else is copied as it is.
+func (f *logFormatter) expand(format, hash string, commit *Commit) string {
+	var b strings.Builder
+	subject, body, _ := strings.Cut(commit.Message, "\n")
+	body = strings.TrimLeft(body, "\n")
+	if body != "" && !strings.HasSuffix(body, "\n") {
+		body += "\n"
+	}
+	when := commitTime(commit)
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		code := format[i+1]
+		i++
+		switch code {
+		case '%':
+			b.WriteByte('%')
+		case 'n':
+			b.WriteByte('\n')
+		case 'H':
+			b.WriteString(hash)
+		case 'h':
+			b.WriteString(hash[:7])
+		case 'T':
+			b.WriteString(commit.Tree)
+		case 't':
+			if commit.Tree != "" {
+				b.WriteString(commit.Tree[:7])
+			}
+		case 'P', 'p':
+			parents := append([]string(nil), commit.Parents...)
+			if code == 'p' {
+				for j, parent := range parents {
+					parents[j] = parent[:7]
+				}
+			}
+			b.WriteString(strings.Join(parents, " "))
+		case 's':
+			b.WriteString(subject)
+		case 'b':
+			b.WriteString(body)
+		case 'B':
+			b.WriteString(commit.Message)
+		case 'd', 'D':
+			b.WriteString(f.decorate(hash, code == 'd'))
+		case 'C':
+			start, name := i+1, ""
+			if rest := format[i+1:]; strings.HasPrefix(rest, "(") && strings.Contains(rest, ")") {
+				name, _, _ = strings.Cut(rest[1:], ")")
+				i += len(name) + 2
+			} else {
+				for _, short := range []string{"red", "green", "blue", "reset"} {
+					if strings.HasPrefix(rest, short) {
+						name = short
+						i += len(short)
+						break
+					}
+				}
+			}
+			if code, ok := ansiColors[name]; ok && f.opts.Color {
+				b.WriteString("\x1b[" + code + "m")
+			} else if !ok {
+				b.WriteString("%C" + format[start:i+1])
+			}
+		case 'a', 'c':
+			if i+1 == len(format) {
+				b.WriteByte('%')
+				b.WriteByte(code)
+				continue
+			}
+			i++
+			switch format[i] {
+			case 'n':
+				b.WriteString(commit.Author)
+			case 'd':
+				b.WriteString(commit.Timestamp)
+			case 'r':
+				b.WriteString(relativeDate(when, f.now))
+			case 'i':
+				b.WriteString(when.Format("2006-01-02 15:04:05 -0700"))
+			case 's':
+				b.WriteString(when.Format("2006-01-02"))
+			case 't':
+				fmt.Fprintf(&b, "%d", when.Unix())
+			default:
+				b.WriteString(format[i-2 : i+1])
+			}
+		default:
+			b.WriteByte('%')
+			b.WriteByte(code)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// ansiColors are the colour names %C accepts.
+var ansiColors = map[string]string{
+	"reset": "", "bold": "1", "dim": "2", "red": "31", "green": "32", "yellow": "33",
+	"blue": "34", "magenta": "35", "cyan": "36", "white": "37",
+}
+
+// paint wraps s in an ANSI colour when colour is on.
+func (f *logFormatter) paint(s, color string) string {
+	if !f.opts.Color {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[m"
+}
+
+// decorate lists the refs at hash, in parentheses if parens is set.
+func (f *logFormatter) decorate(hash string, parens bool) string {
+	labels := f.decorations[hash]
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = f.paint(label.Label, label.Color)
+	}
+	if !parens {
+		return strings.Join(parts, ", ")
+	}
+	return " " + f.paint("(", "33") + strings.Join(parts, f.paint(", ", "33")) + f.paint(")", "33")
+}
+
+// relativeDate describes how long ago t was, as in "3 days ago".
+func relativeDate(t, now time.Time) string {
+	d := now.Sub(t)
+	if d < 0 {
+		return "in the future"
+	}
+	seconds := int(d.Seconds())
+	units := []struct {
+		name string
+		size int
+	}{
+		{"year", 365 * 24 * 3600},
+		{"month", 30 * 24 * 3600},
+		{"week", 7 * 24 * 3600},
+		{"day", 24 * 3600},
+		{"hour", 3600},
+		{"minute", 60},
+	}
+	for _, unit := range units {
+		if n := seconds / unit.size; n >= 1 && (unit.name != "week" || n < 5) {
+			return fmt.Sprintf("%d %s ago", n, plural(n, unit.name, unit.name+"s"))
+		}
+	}
+	return fmt.Sprintf("%d %s ago", seconds, plural(seconds, "second", "seconds"))
+}
+
+// commitDiffPairs returns the files a commit changed against its first
+// parent, or everything for a root commit, limited to paths. Blobs a
+// partial clone left out are fetched first.
+func commitDiffPairs(store *ObjectStore, commit *Commit, paths []string) ([][2]*diffFile, error) {
+	old := make(map[string]TreeEntry)
+	if len(commit.Parents) > 0 && store.Has(kindCommit, commit.Parents[0]) {
+		parent, err := store.LoadCommit(commit.Parents[0])
+		if err != nil {
+			return nil, err
+		}
+		if old, err = commitEntries(parent); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := commitEntries(commit)
+	if err != nil {
+		return nil, err
+	}
+	var pairs [][2]*diffFile
+	var needed []string
+	for _, pair := range treeDiffPairs(old, entries) {
+		if !matchesPaths(diffPath(pair), paths) {
+			continue
+		}
+		pairs = append(pairs, pair)
+		for _, file := range pair {
+			if file != nil {
+				needed = append(needed, file.Hash)
+			}
+		}
+	}
+	return pairs, store.prefetchBlobs(needed)
+}
@@ -1,11 +1,7 @@
 package repo
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
 )
 
 type fileEntry struct {
@@ -13,58 +9,67 @@ type fileEntry struct {
 	Path string
 }
 
-
 func LoadCommit(hash string) (*Commit, error) {
-	commitPath := filepath.Join(".kommito", "objects", "commits", hash)
-	data, err := os.ReadFile(commitPath)
+	commit, err := localObjects().LoadCommit(hash)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read commit object: %w", err)
 	}
-	var commit Commit
-	if err := json.Unmarshal(data, &commit); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal commit: %w", err)
-	}
-	return &commit, nil
+	return commit, nil
 }
 
-
-func getBlobToPathMap(commit *Commit) (map[string]string, error) {
-	indexPath := filepath.Join(".kommito", "index")
-	indexData, err := os.ReadFile(indexPath)
+// commitFiles maps every path in a commit to its blob.
+func commitFiles(commit *Commit) (map[string]string, error) {
+	entries, err := commitEntries(commit)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read index: %w", err)
+		return nil, err
 	}
-	blobToPath := make(map[string]string)
-	lines := string(indexData)
-	for _, line := range splitLines(lines) {
-		if line == "" {
-			continue
-		}
-		var hash, path string
-		fmt.Sscanf(line, "%s %s", &hash, &path)
-		blobToPath[hash] = path
+	files := make(map[string]string, len(entries))
+	for path, entry := range entries {
+		files[path] = entry.Hash
 	}
-	return blobToPath, nil
+	return files, nil
 }
 
-
-func splitLines(s string) []string {
-	var lines []string
-	start := 0
-	for i := range s {
-		if s[i] == '\n' {
-			lines = append(lines, s[start:i])
-			start = i + 1
+// commitEntries maps every path in a commit to its tree entry. Commits
+// written before trees existed fall back to the paths recorded in the
+// index.
+func commitEntries(commit *Commit) (map[string]TreeEntry, error) {
+	files := make(map[string]TreeEntry)
+	if commit.Tree != "" {
+		tree, err := localObjects().ReadTree(commit.Tree)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range tree.Entries {
+			files[entry.Path] = entry
 		}
+		return files, nil
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	byBlob := make(map[string]indexEntry)
+	for _, entry := range entries {
+		byBlob[entry.Hash] = entry
 	}
-	if start < len(s) {
-		lines = append(lines, s[start:])
+	for _, blob := range commit.Blobs {
+		if entry, ok := byBlob[blob]; ok {
+			files[entry.Path] = TreeEntry{Path: entry.Path, Hash: blob, Mode: entry.Mode}
+		}
 	}
-	return lines
+	return files, nil
 }
 
+// mergeTextLimit is the largest blob that merge will load into memory to
+// write conflict markers.
+const mergeTextLimit = 16 << 20
 
 func MergeBranches(targetBranch string) error {
+	if err := requireWorkTree(); err != nil {
+		return err
+	}
 	bm := NewBranchManager(".")
 	currentBranch, err := bm.GetCurrentBranch()
 	if err != nil {
@@ -81,66 +86,68 @@ func MergeBranches(targetBranch string) error {
 	if err != nil {
 		return err
 	}
-	currentCommit, err := LoadCommit(currentCommitHash)
+	return mergeCommits(currentCommitHash, targetBranch, targetCommitHash)
+}
+
+// mergeCommits merges target into the working tree and index, which hold
+// current, with a three-way merge against their merge base. Conflicted
+// files get markers labelled with targetName. MERGE_HEAD is recorded so
+// the next commit concludes the merge.
+func mergeCommits(currentCommitHash, targetName, targetCommitHash string) error {
+	if err := checkNothingInProgress(); err != nil {
+		return err
+	}
+	store := localObjects()
+	if upToDate, err := isAncestor(store, targetCommitHash, currentCommitHash); err != nil || upToDate {
+		if err == nil {
+			fmt.Println("Already up to date.")
+		}
+		return err
+	}
+	headFiles, err := revisionEntries(currentCommitHash)
 	if err != nil {
 		return err
 	}
-	targetCommit, err := LoadCommit(targetCommitHash)
+	staged, err := indexTree()
 	if err != nil {
 		return err
 	}
-	
-	blobToPath, err := getBlobToPathMap(currentCommit)
+	if !sameEntries(staged, headFiles) {
+		return fmt.Errorf("cannot merge with staged changes, commit them first")
+	}
+	base, err := mergeBase(store, currentCommitHash, targetCommitHash)
 	if err != nil {
 		return err
 	}
-	conflicts := []string{}
-	for _, targetBlob := range targetCommit.Blobs {
-		path, ok := blobToPath[targetBlob]
-		if !ok {
-			
-			blobPath := filepath.Join(".kommito", "objects", "blobs", targetBlob)
-			content, err := os.ReadFile(blobPath)
-			if err != nil {
-				return fmt.Errorf("failed to read blob: %w", err)
-			}
-			if err := ioutil.WriteFile(path, content, 0644); err != nil {
-				return fmt.Errorf("failed to write file: %w", err)
-			}
-			continue
-		}
-		
-		currentBlobPath := filepath.Join(".kommito", "objects", "blobs", targetBlob)
-		currentContent, _ := os.ReadFile(currentBlobPath)
-		targetBlobPath := filepath.Join(".kommito", "objects", "blobs", targetBlob)
-		targetContent, _ := os.ReadFile(targetBlobPath)
-		if string(currentContent) != string(targetContent) {
-			
-			conflictContent := []byte(
-				"<<<<<<< " + currentBranch + "\n" +
-				string(currentContent) +
-				"\n=======\n" +
-				string(targetContent) +
-				"\n>>>>>>> " + targetBranch + "\n")
-			if err := ioutil.WriteFile(path, conflictContent, 0644); err != nil {
-				return fmt.Errorf("failed to write conflict file: %w", err)
-			}
-			conflicts = append(conflicts, path)
-		} else {
-			
-			if err := ioutil.WriteFile(path, currentContent, 0644); err != nil {
-				return fmt.Errorf("failed to write file: %w", err)
-			}
+	baseFiles := map[string]TreeEntry{}
+	if base != "" {
+		if baseFiles, err = revisionEntries(base); err != nil {
+			return err
 		}
 	}
-	if len(conflicts) > 0 {
+	theirs, err := revisionEntries(targetCommitHash)
+	if err != nil {
+		return err
+	}
+	merge, _, err := applyChange(store, baseFiles, theirs, targetName)
+	if err != nil {
+		return err
+	}
+
+	// MERGE_HEAD makes the next commit record targetCommitHash as its
+	// second parent, so the merged history is not pushed as a divergence.
+	if err := writeFileAtomic(localRefs().path("MERGE_HEAD"), []byte(targetCommitHash), 0644); err != nil {
+		return fmt.Errorf("failed to record MERGE_HEAD: %w", err)
+	}
+	if len(merge.Conflicts) > 0 {
 		fmt.Println("Merge completed with conflicts in:")
-		for _, c := range conflicts {
+		for _, c := range merge.Conflicts {
 			fmt.Println("  ", c)
 		}
-		fmt.Println("Please resolve conflicts and commit.")
+		fmt.Println("Please resolve conflicts, add the files and commit.")
 	} else {
 		fmt.Println("Merge completed successfully. No conflicts detected.")
+		fmt.Println("The merged files are staged; commit to conclude the merge.")
 	}
 	return nil
-} 
\ No newline at end of file
+}
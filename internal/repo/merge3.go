@@ -0,0 +1,238 @@
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// mergeHunk is a change one side made to the base: lines [Start, End) of
+// the base replaced by Lines. An insertion has Start == End.
+type mergeHunk struct {
+	Start, End int
+	Lines      []string
+}
+
+// diffHunks groups an edit script from base to other into hunks.
+func diffHunks(base, other []string) []mergeHunk {
+	var hunks []mergeHunk
+	var open *mergeHunk
+	for _, op := range diffLines(base, other) {
+		if op.Kind == ' ' {
+			open = nil
+			continue
+		}
+		if open == nil {
+			hunks = append(hunks, mergeHunk{Start: op.A, End: op.A})
+			open = &hunks[len(hunks)-1]
+		}
+		if op.Kind == '-' {
+			open.End = op.A + 1
+		} else {
+			open.Lines = append(open.Lines, other[op.B])
+		}
+	}
+	return hunks
+}
+
+// mergeLines merges the changes ours and theirs made to base. Changes to
+// separate parts of the base are both taken; changes to the same or
+// adjacent lines conflict unless they are identical, and are written
+// between conflict markers labelled with the two sides. It reports
+// whether the merge was clean.
+func mergeLines(base, ours, theirs []string, oursLabel, theirsLabel string) ([]string, bool) {
+	a, b := diffHunks(base, ours), diffHunks(base, theirs)
+	var merged []string
+	clean := true
+	pos := 0
+	for len(a) > 0 || len(b) > 0 {
+		// Start a region at the first hunk and grow it while a hunk from
+		// either side touches it.
+		var start, end int
+		if len(b) == 0 || (len(a) > 0 && a[0].Start <= b[0].Start) {
+			start, end = a[0].Start, a[0].End
+		} else {
+			start, end = b[0].Start, b[0].End
+		}
+		var fromA, fromB []mergeHunk
+		for grown := true; grown; {
+			grown = false
+			if len(a) > 0 && a[0].Start <= end {
+				end = max(end, a[0].End)
+				fromA, a = append(fromA, a[0]), a[1:]
+				grown = true
+			}
+			if len(b) > 0 && b[0].Start <= end {
+				end = max(end, b[0].End)
+				fromB, b = append(fromB, b[0]), b[1:]
+				grown = true
+			}
+		}
+
+		merged = append(merged, base[pos:start]...)
+		pos = end
+		oursSide := applyHunks(base, start, end, fromA)
+		theirsSide := applyHunks(base, start, end, fromB)
+		switch {
+		case len(fromB) == 0:
+			merged = append(merged, oursSide...)
+		case len(fromA) == 0, slices.Equal(oursSide, theirsSide):
+			merged = append(merged, theirsSide...)
+		default:
+			clean = false
+			merged = append(merged, "<<<<<<< "+oursLabel+"\n")
+			merged = append(merged, withFinalNewline(oursSide)...)
+			merged = append(merged, "=======\n")
+			merged = append(merged, withFinalNewline(theirsSide)...)
+			merged = append(merged, ">>>>>>> "+theirsLabel+"\n")
+		}
+	}
+	return append(merged, base[pos:]...), clean
+}
+
+// applyHunks returns lines [start, end) of base with hunks applied.
+func applyHunks(base []string, start, end int, hunks []mergeHunk) []string {
+	var lines []string
+	pos := start
+	for _, h := range hunks {
+		lines = append(lines, base[pos:h.Start]...)
+		lines = append(lines, h.Lines...)
+		pos = h.End
+	}
+	return append(lines, base[pos:end]...)
+}
+
+// withFinalNewline ends the last line with a newline, so a conflict marker
+// after it starts a line of its own.
+func withFinalNewline(lines []string) []string {
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines = append(lines[:n-1:n-1], lines[n-1]+"\n")
+	}
+	return lines
+}
+
+// treeMerge is the outcome of merging two trees against a base.
+type treeMerge struct {
+	// Index is the merged tree. A conflicted file keeps our version.
+	Index map[string]TreeEntry
+	// Worktree is what to write for the conflicted files: the content
+	// with conflict markers, or the version that was modified when the
+	// other side deleted the file.
+	Worktree map[string]TreeEntry
+	// Conflicts describes each conflicted file.
+	Conflicts []string
+	// Paths are the conflicted files.
+	Paths []string
+}
+
+// mergeTrees merges the changes ours and theirs made to base, file by file
+// and, for files both changed, line by line. Binary files and symlinks
+// changed on both sides conflict and keep our version.
+func mergeTrees(store *ObjectStore, base, ours, theirs map[string]TreeEntry, oursLabel, theirsLabel string) (*treeMerge, error) {
+	paths := make(map[string]bool)
+	for _, files := range []map[string]TreeEntry{base, ours, theirs} {
+		for path := range files {
+			paths[path] = true
+		}
+	}
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	var needed []string
+	for _, path := range sorted {
+		if ours[path] != theirs[path] && ours[path] != base[path] && theirs[path] != base[path] {
+			needed = append(needed, base[path].Hash, ours[path].Hash, theirs[path].Hash)
+		}
+	}
+	if err := store.prefetchBlobs(needed); err != nil {
+		return nil, err
+	}
+
+	result := &treeMerge{Index: make(map[string]TreeEntry), Worktree: make(map[string]TreeEntry)}
+	conflict := func(path, why string, worktree TreeEntry) {
+		result.Conflicts = append(result.Conflicts, fmt.Sprintf("%s (%s)", path, why))
+		result.Paths = append(result.Paths, path)
+		if worktree.Hash != "" {
+			result.Worktree[path] = worktree
+		}
+	}
+	for _, path := range sorted {
+		b, inBase := base[path]
+		o, inOurs := ours[path]
+		t, inTheirs := theirs[path]
+		switch {
+		case inOurs == inTheirs && o == t, inBase == inTheirs && b == t:
+			if inOurs {
+				result.Index[path] = o
+			}
+			continue
+		case inBase == inOurs && b == o:
+			if inTheirs {
+				result.Index[path] = t
+			}
+			continue
+		case !inOurs:
+			conflict(path, "deleted by us, modified by them", t)
+			continue
+		case !inTheirs:
+			result.Index[path] = o
+			conflict(path, "modified by us, deleted by them", TreeEntry{})
+			continue
+		}
+
+		result.Index[path] = o
+		merged := TreeEntry{Path: path, Hash: o.Hash, Mode: o.Mode}
+		switch {
+		case o.Mode == t.Mode, t.Mode == b.Mode && inBase:
+		case o.Mode == b.Mode && inBase:
+			merged.Mode = t.Mode
+		default:
+			conflict(path, "mode changed on both sides, kept ours", TreeEntry{})
+			continue
+		}
+		switch {
+		case o.Hash == t.Hash, t.Hash == b.Hash && inBase:
+		case o.Hash == b.Hash && inBase:
+			merged.Hash = t.Hash
+		case o.Mode == modeSymlink || t.Mode == modeSymlink:
+			conflict(path, "symlink changed on both sides, kept ours", TreeEntry{})
+			continue
+		default:
+			var sides [3][]string
+			binary := false
+			for i, entry := range []TreeEntry{b, o, t} {
+				if entry.Hash == "" {
+					continue
+				}
+				content, isBinary, err := diffContent(store, &diffFile{Path: path, Hash: entry.Hash, Mode: entry.Mode})
+				if err != nil {
+					return nil, err
+				}
+				binary = binary || isBinary
+				sides[i] = splitLines(content)
+			}
+			if binary {
+				conflict(path, "binary, kept ours", TreeEntry{})
+				continue
+			}
+			lines, clean := mergeLines(sides[0], sides[1], sides[2], oursLabel, theirsLabel)
+			content := []byte(strings.Join(lines, ""))
+			hash, err := store.writeContent(path, bytes.NewReader(content), int64(len(content)))
+			if err != nil {
+				return nil, err
+			}
+			merged.Hash = hash
+			if !clean {
+				conflict(path, "content", merged)
+				continue
+			}
+		}
+		result.Index[path] = merged
+	}
+	return result, nil
+}
@@ -0,0 +1,147 @@
+package repo
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// lines splits text the way merged files are, keeping each newline.
+func textLines(text string) []string {
+	return splitLines([]byte(text))
+}
+
+func TestMergeLines(t *testing.T) {
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		want               string
+		clean              bool
+	}{
+		{
+			name:   "separate edits",
+			base:   "a\nb\nc\nd\ne\n",
+			ours:   "A\nb\nc\nd\ne\n",
+			theirs: "a\nb\nc\nd\nE\n",
+			want:   "A\nb\nc\nd\nE\n",
+			clean:  true,
+		},
+		{
+			name:   "adjacent edits",
+			base:   "a\nb\nc\n",
+			ours:   "A\nb\nc\n",
+			theirs: "a\nB\nc\n",
+			want:   "<<<<<<< ours\nA\nb\n=======\na\nB\n>>>>>>> theirs\nc\n",
+		},
+		{
+			name:   "identical edits",
+			base:   "a\nb\nc\n",
+			ours:   "a\nB\nc\n",
+			theirs: "a\nB\nc\n",
+			want:   "a\nB\nc\n",
+			clean:  true,
+		},
+		{
+			name:   "one side only",
+			base:   "a\nb\n",
+			ours:   "a\nb\n",
+			theirs: "a\nx\nb\n",
+			want:   "a\nx\nb\n",
+			clean:  true,
+		},
+		{
+			name:   "insertions at end of file",
+			base:   "a\nb\n",
+			ours:   "a\nb\nours\n",
+			theirs: "a\nb\ntheirs\n",
+			want:   "a\nb\n<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs\n",
+		},
+		{
+			name:   "same insertion at end of file",
+			base:   "a\nb\n",
+			ours:   "a\nb\nc\n",
+			theirs: "a\nb\nc\n",
+			want:   "a\nb\nc\n",
+			clean:  true,
+		},
+		{
+			name:   "delete against modify",
+			base:   "a\nb\nc\n",
+			ours:   "a\nc\n",
+			theirs: "a\nB\nc\n",
+			want:   "a\n<<<<<<< ours\n=======\nB\n>>>>>>> theirs\nc\n",
+		},
+		{
+			name:   "delete against separate modify",
+			base:   "a\nb\nc\nd\n",
+			ours:   "b\nc\nd\n",
+			theirs: "a\nb\nc\nD\n",
+			want:   "b\nc\nD\n",
+			clean:  true,
+		},
+		{
+			name:   "missing final newline",
+			base:   "a\nb",
+			ours:   "a\nB",
+			theirs: "a\nb\nc",
+			want:   "a\n<<<<<<< ours\nB\n=======\nb\nc\n>>>>>>> theirs\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, clean := mergeLines(textLines(tt.base), textLines(tt.ours), textLines(tt.theirs), "ours", "theirs")
+			if got := strings.Join(merged, ""); got != tt.want || clean != tt.clean {
+				t.Errorf("merged (clean %v):\n%s\nwant (clean %v):\n%s", clean, got, tt.clean, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeTrees(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := InitRepo(); err != nil {
+		t.Fatal(err)
+	}
+	store := localObjects()
+	file := func(path, content string) TreeEntry {
+		hash, err := store.Write(kindBlob, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return TreeEntry{Path: path, Hash: hash, Mode: modeRegular}
+	}
+	tree := func(entries ...TreeEntry) map[string]TreeEntry {
+		files := make(map[string]TreeEntry)
+		for _, entry := range entries {
+			files[entry.Path] = entry
+		}
+		return files
+	}
+
+	base := tree(file("both", "a\nb\nc\n"), file("gone", "x\n"), file("kept", "k\n"))
+	ours := tree(file("both", "A\nb\nc\n"), file("kept", "k\n"), file("new", "n\n"))
+	theirs := tree(file("both", "a\nb\nC\n"), file("gone", "y\n"), file("kept", "k\n"))
+	merge, err := mergeTrees(store, base, ours, theirs, "ours", "theirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"gone"}; !slices.Equal(merge.Paths, want) {
+		t.Fatalf("conflicts %v, want %v", merge.Paths, want)
+	}
+	if want := "gone (deleted by us, modified by them)"; merge.Conflicts[0] != want {
+		t.Errorf("conflict %q, want %q", merge.Conflicts[0], want)
+	}
+	if merge.Worktree["gone"] != theirs["gone"] {
+		t.Errorf("worktree keeps %v, want their version", merge.Worktree["gone"])
+	}
+	if want := file("both", "A\nb\nC\n"); merge.Index["both"] != want {
+		t.Errorf("both merged to %v, want %v", merge.Index["both"], want)
+	}
+	if merge.Index["new"] != ours["new"] || merge.Index["kept"] != base["kept"] {
+		t.Errorf("index %v lost a file one side left alone", merge.Index)
+	}
+	if _, ok := merge.Index["gone"]; ok {
+		t.Errorf("index keeps the file we deleted")
+	}
+}
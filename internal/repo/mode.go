@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// File modes use Git's notation. Trees and the index leave the mode of a
+// regular file empty, so trees written before modes were recorded keep
+// their hashes. A symlink is stored as a blob holding its target.
+const (
+	modeRegular    = "100644"
+	modeExecutable = "100755"
+	modeSymlink    = "120000"
+)
+
+// storedMode returns mode the way trees and the index record it.
+func storedMode(mode string) string {
+	if mode == modeRegular {
+		return ""
+	}
+	return mode
+}
+
+// displayMode returns mode in full, for output.
+func displayMode(mode string) string {
+	if mode == "" {
+		return modeRegular
+	}
+	return mode
+}
+
+func isFileMode(mode string) bool {
+	switch mode {
+	case "", modeRegular, modeExecutable, modeSymlink:
+		return true
+	}
+	return false
+}
+
+// fileModeEnabled reports core.fileMode: whether the executable bit and
+// symlinks in the working tree are meaningful. It is on unless turned off
+// for a filesystem that cannot represent them.
+func fileModeEnabled() bool {
+	cfg, err := loadConfig()
+	return err != nil || cfg.Core.FileMode == nil || *cfg.Core.FileMode
+}
+
+// worktreeMode returns the mode to record for a file in the working tree.
+// With core.fileMode off the executable bit is not trusted, so a regular
+// file keeps the mode it was recorded with.
+func worktreeMode(info os.FileInfo, recorded string, fileMode bool) string {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return modeSymlink
+	case !fileMode:
+		return storedMode(recorded)
+	case info.Mode().Perm()&0111 != 0:
+		return modeExecutable
+	}
+	return ""
+}
+
+// hashWorktreeFile returns the blob hash and mode of a file in the working
+// tree, without following it if it is a symlink.
+func hashWorktreeFile(path, recorded string, fileMode bool) (string, string, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", "", err
+	}
+	mode := worktreeMode(info, recorded, fileMode)
+	if info.Mode()&os.ModeSymlink == 0 {
+		hash, err := hashFile(path)
+		return hash, mode, err
+	}
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(target))), mode, nil
+}
+
+// checkoutEntry writes a tree entry to path with its mode. A regular file
+// keeps the permissions of the file it replaces apart from the executable
+// bit; with core.fileMode off it keeps them entirely, and a symlink is
+// written as a file holding its target.
+func (s *ObjectStore) checkoutEntry(entry TreeEntry, path string, fileMode bool) error {
+	perm := os.FileMode(0644)
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode().IsRegular() {
+		perm = info.Mode().Perm()
+	}
+	if !fileMode || entry.Mode != modeSymlink {
+		if fileMode {
+			perm &^= 0111
+			if entry.Mode == modeExecutable {
+				perm |= (perm & 0444) >> 2
+			}
+		}
+		return s.checkoutObject(entry.Hash, path, perm)
+	}
+
+	target, err := s.Read(kindBlob, entry.Hash)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+	}
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".kommito_tmp_link_%d", os.Getpid()))
+	os.Remove(tmp)
+	if err := os.Symlink(string(target), tmp); err != nil {
+		return fmt.Errorf("failed to create symlink %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
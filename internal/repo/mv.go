@@ -0,0 +1,118 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileMove is a tracked file MoveFiles renamed.
+type FileMove struct {
+	From, To string
+}
+
+// MoveFiles renames each source, a tracked file or a directory of them, to
+// dst in the working tree and the index. When dst is an existing directory
+// the sources are moved into it, which is required for more than one.
+// Every move is checked before any is made, and the ones made are undone
+// if a later one fails.
+func MoveFiles(sources []string, dst string) ([]FileMove, error) {
+	if err := requireWorkTree(); err != nil {
+		return nil, err
+	}
+	staged, err := indexTree()
+	if err != nil {
+		return nil, err
+	}
+	dst, err = cleanPathspec(dst)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filepath.FromSlash(dst))
+	intoDir := err == nil && info.IsDir()
+	if len(sources) > 1 && !intoDir {
+		return nil, fmt.Errorf("destination '%s' is not a directory", dst)
+	}
+
+	var moves []FileMove
+	renamed := make(map[string]string)
+	for _, source := range sources {
+		src, err := cleanPathspec(source)
+		if err != nil {
+			return nil, err
+		}
+		target := dst
+		if intoDir {
+			target = path.Join(dst, path.Base(src))
+		}
+		if src == "." || target == src || strings.HasPrefix(target, src+"/") {
+			return nil, fmt.Errorf("cannot move '%s' into itself", source)
+		}
+		if _, err := os.Lstat(filepath.FromSlash(src)); err != nil {
+			return nil, fmt.Errorf("cannot move '%s': %w", source, err)
+		}
+		if _, err := os.Lstat(filepath.FromSlash(target)); err == nil {
+			return nil, fmt.Errorf("destination '%s' already exists", target)
+		}
+		tracked := false
+		for file := range staged {
+			if file == src || strings.HasPrefix(file, src+"/") {
+				renamed[file] = target + strings.TrimPrefix(file, src)
+				tracked = true
+			}
+		}
+		if !tracked {
+			return nil, fmt.Errorf("'%s' is not tracked", source)
+		}
+		moves = append(moves, FileMove{From: src, To: target})
+	}
+	for from, to := range renamed {
+		if _, ok := staged[to]; ok && renamed[to] == "" {
+			return nil, fmt.Errorf("cannot move '%s' over tracked file '%s'", from, to)
+		}
+	}
+
+	var done []FileMove
+	undo := func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			os.Rename(filepath.FromSlash(done[i].To), filepath.FromSlash(done[i].From))
+		}
+	}
+	for _, move := range moves {
+		to := filepath.FromSlash(move.To)
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			undo()
+			return nil, fmt.Errorf("failed to create directory for %s: %w", move.To, err)
+		}
+		if err := os.Rename(filepath.FromSlash(move.From), to); err != nil {
+			undo()
+			return nil, fmt.Errorf("failed to move %s: %w", move.From, err)
+		}
+		done = append(done, move)
+	}
+	err = updateIndex(func(entries []indexEntry) []indexEntry {
+		for i, entry := range entries {
+			if to, ok := renamed[entry.Path]; ok {
+				entries[i].Path = to
+			}
+		}
+		return entries
+	})
+	if err != nil {
+		undo()
+		return nil, err
+	}
+	for _, move := range moves {
+		pruneEmptyDirs(filepath.Dir(filepath.FromSlash(move.From)))
+	}
+
+	files := make([]FileMove, 0, len(renamed))
+	for from, to := range renamed {
+		files = append(files, FileMove{From: from, To: to})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].From < files[j].From })
+	return files, nil
+}
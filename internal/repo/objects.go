@@ -0,0 +1,280 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Object kinds double as the directory names under .kommito/objects.
+const (
+	kindBlob   = "blobs"
+	kindCommit = "commits"
+	kindTree   = "trees"
+)
+
+// ObjectStore gives access to the content-addressed objects of the
+// repository whose metadata lives in dir (normally ".kommito").
+type ObjectStore struct {
+	dir string
+	// shallow caches the shallow file; see shallowCommits.
+	shallow map[string]bool
+}
+
+func NewObjectStore(dir string) *ObjectStore {
+	return &ObjectStore{dir: dir}
+}
+
+func localObjects() *ObjectStore {
+	return NewObjectStore(repoDir())
+}
+
+func (s *ObjectStore) path(kind, hash string) string {
+	return filepath.Join(s.dir, "objects", kind, hash)
+}
+
+// Has reports whether an object is stored. A blob counts as stored when
+// either the plain blob or its chunk manifest is present.
+func (s *ObjectStore) Has(kind, hash string) bool {
+	if _, err := os.Stat(s.path(kind, hash)); err == nil {
+		return true
+	}
+	return kind == kindBlob && s.isChunked(hash)
+}
+
+// Size returns the content size of an object without reading it.
+func (s *ObjectStore) Size(kind, hash string) (int64, error) {
+	info, err := os.Stat(s.path(kind, hash))
+	if err != nil {
+		if kind == kindBlob && s.isChunked(hash) {
+			manifest, err := s.ReadManifest(hash)
+			if err != nil {
+				return 0, err
+			}
+			return manifest.Size, nil
+		}
+		if kind == kindBlob {
+			if tried, fetchErr := s.fetchPromisedBlob(hash, err); tried {
+				if fetchErr != nil {
+					return 0, fetchErr
+				}
+				return s.Size(kind, hash)
+			}
+		}
+		return 0, fmt.Errorf("failed to stat %s %s: %w", kind, hash, err)
+	}
+	return info.Size(), nil
+}
+
+// Open streams an object. Chunked blobs are reassembled transparently, and
+// blobs left out of a partial clone are fetched from the promisor remote.
+func (s *ObjectStore) Open(kind, hash string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(kind, hash))
+	if err != nil {
+		if kind == kindBlob && s.isChunked(hash) {
+			manifest, err := s.ReadManifest(hash)
+			if err != nil {
+				return nil, err
+			}
+			return &chunkReader{store: s, chunks: manifest.Chunks}, nil
+		}
+		if kind == kindBlob {
+			if tried, fetchErr := s.fetchPromisedBlob(hash, err); tried {
+				if fetchErr != nil {
+					return nil, fetchErr
+				}
+				return s.Open(kind, hash)
+			}
+		}
+		return nil, fmt.Errorf("failed to open %s %s: %w", kind, hash, err)
+	}
+	return f, nil
+}
+
+func (s *ObjectStore) Read(kind, hash string) ([]byte, error) {
+	r, err := s.Open(kind, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s %s: %w", kind, hash, err)
+	}
+	return data, nil
+}
+
+func (s *ObjectStore) Write(kind string, data []byte) (string, error) {
+	hash, _, err := s.WriteStream(kind, bytes.NewReader(data))
+	return hash, err
+}
+
+// WriteStream hashes and stores an object in a single pass: the content is
+// copied into a temporary file while it is hashed, and the file is renamed
+// to its hash once complete. Memory use is independent of the object size.
+func (s *ObjectStore) WriteStream(kind string, r io.Reader) (string, int64, error) {
+	dir := filepath.Join(s.dir, "objects", kind)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create object directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp_obj_")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create temporary object: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	h := sha1.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		tmp.Close()
+		return "", 0, fmt.Errorf("failed to write object: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", 0, fmt.Errorf("failed to sync object: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, fmt.Errorf("failed to close object: %w", err)
+	}
+
+	hash := fmt.Sprintf("%x", h.Sum(nil))
+	objectPath := s.path(kind, hash)
+	if freshen(objectPath) {
+		return hash, size, nil
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return "", 0, fmt.Errorf("failed to write object: %w", err)
+	}
+	if err := os.Rename(tmpPath, objectPath); err != nil {
+		return "", 0, fmt.Errorf("failed to store object: %w", err)
+	}
+	return hash, size, nil
+}
+
+// freshen renews the modification time of an object file that is already
+// stored and reports whether there was one. Prune spares recent objects, so
+// an unreachable object written again is kept until whatever refers to it
+// is recorded.
+func freshen(path string) bool {
+	now := time.Now()
+	return os.Chtimes(path, now, now) == nil
+}
+
+// CopyTo streams an object into w.
+func (s *ObjectStore) CopyTo(kind, hash string, w io.Writer) (int64, error) {
+	r, err := s.Open(kind, hash)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(w, r)
+}
+
+type TreeEntry struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	// Mode is modeExecutable or modeSymlink, or empty for a regular file.
+	Mode string `json:"mode,omitempty"`
+}
+
+// Tree records the full path of every file in a commit, sorted by path.
+type Tree struct {
+	Entries []TreeEntry `json:"entries"`
+}
+
+func (s *ObjectStore) WriteTree(entries []TreeEntry) (string, error) {
+	sorted := append([]TreeEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+	data, err := json.MarshalIndent(Tree{Entries: sorted}, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal tree: %w", err)
+	}
+	return s.Write(kindTree, data)
+}
+
+func (s *ObjectStore) ReadTree(hash string) (*Tree, error) {
+	data, err := s.Read(kindTree, hash)
+	if err != nil {
+		return nil, err
+	}
+	var tree Tree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tree %s: %w", hash, err)
+	}
+	return &tree, nil
+}
+
+// LoadCommit reads a commit as history walks see it: the commits at the
+// boundary of a shallow clone have no parents.
+func (s *ObjectStore) LoadCommit(hash string) (*Commit, error) {
+	commit, err := s.readCommit(hash)
+	if err != nil {
+		return nil, err
+	}
+	if s.isShallow(hash) {
+		commit.Parents = nil
+	}
+	return commit, nil
+}
+
+// readCommit reads a commit exactly as stored.
+func (s *ObjectStore) readCommit(hash string) (*Commit, error) {
+	data, err := s.Read(kindCommit, hash)
+	if err != nil {
+		return nil, err
+	}
+	var commit Commit
+	if err := json.Unmarshal(data, &commit); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal commit: %w", err)
+	}
+	return &commit, nil
+}
+
+// checkoutObject streams a blob into path through a temporary file in the
+// same directory, creating parent directories as needed. Large-object
+// pointers are replaced by the content they refer to.
+func (s *ObjectStore) checkoutObject(hash, path string, perm os.FileMode) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".kommito_tmp_")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	tmpPath := tmp.Name()
+	content, err := s.openWorktreeContent(hash)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	_, err = io.Copy(tmp, content)
+	content.Close()
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
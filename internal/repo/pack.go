@@ -0,0 +1,206 @@
+package repo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A pack streams objects between repositories over a connection:
+//
+//	KPACK 1
+//	<kind> <hash> <size>
+//	<size bytes of raw object>
+//	...
+//	end <count>
+//
+// Objects are written in transferOrder, so a receiver that stops half-way
+// never stores a commit without its history. The trailer catches truncated
+// streams; every object except a manifest is verified against its hash.
+const packHeader = "KPACK 1"
+
+// writePack streams the given objects from src to w.
+func writePack(w io.Writer, src *ObjectStore, refs []objectRef) error {
+	ordered, err := transferOrder(src, refs)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, packHeader)
+	for _, ref := range ordered {
+		if err := writePackEntry(bw, src, ref); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(bw, "end %d\n", len(ordered))
+	return bw.Flush()
+}
+
+func writePackEntry(w io.Writer, src *ObjectStore, ref objectRef) error {
+	f, err := os.Open(src.path(ref.Kind, ref.Hash))
+	if err != nil {
+		return fmt.Errorf("failed to read %s %s: %w", strings.TrimSuffix(ref.Kind, "s"), ref.Hash, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s %s %d\n", ref.Kind, ref.Hash, info.Size())
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return err
+	}
+	if n != info.Size() {
+		return fmt.Errorf("%s %s changed while it was being sent", strings.TrimSuffix(ref.Kind, "s"), ref.Hash)
+	}
+	return nil
+}
+
+// readPack stores every object of a pack in dst and returns how many were
+// received.
+func readPack(r io.Reader, dst *ObjectStore) (int, error) {
+	br := bufio.NewReaderSize(r, 1<<16)
+	line, err := readPackLine(br)
+	if err != nil {
+		return 0, err
+	}
+	if line != packHeader {
+		return 0, fmt.Errorf("not a Kommito pack (got %q)", line)
+	}
+	count := 0
+	for {
+		line, err := readPackLine(br)
+		if err != nil {
+			return count, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "end" {
+			if fields[1] != strconv.Itoa(count) {
+				return count, fmt.Errorf("pack announced %s objects but carried %d", fields[1], count)
+			}
+			return count, nil
+		}
+		if len(fields) != 3 || !isObjectKind(fields[0]) || !isObjectHash(fields[1]) {
+			return count, fmt.Errorf("malformed pack entry %q", line)
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || size < 0 {
+			return count, fmt.Errorf("malformed pack entry %q", line)
+		}
+		body := io.LimitReader(br, size)
+		if err := dst.writeRaw(objectRef{Kind: fields[0], Hash: fields[1]}, body); err != nil {
+			return count, err
+		}
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+func readPackLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			return "", fmt.Errorf("pack ended unexpectedly")
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+func isObjectKind(kind string) bool {
+	switch kind {
+	case kindBlob, kindCommit, kindTree, kindChunk, kindManifest:
+		return true
+	}
+	return false
+}
+
+// commonObjects builds the have() test used to decide what the other side
+// of a transfer lacks, given the commits it says it has. The history of
+// those commits is known to be on both sides, and so is everything in their
+// own trees. Objects that only occur deeper in that history may be sent
+// again, which the receiver simply ignores. The history behind the other
+// side's shallow commits is not assumed to be there.
+func commonObjects(store *ObjectStore, haves, shallow []string) (func(kind, hash string) bool, error) {
+	boundary := make(map[string]bool)
+	for _, hash := range shallow {
+		boundary[hash] = true
+	}
+	common := make(reachableSet)
+	var pending []string
+	for _, hash := range haves {
+		if !isObjectHash(hash) || !store.Has(kindCommit, hash) || !common.mark(kindCommit, hash) {
+			continue
+		}
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range commit.Blobs {
+			if err := walkBlob(store, blob, common.mark); err != nil {
+				return nil, err
+			}
+		}
+		if commit.Tree != "" && common.mark(kindTree, commit.Tree) {
+			tree, err := store.ReadTree(commit.Tree)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range tree.Entries {
+				if err := walkBlob(store, entry.Hash, common.mark); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !boundary[hash] {
+			pending = append(pending, commit.Parents...)
+		}
+	}
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if !common.mark(kindCommit, hash) {
+			continue
+		}
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		if !boundary[hash] {
+			pending = append(pending, commit.Parents...)
+		}
+	}
+	return func(kind, hash string) bool { return common[kind][hash] }, nil
+}
+
+// checkConnected verifies that everything reachable from tips is stored,
+// stopping at commits that were already reachable before a push. A push
+// whose pack left something out is rejected before any ref moves.
+func checkConnected(store *ObjectStore, tips, known []string) error {
+	have, err := commonObjects(store, known, nil)
+	if err != nil {
+		return err
+	}
+	var missing error
+	seen := make(reachableSet)
+	err = walkObjects(store, tips, func(kind, hash string) bool {
+		if !seen.mark(kind, hash) || have(kind, hash) {
+			return false
+		}
+		if missing == nil && !store.hasRaw(kind, hash) {
+			missing = fmt.Errorf("%s %s is missing", strings.TrimSuffix(kind, "s"), hash)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return missing
+}
@@ -0,0 +1,83 @@
+package repo
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Pager is where long output goes: a pager command when standard output is
+// a terminal, standard output itself otherwise.
+type Pager struct {
+	io.Writer
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// StartPager starts the pager named by $KOMMITO_PAGER, core.pager or
+// $PAGER, falling back to less. Output is written straight through when it
+// is not a terminal, when the pager is "cat", or when it cannot be started.
+func StartPager() *Pager {
+	direct := &Pager{Writer: os.Stdout}
+	if !IsTerminal(os.Stdout) {
+		return direct
+	}
+	command := os.Getenv("KOMMITO_PAGER")
+	if command == "" {
+		if cfg, err := loadConfig(); err == nil {
+			command = cfg.Core.Pager
+		}
+	}
+	if command == "" {
+		command = os.Getenv("PAGER")
+	}
+	if command == "" {
+		command = "less"
+	}
+	args := strings.Fields(command)
+	if len(args) == 0 || args[0] == "cat" {
+		return direct
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if os.Getenv("LESS") == "" {
+		// Quit when the output fits on one screen, keep colours, and do
+		// not clear the screen on exit.
+		cmd.Env = append(cmd.Env, "LESS=FRX")
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return direct
+	}
+	if err := cmd.Start(); err != nil {
+		return direct
+	}
+	return &Pager{Writer: stdin, cmd: cmd, stdin: stdin}
+}
+
+// IsTerminal reports whether f is a terminal rather than a file or pipe.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Close waits for the user to leave the pager.
+func (p *Pager) Close() error {
+	if p.cmd == nil {
+		return nil
+	}
+	p.stdin.Close()
+	return p.cmd.Wait()
+}
+
+// IsPagerQuit reports whether err came from writing to a pager the user
+// had already quit, which is not worth reporting.
+func IsPagerQuit(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed)
+}
@@ -0,0 +1,196 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A partial clone fetches commits and trees but leaves out some blobs,
+// selected by a filter such as "blob:none" or "blob:limit=1m". The remote
+// it was cloned from keeps the filter in its config and becomes the
+// promisor remote: blobs missing locally are fetched from it on first use,
+// in one batch before checkouts and merges and one at a time otherwise.
+
+// blobFilter leaves out blobs of at least limit bytes; blob:none has a
+// limit of zero and leaves out every blob.
+type blobFilter struct {
+	limit int64
+}
+
+func parseBlobFilter(spec string) (blobFilter, error) {
+	switch {
+	case spec == "blob:none":
+		return blobFilter{}, nil
+	case strings.HasPrefix(spec, "blob:limit="):
+		limit, err := parseSize(strings.TrimPrefix(spec, "blob:limit="))
+		if err != nil {
+			return blobFilter{}, err
+		}
+		return blobFilter{limit: limit}, nil
+	}
+	return blobFilter{}, fmt.Errorf("unsupported filter '%s' (use blob:none or blob:limit=<size>)", spec)
+}
+
+// omits reports whether the filter leaves an object out of a fetch. Blobs
+// the sending side only has on promise itself are left out as well.
+func (f blobFilter) omits(store *ObjectStore, kind, hash string) bool {
+	if kind != kindBlob && kind != kindManifest {
+		return false
+	}
+	if f.limit == 0 || !store.Has(kindBlob, hash) {
+		return true
+	}
+	size, err := store.Size(kindBlob, hash)
+	return err == nil && size >= f.limit
+}
+
+// promisor returns the remote that promised the blobs a partial clone left
+// out, preferring origin when several remotes have a filter.
+func (s *ObjectStore) promisor() (string, RemoteConfig, bool) {
+	cfg, err := loadConfigFrom(s.dir)
+	if err != nil {
+		return "", RemoteConfig{}, false
+	}
+	if remote, ok := cfg.Remotes["origin"]; ok && remote.Filter != "" {
+		return "origin", remote, true
+	}
+	var names []string
+	for name, remote := range cfg.Remotes {
+		if remote.Filter != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", RemoteConfig{}, false
+	}
+	sort.Strings(names)
+	return names[0], cfg.Remotes[names[0]], true
+}
+
+// fetchPromised fetches blobs that are missing locally from the promisor
+// remote.
+func (s *ObjectStore) fetchPromised(hashes []string) error {
+	what := fmt.Sprintf("%d blobs", len(hashes))
+	if len(hashes) == 1 {
+		what = "blob " + hashes[0]
+	}
+	name, remote, ok := s.promisor()
+	if !ok {
+		return fmt.Errorf("%s not found", what)
+	}
+	transport, err := openTransport(remote.URL)
+	if err == nil {
+		defer transport.Close()
+		_, err = transport.FetchBlobs(hashes, s)
+	}
+	if err != nil {
+		return fmt.Errorf("%s left out of this partial clone could not be fetched from remote '%s' (%s): %w", what, name, remote.URL, err)
+	}
+	for _, hash := range hashes {
+		if !s.Has(kindBlob, hash) {
+			return fmt.Errorf("remote '%s' did not send blob %s", name, hash)
+		}
+	}
+	return nil
+}
+
+// fetchPromisedBlob fetches one missing blob when the repository is a
+// partial clone; it reports whether there was anything to try.
+func (s *ObjectStore) fetchPromisedBlob(hash string, err error) (bool, error) {
+	if !os.IsNotExist(err) {
+		return false, nil
+	}
+	if _, _, ok := s.promisor(); !ok {
+		return false, nil
+	}
+	return true, s.fetchPromised([]string{hash})
+}
+
+// prefetchBlobs fetches, in a single request, whichever of the given blobs
+// a partial clone left out.
+func (s *ObjectStore) prefetchBlobs(hashes []string) error {
+	var missing []string
+	seen := make(map[string]bool)
+	for _, hash := range hashes {
+		if hash != "" && !seen[hash] && !s.Has(kindBlob, hash) {
+			missing = append(missing, hash)
+		}
+		seen[hash] = true
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if _, _, ok := s.promisor(); !ok {
+		return nil
+	}
+	return s.fetchPromised(missing)
+}
+
+// promisedObjects lists the stored objects that make up the given blobs,
+// for a client filling in a partial clone. Blobs are requested by hash, so
+// any blob of the repository can be fetched this way.
+func promisedObjects(store *ObjectStore, hashes []string) ([]objectRef, error) {
+	for _, hash := range hashes {
+		if !isObjectHash(hash) {
+			return nil, fmt.Errorf("'%s' is not an object name", hash)
+		}
+	}
+	if err := store.prefetchBlobs(hashes); err != nil {
+		return nil, err
+	}
+	var refs []objectRef
+	seen := make(reachableSet)
+	for _, hash := range hashes {
+		if !store.Has(kindBlob, hash) {
+			return nil, fmt.Errorf("blob %s not found", hash)
+		}
+		err := walkBlob(store, hash, func(kind, hash string) bool {
+			if seen.mark(kind, hash) {
+				refs = append(refs, objectRef{Kind: kind, Hash: hash})
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// fillPromised makes sure every blob about to be sent from a partial clone
+// is stored, fetching those it only has on promise. A blob that arrives
+// chunked is replaced by its manifest and chunks.
+func (s *ObjectStore) fillPromised(refs []objectRef) ([]objectRef, error) {
+	if _, _, ok := s.promisor(); !ok {
+		return refs, nil
+	}
+	var missing []string
+	for _, ref := range refs {
+		if ref.Kind == kindBlob && !s.hasRaw(kindBlob, ref.Hash) {
+			missing = append(missing, ref.Hash)
+		}
+	}
+	if len(missing) == 0 {
+		return refs, nil
+	}
+	if err := s.prefetchBlobs(missing); err != nil {
+		return nil, err
+	}
+	filled := make([]objectRef, 0, len(refs))
+	for _, ref := range refs {
+		if ref.Kind != kindBlob || s.hasRaw(kindBlob, ref.Hash) {
+			filled = append(filled, ref)
+			continue
+		}
+		err := walkBlob(s, ref.Hash, func(kind, hash string) bool {
+			filled = append(filled, objectRef{Kind: kind, Hash: hash})
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return filled, nil
+}
@@ -0,0 +1,538 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ErrConflicts is returned by a command that stopped on conflicts for the
+// user to resolve, once it has printed them and how to go on.
+var ErrConflicts = errors.New("stopped on conflicts")
+
+// PickOptions controls how CherryPick and Revert apply commits.
+type PickOptions struct {
+	// NoCommit leaves the changes in the index and working tree instead
+	// of committing each one.
+	NoCommit bool
+	// Mainline is the parent, counting from 1, that a merge commit's
+	// changes are taken against.
+	Mainline int
+}
+
+// pickSequence is a cherry-pick or revert that stopped, kept in
+// .kommito/sequencer until it is continued, skipped past or aborted.
+type pickSequence struct {
+	Action   string `json:"action"`
+	Head     string `json:"head"`
+	Mainline int    `json:"mainline,omitempty"`
+	NoCommit bool   `json:"noCommit,omitempty"`
+	// Todo are the commits left to apply, the one stopped at first.
+	Todo []string `json:"todo"`
+	// Message, Author and Conflicts are set when the first commit in Todo
+	// stopped on conflicts: what to commit once they are resolved.
+	Message   string   `json:"message,omitempty"`
+	Author    string   `json:"author,omitempty"`
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// CherryPick applies the changes each commit made, in order, on top of
+// HEAD, committing each with its author and message and a line recording
+// where it came from. A range such as a..b picks its commits oldest first.
+func CherryPick(revs []string, opts PickOptions) error {
+	return startPicks("cherry-pick", revs, opts)
+}
+
+// Revert undoes the changes each commit made, newest first, committing
+// each undo with a message recording the commit it reverts.
+func Revert(revs []string, opts PickOptions) error {
+	return startPicks("revert", revs, opts)
+}
+
+func startPicks(action string, revs []string, opts PickOptions) error {
+	if err := requireWorkTree(); err != nil {
+		return err
+	}
+	if err := checkNothingInProgress(); err != nil {
+		return err
+	}
+	head, err := resolveHead()
+	if err != nil {
+		return err
+	}
+	if head == "" {
+		return fmt.Errorf("cannot %s onto a branch with no commits", action)
+	}
+	store := localObjects()
+	commits, err := pickCommits(store, revs, action == "revert")
+	if err != nil {
+		return err
+	}
+	if !opts.NoCommit {
+		// Each commit is made from the index, which must not carry
+		// anything else along.
+		headFiles, err := revisionEntries(head)
+		if err != nil {
+			return err
+		}
+		staged, err := indexTree()
+		if err != nil {
+			return err
+		}
+		if !sameEntries(staged, headFiles) {
+			return fmt.Errorf("your index has staged changes, commit them first or use --no-commit")
+		}
+	}
+	seq := &pickSequence{Action: action, Head: head, Mainline: opts.Mainline, NoCommit: opts.NoCommit, Todo: commits}
+	for _, hash := range commits {
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return err
+		}
+		if _, err := seq.parent(hash, commit); err != nil {
+			return err
+		}
+	}
+	return seq.run(store)
+}
+
+// pickCommits resolves the commits to apply. Plain revisions are taken as
+// given; with a range or an excluded revision the commits in it are
+// walked, newest first for a revert and oldest first otherwise.
+func pickCommits(store *ObjectStore, revs []string, newestFirst bool) ([]string, error) {
+	walk := false
+	for _, rev := range revs {
+		if strings.HasPrefix(rev, "^") || strings.Contains(rev, "..") {
+			walk = true
+		}
+	}
+	var commits []string
+	if !walk {
+		for _, rev := range revs {
+			hash, err := resolveRevision(rev)
+			if err != nil {
+				return nil, err
+			}
+			commits = append(commits, hash)
+		}
+		return commits, nil
+	}
+	tips, hidden, err := logRange(store, LogOptions{Revisions: revs})
+	if err != nil {
+		return nil, err
+	}
+	err = walkLog(store, tips, hidden, false, nil, func(hash string, _ *Commit, _ []string, _ bool) (bool, error) {
+		commits = append(commits, hash)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(commits) == 0 {
+		return nil, fmt.Errorf("no commits in %s", strings.Join(revs, " "))
+	}
+	if !newestFirst {
+		slices.Reverse(commits)
+	}
+	return commits, nil
+}
+
+// run applies the commits left to do, stopping at the first one that
+// conflicts. When it fails after making progress, the commits left are
+// saved so the sequence can be continued or aborted.
+func (seq *pickSequence) run(store *ObjectStore) error {
+	todo := len(seq.Todo)
+	err := seq.apply(store)
+	if err != nil && len(seq.Todo) < todo {
+		seq.save()
+	}
+	return err
+}
+
+func (seq *pickSequence) apply(store *ObjectStore) error {
+	for len(seq.Todo) > 0 {
+		hash := seq.Todo[0]
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return err
+		}
+		base, theirs, label, err := seq.sides(store, hash, commit)
+		if err != nil {
+			return err
+		}
+		message, author := seq.message(hash, commit)
+		merge, ours, err := applyChange(store, base, theirs, label)
+		if err != nil {
+			return err
+		}
+		if len(merge.Conflicts) > 0 {
+			if err := writeFileAtomic(localRefs().path(seq.pickHead()), []byte(hash), 0644); err != nil {
+				return fmt.Errorf("failed to record %s: %w", seq.pickHead(), err)
+			}
+			seq.Message, seq.Author, seq.Conflicts = message, author, merge.Paths
+			if err := seq.save(); err != nil {
+				return err
+			}
+			printConflicts(seq.Action, hash, commit, merge.Conflicts)
+			return ErrConflicts
+		}
+
+		if !seq.NoCommit {
+			if sameEntries(merge.Index, ours) {
+				fmt.Printf("Skipped %s %s, its changes are already in HEAD\n", hash[:7], commitSubject(commit.Message))
+			} else {
+				created, err := commitIndex(message, author, false)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s %s as %s: %s\n", seq.done(), hash[:7], created[:7], commitSubject(message))
+			}
+		} else {
+			fmt.Printf("%s %s into the index: %s\n", seq.done(), hash[:7], commitSubject(commit.Message))
+		}
+		seq.Todo = seq.Todo[1:]
+	}
+	return removeSequence()
+}
+
+// sides returns the trees to merge into the index for a commit: the
+// change from base to theirs is applied. A cherry-pick applies the change
+// from the commit's parent to the commit, a revert the change back.
+func (seq *pickSequence) sides(store *ObjectStore, hash string, commit *Commit) (base, theirs map[string]TreeEntry, label string, err error) {
+	parent, err := seq.parent(hash, commit)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	parentFiles, files, err := commitChange(store, commit, parent)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	label = fmt.Sprintf("%s (%s)", hash[:7], commitSubject(commit.Message))
+	if seq.Action == "revert" {
+		return files, parentFiles, "parent of " + label, nil
+	}
+	return parentFiles, files, label, nil
+}
+
+// commitChange returns the files of a commit's parent, none for a root
+// commit, and of the commit itself.
+func commitChange(store *ObjectStore, commit *Commit, parent string) (map[string]TreeEntry, map[string]TreeEntry, error) {
+	parentFiles := make(map[string]TreeEntry)
+	if parent != "" {
+		parentCommit, err := store.LoadCommit(parent)
+		if err != nil {
+			return nil, nil, err
+		}
+		if parentFiles, err = commitEntries(parentCommit); err != nil {
+			return nil, nil, err
+		}
+	}
+	files, err := commitEntries(commit)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parentFiles, files, nil
+}
+
+// applyChange merges the change from base to theirs into the index and
+// the working tree, and returns the merge and the index it started from.
+// The index keeps our side of each conflict until the resolution is
+// added, while the working tree gets the conflict markers.
+func applyChange(store *ObjectStore, base, theirs map[string]TreeEntry, label string) (*treeMerge, map[string]TreeEntry, error) {
+	ours, err := indexTree()
+	if err != nil {
+		return nil, nil, err
+	}
+	merge, err := mergeTrees(store, base, ours, theirs, "HEAD", label)
+	if err != nil {
+		return nil, nil, err
+	}
+	target := make(map[string]TreeEntry, len(merge.Index))
+	for path, entry := range merge.Index {
+		target[path] = entry
+	}
+	for path, entry := range merge.Worktree {
+		target[path] = entry
+	}
+	if err := moveWorkingTree(ours, target); err != nil {
+		return nil, nil, err
+	}
+	if len(merge.Conflicts) == 0 {
+		return merge, ours, nil
+	}
+	err = updateIndex(func(entries []indexEntry) []indexEntry {
+		for _, path := range merge.Paths {
+			entries = slices.DeleteFunc(entries, func(e indexEntry) bool { return e.Path == path })
+			if entry, ok := merge.Index[path]; ok {
+				entries = append(entries, indexEntry{Hash: entry.Hash, Path: path, Mode: entry.Mode})
+			}
+		}
+		return entries
+	})
+	return merge, ours, err
+}
+
+// printConflicts tells the user how to go on after a command stopped on
+// conflicts applying a commit.
+func printConflicts(command, hash string, commit *Commit, conflicts []string) {
+	fmt.Printf("Could not apply %s %s, conflicts in:\n", hash[:7], commitSubject(commit.Message))
+	for _, c := range conflicts {
+		fmt.Println("  ", c)
+	}
+	fmt.Printf("Resolve them, add the files and run 'kommito %s --continue'\n", command)
+	fmt.Println("(or --skip to drop this commit, --abort to go back to where you started).")
+}
+
+// parent picks the parent a commit's changes are taken against.
+func (seq *pickSequence) parent(hash string, commit *Commit) (string, error) {
+	switch {
+	case len(commit.Parents) > 1 && seq.Mainline == 0:
+		return "", fmt.Errorf("commit %s is a merge but no -m option was given", hash[:7])
+	case len(commit.Parents) > 1 && seq.Mainline > len(commit.Parents):
+		return "", fmt.Errorf("commit %s does not have parent %d", hash[:7], seq.Mainline)
+	case len(commit.Parents) > 1:
+		return commit.Parents[seq.Mainline-1], nil
+	case seq.Mainline != 0:
+		return "", fmt.Errorf("-m was given but commit %s is not a merge", hash[:7])
+	case len(commit.Parents) == 1:
+		return commit.Parents[0], nil
+	}
+	return "", nil
+}
+
+// message returns the message and author to commit a pick with. A
+// cherry-pick keeps the original author and message and records the
+// commit it was picked from, as "git cherry-pick -x" does; a revert is
+// authored by the user and names the commit it reverts.
+func (seq *pickSequence) message(hash string, commit *Commit) (string, string) {
+	if seq.Action == "revert" {
+		message := fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s", commitSubject(commit.Message), hash)
+		if len(commit.Parents) > 1 {
+			message += fmt.Sprintf(", reversing\nchanges made to %s", commit.Parents[seq.Mainline-1])
+		}
+		return message + ".", commitAuthor()
+	}
+	message := strings.TrimRight(commit.Message, "\n")
+	return fmt.Sprintf("%s\n\n(cherry picked from commit %s)", message, hash), commit.Author
+}
+
+func (seq *pickSequence) pickHead() string {
+	if seq.Action == "revert" {
+		return "REVERT_HEAD"
+	}
+	return "CHERRY_PICK_HEAD"
+}
+
+func (seq *pickSequence) done() string {
+	if seq.Action == "revert" {
+		return "⏪ Reverted"
+	}
+	return "🍒 Picked"
+}
+
+// ContinuePick commits the resolution of the conflicts a cherry-pick or
+// revert stopped at, then applies the commits left.
+func ContinuePick(action string) error {
+	seq, err := loadSequence(action)
+	if err != nil {
+		return err
+	}
+	store := localObjects()
+	if len(seq.Conflicts) > 0 {
+		unresolved, err := unresolvedPaths(store, seq.Conflicts)
+		if err != nil {
+			return err
+		}
+		if len(unresolved) > 0 {
+			return fmt.Errorf("resolve the conflicts in %s and add the files first", strings.Join(unresolved, ", "))
+		}
+		refs := localRefs()
+		pending, err := refs.resolve(seq.pickHead())
+		if err != nil {
+			return err
+		}
+		// Without the pick head the resolution was already committed by
+		// hand.
+		if pending != "" && !seq.NoCommit {
+			headFiles, err := revisionEntries("HEAD")
+			if err != nil {
+				return err
+			}
+			staged, err := indexTree()
+			if err != nil {
+				return err
+			}
+			if sameEntries(staged, headFiles) {
+				return fmt.Errorf("nothing left to commit after resolving, use --skip to drop %s", seq.Todo[0][:7])
+			}
+			created, err := commitIndex(seq.Message, seq.Author, false)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s %s as %s: %s\n", seq.done(), seq.Todo[0][:7], created[:7], commitSubject(seq.Message))
+		}
+		if err := seq.clearPickHead(); err != nil {
+			return err
+		}
+		seq.Todo = seq.Todo[1:]
+		seq.Message, seq.Author, seq.Conflicts = "", "", nil
+	}
+	if err := seq.save(); err != nil {
+		return err
+	}
+	return seq.run(store)
+}
+
+// SkipPick drops the commit a cherry-pick or revert stopped at, putting
+// the working tree and index back to HEAD, and applies the commits left.
+func SkipPick(action string) error {
+	seq, err := loadSequence(action)
+	if err != nil {
+		return err
+	}
+	if err := resetToCommit("HEAD", seq.Conflicts); err != nil {
+		return err
+	}
+	if err := seq.clearPickHead(); err != nil {
+		return err
+	}
+	seq.Todo = seq.Todo[1:]
+	seq.Message, seq.Author, seq.Conflicts = "", "", nil
+	if err := seq.save(); err != nil {
+		return err
+	}
+	return seq.run(localObjects())
+}
+
+// AbortPick gives up on a cherry-pick or revert, moving HEAD, the working
+// tree and the index back to where it started.
+func AbortPick(action string) error {
+	seq, err := loadSequence(action)
+	if err != nil {
+		return err
+	}
+	head, err := resolveHead()
+	if err != nil {
+		return err
+	}
+	if head != seq.Head {
+		if err := localRefs().updateHead(seq.Head, head, seq.Action+": abort"); err != nil {
+			return fmt.Errorf("failed to update HEAD: %w", err)
+		}
+	}
+	if err := resetToCommit(seq.Head, seq.Conflicts); err != nil {
+		return err
+	}
+	if err := seq.clearPickHead(); err != nil {
+		return err
+	}
+	return removeSequence()
+}
+
+// resetToCommit discards what a stopped command left in the working tree
+// and index, including the conflicted paths, resetting them to rev.
+func resetToCommit(rev string, paths []string) error {
+	files, err := revisionEntries(rev)
+	if err != nil {
+		return err
+	}
+	return resetWorkingTree(files, paths)
+}
+
+func (seq *pickSequence) clearPickHead() error {
+	if err := os.Remove(localRefs().path(seq.pickHead())); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear %s: %w", seq.pickHead(), err)
+	}
+	return nil
+}
+
+// unresolvedPaths returns the conflicted files whose resolution is not
+// staged yet. A file deleted from the working tree is resolved as deleted
+// and dropped from the index.
+func unresolvedPaths(store *ObjectStore, paths []string) ([]string, error) {
+	staged, err := indexTree()
+	if err != nil {
+		return nil, err
+	}
+	fileMode := fileModeEnabled()
+	var unresolved, deleted []string
+	for _, path := range paths {
+		entry, inIndex := staged[path]
+		hash, _, err := hashWorktreeFile(path, entry.Mode, fileMode)
+		if os.IsNotExist(err) {
+			deleted = append(deleted, path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !inIndex || hash != store.worktreeHash(entry.Hash) {
+			unresolved = append(unresolved, path)
+			continue
+		}
+		content, binary, err := diffContent(store, &diffFile{Path: path, Hash: entry.Hash, Mode: entry.Mode})
+		if err != nil {
+			return nil, err
+		}
+		if !binary && hasConflictMarkers(content) {
+			unresolved = append(unresolved, path)
+		}
+	}
+	if len(unresolved) > 0 || len(deleted) == 0 {
+		return unresolved, nil
+	}
+	return nil, updateIndex(func(entries []indexEntry) []indexEntry {
+		return slices.DeleteFunc(entries, func(e indexEntry) bool { return slices.Contains(deleted, e.Path) })
+	})
+}
+
+// hasConflictMarkers reports whether content still has the markers a
+// conflict was written with.
+func hasConflictMarkers(content []byte) bool {
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("<<<<<<< ")) || bytes.HasPrefix(line, []byte(">>>>>>> ")) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadSequence(action string) (*pickSequence, error) {
+	data, err := os.ReadFile(localRefs().path("sequencer"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no %s in progress", action)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sequencer state: %w", err)
+	}
+	var seq pickSequence
+	if err := json.Unmarshal(data, &seq); err != nil {
+		return nil, fmt.Errorf("failed to parse sequencer state: %w", err)
+	}
+	if seq.Action != action {
+		return nil, fmt.Errorf("a %s is in progress, not a %s", seq.Action, action)
+	}
+	return &seq, nil
+}
+
+func (seq *pickSequence) save() error {
+	data, err := json.MarshalIndent(seq, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sequencer state: %w", err)
+	}
+	if err := writeFileAtomic(localRefs().path("sequencer"), data, 0644); err != nil {
+		return fmt.Errorf("failed to save sequencer state: %w", err)
+	}
+	return nil
+}
+
+func removeSequence() error {
+	if err := os.Remove(localRefs().path("sequencer")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear sequencer state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,657 @@
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// RebaseOptions controls how Rebase replays commits.
+type RebaseOptions struct {
+	// Interactive opens the todo list in the editor before starting.
+	Interactive bool
+	// Autosquash moves commits whose subject starts with "fixup! " or
+	// "squash! " after the commit they name, marked fixup or squash.
+	Autosquash bool
+}
+
+// rebaseStep is one line of a rebase todo list: an action on a commit, or
+// a shell command to run.
+type rebaseStep struct {
+	Action  string `json:"action"`
+	Commit  string `json:"commit,omitempty"`
+	Command string `json:"command,omitempty"`
+}
+
+// rebaseState is a rebase in progress, saved in .kommito/rebase before
+// every step so an interrupted rebase can be continued or aborted.
+type rebaseState struct {
+	// Branch is the branch being rebased, moved to the result at the end;
+	// empty when HEAD was detached.
+	Branch   string       `json:"branch,omitempty"`
+	OrigHead string       `json:"origHead"`
+	Onto     string       `json:"onto"`
+	Todo     []rebaseStep `json:"todo"`
+	// Stopped is the step that stopped on conflicts, with the message and
+	// author to commit it with once they are resolved.
+	Stopped   *rebaseStep `json:"stopped,omitempty"`
+	Message   string      `json:"message,omitempty"`
+	Author    string      `json:"author,omitempty"`
+	Conflicts []string    `json:"conflicts,omitempty"`
+	// Edit is set while stopped after an edit step; what is staged then
+	// is amended into HEAD on --continue.
+	Edit bool `json:"edit,omitempty"`
+	// SquashEdit is set while a chain of squashes and fixups includes a
+	// squash, so the combined message is edited at the end of the chain.
+	SquashEdit bool `json:"squashEdit,omitempty"`
+}
+
+// rebaseActions maps the actions of a todo list, and their one-letter
+// forms, to their names.
+var rebaseActions = map[string]string{
+	"p": "pick", "pick": "pick",
+	"r": "reword", "reword": "reword",
+	"e": "edit", "edit": "edit",
+	"s": "squash", "squash": "squash",
+	"f": "fixup", "fixup": "fixup",
+	"x": "exec", "exec": "exec",
+	"d": "drop", "drop": "drop",
+}
+
+const rebaseTodoHelp = `
+Commands:
+p, pick <commit> = use commit
+r, reword <commit> = use commit, but edit the commit message
+e, edit <commit> = use commit, but stop for amending
+s, squash <commit> = use commit, but meld into previous commit
+f, fixup <commit> = like "squash", but discard this commit's message
+x, exec <command> = run command (the rest of the line) using shell
+d, drop <commit> = remove commit
+
+These lines can be re-ordered; they are executed from top to bottom.
+If you remove a line here THAT COMMIT WILL BE LOST.
+However, if you remove everything, the rebase will be aborted.`
+
+// Rebase replays the commits of the current branch that upstream does not
+// have on top of upstream, one at a time, then moves the branch to the
+// result. Merge commits are left out, and commits whose changes upstream
+// already has are dropped. HEAD is detached while the rebase runs.
+func Rebase(upstream string, opts RebaseOptions) error {
+	if err := requireWorkTree(); err != nil {
+		return err
+	}
+	if err := checkNothingInProgress(); err != nil {
+		return err
+	}
+	head, err := resolveHead()
+	if err != nil {
+		return err
+	}
+	if head == "" {
+		return fmt.Errorf("cannot rebase a branch with no commits")
+	}
+	changed, err := localChanges(head)
+	if err != nil {
+		return err
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("cannot rebase with local changes, commit them first:\n  %s", strings.Join(changed, "\n  "))
+	}
+	onto, err := resolveRevision(upstream)
+	if err != nil {
+		return err
+	}
+	store := localObjects()
+	if !opts.Interactive && !opts.Autosquash {
+		if upToDate, err := isAncestor(store, onto, head); err != nil || upToDate {
+			if err == nil {
+				fmt.Println("✅ Current branch is up to date")
+			}
+			return err
+		}
+	}
+
+	commits, err := rebaseCommits(store, head, onto)
+	if err != nil {
+		return err
+	}
+	todo := make([]rebaseStep, 0, len(commits))
+	for _, hash := range commits {
+		todo = append(todo, rebaseStep{Action: "pick", Commit: hash})
+	}
+	if opts.Autosquash {
+		if todo, err = autosquash(store, todo); err != nil {
+			return err
+		}
+	}
+	if opts.Interactive {
+		if todo, err = editTodo(store, todo, onto); err != nil {
+			return err
+		}
+		if len(todo) == 0 {
+			fmt.Println("Nothing to do")
+			return nil
+		}
+	}
+
+	refs := localRefs()
+	branch, err := refs.headTarget()
+	if err != nil {
+		return err
+	}
+	ontoCommit, err := LoadCommit(onto)
+	if err != nil {
+		return err
+	}
+	if err := updateWorkingTree(head, ontoCommit); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(refs.path("ORIG_HEAD"), []byte(head), 0644); err != nil {
+		return fmt.Errorf("failed to record ORIG_HEAD: %w", err)
+	}
+	if err := refs.setHead(onto, "rebase (start): checkout "+upstream); err != nil {
+		return fmt.Errorf("failed to update HEAD: %w", err)
+	}
+	state := &rebaseState{Branch: branch, OrigHead: head, Onto: onto, Todo: todo}
+	fmt.Printf("🔁 Rebasing %d %s onto %s\n", len(todo), plural(len(todo), "step", "steps"), onto[:7])
+	return state.run(store)
+}
+
+// checkNothingInProgress refuses to start a command that moves HEAD while
+// a merge, cherry-pick, revert or rebase is waiting to be finished.
+func checkNothingInProgress() error {
+	refs := localRefs()
+	if _, err := os.Stat(refs.path("rebase")); err == nil {
+		return fmt.Errorf("a rebase is in progress, use 'kommito rebase --continue', --skip or --abort")
+	}
+	if _, err := os.Stat(refs.path("sequencer")); err == nil {
+		return fmt.Errorf("a cherry-pick or revert is in progress, use --continue, --skip or --abort")
+	}
+	if mergeHead, err := refs.resolve("MERGE_HEAD"); err != nil || mergeHead != "" {
+		return fmt.Errorf("a merge is in progress, commit it first")
+	}
+	return nil
+}
+
+// localChanges lists the tracked files whose staged or working tree
+// version differs from the commit head.
+func localChanges(head string) ([]string, error) {
+	files, err := revisionEntries(head)
+	if err != nil {
+		return nil, err
+	}
+	staged, err := indexTree()
+	if err != nil {
+		return nil, err
+	}
+	objects := localObjects()
+	fileMode := fileModeEnabled()
+	var changed []string
+	for path, entry := range staged {
+		hash, mode, err := hashWorktreeFile(path, entry.Mode, fileMode)
+		if files[path] != entry || err != nil || hash != objects.worktreeHash(entry.Hash) || mode != entry.Mode {
+			changed = append(changed, path)
+		}
+	}
+	for path := range files {
+		if _, ok := staged[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// rebaseCommits returns the commits reachable from head but not from onto,
+// parents first, leaving out merges.
+func rebaseCommits(store *ObjectStore, head, onto string) ([]string, error) {
+	hidden, err := reachableCommits(store, []string{onto})
+	if err != nil {
+		return nil, err
+	}
+	var commits []string
+	err = walkLog(store, []string{head}, hidden, false, nil, func(hash string, commit *Commit, _ []string, _ bool) (bool, error) {
+		if len(commit.Parents) < 2 {
+			commits = append(commits, hash)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return topoSortCommits(store, commits)
+}
+
+// autosquash moves each "fixup! <subject>" and "squash! <subject>" commit
+// to just after the earlier commit it names, by subject or hash prefix,
+// as a fixup or squash of it.
+func autosquash(store *ObjectStore, todo []rebaseStep) ([]rebaseStep, error) {
+	subjects := make([]string, len(todo))
+	for i, step := range todo {
+		commit, err := store.LoadCommit(step.Commit)
+		if err != nil {
+			return nil, err
+		}
+		subjects[i] = commitSubject(commit.Message)
+	}
+	moved := make(map[int]bool)
+	attached := make(map[int][]rebaseStep)
+	for i, subject := range subjects {
+		action, target := "", subject
+		for {
+			if rest, ok := strings.CutPrefix(target, "fixup! "); ok {
+				target = rest
+				if action == "" {
+					action = "fixup"
+				}
+			} else if rest, ok := strings.CutPrefix(target, "squash! "); ok {
+				target = rest
+				if action == "" {
+					action = "squash"
+				}
+			} else {
+				break
+			}
+		}
+		if action == "" {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if moved[j] {
+				continue
+			}
+			if subjects[j] == target || strings.HasPrefix(subjects[j], target) || strings.HasPrefix(todo[j].Commit, target) {
+				attached[j] = append(attached[j], rebaseStep{Action: action, Commit: todo[i].Commit})
+				moved[i] = true
+				break
+			}
+		}
+	}
+	var sorted []rebaseStep
+	for i, step := range todo {
+		if !moved[i] {
+			sorted = append(sorted, step)
+			sorted = append(sorted, attached[i]...)
+		}
+	}
+	return sorted, nil
+}
+
+// editTodo lets the user edit the todo list in .kommito/rebase-todo and
+// returns the steps they left.
+func editTodo(store *ObjectStore, todo []rebaseStep, onto string) ([]rebaseStep, error) {
+	var b strings.Builder
+	for _, step := range todo {
+		commit, err := store.LoadCommit(step.Commit)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", step.Action, step.Commit[:7], commitSubject(commit.Message))
+	}
+	fmt.Fprintf(&b, "\n# Rebase onto %s (%d %s)\n", onto[:7], len(todo), plural(len(todo), "command", "commands"))
+	for _, line := range strings.Split(rebaseTodoHelp, "\n") {
+		b.WriteString(strings.TrimRight("# "+line, " ") + "\n")
+	}
+	path := localRefs().path("rebase-todo")
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write todo list: %w", err)
+	}
+	defer os.Remove(path)
+	if err := editFile(path); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read todo list: %w", err)
+	}
+	return parseTodo(store, string(data))
+}
+
+// parseTodo reads an edited todo list. Dropped commits are left out.
+func parseTodo(store *ObjectStore, text string) ([]rebaseStep, error) {
+	var todo []rebaseStep
+	for n, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		word, rest, _ := strings.Cut(line, " ")
+		action, ok := rebaseActions[word]
+		if !ok {
+			return nil, fmt.Errorf("line %d of the todo list: unknown command '%s'", n+1, word)
+		}
+		rest = strings.TrimSpace(rest)
+		if action == "exec" {
+			if rest == "" {
+				return nil, fmt.Errorf("line %d of the todo list: exec needs a command", n+1)
+			}
+			todo = append(todo, rebaseStep{Action: action, Command: rest})
+			continue
+		}
+		if action == "drop" {
+			continue
+		}
+		name, _, _ := strings.Cut(rest, " ")
+		if name == "" {
+			return nil, fmt.Errorf("line %d of the todo list: %s needs a commit", n+1, action)
+		}
+		hash, err := expandCommitHash(store, name)
+		if err != nil {
+			return nil, fmt.Errorf("line %d of the todo list: %w", n+1, err)
+		}
+		if (action == "squash" || action == "fixup") && !hasCommitStep(todo) {
+			return nil, fmt.Errorf("line %d of the todo list: cannot %s without a previous commit", n+1, action)
+		}
+		todo = append(todo, rebaseStep{Action: action, Commit: hash})
+	}
+	return todo, nil
+}
+
+func hasCommitStep(todo []rebaseStep) bool {
+	for _, step := range todo {
+		if step.Commit != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// run carries out the steps left, saving the state before each, until one
+// stops or the rebase is finished.
+func (state *rebaseState) run(store *ObjectStore) error {
+	for len(state.Todo) > 0 {
+		if err := state.save(); err != nil {
+			return err
+		}
+		step := state.Todo[0]
+		state.Todo = state.Todo[1:]
+		stopped, err := state.do(store, step)
+		if err != nil && !errors.Is(err, ErrConflicts) {
+			return err
+		}
+		if stopped {
+			if saveErr := state.save(); saveErr != nil {
+				return saveErr
+			}
+			return err
+		}
+	}
+	return state.finish()
+}
+
+// do carries out one step, reporting whether the rebase stopped there.
+func (state *rebaseState) do(store *ObjectStore, step rebaseStep) (bool, error) {
+	if step.Action == "exec" {
+		fmt.Printf("⚙️  Running: %s\n", step.Command)
+		cmd := exec.Command("sh", "-c", step.Command)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Printf("Command failed (%v): %s\n", err, step.Command)
+			fmt.Println("Fix the problem and run 'kommito rebase --continue'.")
+			return true, nil
+		}
+		return false, nil
+	}
+
+	commit, err := store.LoadCommit(step.Commit)
+	if err != nil {
+		return false, err
+	}
+	parent := ""
+	if len(commit.Parents) > 0 {
+		parent = commit.Parents[0]
+	}
+	base, theirs, err := commitChange(store, commit, parent)
+	if err != nil {
+		return false, err
+	}
+	label := fmt.Sprintf("%s (%s)", step.Commit[:7], commitSubject(commit.Message))
+	merge, _, err := applyChange(store, base, theirs, label)
+	if err != nil {
+		return false, err
+	}
+
+	message, author := commit.Message, commit.Author
+	if step.Action == "squash" || step.Action == "fixup" {
+		head, err := resolveHead()
+		if err != nil {
+			return false, err
+		}
+		headCommit, err := store.LoadCommit(head)
+		if err != nil {
+			return false, err
+		}
+		message, author = headCommit.Message, headCommit.Author
+		if step.Action == "squash" {
+			message = strings.TrimRight(message, "\n") + "\n\n" + commit.Message
+		}
+	}
+	if len(merge.Conflicts) > 0 {
+		state.Stopped = &step
+		state.Message, state.Author, state.Conflicts = message, author, merge.Paths
+		printConflicts("rebase", step.Commit, commit, merge.Conflicts)
+		return true, ErrConflicts
+	}
+	return state.commit(step, message, author, sameEntries(base, theirs))
+}
+
+// commit records a step once its changes are in the index, reporting
+// whether the rebase stops there for an edit. A step that changes nothing
+// is dropped as already applied, unless its commit was empty to begin
+// with and keepEmpty is set.
+func (state *rebaseState) commit(step rebaseStep, message, author string, keepEmpty bool) (bool, error) {
+	short := step.Commit[:7]
+	if step.Action == "squash" || step.Action == "fixup" {
+		if step.Action == "squash" {
+			state.SquashEdit = true
+		}
+		if next := state.nextAction(); next != "squash" && next != "fixup" && state.SquashEdit {
+			state.SquashEdit = false
+			edited, err := editMessage(message, "This is the combination of the squashed commits.")
+			if err != nil {
+				return false, err
+			}
+			message = edited
+		}
+		created, err := commitIndex(message, author, true)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("🧩 Squashed %s into %s: %s\n", short, created[:7], commitSubject(message))
+		return false, nil
+	}
+
+	headFiles, err := revisionEntries("HEAD")
+	if err != nil {
+		return false, err
+	}
+	staged, err := indexTree()
+	if err != nil {
+		return false, err
+	}
+	if sameEntries(staged, headFiles) && !keepEmpty {
+		fmt.Printf("Skipped %s %s, its changes are already applied\n", short, commitSubject(message))
+		return false, nil
+	}
+	if step.Action == "reword" {
+		if message, err = editMessage(message, fmt.Sprintf("Rewording %s.", short)); err != nil {
+			return false, err
+		}
+	}
+	created, err := commitIndex(message, author, false)
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("🍒 Applied %s as %s: %s\n", short, created[:7], commitSubject(message))
+	if step.Action == "edit" {
+		state.Edit = true
+		fmt.Printf("Stopped at %s %s\n", created[:7], commitSubject(message))
+		fmt.Println("Make your changes, add them and run 'kommito rebase --continue' to amend the commit.")
+		return true, nil
+	}
+	return false, nil
+}
+
+func (state *rebaseState) nextAction() string {
+	if len(state.Todo) == 0 {
+		return ""
+	}
+	return state.Todo[0].Action
+}
+
+// finish moves the rebased branch to the result and checks it out again.
+func (state *rebaseState) finish() error {
+	head, err := resolveHead()
+	if err != nil {
+		return err
+	}
+	refs := localRefs()
+	name := "detached HEAD"
+	if state.Branch != "" {
+		name = strings.TrimPrefix(state.Branch, "refs/heads/")
+		if err := refs.update(state.Branch, head, state.OrigHead, "rebase (finish): "+state.Branch+" onto "+state.Onto); err != nil {
+			return fmt.Errorf("failed to update %s: %w", name, err)
+		}
+		if err := refs.setHead("ref: "+state.Branch, "rebase (finish): returning to "+state.Branch); err != nil {
+			return fmt.Errorf("failed to update HEAD: %w", err)
+		}
+	}
+	if err := removeRebase(); err != nil {
+		return err
+	}
+	fmt.Printf("✨ Rebased %s onto %s\n", name, state.Onto[:7])
+	return nil
+}
+
+// ContinueRebase commits the step the rebase stopped at, once its
+// conflicts are resolved and added, or amends HEAD with what is staged
+// after an edit, then carries on.
+func ContinueRebase() error {
+	state, err := loadRebase()
+	if err != nil {
+		return err
+	}
+	store := localObjects()
+	switch {
+	case state.Stopped != nil:
+		unresolved, err := unresolvedPaths(store, state.Conflicts)
+		if err != nil {
+			return err
+		}
+		if len(unresolved) > 0 {
+			return fmt.Errorf("resolve the conflicts in %s and add the files first", strings.Join(unresolved, ", "))
+		}
+		step := *state.Stopped
+		message, author := state.Message, state.Author
+		state.Stopped, state.Message, state.Author, state.Conflicts = nil, "", "", nil
+		stopped, err := state.commit(step, message, author, false)
+		if err != nil {
+			return err
+		}
+		if stopped {
+			return state.save()
+		}
+	case state.Edit:
+		head, err := resolveHead()
+		if err != nil {
+			return err
+		}
+		headFiles, err := revisionEntries(head)
+		if err != nil {
+			return err
+		}
+		staged, err := indexTree()
+		if err != nil {
+			return err
+		}
+		if !sameEntries(staged, headFiles) {
+			headCommit, err := store.LoadCommit(head)
+			if err != nil {
+				return err
+			}
+			created, err := commitIndex(headCommit.Message, headCommit.Author, true)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("✏️  Amended %s as %s: %s\n", head[:7], created[:7], commitSubject(headCommit.Message))
+		}
+		state.Edit = false
+	}
+	return state.run(store)
+}
+
+// SkipRebase drops the step the rebase stopped at, putting the working
+// tree and index back to HEAD, and carries on.
+func SkipRebase() error {
+	state, err := loadRebase()
+	if err != nil {
+		return err
+	}
+	if err := resetToCommit("HEAD", state.Conflicts); err != nil {
+		return err
+	}
+	state.Stopped, state.Message, state.Author, state.Conflicts = nil, "", "", nil
+	state.Edit = false
+	return state.run(localObjects())
+}
+
+// AbortRebase gives up on the rebase, checking out the branch as it was
+// before it started.
+func AbortRebase() error {
+	state, err := loadRebase()
+	if err != nil {
+		return err
+	}
+	if err := resetToCommit(state.OrigHead, state.Conflicts); err != nil {
+		return err
+	}
+	refs := localRefs()
+	if state.Branch != "" {
+		err = refs.setHead("ref: "+state.Branch, "rebase (abort): returning to "+state.Branch)
+	} else {
+		err = refs.setHead(state.OrigHead, "rebase (abort): returning to "+state.OrigHead)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update HEAD: %w", err)
+	}
+	return removeRebase()
+}
+
+func loadRebase() (*rebaseState, error) {
+	data, err := os.ReadFile(localRefs().path("rebase"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no rebase in progress")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rebase state: %w", err)
+	}
+	var state rebaseState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse rebase state: %w", err)
+	}
+	return &state, nil
+}
+
+func (state *rebaseState) save() error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal rebase state: %w", err)
+	}
+	if err := writeFileAtomic(localRefs().path("rebase"), data, 0644); err != nil {
+		return fmt.Errorf("failed to save rebase state: %w", err)
+	}
+	return nil
+}
+
+func removeRebase() error {
+	if err := os.Remove(localRefs().path("rebase")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear rebase state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// specialRefs are the pseudo-refs kept directly under .kommito that can
+// point at a commit outside of refs/.
+var specialRefs = []string{"HEAD", "ORIG_HEAD", "MERGE_HEAD", "CHERRY_PICK_HEAD", "REVERT_HEAD"}
+
+const zeroHash = "0000000000000000000000000000000000000000"
+
+// refStore reads and updates the refs of the repository whose metadata
+// lives in dir (normally ".kommito").
+type refStore struct {
+	dir string
+}
+
+func newRefStore(dir string) *refStore {
+	return &refStore{dir: dir}
+}
+
+func localRefs() *refStore {
+	return newRefStore(repoDir())
+}
+
+func (rs *refStore) path(name string) string {
+	return filepath.Join(rs.dir, filepath.FromSlash(name))
+}
+
+func (rs *refStore) read(name string) (string, error) {
+	data, err := os.ReadFile(rs.path(name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// resolve follows symbolic refs ("ref: refs/heads/main") until it reaches
+// a commit hash. An unborn branch resolves to the empty string.
+func (rs *refStore) resolve(name string) (string, error) {
+	for depth := 0; depth < 5; depth++ {
+		value, err := rs.read(name)
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if !strings.HasPrefix(value, "ref: ") {
+			return value, nil
+		}
+		name = strings.TrimSpace(strings.TrimPrefix(value, "ref: "))
+	}
+	return "", fmt.Errorf("symbolic ref loop at %s", name)
+}
+
+func resolveHead() (string, error) {
+	return localRefs().resolve("HEAD")
+}
+
+// headTarget returns the ref HEAD points at, or "" when HEAD is detached.
+func (rs *refStore) headTarget() (string, error) {
+	value, err := rs.read("HEAD")
+	if err != nil {
+		return "", fmt.Errorf("failed to read HEAD: %w", err)
+	}
+	if strings.HasPrefix(value, "ref: ") {
+		return strings.TrimSpace(strings.TrimPrefix(value, "ref: ")), nil
+	}
+	return "", nil
+}
+
+func isRefFile(name string) bool {
+	return !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".lock")
+}
+
+// checkRefName rejects names that would clash with lock files, temporary
+// files or revision syntax.
+func checkRefName(name string) error {
+	if name == "" {
+		return fmt.Errorf("ref name cannot be empty")
+	}
+	if strings.Contains(name, "..") || strings.ContainsAny(name, " ~^:?*[\\") || strings.HasSuffix(name, "/") {
+		return fmt.Errorf("'%s' is not a valid ref name", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.HasPrefix(part, "-") || strings.HasSuffix(part, ".lock") {
+			return fmt.Errorf("'%s' is not a valid ref name", name)
+		}
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("'%s' is not a valid ref name", name)
+		}
+	}
+	return nil
+}
+
+// list returns every ref stored under refs/ keyed by its full
+// name (e.g. "refs/heads/main").
+func (rs *refStore) list() (map[string]string, error) {
+	refs := make(map[string]string)
+	root := rs.path("refs")
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !isRefFile(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(rs.dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		value, err := rs.resolve(name)
+		if err != nil {
+			return err
+		}
+		refs[name] = value
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs: %w", err)
+	}
+	return refs, nil
+}
+
+// update moves a ref from oldHash to newHash while holding its lock. The
+// update fails with ErrRefChanged if the ref no longer holds oldHash; an
+// empty oldHash means the ref must not exist yet.
+func (rs *refStore) update(name, newHash, oldHash, message string) error {
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	refPath := rs.path(name)
+	lock, err := acquireLock(refPath)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	current, err := rs.read(name)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if current != oldHash {
+		return fmt.Errorf("cannot update %s: expected %s but found %s: %w",
+			name, describeRefValue(oldHash), describeRefValue(current), ErrRefChanged)
+	}
+
+	if err := writeFileAtomic(refPath, []byte(newHash), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return rs.appendReflog(name, oldHash, newHash, message)
+}
+
+// updateHead advances whatever HEAD points at: the current branch when HEAD
+// is symbolic, or HEAD itself when detached.
+func (rs *refStore) updateHead(newHash, oldHash, message string) error {
+	target, err := rs.headTarget()
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		return rs.update("HEAD", newHash, oldHash, message)
+	}
+	if err := rs.update(target, newHash, oldHash, message); err != nil {
+		return err
+	}
+	return rs.appendReflog("HEAD", oldHash, newHash, message)
+}
+
+// setHead replaces HEAD unconditionally, either with "ref: <name>" or with a
+// commit hash for a detached checkout.
+func (rs *refStore) setHead(value, message string) error {
+	headPath := rs.path("HEAD")
+	lock, err := acquireLock(headPath)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	oldHash, err := rs.resolve("HEAD")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(headPath, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to update HEAD: %w", err)
+	}
+	newHash, err := rs.resolve("HEAD")
+	if err != nil {
+		return err
+	}
+	return rs.appendReflog("HEAD", oldHash, newHash, message)
+}
+
+// delete removes a ref and its reflog, provided it still holds oldHash.
+func (rs *refStore) delete(name, oldHash string) error {
+	refPath := rs.path(name)
+	lock, err := acquireLock(refPath)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	current, err := rs.read(name)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if current != oldHash {
+		return fmt.Errorf("cannot delete %s: expected %s but found %s: %w",
+			name, describeRefValue(oldHash), describeRefValue(current), ErrRefChanged)
+	}
+	if err := os.Remove(refPath); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	if err := os.Remove(rs.path("logs/" + name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete reflog for %s: %w", name, err)
+	}
+	return nil
+}
+
+func describeRefValue(value string) string {
+	if value == "" {
+		return "no ref"
+	}
+	return value
+}
+
+// appendReflog records a ref movement as
+// "<old> <new> <author> <unix-time> <zone>\t<message>".
+func (rs *refStore) appendReflog(name, oldHash, newHash, message string) error {
+	if oldHash == newHash {
+		return nil
+	}
+	if oldHash == "" {
+		oldHash = zeroHash
+	}
+	if newHash == "" {
+		newHash = zeroHash
+	}
+	logPath := rs.path("logs/" + name)
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return fmt.Errorf("failed to create reflog directory: %w", err)
+	}
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open reflog: %w", err)
+	}
+	defer f.Close()
+
+	now := time.Now()
+	message = strings.ReplaceAll(message, "\n", " ")
+	line := fmt.Sprintf("%s %s %s %d %s\t%s\n", oldHash, newHash, commitAuthor(), now.Unix(), now.Format("-0700"), message)
+	if _, err := f.WriteString(line); err != nil {
+		return fmt.Errorf("failed to write reflog: %w", err)
+	}
+	return nil
+}
+
+// RefUpdate moves Name from Old to New; an empty Old means the ref must not
+// exist yet and an empty New deletes it.
+type RefUpdate struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// updateAll applies several ref updates atomically: every ref is locked and
+// checked against its expected old value before any of them is written.
+func (rs *refStore) updateAll(updates []RefUpdate, message string) error {
+	sorted := append([]RefUpdate(nil), updates...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	for _, update := range sorted {
+		if err := checkRefName(update.Name); err != nil {
+			return err
+		}
+		lock, err := acquireLock(rs.path(update.Name))
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	for _, update := range sorted {
+		current, err := rs.read(update.Name)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read %s: %w", update.Name, err)
+		}
+		if current != update.Old {
+			return fmt.Errorf("cannot update %s: expected %s but found %s: %w",
+				update.Name, describeRefValue(update.Old), describeRefValue(current), ErrRefChanged)
+		}
+	}
+
+	for _, update := range sorted {
+		if update.New == "" {
+			if err := os.Remove(rs.path(update.Name)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete %s: %w", update.Name, err)
+			}
+			if err := os.Remove(rs.path("logs/" + update.Name)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete reflog for %s: %w", update.Name, err)
+			}
+			continue
+		}
+		if err := writeFileAtomic(rs.path(update.Name), []byte(update.New), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", update.Name, err)
+		}
+		if err := rs.appendReflog(update.Name, update.Old, update.New, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,464 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrNonFastForward is returned when a push would discard commits on the
+// remote branch.
+var ErrNonFastForward = errors.New("non-fast-forward")
+
+func AddRemote(name, url string) error {
+	if err := checkRefName(name); err != nil {
+		return fmt.Errorf("invalid remote name: %w", err)
+	}
+	return updateConfig(func(cfg *Config) error {
+		if _, ok := cfg.Remotes[name]; ok {
+			return fmt.Errorf("remote '%s' already exists", name)
+		}
+		if cfg.Remotes == nil {
+			cfg.Remotes = make(map[string]RemoteConfig)
+		}
+		cfg.Remotes[name] = RemoteConfig{URL: url}
+		return nil
+	})
+}
+
+// RemoveRemote forgets a remote together with its remote-tracking refs.
+func RemoveRemote(name string) error {
+	err := updateConfig(func(cfg *Config) error {
+		if _, ok := cfg.Remotes[name]; !ok {
+			return fmt.Errorf("no such remote '%s'", name)
+		}
+		delete(cfg.Remotes, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	refs := localRefs()
+	tracking, err := refs.list()
+	if err != nil {
+		return err
+	}
+	for ref, hash := range tracking {
+		if strings.HasPrefix(ref, "refs/remotes/"+name+"/") {
+			if err := refs.delete(ref, hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func ListRemotes() (map[string]string, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	remotes := make(map[string]string)
+	for name, remote := range cfg.Remotes {
+		remotes[name] = remote.URL
+	}
+	return remotes, nil
+}
+
+func remoteConfig(name string) (RemoteConfig, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return RemoteConfig{}, err
+	}
+	remote, ok := cfg.Remotes[name]
+	if !ok {
+		return RemoteConfig{}, fmt.Errorf("no such remote '%s'", name)
+	}
+	return remote, nil
+}
+
+func remoteURL(name string) (string, error) {
+	remote, err := remoteConfig(name)
+	return remote.URL, err
+}
+
+// setOrigin records url as the "origin" remote of the repository whose
+// metadata lives in dir and creates remote-tracking refs for refs.
+func setOrigin(dir, url string, refs map[string]string, remote RemoteConfig) error {
+	cfg, err := loadConfigFrom(dir)
+	if err != nil {
+		return err
+	}
+	if cfg.Remotes == nil {
+		cfg.Remotes = make(map[string]RemoteConfig)
+	}
+	remote.URL = url
+	cfg.Remotes["origin"] = remote
+	if err := saveConfigTo(dir, cfg); err != nil {
+		return err
+	}
+
+	store := newRefStore(dir)
+	for name, hash := range refs {
+		if !strings.HasPrefix(name, "refs/heads/") {
+			continue
+		}
+		tracking := "refs/remotes/origin/" + strings.TrimPrefix(name, "refs/heads/")
+		if err := store.update(tracking, hash, "", "clone: from "+url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RefChange describes how one local ref moved during fetch or push.
+type RefChange struct {
+	Remote string
+	Local  string
+	Old    string
+	New    string
+}
+
+func (c RefChange) String() string {
+	switch {
+	case c.New == "":
+		return fmt.Sprintf(" - [deleted]         %s", c.Local)
+	case c.Old == "":
+		return fmt.Sprintf(" * [new]             %s -> %s", c.Remote, c.Local)
+	default:
+		return fmt.Sprintf("   %s..%s  %s -> %s", c.Old[:7], c.New[:7], c.Remote, c.Local)
+	}
+}
+
+type FetchResult struct {
+	Objects int
+	Changes []RefChange
+}
+
+// Fetch copies the objects of every branch and tag of a remote that are
+// missing locally and moves refs/remotes/<remote>/* to match. Tags are only
+// created, never moved. With prune set, tracking refs for branches that no
+// longer exist on the remote are deleted. A mirror remote instead overwrites
+// the local branches and tags, see fetchMirror.
+//
+// A remote cloned with a single branch only fetches that branch, and only
+// gets the tags that point into history fetched anyway.
+//
+// A bundle file can be fetched without adding it as a remote; its branches
+// are then tracked under refs/remotes/bundle/.
+func Fetch(remote string, opts FetchOptions) (*FetchResult, error) {
+	config, err := remoteConfig(remote)
+	if err != nil {
+		if !isBundle(remote) {
+			return nil, err
+		}
+		config, remote = RemoteConfig{URL: absoluteRemotePath(remote)}, "bundle"
+	}
+	store := localObjects()
+	if opts.Unshallow && len(store.shallowCommits()) == 0 {
+		return nil, fmt.Errorf("--unshallow on a complete repository does not make sense")
+	}
+	if opts.Filter == "" {
+		opts.Filter = config.Filter
+	}
+	url := config.URL
+	if config.Mirror {
+		return fetchMirror(url, opts)
+	}
+	transport, err := openTransport(url)
+	if err != nil {
+		return nil, err
+	}
+	defer transport.Close()
+
+	remoteRefs, _, err := transport.ListRefs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote refs: %w", err)
+	}
+	var wants []string
+	for name, hash := range remoteRefs {
+		if config.fetches(name) {
+			wants = append(wants, hash)
+		}
+	}
+	objects, err := fetchInto(transport, wants, store, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch objects: %w", err)
+	}
+
+	result := &FetchResult{Objects: objects}
+	refs := localRefs()
+	local, err := refs.list()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(remoteRefs))
+	for name := range remoteRefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hash := remoteRefs[name]
+		// Tags outside the configured refs are followed when the fetch
+		// brought their commits; other branches never are.
+		if !config.fetches(name) && (!strings.HasPrefix(name, "refs/tags/") || !store.Has(kindCommit, hash)) {
+			continue
+		}
+		target := name
+		if strings.HasPrefix(name, "refs/heads/") {
+			target = "refs/remotes/" + remote + "/" + strings.TrimPrefix(name, "refs/heads/")
+		} else if _, exists := local[name]; exists {
+			continue
+		}
+		old := local[target]
+		if old == hash {
+			continue
+		}
+		if err := refs.update(target, hash, old, "fetch: from "+url); err != nil {
+			return nil, err
+		}
+		result.Changes = append(result.Changes, RefChange{Remote: name, Local: target, Old: old, New: hash})
+	}
+
+	if opts.Prune {
+		prefix := "refs/remotes/" + remote + "/"
+		for name, hash := range local {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if _, ok := remoteRefs["refs/heads/"+strings.TrimPrefix(name, prefix)]; ok {
+				continue
+			}
+			if err := refs.delete(name, hash); err != nil {
+				return nil, err
+			}
+			result.Changes = append(result.Changes, RefChange{Local: name, Old: hash})
+		}
+	}
+	return result, nil
+}
+
+// fetchMirror makes the local branches and tags an exact copy of the
+// remote's, including deleting those the remote no longer has.
+func fetchMirror(url string, opts FetchOptions) (*FetchResult, error) {
+	transport, err := openTransport(url)
+	if err != nil {
+		return nil, err
+	}
+	defer transport.Close()
+
+	remoteRefs, _, err := transport.ListRefs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote refs: %w", err)
+	}
+	var wants []string
+	for _, hash := range remoteRefs {
+		wants = append(wants, hash)
+	}
+	objects, err := fetchInto(transport, wants, localObjects(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch objects: %w", err)
+	}
+
+	refs := localRefs()
+	local, err := refs.list()
+	if err != nil {
+		return nil, err
+	}
+	result := &FetchResult{Objects: objects}
+	var updates []RefUpdate
+	for name, hash := range remoteRefs {
+		if local[name] != hash {
+			updates = append(updates, RefUpdate{Name: name, Old: local[name], New: hash})
+			result.Changes = append(result.Changes, RefChange{Remote: name, Local: name, Old: local[name], New: hash})
+		}
+	}
+	if err := refs.updateAll(updates, "fetch: mirror "+url); err != nil {
+		return nil, err
+	}
+	for name, hash := range local {
+		_, kept := remoteRefs[name]
+		if kept || !(strings.HasPrefix(name, "refs/heads/") || strings.HasPrefix(name, "refs/tags/")) {
+			continue
+		}
+		if err := refs.delete(name, hash); err != nil {
+			return nil, err
+		}
+		result.Changes = append(result.Changes, RefChange{Local: name, Old: hash})
+	}
+	sort.Slice(result.Changes, func(i, j int) bool { return result.Changes[i].Local < result.Changes[j].Local })
+	return result, nil
+}
+
+type PushOptions struct {
+	Force bool
+	// ForceWithLease allows a non-fast-forward update only while the remote
+	// branch still holds Expect, or the remote-tracking ref when Expect is
+	// empty.
+	ForceWithLease bool
+	Expect         string
+}
+
+type PushResult struct {
+	Objects int
+	Change  RefChange
+}
+
+// Push sends a local branch to the same branch on a remote. Unless forced,
+// the remote branch may only move forward; the final ref update is a
+// compare-and-swap, so a concurrent push to the same branch is detected.
+func Push(remote, branch string, opts PushOptions) (*PushResult, error) {
+	url, err := remoteURL(remote)
+	if err != nil {
+		return nil, err
+	}
+	if branch == "" {
+		if branch, err = NewBranchManager(".").GetCurrentBranch(); err != nil {
+			return nil, err
+		}
+	}
+	refName := "refs/heads/" + branch
+	refs := localRefs()
+	local, err := refs.resolve(refName)
+	if err != nil {
+		return nil, err
+	}
+	if local == "" {
+		return nil, fmt.Errorf("branch '%s' has no commits to push", branch)
+	}
+
+	transport, err := openTransport(url)
+	if err != nil {
+		return nil, err
+	}
+	defer transport.Close()
+
+	remoteRefs, _, err := transport.ListRefs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote refs: %w", err)
+	}
+	old := remoteRefs[refName]
+	tracking := "refs/remotes/" + remote + "/" + branch
+	result := &PushResult{Change: RefChange{Remote: refName, Local: tracking, Old: old, New: local}}
+	if old == local {
+		return result, nil
+	}
+
+	switch {
+	case opts.ForceWithLease:
+		expect := opts.Expect
+		if expect == "" {
+			if expect, err = refs.resolve(tracking); err != nil {
+				return nil, err
+			}
+		}
+		if old != expect {
+			return nil, fmt.Errorf("stale info: %s on %s is %s, expected %s; fetch and review before forcing",
+				branch, remote, describeRefValue(old), describeRefValue(expect))
+		}
+	case opts.Force:
+	case old != "":
+		objects := localObjects()
+		if !objects.Has(kindCommit, old) {
+			return nil, fmt.Errorf("%s on %s has commits you do not have; fetch and merge first: %w", branch, remote, ErrNonFastForward)
+		}
+		ok, err := isAncestor(objects, old, local)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s on %s has diverged from yours; merge or use --force-with-lease: %w", branch, remote, ErrNonFastForward)
+		}
+	}
+
+	sent, err := transport.Push(localObjects(), []RefUpdate{{Name: refName, Old: old, New: local}})
+	if err != nil {
+		return nil, err
+	}
+	result.Objects = sent
+
+	current, err := refs.resolve(tracking)
+	if err != nil {
+		return nil, err
+	}
+	if err := refs.update(tracking, local, current, "push: to "+url); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Pull fetches from a remote and integrates its copy of branch into the
+// current branch: a fast-forward when possible, a merge otherwise.
+func Pull(remote, branch string) (*FetchResult, error) {
+	if err := requireWorkTree(); err != nil {
+		return nil, err
+	}
+	fetched, err := Fetch(remote, FetchOptions{})
+	if err != nil {
+		return nil, err
+	}
+	bm := NewBranchManager(".")
+	current, err := bm.GetCurrentBranch()
+	if err != nil {
+		return nil, err
+	}
+	if branch == "" {
+		branch = current
+	}
+
+	refs := localRefs()
+	trackingName := remote + "/" + branch
+	target, err := refs.resolve("refs/remotes/" + trackingName)
+	if err != nil {
+		return nil, err
+	}
+	if target == "" {
+		return nil, fmt.Errorf("remote '%s' has no branch '%s'", remote, branch)
+	}
+	head, err := resolveHead()
+	if err != nil {
+		return nil, err
+	}
+
+	objects := localObjects()
+	if upToDate, err := isAncestor(objects, target, head); err != nil || (upToDate && head != "") {
+		if err == nil {
+			fmt.Println("Already up to date.")
+		}
+		return fetched, err
+	}
+	fastForward, err := isAncestor(objects, head, target)
+	if err != nil {
+		return nil, err
+	}
+	if !fastForward {
+		return fetched, mergeCommits(head, trackingName, target)
+	}
+
+	commit, err := LoadCommit(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := updateWorkingTree(head, commit); err != nil {
+		return nil, err
+	}
+	if err := refs.updateHead(target, head, "pull: fast-forward to "+trackingName); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Fast-forwarded %s to %s\n", current, target[:7])
+	return fetched, nil
+}
+
+// absoluteRemotePath keeps local remote URLs usable from any directory.
+func absoluteRemotePath(url string) string {
+	if strings.Contains(url, "://") || isNetworkURL(url) {
+		return url
+	}
+	if abs, err := filepath.Abs(url); err == nil {
+		return abs
+	}
+	return url
+}
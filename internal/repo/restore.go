@@ -0,0 +1,130 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// RestoreOptions controls RestoreFiles.
+type RestoreOptions struct {
+	// Source is the revision to restore from. When it is empty the working
+	// tree is restored from the index, and the index from HEAD.
+	Source string
+	// Staged restores the index and Worktree the working tree; the working
+	// tree alone when neither is set.
+	Staged, Worktree bool
+}
+
+// RestoreFiles puts the files the paths name back to how they are in the
+// source, discarding their changes. Tracked files the source does not have
+// are removed. It returns the files restored.
+func RestoreFiles(paths []string, opts RestoreOptions) ([]string, error) {
+	if err := requireWorkTree(); err != nil {
+		return nil, err
+	}
+	if !opts.Staged {
+		opts.Worktree = true
+	}
+	staged, err := indexTree()
+	if err != nil {
+		return nil, err
+	}
+	source := staged
+	switch {
+	case opts.Source != "":
+		if source, err = revisionEntries(opts.Source); err != nil {
+			return nil, err
+		}
+	case opts.Staged:
+		head, err := resolveHead()
+		if err != nil {
+			return nil, err
+		}
+		source = map[string]TreeEntry{}
+		if head != "" {
+			if source, err = revisionEntries(head); err != nil {
+				return nil, err
+			}
+		}
+	}
+	candidates := make(map[string]TreeEntry, len(source))
+	for path, entry := range staged {
+		candidates[path] = entry
+	}
+	for path, entry := range source {
+		candidates[path] = entry
+	}
+	files, err := pathspecFiles(candidates, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Worktree {
+		objects := localObjects()
+		var needed []string
+		for _, path := range files {
+			if err := checkWorktreePath(path); err != nil {
+				return nil, err
+			}
+			if entry, ok := source[path]; ok {
+				needed = append(needed, entry.Hash)
+			}
+		}
+		if err := objects.prefetchBlobs(needed); err != nil {
+			return nil, err
+		}
+		fileMode := fileModeEnabled()
+		for _, path := range files {
+			diskPath := filepath.FromSlash(path)
+			entry, ok := source[path]
+			if !ok {
+				if _, tracked := staged[path]; tracked {
+					if err := os.Remove(diskPath); err != nil && !os.IsNotExist(err) {
+						return nil, fmt.Errorf("failed to remove %s: %w", path, err)
+					}
+					pruneEmptyDirs(filepath.Dir(diskPath))
+				}
+				continue
+			}
+			if hash, mode, err := hashWorktreeFile(diskPath, entry.Mode, fileMode); err == nil && hash == objects.worktreeHash(entry.Hash) && mode == entry.Mode {
+				continue
+			}
+			if info, err := os.Lstat(diskPath); err == nil && info.IsDir() {
+				if err := os.RemoveAll(diskPath); err != nil {
+					return nil, fmt.Errorf("failed to replace directory %s: %w", path, err)
+				}
+			}
+			if err := objects.checkoutEntry(entry, diskPath, fileMode); err != nil {
+				return nil, fmt.Errorf("failed to restore file %s: %w", path, err)
+			}
+		}
+	}
+
+	if opts.Staged {
+		restored := make(map[string]bool, len(files))
+		for _, path := range files {
+			restored[path] = true
+		}
+		err = updateIndex(func(entries []indexEntry) []indexEntry {
+			kept := entries[:0]
+			for _, entry := range entries {
+				if !restored[entry.Path] {
+					kept = append(kept, entry)
+				} else if file, ok := source[entry.Path]; ok {
+					kept = append(kept, indexEntry{Hash: file.Hash, Path: entry.Path, Mode: file.Mode})
+				}
+			}
+			for _, path := range files {
+				if file, ok := source[path]; ok {
+					kept = stageEntry(kept, indexEntry{Hash: file.Hash, Path: path, Mode: file.Mode})
+				}
+			}
+			return kept
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
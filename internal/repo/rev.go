@@ -0,0 +1,155 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// resolveRevision turns a name given on the command line into a commit
+// hash. It accepts HEAD, a branch, tag or remote-tracking branch, a full
+// ref name, or a commit hash abbreviated to at least four characters,
+// followed by any number of "~<n>" (n-th first-parent ancestor) and
+// "^<n>" (n-th parent) steps.
+func resolveRevision(name string) (string, error) {
+	hash, _, err := resolveRevisionRef(name)
+	return hash, err
+}
+
+// resolveRevisionRef is resolveRevision that also returns the full ref name
+// the revision was found under, or "" for HEAD, hashes and ancestors.
+func resolveRevisionRef(name string) (string, string, error) {
+	if i := strings.IndexAny(name, "~^"); i > 0 {
+		hash, err := resolveRevision(name[:i])
+		if err != nil {
+			return "", "", err
+		}
+		hash, err = walkAncestry(localObjects(), hash, name[i:])
+		return hash, "", err
+	}
+	refs := localRefs()
+	if name == "HEAD" || name == "@" {
+		head, err := resolveHead()
+		if err != nil {
+			return "", "", err
+		}
+		if head == "" {
+			return "", "", fmt.Errorf("HEAD does not point at a commit yet")
+		}
+		return head, "", nil
+	}
+	for _, ref := range []string{name, "refs/" + name, "refs/heads/" + name, "refs/tags/" + name, "refs/remotes/" + name} {
+		if !strings.HasPrefix(ref, "refs/") || checkRefName(strings.TrimPrefix(ref, "refs/")) != nil {
+			continue
+		}
+		hash, err := refs.read(ref)
+		if err == nil && hash != "" {
+			return hash, ref, nil
+		}
+	}
+	hash, err := expandCommitHash(localObjects(), name)
+	return hash, "", err
+}
+
+// expandCommitHash finds the one stored commit whose hash starts with
+// prefix.
+func expandCommitHash(store *ObjectStore, prefix string) (string, error) {
+	matches, err := expandHash(store, kindCommit, prefix)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case len(matches) == 0 && len(prefix) == 40:
+		return "", fmt.Errorf("commit %s not found", prefix)
+	case len(matches) == 0:
+		return "", fmt.Errorf("unknown revision '%s'", prefix)
+	case len(matches) == 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("short commit hash '%s' is ambiguous", prefix)
+}
+
+// expandHash lists the stored objects of one kind whose hash starts with
+// prefix, which must be at least four hex digits.
+func expandHash(store *ObjectStore, kind, prefix string) ([]string, error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) < 4 || len(prefix) > 40 || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("unknown revision '%s'", prefix)
+	}
+	if len(prefix) == 40 {
+		if store.Has(kind, prefix) {
+			return []string{prefix}, nil
+		}
+		return nil, nil
+	}
+	entries, err := os.ReadDir(filepath.Join(store.dir, "objects", kind))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %w", kind, err)
+	}
+	var matches []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) && isObjectHash(entry.Name()) {
+			matches = append(matches, entry.Name())
+		}
+	}
+	return matches, nil
+}
+
+// walkAncestry follows a chain of "~<n>" and "^<n>" steps from hash.
+func walkAncestry(store *ObjectStore, hash, steps string) (string, error) {
+	for steps != "" {
+		op := steps[0]
+		end := 1
+		for end < len(steps) && steps[end] >= '0' && steps[end] <= '9' {
+			end++
+		}
+		if op != '~' && op != '^' {
+			return "", fmt.Errorf("invalid revision suffix '%s'", steps)
+		}
+		n := 1
+		if end > 1 {
+			var err error
+			if n, err = strconv.Atoi(steps[1:end]); err != nil {
+				return "", fmt.Errorf("invalid revision suffix '%s'", steps)
+			}
+		}
+		steps = steps[end:]
+
+		generations, parent := n, 1
+		if op == '^' {
+			generations, parent = 1, n
+			if n == 0 {
+				continue
+			}
+		}
+		for ; generations > 0; generations-- {
+			commit, err := store.LoadCommit(hash)
+			if err != nil {
+				return "", err
+			}
+			if parent > len(commit.Parents) {
+				if store.isShallow(hash) {
+					return "", fmt.Errorf("history before %s was not fetched (shallow clone)", hash[:7])
+				}
+				return "", fmt.Errorf("commit %s has no parent %d", hash[:7], parent)
+			}
+			hash = commit.Parents[parent-1]
+		}
+	}
+	return hash, nil
+}
+
+// revisionEntries returns the files of the commit a revision names.
+func revisionEntries(rev string) (map[string]TreeEntry, error) {
+	hash, err := resolveRevision(rev)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := LoadCommit(hash)
+	if err != nil {
+		return nil, err
+	}
+	return commitEntries(commit)
+}
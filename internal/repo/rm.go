@@ -0,0 +1,92 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// RemoveOptions controls RemoveFiles.
+type RemoveOptions struct {
+	// Cached only stops tracking the files, leaving them in the working
+	// tree.
+	Cached bool
+	// Force removes files even when changes to them would be lost.
+	Force bool
+}
+
+// RemoveFiles stops tracking the files the paths name and, unless
+// opts.Cached is set, deletes them from the working tree. When a file has
+// changes that are not committed nothing is removed, unless opts.Force is
+// set. It returns the files removed.
+func RemoveFiles(paths []string, opts RemoveOptions) ([]string, error) {
+	if err := requireWorkTree(); err != nil {
+		return nil, err
+	}
+	staged, err := indexTree()
+	if err != nil {
+		return nil, err
+	}
+	files, err := pathspecFiles(staged, paths)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Force {
+		head, err := resolveHead()
+		if err != nil {
+			return nil, err
+		}
+		headFiles := map[string]TreeEntry{}
+		if head != "" {
+			if headFiles, err = revisionEntries(head); err != nil {
+				return nil, err
+			}
+		}
+		objects := localObjects()
+		fileMode := fileModeEnabled()
+		for _, path := range files {
+			entry := staged[path]
+			hash, mode, err := hashWorktreeFile(filepath.FromSlash(path), entry.Mode, fileMode)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			modified := err == nil && (hash != objects.worktreeHash(entry.Hash) || mode != entry.Mode)
+			stagedChange := headFiles[path] != entry
+			switch {
+			case opts.Cached && modified && stagedChange:
+				return nil, fmt.Errorf("'%s' has staged changes that differ from both the file and HEAD, use --force to remove it", path)
+			case !opts.Cached && modified:
+				return nil, fmt.Errorf("'%s' has local modifications, use --cached to keep the file or --force to remove it", path)
+			case !opts.Cached && stagedChange:
+				return nil, fmt.Errorf("'%s' has changes staged in the index, use --cached to keep the file or --force to remove it", path)
+			}
+		}
+	}
+
+	removed := make(map[string]bool, len(files))
+	for _, path := range files {
+		removed[path] = true
+	}
+	err = updateIndex(func(entries []indexEntry) []indexEntry {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if !removed[entry.Path] {
+				kept = append(kept, entry)
+			}
+		}
+		return kept
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Cached {
+		for _, path := range files {
+			diskPath := filepath.FromSlash(path)
+			if err := os.Remove(diskPath); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to remove %s: %w", path, err)
+			}
+			pruneEmptyDirs(filepath.Dir(diskPath))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,125 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The shallow file of a shallow clone lists, one per line, the commits whose
+// parents were not fetched. LoadCommit treats them as root commits, so log,
+// ancestry checks, gc and transfers all stop at that boundary instead of
+// failing on the missing history.
+const shallowFile = "shallow"
+
+func (s *ObjectStore) shallowCommits() map[string]bool {
+	if s.shallow != nil {
+		return s.shallow
+	}
+	s.shallow = make(map[string]bool)
+	data, err := os.ReadFile(filepath.Join(s.dir, shallowFile))
+	if err != nil {
+		return s.shallow
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if hash := strings.TrimSpace(line); isObjectHash(hash) {
+			s.shallow[hash] = true
+		}
+	}
+	return s.shallow
+}
+
+func (s *ObjectStore) isShallow(hash string) bool {
+	return s.shallowCommits()[hash]
+}
+
+func (s *ObjectStore) shallowList() []string {
+	var hashes []string
+	for hash := range s.shallowCommits() {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func (s *ObjectStore) writeShallow(commits map[string]bool) error {
+	path := filepath.Join(s.dir, shallowFile)
+	s.shallow = commits
+	if len(commits) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", shallowFile, err)
+		}
+		return nil
+	}
+	var data strings.Builder
+	for _, hash := range s.shallowList() {
+		data.WriteString(hash + "\n")
+	}
+	if err := writeFileAtomic(path, []byte(data.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", shallowFile, err)
+	}
+	return nil
+}
+
+// updateShallow recomputes the shallow boundary after a fetch: every commit
+// reachable from tips or from the old boundary whose parents are not all
+// stored is a shallow commit. Commits whose missing history has now arrived
+// drop out.
+func (s *ObjectStore) updateShallow(tips []string) error {
+	shallow := make(map[string]bool)
+	pending := append(s.shallowList(), tips...)
+	seen := make(map[string]bool)
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[hash] || !s.Has(kindCommit, hash) {
+			continue
+		}
+		seen[hash] = true
+		commit, err := s.readCommit(hash)
+		if err != nil {
+			return err
+		}
+		for _, parent := range commit.Parents {
+			if s.Has(kindCommit, parent) {
+				pending = append(pending, parent)
+			} else {
+				shallow[hash] = true
+			}
+		}
+	}
+	return s.writeShallow(shallow)
+}
+
+// historyWithin returns the commits at most depth commits deep from tips,
+// not descending into commits have() reports as already present.
+func historyWithin(store *ObjectStore, tips []string, depth int, have func(kind, hash string) bool) (map[string]bool, error) {
+	within := make(map[string]bool)
+	level := tips
+	for d := 1; d <= depth && len(level) > 0; d++ {
+		var next []string
+		for _, hash := range level {
+			if hash == "" || within[hash] || have(kindCommit, hash) {
+				continue
+			}
+			within[hash] = true
+			if d == depth {
+				continue
+			}
+			commit, err := store.LoadCommit(hash)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, commit.Parents...)
+		}
+		level = next
+	}
+	return within, nil
+}
+
+// IsShallow reports whether the current repository is a shallow clone.
+func IsShallow() bool {
+	return len(localObjects().shallowCommits()) > 0
+}
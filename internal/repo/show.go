@@ -0,0 +1,276 @@
+package repo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ShowOptions controls what Show prints for commits.
+type ShowOptions struct {
+	// NoPatch leaves out the diff; Stat adds a diffstat.
+	NoPatch, Stat bool
+	// Paths limits the diff to these files and directories.
+	Paths []string
+	Color bool
+}
+
+// shownObject is an object found by name: a commit, a tree, or a blob. A
+// directory at a revision is its commit's tree with Dir set, since trees
+// list every path of a commit at once.
+type shownObject struct {
+	Kind string
+	Hash string
+	Dir  string
+	// Tag is the tag the commit was named by, if any.
+	Tag string
+	// File is set for a blob named by path, whose content is shown as
+	// the file was rather than as stored.
+	File bool
+}
+
+// Show writes each named object: a commit with its diff, a tag with the
+// commit it points at, a tree's listing or a blob's content. Names are
+// revisions, "<rev>:<path>" for a file or directory at a revision, or
+// abbreviated hashes of any object. Tags are refs rather than objects, so
+// there is no annotation to show.
+func Show(w io.Writer, names []string, opts ShowOptions) error {
+	if len(names) == 0 {
+		names = []string{"HEAD"}
+	}
+	store := localObjects()
+	var objects []shownObject
+	for _, name := range names {
+		object, err := findObject(store, name)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, object)
+	}
+	decorations, err := refDecorations(store)
+	if err != nil {
+		return err
+	}
+	f := logFormatter{
+		store:       store,
+		opts:        LogOptions{Patch: !opts.NoPatch, Stat: opts.Stat, Paths: opts.Paths, Color: opts.Color},
+		decorations: decorations,
+		shallow:     store.shallowCommits(),
+		now:         time.Now(),
+	}
+
+	bw := bufio.NewWriter(w)
+	for i, object := range objects {
+		if i > 0 && object.Kind != kindBlob {
+			fmt.Fprintln(bw)
+		}
+		switch object.Kind {
+		case kindCommit:
+			if object.Tag != "" {
+				fmt.Fprintf(bw, "🏷️ Tag: %s\n", object.Tag)
+			}
+			commit, err := store.LoadCommit(object.Hash)
+			if err != nil {
+				return err
+			}
+			if err := f.write(bw, object.Hash, commit, true); err != nil {
+				return err
+			}
+			if len(commit.Parents) > 1 && (f.opts.Patch || f.opts.Stat) {
+				if err := writeMergeDiff(bw, &f, commit); err != nil {
+					return err
+				}
+			}
+		case kindTree:
+			if err := writeTreeListing(bw, store, names[i], object); err != nil {
+				return err
+			}
+		case kindBlob:
+			var r io.ReadCloser
+			if object.File {
+				r, err = store.openWorktreeContent(object.Hash)
+			} else {
+				r, err = store.Open(kindBlob, object.Hash)
+			}
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(bw, r)
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("failed to read blob %s: %w", object.Hash, err)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// findObject resolves a name given to show.
+func findObject(store *ObjectStore, name string) (shownObject, error) {
+	if rev, path, ok := strings.Cut(name, ":"); ok {
+		if rev == "" {
+			rev = "HEAD"
+		}
+		hash, err := resolveRevision(rev)
+		if err != nil {
+			return shownObject{}, err
+		}
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return shownObject{}, err
+		}
+		entries, err := commitEntries(commit)
+		if err != nil {
+			return shownObject{}, err
+		}
+		path = strings.Trim(path, "/")
+		if entry, ok := entries[path]; ok {
+			return shownObject{Kind: kindBlob, Hash: entry.Hash, File: entry.Mode != modeSymlink}, nil
+		}
+		for file := range entries {
+			if path == "" || strings.HasPrefix(file, path+"/") {
+				return shownObject{Kind: kindTree, Hash: commit.Tree, Dir: path}, nil
+			}
+		}
+		return shownObject{}, fmt.Errorf("path '%s' does not exist in '%s'", path, rev)
+	}
+
+	hash, ref, revErr := resolveRevisionRef(name)
+	if revErr == nil {
+		object := shownObject{Kind: kindCommit, Hash: hash}
+		if strings.HasPrefix(ref, "refs/tags/") {
+			object.Tag = strings.TrimPrefix(ref, "refs/tags/")
+		}
+		return object, nil
+	}
+	var found []shownObject
+	for _, kind := range []string{kindTree, kindBlob, kindManifest} {
+		matches, err := expandHash(store, kind, name)
+		if err != nil {
+			return shownObject{}, revErr
+		}
+		for _, match := range matches {
+			object := shownObject{Kind: kind, Hash: match}
+			if kind == kindManifest {
+				// A chunked blob is stored as the manifest of its chunks.
+				object.Kind = kindBlob
+			}
+			found = append(found, object)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return shownObject{}, revErr
+	case 1:
+		return found[0], nil
+	}
+	return shownObject{}, fmt.Errorf("short object hash '%s' is ambiguous", name)
+}
+
+// writeMergeDiff shows what a merge changed beyond its parents: the files
+// that differ from every parent, against each parent in turn. Files taken
+// unchanged from one side are left out, as in Git's combined diff.
+func writeMergeDiff(w io.Writer, f *logFormatter, commit *Commit) error {
+	entries, err := commitEntries(commit)
+	if err != nil {
+		return err
+	}
+	var parents []map[string]TreeEntry
+	for _, hash := range commit.Parents {
+		parent, err := f.store.LoadCommit(hash)
+		if err != nil {
+			return err
+		}
+		parentEntries, err := commitEntries(parent)
+		if err != nil {
+			return err
+		}
+		parents = append(parents, parentEntries)
+	}
+	resolved := make(map[string]bool)
+	for _, pair := range treeDiffPairs(parents[0], entries) {
+		path := diffPath(pair)
+		resolved[path] = matchesPaths(path, f.opts.Paths)
+		for _, parent := range parents[1:] {
+			old, inOld := parent[path]
+			entry, inNew := entries[path]
+			if inOld == inNew && old == entry {
+				resolved[path] = false
+			}
+		}
+	}
+
+	for i, parent := range parents {
+		var pairs [][2]*diffFile
+		var needed []string
+		for _, pair := range treeDiffPairs(parent, entries) {
+			if !resolved[diffPath(pair)] {
+				continue
+			}
+			pairs = append(pairs, pair)
+			for _, file := range pair {
+				if file != nil {
+					needed = append(needed, file.Hash)
+				}
+			}
+		}
+		if len(pairs) == 0 {
+			continue
+		}
+		if err := f.store.prefetchBlobs(needed); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "🔀 Against parent %s:\n", commit.Parents[i][:7])
+		if f.opts.Stat {
+			if err := writeDiffStat(w, f.store, pairs); err != nil {
+				return err
+			}
+		}
+		if f.opts.Patch {
+			for _, pair := range pairs {
+				if err := writeFileDiff(w, f.store, pair[0], pair[1]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// writeTreeListing lists the files and directories directly inside a tree,
+// or inside object.Dir of it, directories with a trailing slash.
+func writeTreeListing(w io.Writer, store *ObjectStore, name string, object shownObject) error {
+	tree, err := store.ReadTree(object.Hash)
+	if err != nil {
+		return err
+	}
+	prefix := ""
+	if object.Dir != "" {
+		prefix = object.Dir + "/"
+	}
+	names := make(map[string]bool)
+	for _, entry := range tree.Entries {
+		rest, ok := strings.CutPrefix(entry.Path, prefix)
+		if !ok {
+			continue
+		}
+		if dir, _, nested := strings.Cut(rest, "/"); nested {
+			names[dir+"/"] = true
+		} else {
+			names[rest] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	fmt.Fprintf(w, "🌳 Tree: %s\n\n", name)
+	for _, name := range sorted {
+		fmt.Fprintln(w, name)
+	}
+	return nil
+}
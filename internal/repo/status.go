@@ -3,25 +3,22 @@ package repo
 import (
 	"crypto/sha1"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
-	"strings"
 )
 
 func Status() error {
+	if err := requireWorkTree(); err != nil {
+		return err
+	}
 
-	indexPath := filepath.Join(".kommito", "index")
-	indexData, _ := os.ReadFile(indexPath)
-	indexLines := strings.Split(strings.TrimSpace(string(indexData)), "\n")
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
 	staged := make(map[string]string)
-	for _, line := range indexLines {
-		if line == "" {
-			continue
-		}
-		parts := strings.SplitN(line, " ", 2)
-		if len(parts) == 2 {
-			staged[parts[1]] = parts[0]
-		}
+	for _, entry := range entries {
+		staged[entry.Path] = entry.Hash
 	}
 
 	fmt.Println("🗂️ Staged files:")
@@ -35,16 +32,18 @@ func Status() error {
 
 	fmt.Println("\n✏️ Modified but unstaged files:")
 	modified := false
-	for file, hash := range staged {
-		content, err := os.ReadFile(file)
+	objects := localObjects()
+	fileMode := fileModeEnabled()
+	for _, entry := range entries {
+		newHash, mode, err := hashWorktreeFile(entry.Path, entry.Mode, fileMode)
 		if err != nil {
 			continue
 		}
-		h := sha1.New()
-		h.Write(content)
-		newHash := fmt.Sprintf("%x", h.Sum(nil))
-		if newHash != hash {
-			fmt.Printf("  📝 %s\n", file)
+		if newHash != objects.worktreeHash(entry.Hash) {
+			fmt.Printf("  📝 %s\n", entry.Path)
+			modified = true
+		} else if mode != entry.Mode {
+			fmt.Printf("  🔧 %s (mode %s → %s)\n", entry.Path, displayMode(entry.Mode), displayMode(mode))
 			modified = true
 		}
 	}
@@ -53,9 +52,9 @@ func Status() error {
 	}
 
 	fmt.Println("\n❓ Untracked files:")
-	entries, _ := os.ReadDir(".")
+	dirEntries, _ := os.ReadDir(".")
 	untracked := false
-	for _, entry := range entries {
+	for _, entry := range dirEntries {
 		name := entry.Name()
 		if entry.IsDir() || name == ".kommito" || name == ".git" {
 			continue
@@ -70,3 +69,17 @@ func Status() error {
 	}
 	return nil
 }
+
+// hashFile computes a file's blob hash without loading it into memory.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
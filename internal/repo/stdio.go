@@ -0,0 +1,295 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The stdio protocol carries the same messages as the HTTP protocol, one
+// JSON document per line, over a pair of pipes such as an SSH session:
+//
+//	upload-pack:  server sends the ref advertisement; the client answers
+//	              with a fetch request (or closes its side when it only
+//	              wanted the refs) and the server streams a pack.
+//	receive-pack: server sends the ref advertisement; the client sends a
+//	              push request followed by a pack and the server answers
+//	              with a push response.
+//
+// A server-side failure is sent as an "error" field in whichever message
+// comes next.
+const (
+	serviceUploadPack  = "upload-pack"
+	serviceReceivePack = "receive-pack"
+)
+
+// UploadPack serves one fetch of the repository at path over r and w.
+func UploadPack(path string, r io.Reader, w io.Writer) error {
+	t, err := advertise(path, w)
+	if err != nil {
+		return err
+	}
+	in := bufio.NewReader(r)
+	line, err := in.ReadBytes('\n')
+	if len(strings.TrimSpace(string(line))) == 0 && (err == io.EOF || err == nil) {
+		return nil
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var req fetchRequest
+	if err := decodeRequest(line, &req); err != nil {
+		return fmt.Errorf("malformed fetch request: %w", err)
+	}
+	missing, err := t.negotiate(req)
+	if err != nil {
+		return err
+	}
+	return writePack(w, NewObjectStore(t.dir), missing)
+}
+
+// ReceivePack accepts one push into the repository at path over r and w.
+func ReceivePack(path string, r io.Reader, w io.Writer) error {
+	t, err := advertise(path, w)
+	if err != nil {
+		return err
+	}
+	in := bufio.NewReader(r)
+	line, err := in.ReadBytes('\n')
+	if err == io.EOF && len(strings.TrimSpace(string(line))) == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var req pushRequest
+	if err := decodeRequest(line, &req); err != nil {
+		return fmt.Errorf("malformed push request: %w", err)
+	}
+	received, err := t.receive(in, req.Updates)
+	resp := pushResponse{Objects: received}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if encodeErr := json.NewEncoder(w).Encode(resp); encodeErr != nil {
+		return encodeErr
+	}
+	return err
+}
+
+// advertise opens the repository at path and sends its refs, or the reason
+// it cannot be served.
+func advertise(path string, w io.Writer) (*localTransport, error) {
+	adv := &refAdvertisement{}
+	dir, bare, err := findRepoDir(path)
+	var t *localTransport
+	if err == nil {
+		t = &localTransport{dir: dir, bare: bare}
+		adv.Refs, adv.Head, err = t.ListRefs()
+	}
+	if err != nil {
+		adv.Error = err.Error()
+	}
+	if encodeErr := json.NewEncoder(w).Encode(adv); encodeErr != nil {
+		return nil, encodeErr
+	}
+	return t, err
+}
+
+// decodeRequest reads a client request strictly, so that a push sent to
+// upload-pack, or a fetch to receive-pack, is refused rather than read as
+// an empty request of the other kind.
+func decodeRequest(line []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// extTransport runs a command for each service and speaks the stdio
+// protocol over its stdin and stdout. In the command, %s stands for the
+// service, so "ext::ssh host kommito %s /srv/project" reaches a remote
+// repository through SSH. A literal upload-pack or receive-pack argument
+// is replaced by the service too, so a command written for cloning can
+// also push. The command is split on spaces, without any shell quoting.
+type extTransport struct {
+	command string
+	upload  *stdioSession
+}
+
+type stdioSession struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	adv    refAdvertisement
+}
+
+func newExtTransport(url string) (*extTransport, error) {
+	command := strings.TrimSpace(strings.TrimPrefix(url, "ext::"))
+	if command == "" {
+		return nil, fmt.Errorf("remote URL '%s' names no command", url)
+	}
+	return &extTransport{command: command}, nil
+}
+
+func (t *extTransport) start(service string) (*stdioSession, error) {
+	args := strings.Fields(t.command)
+	for i, arg := range args {
+		if arg == serviceUploadPack || arg == serviceReceivePack {
+			args[i] = service
+			continue
+		}
+		args[i] = strings.ReplaceAll(arg, "%s", service)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run '%s': %w", args[0], err)
+	}
+	session := &stdioSession{cmd: cmd, stdin: stdin, stdout: bufio.NewReaderSize(stdout, 1<<16)}
+	line, err := session.stdout.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &session.adv)
+	}
+	if err != nil {
+		session.close()
+		return nil, fmt.Errorf("'%s' did not answer like kommito %s: %w", t.command, service, err)
+	}
+	if session.adv.Error != "" {
+		session.close()
+		return nil, fmt.Errorf("remote: %s", session.adv.Error)
+	}
+	if session.adv.Refs == nil {
+		session.adv.Refs = make(map[string]string)
+	}
+	return session, nil
+}
+
+// close ends the session by closing its input and waits for the command.
+func (s *stdioSession) close() error {
+	s.stdin.Close()
+	io.Copy(io.Discard, s.stdout)
+	return s.cmd.Wait()
+}
+
+func (t *extTransport) ListRefs() (map[string]string, string, error) {
+	if t.upload == nil {
+		session, err := t.start(serviceUploadPack)
+		if err != nil {
+			return nil, "", err
+		}
+		t.upload = session
+	}
+	return t.upload.adv.Refs, t.upload.adv.Head, nil
+}
+
+func (t *extTransport) Fetch(wants []string, dst *ObjectStore, opts FetchOptions) (int, error) {
+	if _, _, err := t.ListRefs(); err != nil {
+		return 0, err
+	}
+	session := t.upload
+	t.upload = nil
+	if len(wants) == 0 && !opts.deepens() {
+		return 0, session.close()
+	}
+
+	local, err := newRefStore(dst.dir).list()
+	if err != nil {
+		session.close()
+		return 0, err
+	}
+	req := fetchRequest{Wants: wants, Shallow: dst.shallowList(), FetchOptions: opts}
+	for _, hash := range local {
+		req.Haves = append(req.Haves, hash)
+	}
+	return session.fetchPack(req, dst)
+}
+
+func (t *extTransport) FetchBlobs(hashes []string, dst *ObjectStore) (int, error) {
+	if _, _, err := t.ListRefs(); err != nil {
+		return 0, err
+	}
+	session := t.upload
+	t.upload = nil
+	return session.fetchPack(fetchRequest{Blobs: hashes}, dst)
+}
+
+// fetchPack sends a fetch request and stores the pack that comes back,
+// ending the session.
+func (s *stdioSession) fetchPack(req fetchRequest, dst *ObjectStore) (int, error) {
+	if err := json.NewEncoder(s.stdin).Encode(req); err != nil {
+		s.close()
+		return 0, err
+	}
+	s.stdin.Close()
+	received, err := readPack(s.stdout, dst)
+	if waitErr := s.close(); err == nil && waitErr != nil {
+		err = fmt.Errorf("remote upload-pack failed: %w", waitErr)
+	}
+	return received, err
+}
+
+func (t *extTransport) Push(src *ObjectStore, updates []RefUpdate) (int, error) {
+	session, err := t.start(serviceReceivePack)
+	if err != nil {
+		return 0, err
+	}
+	var known, wants []string
+	for _, hash := range session.adv.Refs {
+		known = append(known, hash)
+	}
+	for _, update := range updates {
+		if update.New != "" {
+			wants = append(wants, update.New)
+		}
+	}
+	have, err := commonObjects(src, known, nil)
+	if err == nil {
+		var missing []objectRef
+		if missing, err = missingObjects(src, wants, have); err == nil {
+			if err = json.NewEncoder(session.stdin).Encode(pushRequest{Updates: updates}); err == nil {
+				err = writePack(session.stdin, src, missing)
+			}
+		}
+	}
+	if err != nil {
+		session.close()
+		return 0, err
+	}
+	session.stdin.Close()
+
+	var resp pushResponse
+	if err := json.NewDecoder(session.stdout).Decode(&resp); err != nil {
+		session.close()
+		return 0, fmt.Errorf("malformed push response: %w", err)
+	}
+	waitErr := session.close()
+	if resp.Error != "" {
+		return 0, fmt.Errorf("remote rejected the push: %s", resp.Error)
+	}
+	if waitErr != nil {
+		return 0, fmt.Errorf("remote receive-pack failed: %w", waitErr)
+	}
+	return resp.Objects, nil
+}
+
+func (t *extTransport) Close() error {
+	if t.upload != nil {
+		session := t.upload
+		t.upload = nil
+		return session.close()
+	}
+	return nil
+}
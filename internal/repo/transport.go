@@ -0,0 +1,388 @@
+package repo
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Transport connects to another repository for fetch and push.
+type Transport interface {
+	// ListRefs returns the remote's branches and tags by full ref name,
+	// plus the branch its HEAD points at (empty when unknown or detached).
+	ListRefs() (refs map[string]string, head string, err error)
+	// Fetch copies every object reachable from wants that dst lacks, within
+	// the history opts allows, and returns how many objects were
+	// transferred. Use fetchInto to keep dst's shallow boundary up to date.
+	Fetch(wants []string, dst *ObjectStore, opts FetchOptions) (int, error)
+	// FetchBlobs copies the given blobs into dst by hash, to fill in what a
+	// partial clone left out.
+	FetchBlobs(hashes []string, dst *ObjectStore) (int, error)
+	// Push sends the objects the remote lacks for the new ref values, then
+	// applies all ref updates atomically.
+	Push(src *ObjectStore, updates []RefUpdate) (int, error)
+	Close() error
+}
+
+// FetchOptions controls how much history a fetch transfers.
+type FetchOptions struct {
+	// Prune deletes remote-tracking branches the remote no longer has.
+	Prune bool `json:"-"`
+	// Depth limits the history fetched behind each wanted commit to that
+	// many commits, leaving a shallow repository. Zero fetches all of it.
+	Depth int `json:"depth,omitempty"`
+	// Deepen fetches that many more commits behind the shallow boundary;
+	// Unshallow fetches all of the history behind it.
+	Deepen    int  `json:"deepen,omitempty"`
+	Unshallow bool `json:"unshallow,omitempty"`
+	// Filter leaves blobs out of the fetch ("blob:none" or
+	// "blob:limit=<size>"), to be fetched from the remote when needed.
+	Filter string `json:"filter,omitempty"`
+}
+
+func (o FetchOptions) deepens() bool {
+	return o.Deepen > 0 || o.Unshallow
+}
+
+// fetchInto fetches through t and then moves the shallow boundary of dst to
+// match the history that arrived, which may have been cut short by the
+// options or by the remote being shallow itself.
+func fetchInto(t Transport, wants []string, dst *ObjectStore, opts FetchOptions) (int, error) {
+	received, err := t.Fetch(wants, dst, opts)
+	if err != nil {
+		return received, err
+	}
+	return received, dst.updateShallow(wants)
+}
+
+// openTransport picks a transport for a remote URL. Plain paths and
+// file:// URLs are served from the local filesystem; http:// and https://
+// URLs talk to `kommito serve`, and ext::<command> URLs to a spawned
+// upload-pack or receive-pack. A path to a bundle file reads the bundle.
+func openTransport(url string) (Transport, error) {
+	switch {
+	case strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://"):
+		return newHTTPTransport(url), nil
+	case strings.HasPrefix(url, "ext::"):
+		return newExtTransport(url)
+	}
+	path := strings.TrimPrefix(url, "file://")
+	if strings.Contains(path, "://") {
+		return nil, fmt.Errorf("unsupported remote URL '%s'", url)
+	}
+	if isBundle(path) {
+		return openBundle(path)
+	}
+	dir, bare, err := findRepoDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return &localTransport{dir: dir, bare: bare}, nil
+}
+
+// isNetworkURL reports whether a remote URL needs a transport other than
+// direct filesystem access.
+func isNetworkURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "ext::")
+}
+
+// findRepoDir locates the metadata directory of the repository at path:
+// path/.kommito for a repository with a working tree, or path itself for a
+// bare repository.
+func findRepoDir(path string) (string, bool, error) {
+	nested := filepath.Join(path, ".kommito")
+	if info, err := os.Stat(nested); err == nil && info.IsDir() {
+		return nested, false, nil
+	}
+	// A bare Git repository also has HEAD and objects/, but no config.json.
+	_, headErr := os.Stat(filepath.Join(path, "HEAD"))
+	_, configErr := os.Stat(filepath.Join(path, "config.json"))
+	info, objectsErr := os.Stat(filepath.Join(path, "objects"))
+	if headErr == nil && configErr == nil && objectsErr == nil && info.IsDir() {
+		return path, true, nil
+	}
+	return "", false, fmt.Errorf("'%s' is not a Kommito repository", path)
+}
+
+// missingObjects lists the objects reachable from wants in src that have()
+// reports as absent. History is not followed past a commit that is already
+// present, since its ancestry is present too.
+func missingObjects(src *ObjectStore, wants []string, have func(kind, hash string) bool) ([]objectRef, error) {
+	return missingObjectsWithin(src, wants, 0, have, make(reachableSet))
+}
+
+// missingObjectsWithin is missingObjects limited to the first depth commits
+// of history behind wants, or all of it when depth is zero. Objects already
+// in seen are skipped.
+func missingObjectsWithin(src *ObjectStore, wants []string, depth int, have func(kind, hash string) bool, seen reachableSet) ([]objectRef, error) {
+	var within map[string]bool
+	if depth > 0 {
+		var err error
+		if within, err = historyWithin(src, wants, depth, have); err != nil {
+			return nil, err
+		}
+	}
+	var missing []objectRef
+	err := walkObjects(src, wants, func(kind, hash string) bool {
+		if kind == kindCommit && within != nil && !within[hash] {
+			return false
+		}
+		if !seen.mark(kind, hash) || have(kind, hash) {
+			return false
+		}
+		missing = append(missing, objectRef{Kind: kind, Hash: hash})
+		return true
+	})
+	return missing, err
+}
+
+// fetchMissing lists the objects a fetch sends: what missingObjects finds
+// for wants, within opts.Depth, plus the history opts asks for behind the
+// receiver's shallow commits.
+func fetchMissing(src *ObjectStore, wants, shallow []string, opts FetchOptions, have func(kind, hash string) bool) ([]objectRef, error) {
+	if opts.Filter != "" {
+		filter, err := parseBlobFilter(opts.Filter)
+		if err != nil {
+			return nil, err
+		}
+		present := have
+		have = func(kind, hash string) bool {
+			return present(kind, hash) || filter.omits(src, kind, hash)
+		}
+	}
+	seen := make(reachableSet)
+	missing, err := missingObjectsWithin(src, wants, opts.Depth, have, seen)
+	if err != nil || !opts.deepens() {
+		return missing, err
+	}
+	var parents []string
+	for _, hash := range shallow {
+		if !isObjectHash(hash) || !src.Has(kindCommit, hash) {
+			continue
+		}
+		commit, err := src.LoadCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, commit.Parents...)
+	}
+	depth := opts.Deepen
+	if opts.Unshallow {
+		depth = 0
+	}
+	deeper, err := missingObjectsWithin(src, parents, depth, have, seen)
+	return append(missing, deeper...), err
+}
+
+// copyObjects copies stored objects between repositories file by file,
+// verifying each hash on the way. Manifests are keyed by the hash of the
+// content they describe, so they are checked by fsck instead.
+func copyObjects(src, dst *ObjectStore, refs []objectRef) error {
+	ordered, err := transferOrder(src, refs)
+	if err != nil {
+		return err
+	}
+	for _, ref := range ordered {
+		if err := copyObject(src, dst, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transferOrder sorts objects so that everything an object refers to is
+// written before it: chunks before manifests, blobs before trees, trees
+// before commits and parents before children. An interrupted transfer then
+// never leaves a commit whose history is incomplete, which missingObjects
+// relies on when it stops at commits that are already present.
+func transferOrder(src *ObjectStore, refs []objectRef) ([]objectRef, error) {
+	refs, err := src.fillPromised(refs)
+	if err != nil {
+		return nil, err
+	}
+	rank := map[string]int{kindChunk: 0, kindBlob: 1, kindManifest: 2, kindTree: 3}
+	var ordered []objectRef
+	var commits []string
+	for _, ref := range refs {
+		if ref.Kind == kindCommit {
+			commits = append(commits, ref.Hash)
+			continue
+		}
+		ordered = append(ordered, ref)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool { return rank[ordered[i].Kind] < rank[ordered[j].Kind] })
+
+	sorted, err := topoSortCommits(src, commits)
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range sorted {
+		ordered = append(ordered, objectRef{Kind: kindCommit, Hash: hash})
+	}
+	return ordered, nil
+}
+
+func copyObject(src, dst *ObjectStore, ref objectRef) error {
+	in, err := os.Open(src.path(ref.Kind, ref.Hash))
+	if err != nil {
+		return fmt.Errorf("failed to read %s %s: %w", strings.TrimSuffix(ref.Kind, "s"), ref.Hash, err)
+	}
+	defer in.Close()
+	return dst.writeRaw(ref, in)
+}
+
+// writeRaw stores an object received from another repository under its
+// advertised hash. A manifest is only stored once its chunks, which arrive
+// first, are found to reassemble to that hash; one already present is kept.
+func (s *ObjectStore) writeRaw(ref objectRef, r io.Reader) error {
+	if ref.Kind == kindManifest {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if freshen(s.path(kindBlob, ref.Hash)) || freshen(s.path(kindManifest, ref.Hash)) {
+			return nil
+		}
+		if err := s.checkManifest(ref.Hash, data); err != nil {
+			return err
+		}
+		dir := filepath.Dir(s.path(kindManifest, ref.Hash))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		return writeFileAtomic(s.path(kindManifest, ref.Hash), data, 0644)
+	}
+
+	hash, _, err := s.WriteStream(ref.Kind, r)
+	if err != nil {
+		return err
+	}
+	if hash != ref.Hash {
+		os.Remove(s.path(ref.Kind, hash))
+		return fmt.Errorf("%s %s arrived corrupt (hashes to %s)", strings.TrimSuffix(ref.Kind, "s"), ref.Hash, hash)
+	}
+	return nil
+}
+
+// checkManifest verifies that a received manifest's chunks are present and
+// reassemble to the blob hash it is stored under.
+func (s *ObjectStore) checkManifest(hash string, data []byte) error {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("manifest %s arrived corrupt: %w", hash, err)
+	}
+	whole := sha1.New()
+	r := &chunkReader{store: s, chunks: manifest.Chunks}
+	defer r.Close()
+	size, err := io.Copy(whole, r)
+	if err != nil {
+		return fmt.Errorf("manifest %s: %w", hash, err)
+	}
+	if got := fmt.Sprintf("%x", whole.Sum(nil)); got != hash || size != manifest.Size {
+		return fmt.Errorf("manifest %s arrived corrupt (its chunks hash to %s)", hash, got)
+	}
+	return nil
+}
+
+// localTransport talks to a repository on the local filesystem, such as a
+// shared directory on a network drive.
+type localTransport struct {
+	dir  string
+	bare bool
+}
+
+func (t *localTransport) ListRefs() (map[string]string, string, error) {
+	refs := newRefStore(t.dir)
+	all, err := refs.list()
+	if err != nil {
+		return nil, "", err
+	}
+	advertised := make(map[string]string)
+	for name, hash := range all {
+		if hash != "" && (strings.HasPrefix(name, "refs/heads/") || strings.HasPrefix(name, "refs/tags/")) {
+			advertised[name] = hash
+		}
+	}
+	head, err := refs.headTarget()
+	if err != nil {
+		return nil, "", err
+	}
+	return advertised, head, nil
+}
+
+func (t *localTransport) Fetch(wants []string, dst *ObjectStore, opts FetchOptions) (int, error) {
+	src := NewObjectStore(t.dir)
+	missing, err := fetchMissing(src, wants, dst.shallowList(), opts, dst.hasRaw)
+	if err != nil {
+		return 0, err
+	}
+	return len(missing), copyObjects(src, dst, missing)
+}
+
+func (t *localTransport) FetchBlobs(hashes []string, dst *ObjectStore) (int, error) {
+	src := NewObjectStore(t.dir)
+	refs, err := promisedObjects(src, hashes)
+	if err != nil {
+		return 0, err
+	}
+	return len(refs), copyObjects(src, dst, refs)
+}
+
+func (t *localTransport) Push(src *ObjectStore, updates []RefUpdate) (int, error) {
+	if err := t.checkPushable(updates); err != nil {
+		return 0, err
+	}
+	dst := NewObjectStore(t.dir)
+	var wants []string
+	for _, update := range updates {
+		wants = append(wants, update.New)
+	}
+	missing, err := missingObjects(src, wants, dst.hasRaw)
+	if err != nil {
+		return 0, err
+	}
+	if err := copyObjects(src, dst, missing); err != nil {
+		return 0, err
+	}
+	return len(missing), newRefStore(t.dir).updateAll(updates, "push")
+}
+
+// checkPushable refuses updates to anything but branches and tags, and
+// moving the branch checked out in a non-bare repository, which would leave
+// its working tree and index out of date.
+func (t *localTransport) checkPushable(updates []RefUpdate) error {
+	for _, update := range updates {
+		if !strings.HasPrefix(update.Name, "refs/heads/") && !strings.HasPrefix(update.Name, "refs/tags/") {
+			return fmt.Errorf("refusing to update '%s': only branches and tags can be pushed", update.Name)
+		}
+	}
+	if t.bare {
+		return nil
+	}
+	head, err := newRefStore(t.dir).headTarget()
+	if err != nil {
+		return err
+	}
+	for _, update := range updates {
+		if update.Name == head {
+			return fmt.Errorf("refusing to update %s, it is checked out in the remote's working tree; push to a bare repository instead", head)
+		}
+	}
+	return nil
+}
+
+func (t *localTransport) Close() error {
+	return nil
+}
+
+// hasRaw reports whether the object file itself is stored, as opposed to
+// Has which also accepts a chunked blob in place of a plain one.
+func (s *ObjectStore) hasRaw(kind, hash string) bool {
+	_, err := os.Stat(s.path(kind, hash))
+	return err == nil
+}
@@ -0,0 +1,66 @@
+package repo
+
+import "fmt"
+
+// objectRef names one stored object by its kind and hash.
+type objectRef struct {
+	Kind string
+	Hash string
+}
+
+// walkObjects visits everything reachable from the given commits: the
+// commits and their history, their trees, and every blob. Chunked blobs are
+// reported as their manifest and chunks, since that is what is stored.
+//
+// enter is called before each object is visited; returning false skips the
+// object and, for commits, the history behind it.
+func walkObjects(store *ObjectStore, commits []string, enter func(kind, hash string) bool) error {
+	pending := append([]string(nil), commits...)
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if hash == "" || !enter(kindCommit, hash) {
+			continue
+		}
+		commit, err := store.LoadCommit(hash)
+		if err != nil {
+			return fmt.Errorf("commit %s is unreadable: %w", hash, err)
+		}
+		for _, blob := range commit.Blobs {
+			if err := walkBlob(store, blob, enter); err != nil {
+				return err
+			}
+		}
+		if commit.Tree != "" && enter(kindTree, commit.Tree) {
+			tree, err := store.ReadTree(commit.Tree)
+			if err != nil {
+				return fmt.Errorf("tree %s of commit %s is unreadable: %w", commit.Tree, hash, err)
+			}
+			for _, entry := range tree.Entries {
+				if err := walkBlob(store, entry.Hash, enter); err != nil {
+					return err
+				}
+			}
+		}
+		pending = append(pending, commit.Parents...)
+	}
+	return nil
+}
+
+func walkBlob(store *ObjectStore, hash string, enter func(kind, hash string) bool) error {
+	if !store.isChunked(hash) {
+		enter(kindBlob, hash)
+		return nil
+	}
+	if !enter(kindManifest, hash) {
+		return nil
+	}
+	manifest, err := store.ReadManifest(hash)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range manifest.Chunks {
+		enter(kindChunk, chunk.Hash)
+	}
+	return nil
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"time"
 
 	repo "github.com/Kshitijknk07/Kommito/internal/repo"
 	"github.com/spf13/cobra"
@@ -22,19 +25,67 @@ var rootCmd = &cobra.Command{
    commit  📝  Commit staged files
    log     📜  Show commit history
    status  🧭  Show repo status
+   diff    🔀  Show changes between the index, working tree and commits
    clone   📋  Clone a repository
-   branch  🌿  Manage branches`,
+   branch  🌿  Manage branches
+   gc      🧹  Clean up unreachable objects
+   prune   ✂️  Remove unreachable objects from the object store
+   fsck    🩺  Verify the object store
+   count-objects 🧮  Count stored objects and their size
+   config  🔧  Read or change repository settings
+   large   🐘  Manage large files stored outside the object store
+   remote  🔗  Manage remote repositories
+   fetch   📥  Download branches from a remote
+   push    📤  Upload a branch to a remote
+   pull    🔄  Fetch and merge from a remote
+   serve   🌐  Host repositories over HTTP
+   bundle  🎁  Move history between repositories as a single file
+   import-git 🐙  Import history from a Git repository
+   fast-export 🚚  Write all history as a git fast-import stream
+   fast-import 🚛  Read a git fast-import stream into the repo
+   show    🔍  Show commits, tags, trees and blobs
+   blame   🕵️  Show who last changed each line of a file
+   bisect  🪓  Find the commit that introduced a bug
+   cherry-pick 🍒  Apply the changes of existing commits
+   revert  ⏪  Undo the changes of existing commits
+   rebase  🔁  Replay commits on top of another base
+   rm      🗑️  Remove files from the index and working tree
+   mv      📦  Move or rename tracked files
+   restore ♻️  Restore files from the index or a commit`,
+	// main prints the error a command returns, once. Usage is only shown
+	// for mistakes in the arguments, not for failures once a command runs.
+	SilenceErrors: true,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
 }
 
 var initCmd = &cobra.Command{
-	Use:   "init",
+	Use:   "init [--bare <dir>]",
 	Short: "Initialize a new Kommito repository",
+	Args:  cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println(`(｀• ω •´)ゞ Roger that!
 
 ⚒️  Spinning up your Kommito engine...
 🗂️  Setting up the repository chamber...`)
 
+		if bare, _ := cmd.Flags().GetBool("bare"); bare {
+			dir := "."
+			if len(args) > 0 {
+				dir = args[0]
+			}
+			if err := repo.InitBareRepo(dir); err != nil {
+				fmt.Printf("(╥﹏╥) Oops! Something went wrong: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("✨ Bare repository initialized in %s!\n", dir)
+			return
+		}
+		if len(args) > 0 {
+			fmt.Println("(╥﹏╥) A directory can only be given together with --bare")
+			os.Exit(1)
+		}
 		if err := repo.InitRepo(); err != nil {
 			fmt.Printf("(╥﹏╥) Oops! Something went wrong: %v\n", err)
 			os.Exit(1)
@@ -58,36 +109,256 @@ var addCmd = &cobra.Command{
 	},
 }
 
+var rmCmd = &cobra.Command{
+	Use:   "rm <paths...>",
+	Short: "Stop tracking files and delete them",
+	Long: `Remove files, or every tracked file under a directory, from the index and
+the working tree. Files with changes that are not committed are refused
+unless --force is given; --cached keeps them in the working tree.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var opts repo.RemoveOptions
+		opts.Cached, _ = cmd.Flags().GetBool("cached")
+		opts.Force, _ = cmd.Flags().GetBool("force")
+		files, err := repo.RemoveFiles(args, opts)
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) rm failed: %v", err)
+		}
+		for _, file := range files {
+			fmt.Printf("🗑️  rm '%s'\n", file)
+		}
+		return nil
+	},
+}
+
+var mvCmd = &cobra.Command{
+	Use:   "mv <source>... <destination>",
+	Short: "Move or rename a file or directory",
+	Long: `Rename a tracked file or directory in the working tree and the index. When
+the destination is an existing directory the sources are moved into it.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		moves, err := repo.MoveFiles(args[:len(args)-1], args[len(args)-1])
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) mv failed: %v", err)
+		}
+		for _, move := range moves {
+			fmt.Printf("🚚 %s → %s\n", move.From, move.To)
+		}
+		return nil
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <paths...>",
+	Short: "Discard changes to files",
+	Long: `Put files back to how they are in the index, discarding working tree
+changes. --staged unstages them instead, restoring the index from HEAD;
+--source takes them from another revision.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var opts repo.RestoreOptions
+		opts.Source, _ = cmd.Flags().GetString("source")
+		opts.Staged, _ = cmd.Flags().GetBool("staged")
+		opts.Worktree, _ = cmd.Flags().GetBool("worktree")
+		files, err := repo.RestoreFiles(args, opts)
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) restore failed: %v", err)
+		}
+		for _, file := range files {
+			fmt.Printf("♻️  Restored %s\n", file)
+		}
+		return nil
+	},
+}
+
 var commitCmd = &cobra.Command{
 	Use:   "commit",
 	Short: "Commit staged files",
-	RunE: func(cmd *cobra.Command, args []string) error {
-		message, _ := cmd.Flags().GetString("message")
-		if message == "" {
-			return fmt.Errorf(`(⊙_☉) You need to provide a commit message!
+	Long: `Record what is staged as a new commit on the current branch.
 
-✨ Example:
-   kommito commit --message "Initial commit"`)
-		}
+Without --message the message is written in the editor (core.editor,
+$VISUAL, $EDITOR or vi), below a summary of what is being committed.
+--fixup and --squash record a commit that rebase --autosquash folds into
+the one named.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var opts repo.CommitOptions
+		opts.Message, _ = cmd.Flags().GetString("message")
+		opts.All, _ = cmd.Flags().GetBool("all")
+		opts.Amend, _ = cmd.Flags().GetBool("amend")
+		opts.Fixup, _ = cmd.Flags().GetString("fixup")
+		opts.Squash, _ = cmd.Flags().GetString("squash")
+		opts.AllowEmpty, _ = cmd.Flags().GetBool("allow-empty")
 		fmt.Println("(ﾉ◕ヮ◕)ﾉ*:･ﾟ✧ Creating your commit...")
-		if err := repo.CommitStaged(message); err != nil {
+		hash, err := repo.CommitStaged(opts)
+		if err != nil {
 			return fmt.Errorf("(╥﹏╥) Commit failed: %v", err)
 		}
-		fmt.Println("(づ｡◕‿‿◕｡)づ Commit created successfully!")
+		if opts.Amend {
+			fmt.Printf("(づ｡◕‿‿◕｡)づ Commit amended as %s!\n", hash[:7])
+		} else {
+			fmt.Printf("(づ｡◕‿‿◕｡)づ Commit %s created successfully!\n", hash[:7])
+		}
 		return nil
 	},
 }
 
 var logCmd = &cobra.Command{
-	Use:   "log",
+	Use:   "log [revisions...] [-- paths...]",
 	Short: "Show commit history",
-	Run: func(cmd *cobra.Command, args []string) {
-		if err := repo.LogCommits(); err != nil {
-			fmt.Printf("(╥﹏╥) Could not show log: %v\n", err)
+	Long: `Show the commits reachable from the given revisions (HEAD by default),
+newest first. "main..topic" or "^main topic" shows what topic has that main
+does not, and paths after -- keep only the commits that change them.
+
+Formats:
+  --oneline                  Short hash, decorations and subject
+  --format "%h %an %ar %s"   %H/%h hash, %T/%t tree, %P/%p parents,
+                             %an author, %ad/%ar/%ai/%as/%at date,
+                             %s subject, %b body, %B message,
+                             %d/%D refs, %C(red) colour, %n newline
+  --graph[=unicode]          Draw branches and merges beside the commits`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var opts repo.LogOptions
+		opts.Revisions = args
+		if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+			opts.Revisions, opts.Paths = args[:dash], args[dash:]
+		}
+		opts.All, _ = cmd.Flags().GetBool("all")
+		opts.MaxCount, _ = cmd.Flags().GetInt("max-count")
+		opts.Author, _ = cmd.Flags().GetString("author")
+		opts.Grep, _ = cmd.Flags().GetString("grep")
+		opts.Format, _ = cmd.Flags().GetString("format")
+		if oneline, _ := cmd.Flags().GetBool("oneline"); oneline {
+			opts.Format = "oneline"
+		}
+		opts.Reverse, _ = cmd.Flags().GetBool("reverse")
+		opts.FirstParent, _ = cmd.Flags().GetBool("first-parent")
+		opts.Patch, _ = cmd.Flags().GetBool("patch")
+		opts.Stat, _ = cmd.Flags().GetBool("stat")
+		opts.Graph, _ = cmd.Flags().GetString("graph")
+		if opts.Graph != "" && opts.Graph != "ascii" && opts.Graph != "unicode" {
+			return fmt.Errorf("(╥﹏╥) Unknown graph style '%s', use ascii or unicode", opts.Graph)
+		}
+		var err error
+		if opts.Color, err = colorFlag(cmd); err != nil {
+			return err
+		}
+		now := time.Now()
+		for flag, target := range map[string]*time.Time{"since": &opts.Since, "until": &opts.Until} {
+			value, _ := cmd.Flags().GetString(flag)
+			if value == "" {
+				continue
+			}
+			t, err := repo.ParseExpiry(value, now)
+			if err != nil {
+				return fmt.Errorf("(╥﹏╥) Invalid --%s date: %v", flag, err)
+			}
+			*target = t
+		}
+
+		out := &repo.Pager{Writer: os.Stdout}
+		if noPager, _ := cmd.Flags().GetBool("no-pager"); !noPager {
+			out = repo.StartPager()
+		}
+		err = repo.Log(out, opts)
+		out.Close()
+		if err != nil && !repo.IsPagerQuit(err) {
+			return fmt.Errorf("(╥﹏╥) Could not show log: %v", err)
+		}
+		return nil
+	},
+}
+
+var showCmd = &cobra.Command{
+	Use:   "show [objects...] [-- paths...]",
+	Short: "Show commits, tags, trees and file contents",
+	Long: `Show objects, HEAD by default:
+
+  kommito show <commit>        Its message, author and diff against its parent
+  kommito show <tag>           The tag and the commit it points at
+  kommito show <rev>:<path>    A file as it was at a revision, or a directory's listing
+  kommito show <hash>          Any tree or blob by (abbreviated) hash
+
+A merge's diff shows only the files that differ from every parent. Tags are
+plain names for commits: they carry no tagger or message of their own.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var opts repo.ShowOptions
+		names := args
+		if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+			names, opts.Paths = args[:dash], args[dash:]
 		}
+		opts.NoPatch, _ = cmd.Flags().GetBool("no-patch")
+		opts.Stat, _ = cmd.Flags().GetBool("stat")
+		if patch, _ := cmd.Flags().GetBool("patch"); opts.Stat && !patch {
+			opts.NoPatch = true
+		}
+		var err error
+		if opts.Color, err = colorFlag(cmd); err != nil {
+			return err
+		}
+
+		out := &repo.Pager{Writer: os.Stdout}
+		if noPager, _ := cmd.Flags().GetBool("no-pager"); !noPager {
+			out = repo.StartPager()
+		}
+		err = repo.Show(out, names, opts)
+		out.Close()
+		if err != nil && !repo.IsPagerQuit(err) {
+			return fmt.Errorf("(╥﹏╥) Could not show object: %v", err)
+		}
+		return nil
 	},
 }
 
+var blameCmd = &cobra.Command{
+	Use:   "blame <file> [revision]",
+	Short: "Show the commit that last changed each line of a file",
+	Long: `Show the commit, author and date that last changed each line of a file,
+following it through renames. Without a revision the working tree file is
+blamed, and lines not committed yet are shown as such.
+
+Commits listed with --ignore-rev, or in --ignore-revs-file (default:
+blame.ignoreRevsFile), are looked through: the lines they changed are
+blamed on the lines they replaced, which suits mass reformatting.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var opts repo.BlameOptions
+		if len(args) == 2 {
+			opts.Rev = args[1]
+		}
+		opts.Ranges, _ = cmd.Flags().GetStringArray("lines")
+		opts.Porcelain, _ = cmd.Flags().GetBool("porcelain")
+		opts.IgnoreRevs, _ = cmd.Flags().GetStringArray("ignore-rev")
+		opts.IgnoreRevsFile, _ = cmd.Flags().GetString("ignore-revs-file")
+
+		out := &repo.Pager{Writer: os.Stdout}
+		if noPager, _ := cmd.Flags().GetBool("no-pager"); !noPager && !opts.Porcelain {
+			out = repo.StartPager()
+		}
+		err := repo.Blame(out, args[0], opts)
+		out.Close()
+		if err != nil && !repo.IsPagerQuit(err) {
+			return fmt.Errorf("(╥﹏╥) Could not blame %s: %v", args[0], err)
+		}
+		return nil
+	},
+}
+
+// colorFlag reads a command's --color setting.
+func colorFlag(cmd *cobra.Command) (bool, error) {
+	switch color, _ := cmd.Flags().GetString("color"); color {
+	case "always":
+		return true, nil
+	case "auto":
+		return repo.IsTerminal(os.Stdout), nil
+	case "never":
+		return false, nil
+	default:
+		return false, fmt.Errorf("(╥﹏╥) Unknown --color setting '%s', use always, auto or never", color)
+	}
+}
+
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Show repository status",
@@ -98,6 +369,23 @@ var statusCmd = &cobra.Command{
 	},
 }
 
+var diffCmd = &cobra.Command{
+	Use:   "diff [paths...]",
+	Short: "Show changes that are not staged yet, or with --staged not committed yet",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var opts repo.DiffOptions
+		opts.Staged, _ = cmd.Flags().GetBool("staged")
+		if cached, _ := cmd.Flags().GetBool("cached"); cached {
+			opts.Staged = true
+		}
+		opts.Paths = args
+		if err := repo.Diff(os.Stdout, opts); err != nil {
+			return fmt.Errorf("(╥﹏╥) Could not show diff: %v", err)
+		}
+		return nil
+	},
+}
+
 var cloneCmd = &cobra.Command{
 	Use:   "clone [source] [destination]",
 	Short: "Clone a repository",
@@ -106,7 +394,19 @@ var cloneCmd = &cobra.Command{
 		source := args[0]
 		destination := args[1]
 		fmt.Println("(ﾉ◕ヮ◕)ﾉ*:･ﾟ✧ Cloning repository...")
-		if err := repo.CloneRepo(source, destination); err != nil {
+		var opts repo.CloneOptions
+		opts.Bare, _ = cmd.Flags().GetBool("bare")
+		opts.Mirror, _ = cmd.Flags().GetBool("mirror")
+		opts.Depth, _ = cmd.Flags().GetInt("depth")
+		opts.Branch, _ = cmd.Flags().GetString("branch")
+		opts.Filter, _ = cmd.Flags().GetString("filter")
+		// Like git, a shallow clone takes a single branch unless told
+		// otherwise with --single-branch=false.
+		opts.SingleBranch = opts.Depth > 0
+		if cmd.Flags().Changed("single-branch") {
+			opts.SingleBranch, _ = cmd.Flags().GetBool("single-branch")
+		}
+		if err := repo.CloneRepo(source, destination, opts); err != nil {
 			fmt.Printf("(╥﹏╥) Clone failed: %v\n", err)
 			os.Exit(1)
 		}
@@ -207,6 +507,123 @@ var mergeCmd = &cobra.Command{
 	},
 }
 
+var cherryPickCmd = &cobra.Command{
+	Use:   "cherry-pick [revs...]",
+	Short: "Apply the changes made by existing commits",
+	Long: `Apply the changes each commit made on top of HEAD with a three-way merge,
+committing each with its original author and message plus a
+"(cherry picked from commit ...)" line. A range like main..topic picks its
+commits oldest first.
+
+When a commit conflicts, resolve the files, add them and run --continue,
+or use --skip to drop that commit or --abort to go back.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runPicks(cmd, args, "cherry-pick", repo.CherryPick)
+	},
+}
+
+var revertCmd = &cobra.Command{
+	Use:   "revert [revs...]",
+	Short: "Undo the changes made by existing commits",
+	Long: `Undo the changes each commit made with a three-way merge, newest first,
+committing each undo as "Revert ..." with a line naming the commit.
+
+When a commit conflicts, resolve the files, add them and run --continue,
+or use --skip to drop that commit or --abort to go back.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runPicks(cmd, args, "revert", repo.Revert)
+	},
+}
+
+func runPicks(cmd *cobra.Command, args []string, action string, start func([]string, repo.PickOptions) error) error {
+	cont, _ := cmd.Flags().GetBool("continue")
+	skip, _ := cmd.Flags().GetBool("skip")
+	abort, _ := cmd.Flags().GetBool("abort")
+	var err error
+	switch {
+	case cont || skip || abort:
+		if len(args) > 0 {
+			return fmt.Errorf("(⊙_☉) --continue, --skip and --abort take no commits")
+		}
+		switch {
+		case cont:
+			err = repo.ContinuePick(action)
+		case skip:
+			err = repo.SkipPick(action)
+		default:
+			if err = repo.AbortPick(action); err == nil {
+				fmt.Printf("🔙 Aborted the %s\n", action)
+			}
+		}
+	case len(args) == 0:
+		return fmt.Errorf("(⊙_☉) Name the commits to %s", action)
+	default:
+		var opts repo.PickOptions
+		opts.NoCommit, _ = cmd.Flags().GetBool("no-commit")
+		opts.Mainline, _ = cmd.Flags().GetInt("mainline")
+		err = start(args, opts)
+	}
+	if errors.Is(err, repo.ErrConflicts) {
+		os.Exit(1)
+	}
+	if err != nil {
+		return fmt.Errorf("(╥﹏╥) %s failed: %v", action, err)
+	}
+	return nil
+}
+
+var rebaseCmd = &cobra.Command{
+	Use:   "rebase [upstream]",
+	Short: "Replay the current branch's commits onto another base",
+	Long: `Replay the commits of the current branch that upstream does not have on top
+of upstream, one at a time, then move the branch to the result.
+
+With --interactive the list of commits opens in the editor first, to be
+reordered, dropped, reworded, edited, squashed or interleaved with exec
+commands. With --autosquash, "fixup! <subject>" and "squash! <subject>"
+commits are moved after the commit they name.
+
+When a commit conflicts, resolve the files, add them and run --continue,
+or use --skip to drop that commit or --abort to go back.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cont, _ := cmd.Flags().GetBool("continue")
+		skip, _ := cmd.Flags().GetBool("skip")
+		abort, _ := cmd.Flags().GetBool("abort")
+		var err error
+		switch {
+		case cont || skip || abort:
+			if len(args) > 0 {
+				return fmt.Errorf("(⊙_☉) --continue, --skip and --abort take no upstream")
+			}
+			switch {
+			case cont:
+				err = repo.ContinueRebase()
+			case skip:
+				err = repo.SkipRebase()
+			default:
+				if err = repo.AbortRebase(); err == nil {
+					fmt.Println("🔙 Aborted the rebase")
+				}
+			}
+		case len(args) == 0:
+			return fmt.Errorf("(⊙_☉) Name the upstream to rebase onto")
+		default:
+			var opts repo.RebaseOptions
+			opts.Interactive, _ = cmd.Flags().GetBool("interactive")
+			opts.Autosquash, _ = cmd.Flags().GetBool("autosquash")
+			err = repo.Rebase(args[0], opts)
+		}
+		if errors.Is(err, repo.ErrConflicts) {
+			os.Exit(1)
+		}
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) rebase failed: %v", err)
+		}
+		return nil
+	},
+}
+
 var checkoutCmd = &cobra.Command{
 	Use:   "checkout [commit-or-branch]",
 	Short: "Restore working directory to a commit or branch",
@@ -220,12 +637,681 @@ var checkoutCmd = &cobra.Command{
 	},
 }
 
+var bisectCmd = &cobra.Command{
+	Use:   "bisect",
+	Short: "Find the commit that introduced a bug by binary search",
+	Long: `Binary-search the history between a good and a bad commit, checking out
+the commit halfway between them at each step until the first bad commit
+is found. The bisection is kept in .kommito/BISECT_* between sessions.
+
+Available subcommands:
+  start [bad [good...]]   Start bisecting, optionally marking commits
+  good [revs...]          Mark commits (default: HEAD) as good
+  bad [rev]               Mark a commit (default: HEAD) as bad
+  skip [revs...]          Mark commits that cannot be tested
+  run <cmd> [args...]     Mark each commit by a command's exit status:
+                          0 good, 125 skip, anything else bad
+  log                     Show the marks made so far
+  reset [commit]          Stop and go back to where bisecting started`,
+}
+
+var bisectStartCmd = &cobra.Command{
+	Use:   "start [bad [good...]]",
+	Short: "Start bisecting",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bad := ""
+		if len(args) > 0 {
+			bad = args[0]
+		}
+		var good []string
+		if len(args) > 1 {
+			good = args[1:]
+		}
+		step, err := repo.BisectStart(bad, good)
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Could not start bisecting: %v", err)
+		}
+		printBisectStep(step)
+		return nil
+	},
+}
+
+// bisectMarkCmd returns the command marking commits with term.
+func bisectMarkCmd(term, short string, args cobra.PositionalArgs) *cobra.Command {
+	return &cobra.Command{
+		Use:   term + " [revs...]",
+		Short: short,
+		Args:  args,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			step, err := repo.BisectMark(term, args)
+			if err != nil {
+				return fmt.Errorf("(╥﹏╥) Could not mark %s: %v", term, err)
+			}
+			printBisectStep(step)
+			return nil
+		},
+	}
+}
+
+var bisectRunCmd = &cobra.Command{
+	Use:   "run <cmd> [args...]",
+	Short: "Bisect automatically with a command's exit status",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		step, err := repo.BisectRun(args, printBisectStep)
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Bisect run failed: %v", err)
+		}
+		printBisectStep(step)
+		return nil
+	},
+}
+
+var bisectLogCmd = &cobra.Command{
+	Use:   "log",
+	Short: "Show the marks made so far",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log, err := repo.BisectLog()
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Could not show bisect log: %v", err)
+		}
+		fmt.Print(log)
+		return nil
+	},
+}
+
+var bisectResetCmd = &cobra.Command{
+	Use:   "reset [commit]",
+	Short: "Stop bisecting and go back to where it started",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		target := ""
+		if len(args) == 1 {
+			target = args[0]
+		}
+		if err := repo.BisectReset(target); err != nil {
+			return fmt.Errorf("(╥﹏╥) Could not reset bisect: %v", err)
+		}
+		fmt.Println("🧹 Bisect finished")
+		return nil
+	},
+}
+
+func printBisectStep(step *repo.BisectStep) {
+	switch {
+	case step == nil:
+		fmt.Println("🔎 Waiting for both a good and a bad commit")
+	case step.Culprit != "":
+		fmt.Printf("🎯 %s is the first bad commit\n", step.Culprit)
+		if err := repo.Show(os.Stdout, []string{step.Culprit}, repo.ShowOptions{NoPatch: true, Stat: true}); err != nil {
+			fmt.Printf("(╥﹏╥) Could not show commit: %v\n", err)
+		}
+	case len(step.Candidates) > 0:
+		fmt.Println("🤷 Only skipped commits are left to test. The first bad commit is one of:")
+		for _, hash := range step.Candidates {
+			fmt.Printf("  %s\n", hash)
+		}
+	default:
+		fmt.Printf("🔎 Bisecting: %d revisions left to test after this (roughly %d steps)\n", step.Remaining, step.Steps)
+		fmt.Printf("[%s] %s\n", step.Next, step.Subject)
+	}
+}
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove unreachable objects older than the prune age",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		prune, _ := cmd.Flags().GetString("prune")
+		return runPrune(cmd, prune)
+	},
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Prune unreachable objects from the object store",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		expire, _ := cmd.Flags().GetString("expire")
+		return runPrune(cmd, expire)
+	},
+}
+
+func runPrune(cmd *cobra.Command, age string) error {
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	cutoff, err := repo.ParseExpiry(age, time.Now())
+	if err != nil {
+		return fmt.Errorf("(⊙_☉) %v", err)
+	}
+	fmt.Println("(ง •_•)ง Sweeping unreachable objects...")
+	result, err := repo.PruneObjects(cutoff, dryRun)
+	if err != nil {
+		return fmt.Errorf("(╥﹏╥) Prune failed: %v", err)
+	}
+	if dryRun {
+		fmt.Printf("🧹 Dry run: %s\n", result)
+		return nil
+	}
+	fmt.Printf("🧹 %s\n", result)
+	return nil
+}
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Verify the integrity of every stored object",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fmt.Println("(ง •_•)ง Checking objects...")
+		result, err := repo.Fsck()
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) fsck failed: %v", err)
+		}
+		for _, problem := range result.Problems {
+			fmt.Printf("  ❌ %s\n", problem)
+		}
+		if len(result.Problems) > 0 {
+			return fmt.Errorf("(╥﹏╥) %d problems found in %d objects", len(result.Problems), result.Checked)
+		}
+		fmt.Printf("✨ %d objects checked, no problems found\n", result.Checked)
+		return nil
+	},
+}
+
+var countObjectsCmd = &cobra.Command{
+	Use:   "count-objects",
+	Short: "Show object counts, disk usage and chunk deduplication",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		counts, err := repo.CountObjects()
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Could not count objects: %v", err)
+		}
+		total, size := counts.Total()
+		fmt.Printf("📦 %d objects, %d KiB\n", total, size/1024)
+		if verbose {
+			for _, kind := range counts.Kinds {
+				fmt.Printf("  %-10s %6d  %10d KiB\n", kind.Kind, kind.Count, kind.Size/1024)
+			}
+		}
+		if counts.ChunkedBlobs > 0 {
+			fmt.Printf("🧩 %d chunked blobs: %d KiB of content stored in %d KiB of chunks (%d KiB saved)\n",
+				counts.ChunkedBlobs, counts.ChunkedSize/1024, counts.ChunkStorage/1024, counts.DedupSavings()/1024)
+		}
+		return nil
+	},
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config [key] [value]",
+	Short: "Get or set a repository setting",
+	Args:  cobra.RangeArgs(0, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			for _, key := range repo.ConfigKeys() {
+				value, err := repo.GetConfig(key)
+				if err != nil {
+					return fmt.Errorf("(╥﹏╥) %v", err)
+				}
+				fmt.Printf("%s=%s\n", key, value)
+			}
+			return nil
+		}
+		if len(args) == 1 {
+			value, err := repo.GetConfig(args[0])
+			if err != nil {
+				return fmt.Errorf("(╥﹏╥) %v", err)
+			}
+			fmt.Println(value)
+			return nil
+		}
+		if err := repo.SetConfig(args[0], args[1]); err != nil {
+			return fmt.Errorf("(╥﹏╥) %v", err)
+		}
+		return nil
+	},
+}
+
+var largeCmd = &cobra.Command{
+	Use:   "large",
+	Short: "Manage large files stored as pointers",
+	Long: `Files matching large.patterns are committed as small pointers and their
+content is kept in a separate large-object store.
+
+Available subcommands:
+  list     List large files at HEAD and in the index
+  fetch    Download missing large objects from large.remote
+  push     Upload cached large objects to large.remote
+  prune    Remove cached large objects that are no longer needed
+  verify   Check cached large objects against their ids`,
+}
+
+var largeListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List large files at HEAD and in the index",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		large, err := repo.ListLargeObjects()
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Could not list large files: %v", err)
+		}
+		if len(large) == 0 {
+			fmt.Println("🐘 No large files tracked")
+			return nil
+		}
+		fmt.Println("🐘 Large files:")
+		for _, object := range large {
+			marker := "☁️ "
+			if object.Cached {
+				marker = "💾"
+			}
+			fmt.Printf("  %s %s %s (%d bytes)\n", marker, object.Oid[:10], object.Path, object.Size)
+		}
+		return nil
+	},
+}
+
+var largeFetchCmd = &cobra.Command{
+	Use:   "fetch",
+	Short: "Download missing large objects needed by HEAD and the index",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fetched, err := repo.FetchLargeObjects()
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Fetch failed after %d objects: %v", fetched, err)
+		}
+		fmt.Printf("✨ Downloaded %d large objects\n", fetched)
+		return nil
+	},
+}
+
+var largePushCmd = &cobra.Command{
+	Use:   "push",
+	Short: "Upload cached large objects missing from the remote",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pushed, err := repo.PushLargeObjects()
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Push failed after %d objects: %v", pushed, err)
+		}
+		fmt.Printf("✨ Uploaded %d large objects\n", pushed)
+		return nil
+	},
+}
+
+var largePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove cached large objects not needed by HEAD or the index",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		removed, reclaimed, err := repo.PruneLargeObjects(dryRun)
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Prune failed: %v", err)
+		}
+		fmt.Printf("🧹 %d large objects removed, %d KiB reclaimed\n", removed, reclaimed/1024)
+		return nil
+	},
+}
+
+var largeVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check cached large objects and the pointers that need them",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		problems, err := repo.VerifyLargeObjects()
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Verify failed: %v", err)
+		}
+		for _, problem := range problems {
+			fmt.Printf("  ❌ %s\n", problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("(╥﹏╥) %d problems found", len(problems))
+		}
+		fmt.Println("✨ All large objects verified")
+		return nil
+	},
+}
+
+var remoteCmd = &cobra.Command{
+	Use:   "remote",
+	Short: "Manage remote repositories",
+}
+
+var remoteAddCmd = &cobra.Command{
+	Use:   "add [name] [url]",
+	Short: "Add a remote",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := repo.AddRemote(args[0], args[1]); err != nil {
+			return fmt.Errorf("(╥﹏╥) Could not add remote: %v", err)
+		}
+		fmt.Printf("🔗 Added remote '%s' -> %s\n", args[0], args[1])
+		return nil
+	},
+}
+
+var remoteRemoveCmd = &cobra.Command{
+	Use:   "remove [name]",
+	Short: "Remove a remote and its remote-tracking branches",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := repo.RemoveRemote(args[0]); err != nil {
+			return fmt.Errorf("(╥﹏╥) Could not remove remote: %v", err)
+		}
+		fmt.Printf("🗑️  Removed remote '%s'\n", args[0])
+		return nil
+	},
+}
+
+var remoteListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List remotes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		remotes, err := repo.ListRemotes()
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Could not list remotes: %v", err)
+		}
+		names := make([]string, 0, len(remotes))
+		for name := range remotes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s\t%s\n", name, remotes[name])
+		}
+		return nil
+	},
+}
+
+var fetchCmd = &cobra.Command{
+	Use:   "fetch [remote-or-bundle]",
+	Short: "Download objects and branches from a remote",
+	Args:  cobra.RangeArgs(0, 1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		remote := "origin"
+		if len(args) > 0 {
+			remote = args[0]
+		}
+		var opts repo.FetchOptions
+		opts.Prune, _ = cmd.Flags().GetBool("prune")
+		opts.Depth, _ = cmd.Flags().GetInt("depth")
+		opts.Deepen, _ = cmd.Flags().GetInt("deepen")
+		opts.Unshallow, _ = cmd.Flags().GetBool("unshallow")
+		result, err := repo.Fetch(remote, opts)
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Fetch failed: %v", err)
+		}
+		printFetchResult(remote, result)
+		return nil
+	},
+}
+
+func printFetchResult(remote string, result *repo.FetchResult) {
+	if len(result.Changes) == 0 && result.Objects == 0 {
+		fmt.Printf("✨ %s is up to date\n", remote)
+		return
+	}
+	fmt.Printf("📥 Fetched %d objects from %s\n", result.Objects, remote)
+	for _, change := range result.Changes {
+		fmt.Println(change)
+	}
+}
+
+var pushCmd = &cobra.Command{
+	Use:   "push [remote] [branch]",
+	Short: "Upload a branch to a remote",
+	Args:  cobra.RangeArgs(0, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		remote, branch := "origin", ""
+		if len(args) > 0 {
+			remote = args[0]
+		}
+		if len(args) > 1 {
+			branch = args[1]
+		}
+		force, _ := cmd.Flags().GetBool("force")
+		lease, _ := cmd.Flags().GetString("force-with-lease")
+		opts := repo.PushOptions{Force: force}
+		if cmd.Flags().Changed("force-with-lease") {
+			opts.ForceWithLease = true
+			if lease != "current" {
+				opts.Expect = lease
+			}
+		}
+		result, err := repo.Push(remote, branch, opts)
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Push rejected: %v", err)
+		}
+		if result.Change.Old == result.Change.New {
+			fmt.Println("✨ Everything up to date")
+			return nil
+		}
+		fmt.Printf("📤 Pushed %d objects to %s\n", result.Objects, remote)
+		fmt.Println(result.Change)
+		return nil
+	},
+}
+
+var pullCmd = &cobra.Command{
+	Use:   "pull [remote] [branch]",
+	Short: "Fetch from a remote and merge into the current branch",
+	Args:  cobra.RangeArgs(0, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		remote, branch := "origin", ""
+		if len(args) > 0 {
+			remote = args[0]
+		}
+		if len(args) > 1 {
+			branch = args[1]
+		}
+		result, err := repo.Pull(remote, branch)
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Pull failed: %v", err)
+		}
+		for _, change := range result.Changes {
+			fmt.Println(change)
+		}
+		return nil
+	},
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve [repos-dir]",
+	Short: "Serve the repositories in a directory over HTTP",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		addr, _ := cmd.Flags().GetString("addr")
+		fmt.Printf("🌐 Serving repositories in %s on %s\n", args[0], addr)
+		if err := repo.Serve(addr, args[0]); err != nil {
+			return fmt.Errorf("(╥﹏╥) Server stopped: %v", err)
+		}
+		return nil
+	},
+}
+
+var importGitCmd = &cobra.Command{
+	Use:   "import-git [git-repo]",
+	Short: "Import the history of a local Git repository",
+	Long: `Converts every branch and tag of a Git repository, with full history and
+authors, into this repository. The Git object database is read directly, so
+git does not need to be installed. Imported commits are remembered in
+.kommito/git-map, so running it again only imports new commits.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		result, err := repo.ImportGit(args[0])
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Import failed: %v", err)
+		}
+		fmt.Printf("📦 Imported %d new commits\n", result.Commits)
+		for _, change := range append(result.Branches, result.Tags...) {
+			fmt.Println(change)
+		}
+		for _, name := range result.Skipped {
+			fmt.Printf("  ⚠️  %s has local changes, left as is\n", name)
+		}
+		for _, name := range result.Annotated {
+			fmt.Printf("  ⚠️  %s is an annotated tag; its tagger and message were dropped\n", name)
+		}
+		if result.CheckedOut != "" {
+			fmt.Printf("  ⚠️  %s is checked out, left as is (switch away and import again to update it)\n", result.CheckedOut)
+		}
+		return nil
+	},
+}
+
+var fastExportCmd = &cobra.Command{
+	Use:   "fast-export",
+	Short: "Write every branch and tag as a git fast-import stream",
+	Long: `Writes the full history of every branch and tag to stdout in the format
+read by git fast-import, e.g.:
+
+   kommito fast-export | (cd ../project.git && git fast-import)`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// stdout carries the stream, so failures go to stderr only.
+		if err := repo.FastExport(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "(╥﹏╥) fast-export: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var fastImportCmd = &cobra.Command{
+	Use:   "fast-import",
+	Short: "Read a git fast-import stream from stdin",
+	Long: `Reads a stream in the format written by git fast-export (or kommito
+fast-export) from stdin and stores its commits, branches and tags, e.g.:
+
+   git -C ../project fast-export --all | kommito fast-import`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		force, _ := cmd.Flags().GetBool("force")
+		result, err := repo.FastImport(os.Stdin, force)
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Import failed: %v", err)
+		}
+		fmt.Printf("📦 Imported %d commits\n", result.Commits)
+		for _, change := range append(result.Branches, result.Tags...) {
+			fmt.Println(change)
+		}
+		for _, name := range result.Skipped {
+			fmt.Printf("  ⚠️  %s has local changes, left as is (use --force to overwrite)\n", name)
+		}
+		for _, name := range result.Annotated {
+			fmt.Printf("  ⚠️  %s is an annotated tag; its tagger and message were dropped\n", name)
+		}
+		if result.CheckedOut != "" {
+			fmt.Printf("  ⚠️  %s is checked out, left as is (switch away and import again to update it)\n", result.CheckedOut)
+		}
+		return nil
+	},
+}
+
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Move history between repositories as a single file",
+	Long: `A bundle holds branches and tags together with the objects they need,
+for carrying history to a machine without network access. Clone or fetch
+from the file as if it were a remote.
+
+Available subcommands:
+  create   Write a bundle of the given branches, tags or ranges
+  verify   Check a bundle and whether this repository can use it`,
+}
+
+var bundleCreateCmd = &cobra.Command{
+	Use:   "create [file] [refs-or-ranges...]",
+	Short: "Write a bundle of the given branches, tags or ranges",
+	Long: `Writes the named branches and tags with their history to a file. Leave
+out history the receiving side already has with a range or ^<rev>:
+
+   kommito bundle create full.bundle --all
+   kommito bundle create update.bundle v1.0..main`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		revs := args[1:]
+		if all, _ := cmd.Flags().GetBool("all"); all {
+			revs = append(revs, "--all")
+		}
+		result, err := repo.CreateBundle(args[0], revs)
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) Could not create bundle: %v", err)
+		}
+		fmt.Printf("📦 Wrote %d objects and %d refs to %s\n", result.Objects, len(result.Refs), args[0])
+		printBundle(result)
+		return nil
+	},
+}
+
+var bundleVerifyCmd = &cobra.Command{
+	Use:   "verify [file]",
+	Short: "Check a bundle and whether this repository can use it",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		result, err := repo.VerifyBundle(args[0])
+		if err != nil {
+			return fmt.Errorf("(╥﹏╥) %s is not usable: %v", args[0], err)
+		}
+		printBundle(result)
+		for _, hash := range result.Missing {
+			fmt.Printf("  ❌ missing prerequisite %s %s\n", hash[:7], result.Prerequisites[hash])
+		}
+		if len(result.Missing) > 0 {
+			return fmt.Errorf("(╥﹏╥) this repository lacks %d commits the bundle builds on", len(result.Missing))
+		}
+		fmt.Printf("✨ %s is okay (%d objects)\n", args[0], result.Objects)
+		return nil
+	},
+}
+
+func printBundle(result *repo.BundleResult) {
+	names := make([]string, 0, len(result.Refs))
+	for name := range result.Refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %s %s\n", result.Refs[name][:7], name)
+	}
+	if len(result.Prerequisites) == 0 {
+		fmt.Println("🌳 The bundle records a complete history")
+	} else {
+		fmt.Printf("🔗 The bundle builds on %d commits the receiver must already have\n", len(result.Prerequisites))
+	}
+}
+
+var uploadPackCmd = &cobra.Command{
+	Use:   "upload-pack [repo]",
+	Short: "Send objects to a fetching client over stdin/stdout",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// stdout carries the protocol, so failures go to stderr only.
+		if err := repo.UploadPack(args[0], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "(╥﹏╥) upload-pack: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var receivePackCmd = &cobra.Command{
+	Use:   "receive-pack [repo]",
+	Short: "Receive objects from a pushing client over stdin/stdout",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// stdout carries the protocol, so failures go to stderr only.
+		if err := repo.ReceivePack(args[0], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "(╥﹏╥) receive-pack: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
 func init() {
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(addCmd)
+	rootCmd.AddCommand(rmCmd)
+	rootCmd.AddCommand(mvCmd)
+	rootCmd.AddCommand(restoreCmd)
 	rootCmd.AddCommand(commitCmd)
 	rootCmd.AddCommand(logCmd)
+	rootCmd.AddCommand(showCmd)
+	rootCmd.AddCommand(blameCmd)
 	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(diffCmd)
 	rootCmd.AddCommand(cloneCmd)
 
 	rootCmd.AddCommand(branchCmd)
@@ -235,9 +1321,125 @@ func init() {
 	branchCmd.AddCommand(branchDeleteCmd)
 	rootCmd.AddCommand(mergeCmd)
 	rootCmd.AddCommand(checkoutCmd)
+	rootCmd.AddCommand(cherryPickCmd)
+	rootCmd.AddCommand(revertCmd)
+	rootCmd.AddCommand(rebaseCmd)
+	rootCmd.AddCommand(bisectCmd)
+	bisectCmd.AddCommand(bisectStartCmd)
+	bisectCmd.AddCommand(bisectMarkCmd("good", "Mark commits as good", cobra.ArbitraryArgs))
+	bisectCmd.AddCommand(bisectMarkCmd("bad", "Mark a commit as bad", cobra.MaximumNArgs(1)))
+	bisectCmd.AddCommand(bisectMarkCmd("skip", "Mark commits that cannot be tested", cobra.ArbitraryArgs))
+	bisectCmd.AddCommand(bisectRunCmd)
+	bisectCmd.AddCommand(bisectLogCmd)
+	bisectCmd.AddCommand(bisectResetCmd)
+	rootCmd.AddCommand(gcCmd)
+	rootCmd.AddCommand(pruneCmd)
+	rootCmd.AddCommand(fsckCmd)
+	rootCmd.AddCommand(countObjectsCmd)
+	rootCmd.AddCommand(configCmd)
+
+	rootCmd.AddCommand(largeCmd)
+	largeCmd.AddCommand(largeListCmd)
+	largeCmd.AddCommand(largeFetchCmd)
+	largeCmd.AddCommand(largePushCmd)
+	largeCmd.AddCommand(largePruneCmd)
+	largeCmd.AddCommand(largeVerifyCmd)
+
+	rootCmd.AddCommand(remoteCmd)
+	remoteCmd.AddCommand(remoteAddCmd)
+	remoteCmd.AddCommand(remoteRemoveCmd)
+	remoteCmd.AddCommand(remoteListCmd)
+	rootCmd.AddCommand(fetchCmd)
+	rootCmd.AddCommand(pushCmd)
+	rootCmd.AddCommand(pullCmd)
+	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(importGitCmd)
+	rootCmd.AddCommand(fastExportCmd)
+	rootCmd.AddCommand(fastImportCmd)
+	rootCmd.AddCommand(bundleCmd)
+	bundleCmd.AddCommand(bundleCreateCmd)
+	bundleCmd.AddCommand(bundleVerifyCmd)
+	rootCmd.AddCommand(uploadPackCmd)
+	rootCmd.AddCommand(receivePackCmd)
+
+	initCmd.Flags().Bool("bare", false, "Create a repository without a working tree, for use as a shared remote")
+	cloneCmd.Flags().Bool("bare", false, "Clone without a working tree")
+	cloneCmd.Flags().Bool("mirror", false, "Bare clone whose branches and tags track the source exactly on fetch")
+	cloneCmd.Flags().Int("depth", 0, "Clone only the latest N commits of history (implies --single-branch)")
+	cloneCmd.Flags().Bool("single-branch", false, "Clone and later fetch only one branch")
+	cloneCmd.Flags().StringP("branch", "b", "", "Check out this branch (or tag) instead of the source's HEAD")
+	cloneCmd.Flags().String("filter", "", "Partial clone: leave out blobs (blob:none or blob:limit=<size>) and fetch them when needed")
+	logCmd.Flags().IntP("max-count", "n", 0, "Show at most this many commits")
+	logCmd.Flags().String("since", "", "Show commits newer than a date or age (\"2024-01-31\", \"2.weeks.ago\")")
+	logCmd.Flags().String("until", "", "Show commits older than a date or age")
+	logCmd.Flags().String("author", "", "Show commits whose author matches this regular expression")
+	logCmd.Flags().String("grep", "", "Show commits whose message matches this regular expression")
+	logCmd.Flags().Bool("oneline", false, "Show each commit on one line")
+	logCmd.Flags().String("format", "", "Format commits with a template or as oneline or medium")
+	logCmd.Flags().Bool("reverse", false, "Show the oldest commits first")
+	logCmd.Flags().Bool("first-parent", false, "Follow only the first parent of merges")
+	logCmd.Flags().BoolP("patch", "p", false, "Show each commit's diff")
+	logCmd.Flags().Bool("stat", false, "Show how many lines each commit changed per file")
+	logCmd.Flags().Bool("all", false, "Show the history of every branch and tag")
+	logCmd.Flags().String("graph", "", "Draw the history as a graph, in ascii (the default) or unicode lines")
+	logCmd.Flags().Lookup("graph").NoOptDefVal = "ascii"
+	logCmd.Flags().String("color", "auto", "Colour hashes, refs and graph lanes: always, auto (on a terminal) or never")
+	logCmd.Flags().Lookup("color").NoOptDefVal = "always"
+	logCmd.Flags().Bool("no-pager", false, "Do not send output through a pager")
+	blameCmd.Flags().StringArrayP("lines", "L", nil, "Only blame lines start,end (also start,+count); may be repeated")
+	blameCmd.Flags().Bool("porcelain", false, "Write the machine-readable format of git blame --porcelain")
+	blameCmd.Flags().StringArray("ignore-rev", nil, "Look through this commit's changes; may be repeated")
+	blameCmd.Flags().String("ignore-revs-file", "", "Look through the commits listed in this file")
+	blameCmd.Flags().Bool("no-pager", false, "Do not send output through a pager")
+	showCmd.Flags().BoolP("no-patch", "s", false, "Leave out the diff")
+	showCmd.Flags().Bool("stat", false, "Show how many lines changed per file instead of the diff")
+	showCmd.Flags().BoolP("patch", "p", false, "Show the diff as well as --stat")
+	showCmd.Flags().String("color", "auto", "Colour hashes and ref names: always, auto (on a terminal) or never")
+	showCmd.Flags().Lookup("color").NoOptDefVal = "always"
+	showCmd.Flags().Bool("no-pager", false, "Do not send output through a pager")
+	bisectRunCmd.Flags().SetInterspersed(false)
+	for _, cmd := range []*cobra.Command{cherryPickCmd, revertCmd} {
+		cmd.Flags().BoolP("no-commit", "n", false, "Apply the changes to the index and working tree without committing")
+		cmd.Flags().IntP("mainline", "m", 0, "Take a merge commit's changes against this parent (1 is the first)")
+		cmd.Flags().Bool("continue", false, "Commit the resolved conflicts and go on with the commits left")
+		cmd.Flags().Bool("skip", false, "Drop the commit that conflicted and go on with the commits left")
+		cmd.Flags().Bool("abort", false, "Stop and go back to where you started")
+	}
+	rebaseCmd.Flags().BoolP("interactive", "i", false, "Edit the list of commits to replay before starting")
+	rebaseCmd.Flags().Bool("autosquash", false, "Move fixup! and squash! commits after the commit they name")
+	rebaseCmd.Flags().Bool("continue", false, "Commit the resolved conflicts or amended edit and go on")
+	rebaseCmd.Flags().Bool("skip", false, "Drop the commit that stopped and go on")
+	rebaseCmd.Flags().Bool("abort", false, "Stop and check out the branch as it was before the rebase")
+	diffCmd.Flags().Bool("staged", false, "Compare the index with HEAD")
+	diffCmd.Flags().Bool("cached", false, "Same as --staged")
+	rmCmd.Flags().Bool("cached", false, "Only stop tracking the files, keeping them in the working tree")
+	rmCmd.Flags().BoolP("force", "f", false, "Remove files even when their changes would be lost")
+	restoreCmd.Flags().StringP("source", "s", "", "Restore from this revision")
+	restoreCmd.Flags().BoolP("staged", "S", false, "Restore the index (from HEAD unless --source is given)")
+	restoreCmd.Flags().BoolP("worktree", "W", false, "Restore the working tree (the default without --staged)")
+	commitCmd.Flags().StringP("message", "m", "", "Commit message (written in the editor when left out)")
+	commitCmd.Flags().BoolP("all", "a", false, "Stage the changes to every tracked file first, deletions included")
+	commitCmd.Flags().Bool("amend", false, "Replace the tip commit instead of adding one")
+	commitCmd.Flags().String("fixup", "", "Make a \"fixup! <subject>\" commit for rebase --autosquash to fold into this commit")
+	commitCmd.Flags().String("squash", "", "Make a \"squash! <subject>\" commit for rebase --autosquash to fold into this commit")
+	commitCmd.Flags().Bool("allow-empty", false, "Commit even when nothing changed")
 
-	commitCmd.Flags().StringP("message", "m", "", "Commit message")
-	commitCmd.MarkFlagRequired("message")
+	gcCmd.Flags().String("prune", repo.DefaultPruneExpire, "Prune unreachable objects older than this age")
+	gcCmd.Flags().Bool("dry-run", false, "Report what would be removed without deleting")
+	pruneCmd.Flags().String("expire", repo.DefaultPruneExpire, "Only prune unreachable objects older than this age")
+	pruneCmd.Flags().Bool("dry-run", false, "Report what would be removed without deleting")
+	countObjectsCmd.Flags().BoolP("verbose", "v", false, "Break the totals down by object kind")
+	largePruneCmd.Flags().Bool("dry-run", false, "Report what would be removed without deleting")
+	fastImportCmd.Flags().BoolP("force", "f", false, "Move branches and tags even when that discards local commits")
+	bundleCreateCmd.Flags().Bool("all", false, "Include every branch and tag")
+	serveCmd.Flags().String("addr", ":8080", "Address to listen on")
+	fetchCmd.Flags().Bool("prune", false, "Remove remote-tracking branches that no longer exist on the remote")
+	fetchCmd.Flags().Int("depth", 0, "Limit the fetched history to N commits behind each remote branch")
+	fetchCmd.Flags().Int("deepen", 0, "Fetch N more commits of history behind a shallow clone's boundary")
+	fetchCmd.Flags().Bool("unshallow", false, "Fetch all of the history missing from a shallow clone")
+	pushCmd.Flags().BoolP("force", "f", false, "Overwrite the remote branch even if it is not an ancestor")
+	pushCmd.Flags().String("force-with-lease", "", "Force only if the remote branch is at the expected commit (default: the remote-tracking branch)")
+	pushCmd.Flags().Lookup("force-with-lease").NoOptDefVal = "current"
 }
 
 func main() {